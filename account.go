@@ -0,0 +1,666 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// accountGrace is how long a deleted account can still be restored before it is erased
+const accountGrace = 14 * 24 * time.Hour
+
+// Kinds of data subject requests
+const (
+	requestAccess  = "access"
+	requestRectify = "rectify"
+	requestErase   = "erase"
+)
+
+// States of a data subject request
+const (
+	requestOpen     = "open"
+	requestDone     = "done"
+	requestRejected = "rejected"
+)
+
+// Reasons an account was erased for
+const (
+	erasureSelf    = "self"
+	erasureRequest = "request"
+	erasureAdmin   = "admin"
+)
+
+// requestKinds lists the kinds of requests in the order they are offered
+var requestKinds = []string{requestAccess, requestRectify, requestErase}
+
+// erasureStatements deletes every row of an account. $1 is the account, the
+// patients it owns go with it, including what other accounts were shared.
+// Children come before their parents so nothing is left pointing at nothing.
+var erasureStatements = []struct {
+	Table string
+	Query string
+}{
+	{"notification_log", `DELETE FROM notification_log WHERE user_id=$1 OR entry_id IN (SELECT entry_id FROM entries WHERE user_id=$1 OR patient_id IN (SELECT patient_id FROM patients WHERE owner_id=$1))`},
+	{"notification_channels", `DELETE FROM notification_channels WHERE user_id=$1`},
+	{"notification_settings", `DELETE FROM notification_settings WHERE user_id=$1`},
+	{"dose_log", `DELETE FROM dose_log WHERE patient_id IN (SELECT patient_id FROM patients WHERE owner_id=$1)`},
+	{"expire_alarms", `DELETE FROM expire_alarms WHERE user_id=$1 OR patient_id IN (SELECT patient_id FROM patients WHERE owner_id=$1)`},
+	{"use_alarms", `DELETE FROM use_alarms WHERE user_id=$1 OR patient_id IN (SELECT patient_id FROM patients WHERE owner_id=$1)`},
+	{"location_moves", `DELETE FROM location_moves WHERE user_id=$1`},
+	{"entries", `DELETE FROM entries WHERE user_id=$1 OR patient_id IN (SELECT patient_id FROM patients WHERE owner_id=$1)`},
+	{"attachments", `DELETE FROM attachments WHERE user_id=$1 OR patient_id IN (SELECT patient_id FROM patients WHERE owner_id=$1)`},
+	{"prescriptions", `DELETE FROM prescriptions WHERE user_id=$1 OR patient_id IN (SELECT patient_id FROM patients WHERE owner_id=$1)`},
+	{"medicine", `DELETE FROM medicine WHERE user_id=$1 OR patient_id IN (SELECT patient_id FROM patients WHERE owner_id=$1)`},
+	{"health_profiles", `DELETE FROM health_profiles WHERE user_id=$1 OR patient_id IN (SELECT patient_id FROM patients WHERE owner_id=$1)`},
+	{"medlist_shares", `DELETE FROM medlist_shares WHERE user_id=$1 OR patient_id IN (SELECT patient_id FROM patients WHERE owner_id=$1)`},
+	{"patient_shares", `DELETE FROM patient_shares WHERE user_id=$1 OR patient_id IN (SELECT patient_id FROM patients WHERE owner_id=$1)`},
+	{"storage_locations", `DELETE FROM storage_locations WHERE user_id=$1`},
+	{"patients", `DELETE FROM patients WHERE owner_id=$1`},
+	{"data_keys", `DELETE FROM data_keys WHERE user_id=$1`},
+	{"users", `DELETE FROM users WHERE user_id=$1`},
+	// The audit log only lets go of the events of accounts which are gone
+	{"audit_log", `DELETE FROM audit_log WHERE owner_id=$1`},
+}
+
+// DataRequest holds a data subject request of an account
+type DataRequest struct {
+	ID        int
+	UserID    int
+	UserName  string
+	Email     string
+	Kind      string
+	Status    string
+	Details   string
+	Response  string
+	CreateAt  string
+	UpdateAt  string
+	HandledBy string
+}
+
+// Erasure holds the record of an erased account, without any of its data
+type Erasure struct {
+	ID          int
+	UserID      int
+	Reason      string
+	RequestedAt string
+	ErasedAt    string
+	Rows        string
+}
+
+// AccountPageData holds all data of the account deletion and requests page
+type AccountPageData struct {
+	Patients  int
+	Shared    int
+	Medicines int
+	Doses     int
+	DeleteAt  string
+	Requests  []DataRequest
+	Kinds     []string
+	IsAdmin   bool
+	Error     string
+	Saved     string
+}
+
+// AdminPageData holds all data of the data subject requests page of admins
+type AdminPageData struct {
+	Requests []DataRequest
+	Erasures []Erasure
+	Kinds    []string
+	Error    string
+	Saved    string
+}
+
+// isAdmin reports if the account is one of the admins of MWS_ADMINS, listed by user name or e-mail address.
+func isAdmin(userID int) bool {
+	var userName, email string
+	if err := db.QueryRow("SELECT username, email FROM users WHERE user_id=$1", userID).Scan(&userName, &email); err != nil {
+		return false
+	}
+
+	for _, admin := range strings.Split(config.Admins, ",") {
+		admin = strings.TrimSpace(admin)
+		if admin != "" && (admin == userName || strings.EqualFold(admin, email)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPassword reports if the password is the one of the account.
+func checkPassword(userID int, password string) bool {
+	var stored string
+	if err := db.QueryRow("SELECT password FROM users WHERE user_id=$1", userID).Scan(&stored); err != nil {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+}
+
+// getDeletionDue returns when the account is erased, if its deletion was requested.
+func getDeletionDue(userID int) (due time.Time, ok bool) {
+	var requestedAt sql.NullInt64
+	if err := db.QueryRow("SELECT delete_requested_at FROM users WHERE user_id=$1", userID).Scan(&requestedAt); err != nil || !requestedAt.Valid {
+		return due, false
+	}
+	return fromEpoch(requestedAt.Int64).Add(accountGrace), true
+}
+
+// eraseAccount deletes the account with everything it holds in one
+// transaction. What is kept is that it happened: the account's ID, why, when
+// and how many rows went, and its data requests without their texts.
+func eraseAccount(userID int, reason string, requestedAt time.Time) error {
+	// Attached files and prescription scans are deleted once the rows pointing at them are
+	blobKeys, err := getBlobKeys("user_id=$1 OR patient_id IN (SELECT patient_id FROM patients WHERE owner_id=$1)", userID)
+	if err != nil {
+		return err
+	}
+	scanKeys, err := getScanKeys("user_id=$1 OR patient_id IN (SELECT patient_id FROM patients WHERE owner_id=$1)", userID)
+	if err != nil {
+		return err
+	}
+	blobKeys = append(blobKeys, scanKeys...)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var counts []string
+	for _, statement := range erasureStatements {
+		result, err := tx.Exec(statement.Query, userID)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("erasing %s: %s", statement.Table, err)
+		}
+
+		if rows, _ := result.RowsAffected(); rows > 0 {
+			counts = append(counts, fmt.Sprintf("%s=%d", statement.Table, rows))
+		}
+	}
+
+	// Requests may quote personal data, only their kind and state stay
+	if _, err = tx.Exec("UPDATE data_requests SET details='', response='' WHERE user_id=$1", userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO erasure_log(user_id,reason,requested_at,erased_at,row_counts) VALUES(?,?,?,?,?)",
+		userID, reason, toEpoch(requestedAt), nowEpoch(), strings.Join(counts, " "))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	deleteBlobs(blobKeys)
+
+	logger.Info("erased account", "user_id", userID, "reason", reason)
+	return nil
+}
+
+// eraseDueAccounts erases the accounts whose grace period has ended.
+func eraseDueAccounts() {
+	type dueAccount struct {
+		UserID      int
+		RequestedAt int64
+	}
+
+	var due []dueAccount
+
+	row, err := db.Query("SELECT user_id, delete_requested_at FROM users WHERE delete_requested_at <= $1", toEpoch(time.Now().Add(-accountGrace)))
+	if err != nil {
+		logger.Error("eraseDueAccounts", "error", err)
+		return
+	}
+
+	for row.Next() {
+		var account dueAccount
+
+		if err = row.Scan(&account.UserID, &account.RequestedAt); err != nil {
+			logger.Error("eraseDueAccounts", "error", err)
+			break
+		}
+
+		due = append(due, account)
+	}
+	row.Close()
+
+	for _, account := range due {
+		if err = eraseAccount(account.UserID, erasureSelf, fromEpoch(account.RequestedAt)); err != nil {
+			logger.Error("eraseDueAccounts", "user_id", account.UserID, "error", err)
+		}
+	}
+}
+
+// getDataRequests returns the requests of the account, or every request for a user ID of 0.
+func getDataRequests(userID int, location *time.Location, locale *Locale) (requests []DataRequest) {
+	row, err := db.Query(`SELECT r.request_id, r.user_id, COALESCE(u.username, ''), COALESCE(u.email, ''), r.kind, r.status, r.details, r.response, r.create_at, r.update_at, COALESCE(h.username, '')
+		FROM data_requests r LEFT JOIN users u ON u.user_id = r.user_id LEFT JOIN users h ON h.user_id = r.handled_by
+		WHERE $1 = 0 OR r.user_id = $1
+		ORDER BY r.status <> 'open', r.request_id DESC`, userID)
+	if err != nil {
+		logger.Error("getDataRequests", "user_id", userID, "error", err)
+		return
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var request DataRequest
+		var createAt, updateAt int64
+
+		if err = row.Scan(&request.ID, &request.UserID, &request.UserName, &request.Email, &request.Kind, &request.Status, &request.Details, &request.Response, &createAt, &updateAt, &request.HandledBy); err != nil {
+			logger.Error("getDataRequests", "user_id", userID, "error", err)
+			return
+		}
+
+		request.CreateAt = locale.FormatDateTime(fromEpoch(createAt).In(location))
+		request.UpdateAt = locale.FormatDateTime(fromEpoch(updateAt).In(location))
+		requests = append(requests, request)
+	}
+
+	return requests
+}
+
+// getErasures returns the latest erasure records.
+func getErasures(limit int, location *time.Location, locale *Locale) (erasures []Erasure) {
+	row, err := db.Query("SELECT erasure_id, user_id, reason, requested_at, erased_at, row_counts FROM erasure_log ORDER BY erasure_id DESC LIMIT $1", limit)
+	if err != nil {
+		logger.Error("getErasures", "error", err)
+		return
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var erasure Erasure
+		var requestedAt, erasedAt int64
+
+		if err = row.Scan(&erasure.ID, &erasure.UserID, &erasure.Reason, &requestedAt, &erasedAt, &erasure.Rows); err != nil {
+			logger.Error("getErasures", "error", err)
+			return
+		}
+
+		erasure.RequestedAt = locale.FormatDateTime(fromEpoch(requestedAt).In(location))
+		erasure.ErasedAt = locale.FormatDateTime(fromEpoch(erasedAt).In(location))
+		erasures = append(erasures, erasure)
+	}
+
+	return erasures
+}
+
+// addDataRequest files a request for the account.
+func addDataRequest(userID int, kind string, details string) error {
+	now := nowEpoch()
+	_, err := db.Exec("INSERT INTO data_requests(user_id,kind,status,details,response,create_at,update_at) VALUES(?,?,?,?,'',?,?)",
+		userID, kind, requestOpen, details, now, now)
+	return err
+}
+
+// isRequestKind reports if the kind is one of the kinds of requests.
+func isRequestKind(kind string) bool {
+	for _, k := range requestKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func accountHandler(response http.ResponseWriter, request *http.Request) {
+	// Check login status
+	if getUserName(request) == "" {
+		http.Redirect(response, request, urlHello, 302)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+	location := getUserLocation(userID)
+	locale := getLocale(request)
+
+	data := AccountPageData{
+		Requests: getDataRequests(userID, location, locale),
+		Kinds:    requestKinds,
+		IsAdmin:  isAdmin(userID),
+		Error:    request.FormValue("error"),
+		Saved:    request.FormValue("saved"),
+	}
+
+	// Tell what goes with the account
+	db.QueryRow("SELECT COUNT(*) FROM patients WHERE owner_id=$1", userID).Scan(&data.Patients)
+	db.QueryRow("SELECT COUNT(*) FROM patient_shares WHERE patient_id IN (SELECT patient_id FROM patients WHERE owner_id=$1)", userID).Scan(&data.Shared)
+	db.QueryRow("SELECT COUNT(*) FROM entries WHERE patient_id IN (SELECT patient_id FROM patients WHERE owner_id=$1)", userID).Scan(&data.Medicines)
+	db.QueryRow("SELECT COUNT(*) FROM dose_log WHERE patient_id IN (SELECT patient_id FROM patients WHERE owner_id=$1)", userID).Scan(&data.Doses)
+
+	if due, ok := getDeletionDue(userID); ok {
+		data.DeleteAt = locale.FormatDateTime(due.In(location))
+	}
+
+	err := renderTemplate(response, request, tmplAccount, data)
+
+	if err != nil {
+		return
+	}
+}
+
+func postDeleteAccountHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+
+	// Deleting takes the password and an explicit confirmation
+	if request.FormValue("confirmDelete") != "on" {
+		http.Redirect(response, request, urlAccount+"?error=confirm", 302)
+		return
+	}
+
+	if !checkPassword(userID, request.FormValue("passwd")) {
+		http.Redirect(response, request, urlAccount+"?error=password", 302)
+		return
+	}
+
+	result, err := db.Exec("UPDATE users SET delete_requested_at=$1 WHERE user_id=$2 AND delete_requested_at IS NULL", nowEpoch(), userID)
+	if err != nil {
+		serverError(response, request, "postDeleteAccountHandler", err)
+		return
+	}
+
+	if changed, err := result.RowsAffected(); err == nil && changed > 0 {
+		auditSecurity(request, userID, auditDeleteRequest, nil)
+	}
+
+	// Let every channel know, in case it was not the user
+	if due, ok := getDeletionDue(userID); ok {
+		locale := getRecipientLocale(userID)
+
+		queueNotification(Notification{
+			UserID: userID,
+			Kind:   "account",
+			Title:  locale.T("notify.delete.title"),
+			Body:   locale.T("notify.delete.body", locale.FormatDateTime(due.In(getUserLocation(userID)))),
+			URL:    urlAccount,
+		})
+	}
+
+	requestLogger(request).Info("account deletion requested", "user_id", userID)
+	http.Redirect(response, request, urlAccount+"?saved=delete", 302)
+}
+
+func postRestoreAccountHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+
+	result, err := db.Exec("UPDATE users SET delete_requested_at=NULL WHERE user_id=$1 AND delete_requested_at IS NOT NULL", userID)
+	if err != nil {
+		serverError(response, request, "postRestoreAccountHandler", err)
+		return
+	}
+
+	if changed, err := result.RowsAffected(); err == nil && changed > 0 {
+		auditSecurity(request, userID, auditDeleteCancel, nil)
+	}
+
+	requestLogger(request).Info("account deletion cancelled", "user_id", userID)
+	http.Redirect(response, request, urlAccount+"?saved=restore", 302)
+}
+
+func postPasswordHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+	password := request.FormValue("newPasswd")
+
+	// Changing takes the current password and a repeated new one
+	if password == "" || password != request.FormValue("newPasswdRepeat") {
+		http.Redirect(response, request, urlAccount+"?error=repeat", 302)
+		return
+	}
+
+	if !checkPassword(userID, request.FormValue("currentPasswd")) {
+		http.Redirect(response, request, urlAccount+"?error=password", 302)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), hashCost)
+	if err != nil {
+		serverError(response, request, "postPasswordHandler", err)
+		return
+	}
+
+	if _, err = db.Exec("UPDATE users SET password=$1 WHERE user_id=$2", hashedPassword, userID); err != nil {
+		serverError(response, request, "postPasswordHandler", err)
+		return
+	}
+
+	auditSecurity(request, userID, auditPasswordChange, nil)
+
+	requestLogger(request).Info("password changed", "user_id", userID)
+	http.Redirect(response, request, urlAccount+"?saved=password", 302)
+}
+
+func postDataRequestHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	kind := request.FormValue("kind")
+	details := strings.TrimSpace(request.FormValue("details"))
+
+	// A correction has to tell what is wrong
+	if !isRequestKind(kind) || (kind == requestRectify && details == "") {
+		http.Redirect(response, request, urlAccount+"?error=request", 302)
+		return
+	}
+
+	if err := addDataRequest(getUserID(getUserName(request)), kind, details); err != nil {
+		serverError(response, request, "postDataRequestHandler", err)
+		return
+	}
+
+	http.Redirect(response, request, urlAccount+"?saved=request", 302)
+}
+
+func adminHandler(response http.ResponseWriter, request *http.Request) {
+	// Check login status
+	if getUserName(request) == "" {
+		http.Redirect(response, request, urlHello, 302)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+
+	// Only admins handle requests
+	if !isAdmin(userID) {
+		http.Error(response, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	location := getUserLocation(userID)
+	locale := getLocale(request)
+
+	data := AdminPageData{
+		Requests: getDataRequests(0, location, locale),
+		Erasures: getErasures(50, location, locale),
+		Kinds:    requestKinds,
+		Error:    request.FormValue("error"),
+		Saved:    request.FormValue("saved"),
+	}
+
+	err := renderTemplate(response, request, tmplAdmin, data)
+
+	if err != nil {
+		return
+	}
+}
+
+// getAdminRequest returns the open request of the form, if the user is an admin.
+func getAdminRequest(request *http.Request) (adminID int, dataRequest DataRequest, ok bool) {
+	adminID = getUserID(getUserName(request))
+	if !isAdmin(adminID) {
+		return 0, dataRequest, false
+	}
+
+	requestID, _ := strconv.Atoi(request.FormValue("requestID"))
+
+	err := db.QueryRow("SELECT r.request_id, r.user_id, r.kind, r.status, u.username, u.email FROM data_requests r JOIN users u ON u.user_id = r.user_id WHERE r.request_id=$1 AND r.status=$2", requestID, requestOpen).
+		Scan(&dataRequest.ID, &dataRequest.UserID, &dataRequest.Kind, &dataRequest.Status, &dataRequest.UserName, &dataRequest.Email)
+	if err != nil {
+		return adminID, dataRequest, false
+	}
+
+	return adminID, dataRequest, true
+}
+
+// closeDataRequest marks the request handled by the admin.
+func closeDataRequest(requestID int, adminID int, status string, reply string) error {
+	_, err := db.Exec("UPDATE data_requests SET status=$1, response=$2, handled_by=$3, update_at=$4 WHERE request_id=$5",
+		status, reply, adminID, nowEpoch(), requestID)
+	return err
+}
+
+func postAdminAddHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	if !isAdmin(getUserID(getUserName(request))) {
+		http.Error(response, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Requests arriving by mail or phone are filed for the account they name
+	kind := request.FormValue("kind")
+	userID, err := findUser(strings.TrimSpace(request.FormValue("user")))
+	if err != nil || !isRequestKind(kind) {
+		http.Redirect(response, request, urlAdmin+"?error=user", 302)
+		return
+	}
+
+	if err = addDataRequest(userID, kind, strings.TrimSpace(request.FormValue("details"))); err != nil {
+		serverError(response, request, "postAdminAddHandler", err)
+		return
+	}
+
+	http.Redirect(response, request, urlAdmin+"?saved=request", 302)
+}
+
+func adminExportHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, urlLogin, 302)
+		return
+	}
+
+	_, dataRequest, ok := getAdminRequest(request)
+	if !ok || dataRequest.Kind != requestAccess {
+		http.Error(response, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// The subject gets what the export page would give them
+	data, err := getExportData(dataRequest.UserID, getPatients(dataRequest.UserID))
+	if err != nil {
+		serverError(response, request, "adminExportHandler", err)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("mws-request-%d.json", dataRequest.ID)))
+
+	if err = writeExport(response, exportJSON, data, getRecipientLocale(dataRequest.UserID)); err != nil {
+		requestLogger(request).Error("adminExportHandler", "request_id", dataRequest.ID, "error", err)
+	}
+}
+
+func postAdminHandleHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	adminID, dataRequest, ok := getAdminRequest(request)
+	if !ok {
+		http.Redirect(response, request, urlAdmin+"?error=request", 302)
+		return
+	}
+
+	reply := strings.TrimSpace(request.FormValue("response"))
+	status := requestDone
+
+	switch request.FormValue("action") {
+	case "reject":
+		status = requestRejected
+
+	case "done":
+		switch dataRequest.Kind {
+		case requestRectify:
+			// Corrections of the account itself are applied here, the rest the user can edit
+			userName := strings.TrimSpace(request.FormValue("userName"))
+			email := strings.TrimSpace(request.FormValue("email"))
+
+			if userName == "" || !isEmailValid(email) {
+				http.Redirect(response, request, urlAdmin+"?error=rectify", 302)
+				return
+			}
+
+			if _, err := db.Exec("UPDATE users SET username=$1, email=$2 WHERE user_id=$3", userName, email, dataRequest.UserID); err != nil {
+				http.Redirect(response, request, urlAdmin+"?error=rectify", 302)
+				return
+			}
+
+		case requestErase:
+			var createAt int64
+			db.QueryRow("SELECT create_at FROM data_requests WHERE request_id=$1", dataRequest.ID).Scan(&createAt)
+
+			// Close the request first, erasing empties its texts
+			if err := closeDataRequest(dataRequest.ID, adminID, status, reply); err != nil {
+				serverError(response, request, "postAdminHandleHandler", err)
+				return
+			}
+
+			if err := eraseAccount(dataRequest.UserID, erasureRequest, fromEpoch(createAt)); err != nil {
+				serverError(response, request, "postAdminHandleHandler", err)
+				return
+			}
+
+			requestLogger(request).Info("data request handled", "request_id", dataRequest.ID, "kind", dataRequest.Kind, "status", status)
+			http.Redirect(response, request, urlAdmin+"?saved=erase", 302)
+			return
+		}
+
+	default:
+		http.Redirect(response, request, urlAdmin+"?error=request", 302)
+		return
+	}
+
+	if err := closeDataRequest(dataRequest.ID, adminID, status, reply); err != nil {
+		serverError(response, request, "postAdminHandleHandler", err)
+		return
+	}
+
+	requestLogger(request).Info("data request handled", "request_id", dataRequest.ID, "kind", dataRequest.Kind, "status", status)
+	http.Redirect(response, request, urlAdmin+"?saved="+status, 302)
+}
@@ -0,0 +1,725 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// attachmentMax limits the size of an uploaded file
+	attachmentMax = 10 << 20
+
+	// attachmentQuota limits the size of all files of an account
+	attachmentQuota = 200 << 20
+
+	// attachmentThumbSize is the longest side of a thumbnail in pixels
+	attachmentThumbSize = 160
+
+	// attachmentMaxPixels limits the images decoded for a thumbnail
+	attachmentMaxPixels = 50000000
+
+	// attachmentNameMax limits the length of a file name kept
+	attachmentNameMax = 120
+)
+
+// attachmentTypes holds the content types a file may have
+var attachmentTypes = []string{"image/jpeg", "image/png", "application/pdf"}
+
+// Upload errors shown on the attachments page
+var (
+	errAttachmentSize  = errors.New("size")
+	errAttachmentType  = errors.New("type")
+	errAttachmentQuota = errors.New("quota")
+)
+
+// Attachment holds a file attached to a medicine, or to one of its entries
+type Attachment struct {
+	ID          int
+	MedicineID  int
+	EntryID     int
+	Name        string
+	ContentType string
+	Size        int64
+	Date        string
+	HasThumb    bool
+}
+
+// IsImage reports if the file is shown as an image.
+func (a Attachment) IsImage() bool {
+	return strings.HasPrefix(a.ContentType, "image/")
+}
+
+// Kilobytes returns the size of the file in kilobytes, rounded up to a tenth.
+func (a Attachment) Kilobytes() float64 {
+	return float64((a.Size*10+1023)/1024) / 10
+}
+
+// AttachmentEntry holds an entry of the medicine files can be attached to
+type AttachmentEntry struct {
+	ID       int
+	Date     string
+	ExpireAt string
+}
+
+// AttachmentsPageData holds all data of the attachments page
+type AttachmentsPageData struct {
+	MedicineID  int
+	Name        string
+	Patient     string
+	Entries     []AttachmentEntry
+	Attachments []Attachment
+	UsedMB      float64
+	QuotaMB     int
+	MaxMB       int
+	Error       string
+	Saved       string
+}
+
+// getAttachmentMedicine returns the patient of the medicine if the user owns
+// it. Attachments are only ever seen by the account owning the patient.
+func getAttachmentMedicine(userID int, medicineID int) (patient Patient, ok bool) {
+	var patientID int
+	if err := db.QueryRow("SELECT patient_id FROM medicine WHERE medicine_id=$1", medicineID).Scan(&patientID); err != nil {
+		return Patient{}, false
+	}
+
+	patient, ok = getPatient(userID, patientID)
+	if !ok || patient.Permission != permissionOwner {
+		return Patient{}, false
+	}
+	return patient, true
+}
+
+// getAttachments returns the files attached to the medicine and its entries, newest first.
+func getAttachments(medicineID int, location *time.Location, locale *Locale) (attachments []Attachment) {
+	row, err := db.Query(`SELECT attachment_id, medicine_id, entry_id, name, content_type, size, thumb_key, create_at
+		FROM attachments WHERE medicine_id=$1 ORDER BY create_at DESC, attachment_id DESC`, medicineID)
+	if err != nil {
+		logger.Error("getAttachments", "medicine_id", medicineID, "error", err)
+		return
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var a Attachment
+		var entryID sql.NullInt64
+		var thumbKey sql.NullString
+		var createAt int64
+
+		if err = row.Scan(&a.ID, &a.MedicineID, &entryID, &a.Name, &a.ContentType, &a.Size, &thumbKey, &createAt); err != nil {
+			logger.Error("getAttachments", "medicine_id", medicineID, "error", err)
+			return
+		}
+
+		a.EntryID = int(entryID.Int64)
+		a.HasThumb = thumbKey.String != ""
+		a.Date = locale.FormatDateTime(fromEpoch(createAt).In(location))
+
+		attachments = append(attachments, a)
+	}
+
+	return attachments
+}
+
+// getAttachmentEntries returns the entries of the medicine.
+func getAttachmentEntries(medicineID int, location *time.Location, locale *Locale) (entries []AttachmentEntry) {
+	row, err := db.Query("SELECT entry_id, entry_at, expire_at FROM entries WHERE medicine_id=$1 ORDER BY entry_at", medicineID)
+	if err != nil {
+		logger.Error("getAttachmentEntries", "medicine_id", medicineID, "error", err)
+		return
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var entry AttachmentEntry
+		var entryAt, expireAt sql.NullInt64
+
+		if err = row.Scan(&entry.ID, &entryAt, &expireAt); err != nil {
+			logger.Error("getAttachmentEntries", "medicine_id", medicineID, "error", err)
+			return
+		}
+
+		entry.Date = locale.FormatDate(fromEpoch(entryAt.Int64).In(location))
+		entry.ExpireAt = locale.FormatDate(fromEpoch(expireAt.Int64).In(location))
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// getAttachmentCounts returns how many files the medicines of the patients
+// the user owns have, by medicine.
+func getAttachmentCounts(patients []Patient) map[int]int {
+	counts := make(map[int]int)
+
+	var owned []Patient
+	for _, patient := range patients {
+		if patient.Permission == permissionOwner {
+			owned = append(owned, patient)
+		}
+	}
+	if len(owned) == 0 {
+		return counts
+	}
+
+	clause, args := patientIDsClause("patient_id", owned)
+
+	row, err := db.Query("SELECT medicine_id, COUNT(*) FROM attachments WHERE "+clause+" GROUP BY medicine_id", args...)
+	if err != nil {
+		logger.Error("getAttachmentCounts", "error", err)
+		return counts
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var medicineID, count int
+		if err = row.Scan(&medicineID, &count); err != nil {
+			logger.Error("getAttachmentCounts", "error", err)
+			return counts
+		}
+		counts[medicineID] = count
+	}
+
+	return counts
+}
+
+// getAttachmentUsage returns the size of all files of the account.
+func getAttachmentUsage(ownerID int) (size int64) {
+	db.QueryRow("SELECT IFNULL(SUM(size),0) FROM attachments WHERE user_id=$1", ownerID).Scan(&size)
+	return size
+}
+
+// readAttachment reads the uploaded file with its name and the content type
+// its content tells.
+func readAttachment(request *http.Request) (name string, contentType string, content []byte, err error) {
+	file, header, err := request.FormFile("file")
+	if err != nil {
+		return "", "", nil, err
+	}
+	defer file.Close()
+
+	content, err = ioutil.ReadAll(io.LimitReader(file, attachmentMax+1))
+	if err != nil {
+		return "", "", nil, err
+	}
+	if len(content) > attachmentMax {
+		return "", "", nil, errAttachmentSize
+	}
+
+	// Names are kept for showing only, without the folders some browsers send
+	name = strings.TrimSpace(filepath.Base(strings.Replace(header.Filename, "\\", "/", -1)))
+	if !utf8.ValidString(name) || name == "." || name == "/" || name == "" {
+		name = "attachment"
+	}
+	if runes := []rune(name); len(runes) > attachmentNameMax {
+		name = string(runes[:attachmentNameMax])
+	}
+
+	contentType = strings.Split(http.DetectContentType(content), ";")[0]
+	for _, allowed := range attachmentTypes {
+		if contentType == allowed {
+			return name, contentType, content, nil
+		}
+	}
+
+	return "", "", nil, errAttachmentType
+}
+
+// makeThumbnail scales the image down to a JPEG of the thumbnail size,
+// averaging the pixels each one covers. Transparency is shown on white.
+func makeThumbnail(content []byte) ([]byte, error) {
+	header, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	if header.Width <= 0 || header.Height <= 0 || header.Width*header.Height > attachmentMaxPixels {
+		return nil, fmt.Errorf("image of %dx%d pixels", header.Width, header.Height)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > attachmentThumbSize || height > attachmentThumbSize {
+		if width >= height {
+			width, height = attachmentThumbSize, height*attachmentThumbSize/width
+		} else {
+			width, height = width*attachmentThumbSize/height, attachmentThumbSize
+		}
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+
+			// The colours are premultiplied, what is not covered is white
+			white := 0xffff - a/n
+			dst.Set(x, y, color.RGBA64{R: uint16(r/n + white), G: uint16(g/n + white), B: uint16(b/n + white), A: 0xffff})
+		}
+	}
+
+	var out bytes.Buffer
+	if err = jpeg.Encode(&out, dst, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// putBlobs seals the files with the data key and stores them by their keys.
+// Files stored before one fails are deleted again.
+func putBlobs(keyID int64, files map[string][]byte, contentType string) error {
+	var stored []string
+
+	for key, content := range files {
+		sealed, err := sealBlob(keyID, key, content)
+		if err == nil {
+			err = blobs.Put(key, sealed, contentType)
+		}
+		if err != nil {
+			deleteBlobs(stored)
+			return err
+		}
+		stored = append(stored, key)
+	}
+
+	return nil
+}
+
+// deleteBlobs deletes the files, the ones which cannot be are logged.
+func deleteBlobs(keys []string) {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if err := blobs.Delete(key); err != nil {
+			logger.Error("deleteBlobs", "key", key, "error", err)
+		}
+	}
+}
+
+// getBlobKeys returns the blob keys of the attachments the query selects.
+func getBlobKeys(query string, args ...interface{}) (keys []string, err error) {
+	row, err := db.Query("SELECT blob_key, IFNULL(thumb_key,'') FROM attachments WHERE "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var blobKey, thumbKey string
+		if err = row.Scan(&blobKey, &thumbKey); err != nil {
+			return nil, err
+		}
+		keys = append(keys, blobKey, thumbKey)
+	}
+
+	return keys, row.Err()
+}
+
+// reencryptAttachments seals the files of every attachment not sealed with
+// the current data key of its account. They are written under new blob keys
+// before the rows point at them, so no row ever points at a file it cannot open.
+func reencryptAttachments() (count int, err error) {
+	type sealedAttachment struct {
+		ID       int
+		UserID   int
+		BlobKey  string
+		ThumbKey string
+		KeyID    int64
+	}
+
+	var stale []sealedAttachment
+
+	row, err := db.Query(`SELECT a.attachment_id, a.user_id, a.blob_key, IFNULL(a.thumb_key,''), a.key_id FROM attachments a
+		WHERE a.key_id != (SELECT MAX(k.key_id) FROM data_keys k WHERE k.user_id = a.user_id)`)
+	if err != nil {
+		return 0, err
+	}
+	for row.Next() {
+		var a sealedAttachment
+		if err = row.Scan(&a.ID, &a.UserID, &a.BlobKey, &a.ThumbKey, &a.KeyID); err != nil {
+			row.Close()
+			return 0, err
+		}
+		stale = append(stale, a)
+	}
+	row.Close()
+
+	for _, a := range stale {
+		keyID, err := getCurrentKeyID(a.UserID)
+		if err != nil {
+			return count, err
+		}
+
+		files := make(map[string][]byte)
+		blobKey := newBlobKey(a.UserID)
+		renamed := map[string]string{a.BlobKey: blobKey, a.ThumbKey: blobKey + ".thumb"}
+
+		for _, key := range []string{a.BlobKey, a.ThumbKey} {
+			if key == "" {
+				continue
+			}
+
+			sealed, err := blobs.Get(key)
+			if err != nil {
+				return count, fmt.Errorf("attachment %d: %s", a.ID, err)
+			}
+			content, err := openBlob(a.KeyID, key, sealed)
+			if err != nil {
+				return count, fmt.Errorf("attachment %d: %s", a.ID, err)
+			}
+
+			files[renamed[key]] = content
+		}
+
+		if err = putBlobs(keyID, files, ""); err != nil {
+			return count, err
+		}
+
+		_, err = db.Exec("UPDATE attachments SET blob_key=$1, thumb_key=$2, key_id=$3 WHERE attachment_id=$4",
+			renamed[a.BlobKey], sql.NullString{String: renamed[a.ThumbKey], Valid: a.ThumbKey != ""}, keyID, a.ID)
+		if err != nil {
+			deleteBlobs([]string{renamed[a.BlobKey], renamed[a.ThumbKey]})
+			return count, err
+		}
+
+		deleteBlobs([]string{a.BlobKey, a.ThumbKey})
+		count++
+	}
+
+	return count, nil
+}
+
+// newBlobKey returns a key for a new file of the account.
+func newBlobKey(ownerID int) string {
+	return fmt.Sprintf("attachments/%d/%s", ownerID, generateSecret(16))
+}
+
+func attachmentsHandler(response http.ResponseWriter, request *http.Request) {
+	// Check login status
+	if getUserName(request) == "" {
+		http.Redirect(response, request, urlHello, 302)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+	medicineID, _ := strconv.Atoi(request.FormValue("medicine"))
+
+	patient, ok := getAttachmentMedicine(userID, medicineID)
+	if !ok {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	location := getUserLocation(userID)
+	locale := getLocale(request)
+
+	data := AttachmentsPageData{
+		MedicineID:  medicineID,
+		Name:        getMedicineNameFromID(medicineID),
+		Patient:     patient.Name,
+		Entries:     getAttachmentEntries(medicineID, location, locale),
+		Attachments: getAttachments(medicineID, location, locale),
+		UsedMB:      float64(getAttachmentUsage(patient.OwnerID)*10>>20) / 10,
+		QuotaMB:     attachmentQuota >> 20,
+		MaxMB:       attachmentMax >> 20,
+		Error:       request.FormValue("error"),
+		Saved:       request.FormValue("saved"),
+	}
+
+	err := renderTemplate(response, request, tmplAttachment, data)
+
+	if err != nil {
+		return
+	}
+}
+
+func postAttachmentHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	request.Body = http.MaxBytesReader(response, request.Body, attachmentMax+64<<10)
+
+	// The medicine comes with the address, so it is known when the body is too large
+	userID := getUserID(getUserName(request))
+	medicineID, _ := strconv.Atoi(request.URL.Query().Get("medicine"))
+	page := fmt.Sprintf("%s?medicine=%d", urlAttachments, medicineID)
+
+	patient, ok := getAttachmentMedicine(userID, medicineID)
+	if !ok {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	if err := request.ParseMultipartForm(attachmentMax); err == http.ErrNotMultipart {
+		http.Redirect(response, request, page+"&error=file", 302)
+		return
+	} else if err != nil {
+		requestLogger(request).Warn("postAttachmentHandler", "error", err)
+		http.Redirect(response, request, page+"&error=size", 302)
+		return
+	}
+
+	// An entry is only attached to if it is one of the medicine
+	var entryID interface{}
+	if id, _ := strconv.Atoi(request.FormValue("entryID")); id != 0 {
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM entries WHERE entry_id=$1 AND medicine_id=$2", id, medicineID).Scan(&count)
+		if count == 0 {
+			http.Redirect(response, request, page+"&error=entry", 302)
+			return
+		}
+		entryID = id
+	}
+
+	name, contentType, content, err := readAttachment(request)
+	if err == nil && getAttachmentUsage(patient.OwnerID)+int64(len(content)) > attachmentQuota {
+		err = errAttachmentQuota
+	}
+	switch err {
+	case nil:
+	case errAttachmentSize, errAttachmentType, errAttachmentQuota:
+		http.Redirect(response, request, page+"&error="+err.Error(), 302)
+		return
+	default:
+		requestLogger(request).Warn("postAttachmentHandler", "error", err)
+		http.Redirect(response, request, page+"&error=file", 302)
+		return
+	}
+
+	blobKey := newBlobKey(patient.OwnerID)
+	files := map[string][]byte{blobKey: content}
+
+	// Images get a thumbnail, one which cannot be made is only missing
+	var thumbKey sql.NullString
+	if strings.HasPrefix(contentType, "image/") {
+		thumb, err := makeThumbnail(content)
+		if err != nil {
+			requestLogger(request).Warn("postAttachmentHandler", "thumbnail", name, "error", err)
+		} else {
+			thumbKey = sql.NullString{String: blobKey + ".thumb", Valid: true}
+			files[thumbKey.String] = thumb
+		}
+	}
+
+	// Files are health data sealed with the owner's key, like the columns
+	var keyID int64
+	if encryptionEnabled() {
+		if keyID, err = getCurrentKeyID(patient.OwnerID); err != nil {
+			serverError(response, request, "postAttachmentHandler", err)
+			return
+		}
+	}
+
+	if err = putBlobs(keyID, files, contentType); err != nil {
+		serverError(response, request, "postAttachmentHandler", err)
+		return
+	}
+
+	err = insertAttachment(requestActor(request), patient, medicineID, entryID, name, contentType, int64(len(content)), blobKey, thumbKey, keyID)
+	if err != nil {
+		deleteBlobs([]string{blobKey, thumbKey.String})
+		serverError(response, request, "postAttachmentHandler", err)
+		return
+	}
+
+	http.Redirect(response, request, page+"&saved=add", 302)
+}
+
+// insertAttachment records a stored file with its audit event.
+func insertAttachment(actor Actor, patient Patient, medicineID int, entryID interface{}, name string, contentType string, size int64, blobKey string, thumbKey sql.NullString, keyID int64) error {
+	plainName := name
+	if err := sealFields(patient.OwnerID, &name); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`INSERT INTO attachments(user_id,patient_id,medicine_id,entry_id,name,content_type,size,blob_key,thumb_key,key_id,create_at)
+		VALUES(?,?,?,?,?,?,?,?,?,?,?)`,
+		patient.OwnerID, patient.ID, medicineID, entryID, name, contentType, size, blobKey, thumbKey, keyID, nowEpoch())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	attachmentID, err := result.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = writeAudit(tx, actor, AuditEvent{
+		OwnerID: patient.OwnerID, PatientID: patient.ID, Action: auditCreate, Entity: auditAttachment, EntityID: attachmentID,
+		After: map[string]interface{}{"medicine_id": medicineID, "entry_id": entryID, "name": plainName, "content_type": contentType, "size": size},
+	})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// getAttachmentFile returns the attachment with the keys of its files if the user owns it.
+func getAttachmentFile(userID int, attachmentID int) (a Attachment, patient Patient, blobKey string, thumbKey string, keyID int64, ok bool) {
+	var entryID sql.NullInt64
+	var thumb sql.NullString
+
+	err := db.QueryRow("SELECT attachment_id, medicine_id, entry_id, name, content_type, size, blob_key, thumb_key, key_id FROM attachments WHERE attachment_id=$1", attachmentID).
+		Scan(&a.ID, &a.MedicineID, &entryID, &a.Name, &a.ContentType, &a.Size, &blobKey, &thumb, &keyID)
+	if err != nil {
+		return a, patient, "", "", 0, false
+	}
+
+	if patient, ok = getAttachmentMedicine(userID, a.MedicineID); !ok {
+		return a, patient, "", "", 0, false
+	}
+
+	a.EntryID = int(entryID.Int64)
+	a.HasThumb = thumb.String != ""
+	return a, patient, blobKey, thumb.String, keyID, true
+}
+
+// attachmentFileHandler serves a file, or its thumbnail, to the account owning it.
+func attachmentFileHandler(response http.ResponseWriter, request *http.Request) {
+	// Check login status
+	if getUserName(request) == "" {
+		http.Redirect(response, request, urlHello, 302)
+		return
+	}
+
+	attachmentID, _ := strconv.Atoi(request.FormValue("id"))
+
+	a, _, blobKey, thumbKey, keyID, ok := getAttachmentFile(getUserID(getUserName(request)), attachmentID)
+	if !ok {
+		http.NotFound(response, request)
+		return
+	}
+
+	contentType := a.ContentType
+	if request.FormValue("thumb") != "" {
+		if thumbKey == "" {
+			http.NotFound(response, request)
+			return
+		}
+		blobKey, contentType = thumbKey, "image/jpeg"
+	} else {
+		response.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": a.Name}))
+	}
+
+	sealed, err := blobs.Get(blobKey)
+	if err == errBlobNotFound {
+		requestLogger(request).Error("attachmentFileHandler", "attachment_id", attachmentID, "key", blobKey, "error", err)
+		http.NotFound(response, request)
+		return
+	}
+	if err != nil {
+		serverError(response, request, "attachmentFileHandler", err)
+		return
+	}
+
+	content, err := openBlob(keyID, blobKey, sealed)
+	if err != nil {
+		serverError(response, request, "attachmentFileHandler", err)
+		return
+	}
+
+	response.Header().Set("Content-Type", contentType)
+	response.Header().Set("X-Content-Type-Options", "nosniff")
+	response.Header().Set("Cache-Control", "private, no-store")
+	response.Write(content)
+}
+
+func postUnattachHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	attachmentID, _ := strconv.Atoi(request.FormValue("attachmentID"))
+
+	a, patient, blobKey, thumbKey, _, ok := getAttachmentFile(getUserID(getUserName(request)), attachmentID)
+	if !ok {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		serverError(response, request, "postUnattachHandler", err)
+		return
+	}
+
+	if _, err = tx.Exec("DELETE FROM attachments WHERE attachment_id=$1", attachmentID); err == nil {
+		err = writeAudit(tx, requestActor(request), AuditEvent{
+			OwnerID: patient.OwnerID, PatientID: patient.ID, Action: auditDelete, Entity: auditAttachment, EntityID: int64(attachmentID),
+			Before: map[string]interface{}{"medicine_id": a.MedicineID, "entry_id": a.EntryID, "name": a.Name, "content_type": a.ContentType, "size": a.Size},
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		serverError(response, request, "postUnattachHandler", err)
+		return
+	}
+
+	// The files go once nothing points at them
+	deleteBlobs([]string{blobKey, thumbKey})
+
+	http.Redirect(response, request, fmt.Sprintf("%s?medicine=%d&saved=delete", urlAttachments, a.MedicineID), 302)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// auditPageSize is how many events the audit page shows
+const auditPageSize = 200
+
+// Audited entities
+const (
+	auditMedicine   = "medicine"
+	auditEntry      = "entry"
+	auditSchedule   = "schedule"
+	auditAlarm      = "alarm"
+	auditAccount    = "account"
+	auditAttachment = "attachment"
+	auditPrescript  = "prescription"
+	auditLocation   = "location"
+)
+
+// Audited actions
+const (
+	auditCreate         = "create"
+	auditUpdate         = "update"
+	auditDelete         = "delete"
+	auditLogin          = "login"
+	auditLogout         = "logout"
+	auditLoginFailed    = "login_failed"
+	auditPasswordChange = "password_change"
+	auditDeleteRequest  = "delete_request"
+	auditDeleteCancel   = "delete_cancel"
+)
+
+// Actor is who makes a change, an account with the request it came with, or
+// the system itself or someone not signed in when UserID is 0
+type Actor struct {
+	UserID    int
+	IP        string
+	RequestID string
+}
+
+// systemActor makes the changes of the scheduler and the command line tools
+var systemActor = Actor{}
+
+// AuditEvent holds a change to write into the audit log
+type AuditEvent struct {
+	// OwnerID is the account whose data changed, the values are sealed with its key
+	OwnerID   int
+	PatientID int
+	Action    string
+	Entity    string
+	EntityID  int64
+	Before    interface{}
+	After     interface{}
+}
+
+// AuditEntry holds an event of the audit log as it is listed and exported
+type AuditEntry struct {
+	ID        int    `json:"id"`
+	Date      string `json:"date"`
+	Actor     string `json:"actor,omitempty"`
+	OwnerID   int    `json:"owner_id"`
+	PatientID int    `json:"patient_id,omitempty"`
+	Action    string `json:"action"`
+	Entity    string `json:"entity"`
+	EntityID  int64  `json:"entity_id,omitempty"`
+	Before    string `json:"before,omitempty"`
+	After     string `json:"after,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// AuditPageData holds all data of the audit log page
+type AuditPageData struct {
+	Entries []AuditEntry
+	IsAdmin bool
+	All     bool
+}
+
+// requestActor returns the signed in account and the address the request came from.
+func requestActor(request *http.Request) Actor {
+	ip, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		ip = request.RemoteAddr
+	}
+
+	actor := Actor{IP: ip, RequestID: getRequestID(request)}
+	if userName := getUserName(request); userName != "" {
+		actor.UserID = getUserID(userName)
+	}
+	return actor
+}
+
+// auditValue returns a value of an event as JSON sealed with the owner's key.
+func auditValue(ownerID int, value interface{}) (string, error) {
+	if value == nil {
+		return "", nil
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	if ownerID == 0 {
+		return string(encoded), nil
+	}
+	return sealField(ownerID, string(encoded))
+}
+
+// writeAudit appends an event to the audit log. It takes the transaction of
+// the change, so the event is only kept if the change is.
+func writeAudit(exec dbExecer, actor Actor, event AuditEvent) error {
+	before, err := auditValue(event.OwnerID, event.Before)
+	if err != nil {
+		return err
+	}
+
+	after, err := auditValue(event.OwnerID, event.After)
+	if err != nil {
+		return err
+	}
+
+	var actorID, patientID, entityID interface{}
+	if actor.UserID != 0 {
+		actorID = actor.UserID
+	}
+	if event.PatientID != 0 {
+		patientID = event.PatientID
+	}
+	if event.EntityID != 0 {
+		entityID = event.EntityID
+	}
+
+	_, err = exec.Exec(`INSERT INTO audit_log(actor_id,owner_id,patient_id,action,entity,entity_id,before_value,after_value,ip,request_id,create_at) VALUES(?,?,?,?,?,?,?,?,?,?,?)`,
+		actorID, event.OwnerID, patientID, event.Action, event.Entity, entityID, before, after, actor.IP, actor.RequestID, nowEpoch())
+	return err
+}
+
+// auditRequest appends an event of the request's account, logging what could not be written.
+func auditRequest(request *http.Request, event AuditEvent) {
+	if err := writeAudit(db, requestActor(request), event); err != nil {
+		requestLogger(request).Error("auditRequest", "action", event.Action, "error", err)
+	}
+}
+
+// auditSecurity appends a security event of the account, or of no known
+// account for a user ID of 0.
+func auditSecurity(request *http.Request, userID int, action string, after interface{}) {
+	actor := requestActor(request)
+
+	// The session of a sign-in only starts with the response
+	if action == auditLogin {
+		actor.UserID = userID
+	}
+
+	err := writeAudit(db, actor, AuditEvent{OwnerID: userID, Action: action, Entity: auditAccount, EntityID: int64(userID), After: after})
+	if err != nil {
+		requestLogger(request).Error("auditSecurity", "action", action, "error", err)
+	}
+}
+
+// getAuditEntries returns the events of the account's data, or of every
+// account for an owner ID of 0, newest first. A limit of 0 returns all.
+func getAuditEntries(ownerID int, limit int, location *time.Location) (entries []AuditEntry, err error) {
+	if limit == 0 {
+		limit = -1
+	}
+
+	row, err := db.Query(`SELECT a.audit_id, a.create_at, a.actor_id, COALESCE(u.username, ''), a.owner_id, a.patient_id, a.action, a.entity, a.entity_id,
+		a.before_value, a.after_value, a.ip, a.request_id
+		FROM audit_log a LEFT JOIN users u ON u.user_id = a.actor_id
+		WHERE $1 = 0 OR a.owner_id = $1
+		ORDER BY a.audit_id DESC LIMIT $2`, ownerID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var entry AuditEntry
+		var createAt int64
+		var actorID, patientID, entityID sql.NullInt64
+		var before, after, ip, requestID sql.NullString
+
+		err = row.Scan(&entry.ID, &createAt, &actorID, &entry.Actor, &entry.OwnerID, &patientID, &entry.Action, &entry.Entity, &entityID,
+			&before, &after, &ip, &requestID)
+		if err != nil {
+			return nil, err
+		}
+
+		// Accounts erased since are only known by their number
+		if actorID.Valid && entry.Actor == "" {
+			entry.Actor = "#" + strconv.FormatInt(actorID.Int64, 10)
+		}
+
+		entry.Date = fromEpoch(createAt).In(location).Format(time.RFC3339)
+		entry.PatientID, entry.EntityID = int(patientID.Int64), entityID.Int64
+		entry.Before, entry.After, entry.IP, entry.RequestID = before.String, after.String, ip.String, requestID.String
+
+		entries = append(entries, entry)
+	}
+
+	return entries, row.Err()
+}
+
+// writeAuditCSV writes the events as a zip holding audit.csv, like the data export does.
+func writeAuditCSV(response http.ResponseWriter, entries []AuditEntry) error {
+	archive := zip.NewWriter(response)
+
+	file, err := archive.Create("audit.csv")
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(file)
+	w.Write([]string{"id", "date", "actor", "owner_id", "patient_id", "action", "entity", "entity_id", "before", "after", "ip", "request_id"})
+	for _, e := range entries {
+		w.Write([]string{strconv.Itoa(e.ID), e.Date, e.Actor, strconv.Itoa(e.OwnerID), strconv.Itoa(e.PatientID), e.Action, e.Entity,
+			strconv.FormatInt(e.EntityID, 10), e.Before, e.After, e.IP, e.RequestID})
+	}
+	w.Flush()
+
+	if err = w.Error(); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+func auditHandler(response http.ResponseWriter, request *http.Request) {
+	// Check login status
+	if getUserName(request) == "" {
+		http.Redirect(response, request, urlHello, 302)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+	location := getUserLocation(userID)
+
+	data := AuditPageData{IsAdmin: isAdmin(userID)}
+
+	// Admins may see the events of every account
+	ownerID := userID
+	if data.IsAdmin && request.FormValue("all") != "" {
+		ownerID = 0
+		data.All = true
+	}
+
+	format := request.FormValue("format")
+
+	limit := auditPageSize
+	if format != "" {
+		limit = 0
+	}
+
+	entries, err := getAuditEntries(ownerID, limit, location)
+	if err != nil {
+		serverError(response, request, "auditHandler", err)
+		return
+	}
+
+	switch format {
+	case "":
+		data.Entries = entries
+
+		err = renderTemplate(response, request, tmplAudit, data)
+
+		if err != nil {
+			return
+		}
+
+	case exportJSON:
+		response.Header().Set("Content-Type", "application/json")
+		response.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "mws-audit-"+time.Now().Format("20060102")+".json"))
+
+		if entries == nil {
+			entries = []AuditEntry{}
+		}
+
+		encoder := json.NewEncoder(response)
+		encoder.SetIndent("", "  ")
+		if err = encoder.Encode(entries); err != nil {
+			requestLogger(request).Error("auditHandler", "format", format, "error", err)
+		}
+
+	case exportCSV:
+		response.Header().Set("Content-Type", "application/zip")
+		response.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "mws-audit-"+time.Now().Format("20060102")+".zip"))
+
+		if err = writeAuditCSV(response, entries); err != nil {
+			requestLogger(request).Error("auditHandler", "format", format, "error", err)
+		}
+
+	default:
+		http.Error(response, "Unknown format", http.StatusBadRequest)
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"database/sql"
-	"fmt"
 	"net/http"
 	"regexp"
 
@@ -48,7 +47,7 @@ func getUserID(userName string) (userID int) {
 	err := result.Scan(&userID)
 
 	if err != nil {
-		fmt.Printf("ERROR getUserID(%s): %s\n", userName, err)
+		logger.Error("getUserID", "user_name", userName, "error", err)
 		return
 	}
 
@@ -60,7 +59,7 @@ func getUserIDAsStr(userName string) (userID string) {
 	err := result.Scan(&userID)
 
 	if err != nil {
-		fmt.Printf("ERROR getUserID(%s): %s\n", userName, err)
+		logger.Error("getUserID", "user_name", userName, "error", err)
 		return
 	}
 
@@ -72,7 +71,7 @@ func getUserNameFromID(userID int) (userName string) {
 	err := result.Scan(&userName)
 
 	if err != nil {
-		fmt.Printf("ERROR getUserNameFromID(%d): %s\n", userID, err)
+		logger.Error("getUserNameFromID", "user_id", userID, "error", err)
 		return
 	}
 
@@ -109,7 +108,7 @@ func loginHandler(response http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	err := tmpl[tmplLogin].Execute(response, nil)
+	err := renderTemplate(response, request, tmplLogin, nil)
 
 	if err != nil {
 		return
@@ -118,6 +117,10 @@ func loginHandler(response http.ResponseWriter, request *http.Request) {
 
 // LogoutHandler clears session cookies and redirects user to homepage
 func LogoutHandler(response http.ResponseWriter, request *http.Request) {
+	if userName := getUserName(request); userName != "" {
+		auditSecurity(request, getUserID(userName), auditLogout, nil)
+	}
+
 	clearSession(response)
 	http.Redirect(response, request, "/", 302)
 }
@@ -128,7 +131,7 @@ func registerHandler(response http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	err := tmpl[tmplRegister].Execute(response, nil)
+	err := renderTemplate(response, request, tmplRegister, nil)
 
 	if err != nil {
 		return
@@ -155,7 +158,8 @@ func postLoginHandler(response http.ResponseWriter, request *http.Request) {
 			Password: nil,
 		}
 
-		result := db.QueryRow("SELECT username, password FROM users WHERE email=$1", u.Email)
+		var userID int
+		result := db.QueryRow("SELECT user_id, username, password FROM users WHERE email=$1", u.Email)
 
 		if err != nil {
 			// If there is an issue with the database, return a 500 error
@@ -165,42 +169,43 @@ func postLoginHandler(response http.ResponseWriter, request *http.Request) {
 
 		storedCreds := &Credentials{}
 
-		err = result.Scan(&u.Username, &storedCreds.Password)
+		err = result.Scan(&userID, &u.Username, &storedCreds.Password)
 		if err != nil {
 			// If an entry with the username does not exist, send an "Unauthorized"(401) status
 			if err == sql.ErrNoRows {
+				auditSecurity(request, 0, auditLoginFailed, map[string]string{"email": email})
 				response.WriteHeader(http.StatusUnauthorized)
 				return
 			}
 			// If the error is of any other type, send a 500 status
-			response.WriteHeader(http.StatusInternalServerError)
+			serverError(response, request, "postLoginHandler", err)
 			return
 		}
 
 		// Compare the stored hashed password, with the hashed version of the password that was received
 		if err = bcrypt.CompareHashAndPassword([]byte(storedCreds.Password), []byte(inputPassword)); err != nil {
 			// If the two passwords DO NOT MATCH; return a 401 status
+			auditSecurity(request, userID, auditLoginFailed, nil)
 			response.WriteHeader(http.StatusUnauthorized)
 			redirectTarget = urlLogin
 		} else {
 			// If passwords MATCH; set session cookie and send user to homepage
-			fmt.Println("DEBUG: Successful login")
 			setSession(u.Username, response)
 			redirectTarget = "/"
 
+			auditSecurity(request, userID, auditLogin, nil)
+
 			// Update user's last login date
 			sqlStatement := `UPDATE users SET last_login = $1 WHERE email = $2`
 			statement, err := db.Prepare(sqlStatement)
 			if err != nil {
-				fmt.Println(err.Error())
+				serverError(response, request, "postLoginHandler", err)
 				return
 			}
 
 			_, err = statement.Exec(getDate(), email)
 			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				fmt.Println(err.Error())
-				fmt.Printf("ERROR postLoginHandler: %s", err)
+				serverError(response, request, "postLoginHandler", err)
 				return
 			}
 		}
@@ -212,7 +217,7 @@ func postLoginHandler(response http.ResponseWriter, request *http.Request) {
 func postRegisterHandler(response http.ResponseWriter, request *http.Request) {
 	// Check request method first
 	if request.Method != "POST" {
-		fmt.Printf("ERROR postRegisterHandler MethodCheck")
+		http.Redirect(response, request, urlRegister, 302)
 		return
 	}
 
@@ -224,13 +229,13 @@ func postRegisterHandler(response http.ResponseWriter, request *http.Request) {
 
 	// Check if any field is empty
 	if request.FormValue("name") == "" || request.FormValue("passwd") == "" || request.FormValue("email") == "" {
-		fmt.Printf("ERROR postRegisterHandler ValueChecks")
+		http.Redirect(response, request, urlRegister, 302)
 		return
 	}
 
 	// Check if the e-mail is valid or not
 	if isEmailValid(request.FormValue("email")) != true {
-		fmt.Printf("ERROR postRegisterHandler EmailCheck(%s)", request.FormValue("email"))
+		http.Redirect(response, request, urlRegister, 302)
 		return
 	}
 
@@ -238,7 +243,7 @@ func postRegisterHandler(response http.ResponseWriter, request *http.Request) {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(request.FormValue("passwd")), hashCost)
 
 	if err != nil {
-		fmt.Printf("ERROR postRegisterHandler hashedPassword: %s", err)
+		serverError(response, request, "postRegisterHandler", err)
 		return
 	}
 
@@ -249,21 +254,55 @@ func postRegisterHandler(response http.ResponseWriter, request *http.Request) {
 		Email:    request.FormValue("email"),
 	}
 
-	// Insert data into database
-	sqlStatement := `INSERT INTO users(username,email,register_date,password,blocked) VALUES(?,?,?,?,?)`
-	statement, err := db.Prepare(sqlStatement)
+	// The browser tells the user's timezone, keep the default if it is unknown
+	var timezone, locale interface{}
+	if value := request.FormValue("timezone"); value != "" {
+		if _, err = loadTimezone(value); err == nil {
+			timezone = value
+		}
+	}
+
+	// Keep the language the account was created in
+	if _, ok := locales[request.FormValue("locale")]; ok {
+		locale = request.FormValue("locale")
+	}
+
+	// The account, its data key and patient are created together, an account
+	// missing either could not be used
+	tx, err := db.Begin()
 	if err != nil {
-		fmt.Println(err.Error())
+		serverError(response, request, "postRegisterHandler", err)
 		return
 	}
 
-	_, err = statement.Exec(u.Username, u.Email, getDate(), string(u.Password), false)
+	var userID int64
+	result, err := tx.Exec(`INSERT INTO users(username,email,register_date,password,blocked,timezone,locale) VALUES(?,?,?,?,?,?,?)`,
+		u.Username, u.Email, getDate(), string(u.Password), false, timezone, locale)
+	if err == nil {
+		userID, err = result.LastInsertId()
+	}
+
+	// Health data of the account is sealed with its own key
+	if err == nil && encryptionEnabled() {
+		err = createDataKey(tx, int(userID))
+	}
+
+	// Every account starts with the account holder as its only patient
+	if err == nil {
+		_, err = createPatient(tx, int(userID), u.Username)
+	}
+
 	if err != nil {
-		fmt.Println(err.Error())
+		tx.Rollback()
+		serverError(response, request, "postRegisterHandler", err)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		serverError(response, request, "postRegisterHandler", err)
 		return
 	}
 
 	// Redirect user to login page
-	fmt.Println("DEBUG: Successful register")
 	http.Redirect(response, request, urlLogin, 302)
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestRegister expects an account to be created with its data key and
+// patient, and nothing of it to be kept when registering fails.
+func TestRegister(t *testing.T) {
+	openTestDatabase(t)
+	useMasterKey(t)
+
+	// Failures answer with the error page
+	tmpl[tmplError] = template.Must(template.New(tmplError).Parse("error"))
+	defer delete(tmpl, tmplError)
+
+	register := func(name string, email string) int {
+		form := url.Values{"name": {name}, "passwd": {"secret123"}, "email": {email}, "timezone": {"Europe/Istanbul"}}
+		request := httptest.NewRequest("POST", urlRegister, strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		recorder := httptest.NewRecorder()
+		postRegisterHandler(recorder, request)
+		return recorder.Code
+	}
+
+	count := func(query string, args ...interface{}) (count int) {
+		if err := db.QueryRow(query, args...).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	if code := register("newcomer", "newcomer@mws.local"); code != http.StatusFound {
+		t.Fatalf("registering answered %d", code)
+	}
+
+	var userID int
+	var timezone string
+	if err := db.QueryRow("SELECT user_id, timezone FROM users WHERE email='newcomer@mws.local'").Scan(&userID, &timezone); err != nil {
+		t.Fatal(err)
+	}
+	if timezone != "Europe/Istanbul" {
+		t.Errorf("timezone = %q, want Europe/Istanbul", timezone)
+	}
+	if patients, keys := getPatients(userID), count("SELECT COUNT(*) FROM data_keys WHERE user_id=$1", userID); len(patients) != 1 || keys != 1 {
+		t.Errorf("account has %d patients and %d data keys, want 1 each", len(patients), keys)
+	}
+
+	// Without a usable master key the data key cannot be made, nothing of the
+	// account is kept
+	masterKeys.current = "missing"
+
+	users, patients := count("SELECT COUNT(*) FROM users"), count("SELECT COUNT(*) FROM patients")
+	if code := register("keyless", "keyless@mws.local"); code != http.StatusInternalServerError {
+		t.Errorf("registering without a data key answered %d", code)
+	}
+	if count("SELECT COUNT(*) FROM users") != users || count("SELECT COUNT(*) FROM patients") != patients {
+		t.Error("a failed registration left rows behind")
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Blob backends of MWS_BLOB_BACKEND
+const (
+	blobBackendLocal = "local"
+	blobBackendS3    = "s3"
+)
+
+// errBlobNotFound is returned when no blob has the key
+var errBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps the files users upload, by keys the database refers to
+type BlobStore interface {
+	Put(key string, content []byte, contentType string) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+	Check() error
+}
+
+// blobs is the store of the configured backend
+var blobs BlobStore
+
+// newBlobStore returns the store of the configured backend.
+func newBlobStore(config Config) (BlobStore, error) {
+	switch config.BlobBackend {
+	case blobBackendLocal:
+		if err := os.MkdirAll(config.BlobDir, 0700); err != nil {
+			return nil, err
+		}
+		return &localBlobStore{dir: config.BlobDir}, nil
+	case blobBackendS3:
+		if config.S3AccessKey == "" || config.S3SecretKey == "" {
+			return nil, errors.New("MWS_S3_ACCESS_KEY and MWS_S3_SECRET_KEY are required")
+		}
+		return &s3BlobStore{
+			endpoint:  strings.TrimRight(config.S3Endpoint, "/"),
+			region:    config.S3Region,
+			bucket:    config.S3Bucket,
+			accessKey: config.S3AccessKey,
+			secretKey: config.S3SecretKey,
+			client:    &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown blob backend %q", config.BlobBackend)
+}
+
+// localBlobStore keeps the blobs as files below a directory
+type localBlobStore struct {
+	dir string
+}
+
+// path returns the file of the key, keys never leave the directory.
+func (s *localBlobStore) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if clean == "/" || clean != "/"+key {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+func (s *localBlobStore) Put(key string, content []byte, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	// Written next to its place and moved there, so a blob is never seen half written
+	file, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(content); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err = file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func (s *localBlobStore) Get(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	return content, err
+}
+
+func (s *localBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *localBlobStore) Check() error {
+	info, err := os.Stat(s.dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", s.dir)
+	}
+	return nil
+}
+
+// s3BlobStore keeps the blobs in a bucket of an S3 compatible service, like
+// MinIO. Buckets are addressed by path, requests are signed with AWS
+// Signature Version 4.
+type s3BlobStore struct {
+	endpoint  string
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// s3Error reads the error the service answered with.
+func s3Error(response *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+	return fmt.Errorf("s3 %s %s: %s %s", response.Request.Method, response.Request.URL.Path, response.Status, strings.TrimSpace(string(body)))
+}
+
+// do sends a signed request for the key, the bucket itself if it is empty.
+func (s *s3BlobStore) do(method string, key string, content []byte, contentType string) (*http.Response, error) {
+	path := "/" + s.bucket
+	if key != "" {
+		path += "/" + key
+	}
+
+	request, err := http.NewRequest(method, s.endpoint+(&url.URL{Path: path}).EscapedPath(), bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+
+	signS3Request(request, content, s.region, s.accessKey, s.secretKey, time.Now())
+
+	return s.client.Do(request)
+}
+
+func (s *s3BlobStore) Put(key string, content []byte, contentType string) error {
+	response, err := s.do(http.MethodPut, key, content, contentType)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return s3Error(response)
+	}
+	return nil
+}
+
+func (s *s3BlobStore) Get(key string) ([]byte, error) {
+	response, err := s.do(http.MethodGet, key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		return ioutil.ReadAll(response.Body)
+	case http.StatusNotFound:
+		return nil, errBlobNotFound
+	}
+	return nil, s3Error(response)
+}
+
+func (s *s3BlobStore) Delete(key string) error {
+	response, err := s.do(http.MethodDelete, key, nil, "")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusOK && response.StatusCode != http.StatusNotFound {
+		return s3Error(response)
+	}
+	return nil
+}
+
+func (s *s3BlobStore) Check() error {
+	response, err := s.do(http.MethodHead, "", nil, "")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("bucket %s: %s", s.bucket, response.Status)
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// signS3Request adds the AWS Signature Version 4 of the request to its
+// headers, signing the host and every header already set.
+func signS3Request(request *http.Request, content []byte, region string, accessKey string, secretKey string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payload := sha256Hex(content)
+
+	request.Header.Set("X-Amz-Date", date)
+	request.Header.Set("X-Amz-Content-Sha256", payload)
+
+	host := request.Host
+	if host == "" {
+		host = request.URL.Host
+	}
+
+	headers := map[string]string{"host": host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// The query parameters are sorted by name, none of the requests made has several of one name
+	query := request.URL.Query()
+	var params []string
+	for name := range query {
+		params = append(params, url.QueryEscape(name)+"="+url.QueryEscape(query.Get(name)))
+	}
+	sort.Strings(params)
+
+	canonical := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		strings.Replace(strings.Join(params, "&"), "+", "%20", -1),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+
+	scope := day + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cabinetPageSize is how many packages a page of the listing shows
+const cabinetPageSize = 25
+
+// Status of a package in the cabinet
+const (
+	cabinetExpired = "expired"
+	cabinetAlarmed = "alarmed"
+	cabinetActive  = "active"
+)
+
+// cabinetStatuses holds the statuses in the order they are sorted by
+var cabinetStatuses = []string{cabinetExpired, cabinetAlarmed, cabinetActive}
+
+// cabinetSorts holds the columns the listing can be sorted by
+var cabinetSorts = []string{"patient", "name", "producer", "type", "entry", "expire", "status"}
+
+// cabinetDefaultSort is the column sorted by when none is picked
+const cabinetDefaultSort = "expire"
+
+// CabinetEntry holds a package of the cabinet as listed and served by the API
+type CabinetEntry struct {
+	ID          int        `json:"id"`
+	MedicineID  int        `json:"medicine_id"`
+	PatientID   int        `json:"patient_id"`
+	Patient     string     `json:"patient"`
+	Name        string     `json:"name"`
+	Producer    string     `json:"producer"`
+	Description string     `json:"description"`
+	Ingredients string     `json:"ingredients"`
+	Type        string     `json:"type"`
+	EntryAt     time.Time  `json:"entry_date"`
+	ExpireAt    time.Time  `json:"expire_date"`
+	PrintedAt   time.Time  `json:"printed_expire_date"`
+	OpenedAt    *time.Time `json:"opened_date,omitempty"`
+	OpenDays    int        `json:"open_days,omitempty"`
+	Status      string     `json:"status"`
+	Alarm       string     `json:"alarm,omitempty"`
+	Attachments int        `json:"attachments"`
+	LocationID  int        `json:"location_id,omitempty"`
+	Location    string     `json:"location,omitempty"`
+	Storage     string     `json:"storage"`
+	EntryDate   string     `json:"-"`
+	FinalDate   string     `json:"-"`
+	OpenedDate  string     `json:"-"`
+	PrintedDate string     `json:"-"`
+	Warnings    []Warning  `json:"-"`
+	Owned       bool       `json:"-"`
+	Managed     bool       `json:"-"`
+}
+
+// StatusClass returns the colour class of the status badge.
+func (e CabinetEntry) StatusClass() string {
+	switch e.Status {
+	case cabinetExpired:
+		return "bg-danger"
+	case cabinetAlarmed:
+		return "bg-warning text-dark"
+	}
+	return "bg-success"
+}
+
+// CabinetQuery holds the search, filters, order and page the cabinet is listed with
+type CabinetQuery struct {
+	Patient   int
+	Location  int
+	Search    string
+	Type      string
+	Status    string
+	From      string
+	To        string
+	Sort      string
+	Desc      bool
+	Page      int
+	DateError bool
+
+	// from and to are the expiry range, zero when not limited
+	from time.Time
+	to   time.Time
+}
+
+// cabinetUnassigned is the location filter of packages not kept at any place
+const cabinetUnassigned = -1
+
+// CabinetLocation holds a place packages of the listing are kept at, for filtering by
+type CabinetLocation struct {
+	ID   int
+	Name string
+}
+
+// CabinetPage holds a page of the packages matching a query
+type CabinetPage struct {
+	Total   int            `json:"total"`
+	Page    int            `json:"page"`
+	Pages   int            `json:"pages"`
+	Entries []CabinetEntry `json:"entries"`
+}
+
+// parseCabinetQuery reads the query of the request. The expiry range is of
+// whole days in the user's timezone, dates which cannot be read are ignored.
+func parseCabinetQuery(request *http.Request, locale *Locale, location *time.Location) CabinetQuery {
+	q := CabinetQuery{
+		Search: strings.TrimSpace(request.FormValue("q")),
+		Type:   request.FormValue("type"),
+		Status: request.FormValue("status"),
+		From:   strings.TrimSpace(request.FormValue("from")),
+		To:     strings.TrimSpace(request.FormValue("to")),
+		Sort:   request.FormValue("sort"),
+		Desc:   request.FormValue("desc") != "",
+	}
+	q.Patient, _ = strconv.Atoi(request.FormValue("patient"))
+	q.Location, _ = strconv.Atoi(request.FormValue("location"))
+	q.Page, _ = strconv.Atoi(request.FormValue("page"))
+
+	if !isOneOf(q.Status, cabinetStatuses) {
+		q.Status = ""
+	}
+	if !isOneOf(q.Sort, cabinetSorts) {
+		q.Sort = cabinetDefaultSort
+	}
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	if q.Location < cabinetUnassigned {
+		q.Location = 0
+	}
+
+	if q.From != "" {
+		if date, err := locale.ParseDate(q.From); err == nil {
+			q.from = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, location)
+		} else {
+			q.DateError = true
+		}
+	}
+	if q.To != "" {
+		if date, err := locale.ParseDate(q.To); err == nil {
+			q.to = time.Date(date.Year(), date.Month(), date.Day()+1, 0, 0, 0, 0, location)
+		} else {
+			q.DateError = true
+		}
+	}
+
+	return q
+}
+
+// isOneOf reports if the value is one of the list.
+func isOneOf(value string, list []string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Filtered reports if anything but the order and page was picked.
+func (q CabinetQuery) Filtered() bool {
+	return q.Search != "" || q.Location != 0 || q.Type != "" || q.Status != "" || q.From != "" || q.To != ""
+}
+
+// values returns the query as the parameters of the listing address.
+func (q CabinetQuery) values() url.Values {
+	values := url.Values{}
+	if q.Patient != 0 {
+		values.Set("patient", strconv.Itoa(q.Patient))
+	}
+	if q.Location != 0 {
+		values.Set("location", strconv.Itoa(q.Location))
+	}
+	for name, value := range map[string]string{"q": q.Search, "type": q.Type, "status": q.Status, "from": q.From, "to": q.To} {
+		if value != "" {
+			values.Set(name, value)
+		}
+	}
+	if q.Sort != cabinetDefaultSort {
+		values.Set("sort", q.Sort)
+	}
+	if q.Desc {
+		values.Set("desc", "1")
+	}
+	if q.Page > 1 {
+		values.Set("page", strconv.Itoa(q.Page))
+	}
+	return values
+}
+
+// SortURL returns the listing sorted by the column, the other way round if it already is.
+func (q CabinetQuery) SortURL(column string) string {
+	q.Desc = q.Sort == column && !q.Desc
+	q.Sort = column
+	q.Page = 1
+	return "/?" + q.values().Encode()
+}
+
+// SortMark returns the arrow of the column the listing is sorted by.
+func (q CabinetQuery) SortMark(column string) string {
+	switch {
+	case q.Sort != column:
+		return ""
+	case q.Desc:
+		return "▼"
+	default:
+		return "▲"
+	}
+}
+
+// Clear returns the listing of the patient without search and filters.
+func (q CabinetQuery) Clear() string {
+	return CabinetQuery{Patient: q.Patient, Sort: q.Sort, Desc: q.Desc}.PageURL(1)
+}
+
+// PageURL returns the page of the listing.
+func (q CabinetQuery) PageURL(page int) string {
+	q.Page = page
+	return "/?" + q.values().Encode()
+}
+
+// searchFold lowers the text for comparing, with the dotted and dotless i of
+// Turkish the same letter.
+func searchFold(text string) string {
+	return strings.ToLower(strings.NewReplacer("İ", "i", "I", "i", "ı", "i").Replace(text))
+}
+
+// cabinetFromSQL is what packages are listed from, with their medicine,
+// patient and place
+const cabinetFromSQL = `FROM entries e JOIN medicine m ON m.medicine_id = e.medicine_id JOIN patients p ON p.patient_id = e.patient_id
+	LEFT JOIN storage_locations l ON l.location_id = e.location_id`
+
+// cabinetOrderSQL holds the columns the database sorts the listing by. Names
+// are sealed and the status comes from the alarms, those are sorted in memory.
+var cabinetOrderSQL = map[string]string{
+	"patient":  "p.name COLLATE NOCASE",
+	"producer": "m.producer COLLATE NOCASE",
+	"type":     "m.type",
+	"entry":    "e.entry_at",
+	"expire":   "final_at",
+}
+
+// where returns the conditions the database matches the patients' packages
+// with, every filter but the search which reads sealed columns. Packages past
+// their expiry are expired, the others are told apart by their alarms in memory.
+func (q CabinetQuery) where(patients []Patient, now time.Time) (clause string, args []interface{}) {
+	clause, args = patientIDsClause("e.patient_id", patients)
+
+	if q.Type != "" {
+		// Older medicines keep the type as it was labelled
+		types := []interface{}{q.Type}
+		for label, code := range optionCodes["type"] {
+			if code == q.Type {
+				types = append(types, label)
+			}
+		}
+		clause += " AND m.type IN (?" + strings.Repeat(",?", len(types)-1) + ")"
+		args = append(args, types...)
+	}
+
+	switch {
+	case q.Location == cabinetUnassigned:
+		clause += " AND l.location_id IS NULL"
+	case q.Location > 0:
+		clause += " AND l.location_id = ?"
+		args = append(args, q.Location)
+	}
+
+	if !q.from.IsZero() {
+		clause += " AND " + entryExpireSQL + " >= ?"
+		args = append(args, toEpoch(q.from))
+	}
+	if !q.to.IsZero() {
+		clause += " AND " + entryExpireSQL + " < ?"
+		args = append(args, toEpoch(q.to))
+	}
+
+	switch q.Status {
+	case cabinetExpired:
+		clause += " AND " + entryExpireSQL + " < ?"
+		args = append(args, toEpoch(now))
+	case cabinetAlarmed, cabinetActive:
+		clause += " AND " + entryExpireSQL + " >= ?"
+		args = append(args, toEpoch(now))
+	}
+
+	return clause, args
+}
+
+// paged reports if the database can sort and page the query, with nothing
+// left to match in memory.
+func (q CabinetQuery) paged() bool {
+	_, ok := cabinetOrderSQL[q.Sort]
+	return ok && q.Search == "" && (q.Status == "" || q.Status == cabinetExpired)
+}
+
+// matches reports if the package is one the query looks for by what is left
+// to the memory, the status its alarm gives it and the search. Every word of
+// the search has to be in the name, producer, description or ingredients.
+func (q CabinetQuery) matches(entry CabinetEntry) bool {
+	if q.Status != "" && entry.Status != q.Status {
+		return false
+	}
+
+	text := searchFold(strings.Join([]string{entry.Name, entry.Producer, entry.Description, entry.Ingredients}, "\n"))
+	for _, word := range strings.Fields(searchFold(q.Search)) {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newCabinetPage returns the numbered page of as many packages, the last one
+// if there are not as many pages.
+func newCabinetPage(total int, number int) (page CabinetPage) {
+	page.Total = total
+	page.Pages = (total + cabinetPageSize - 1) / cabinetPageSize
+	if page.Pages < 1 {
+		page.Pages = 1
+	}
+	page.Page = number
+	if page.Page > page.Pages {
+		page.Page = page.Pages
+	}
+	page.Entries = []CabinetEntry{}
+	return page
+}
+
+// apply returns the page of the packages matching the query in its order.
+func (q CabinetQuery) apply(entries []CabinetEntry) (page CabinetPage) {
+	matching := []CabinetEntry{}
+	for _, entry := range entries {
+		if q.matches(entry) {
+			matching = append(matching, entry)
+		}
+	}
+
+	statusOrder := make(map[string]int)
+	for i, status := range cabinetStatuses {
+		statusOrder[status] = i
+	}
+
+	less := map[string]func(a, b CabinetEntry) bool{
+		"patient":  func(a, b CabinetEntry) bool { return searchFold(a.Patient) < searchFold(b.Patient) },
+		"name":     func(a, b CabinetEntry) bool { return searchFold(a.Name) < searchFold(b.Name) },
+		"producer": func(a, b CabinetEntry) bool { return searchFold(a.Producer) < searchFold(b.Producer) },
+		"type":     func(a, b CabinetEntry) bool { return a.Type < b.Type },
+		"entry":    func(a, b CabinetEntry) bool { return a.EntryAt.Before(b.EntryAt) },
+		"expire":   func(a, b CabinetEntry) bool { return a.ExpireAt.Before(b.ExpireAt) },
+		"status":   func(a, b CabinetEntry) bool { return statusOrder[a.Status] < statusOrder[b.Status] },
+	}[q.Sort]
+
+	// Ties keep the order of expiry the entries come in
+	sort.SliceStable(matching, func(i, j int) bool {
+		if q.Desc {
+			return less(matching[j], matching[i])
+		}
+		return less(matching[i], matching[j])
+	})
+
+	page = newCabinetPage(len(matching), q.Page)
+
+	from := (page.Page - 1) * cabinetPageSize
+	to := from + cabinetPageSize
+	if to > len(matching) {
+		to = len(matching)
+	}
+	page.Entries = matching[from:to]
+
+	return page
+}
+
+// getCabinetTypes returns the medicine types of the patients' packages, for filtering by.
+func getCabinetTypes(patients []Patient) (types []string) {
+	clause, args := patientIDsClause("e.patient_id", patients)
+
+	row, err := db.Query("SELECT DISTINCT m.type FROM entries e JOIN medicine m ON m.medicine_id = e.medicine_id WHERE "+clause, args...)
+	if err != nil {
+		logger.Error("getCabinetTypes", "error", err)
+		return nil
+	}
+	defer row.Close()
+
+	seen := make(map[string]bool)
+	for row.Next() {
+		var kind sql.NullString
+		if err = row.Scan(&kind); err != nil {
+			logger.Error("getCabinetTypes", "error", err)
+			return types
+		}
+
+		// Older medicines keep the type as it was labelled
+		code := normalizeOption("type", kind.String)
+		if code != "" && !seen[code] {
+			seen[code] = true
+			types = append(types, code)
+		}
+	}
+	sort.Strings(types)
+
+	return types
+}
+
+// getCabinetLocations returns the places the patients' packages are kept at, for filtering by.
+func getCabinetLocations(patients []Patient) (locations []CabinetLocation) {
+	clause, args := patientIDsClause("e.patient_id", patients)
+
+	row, err := db.Query(`SELECT DISTINCT l.location_id, l.name FROM entries e JOIN storage_locations l ON l.location_id = e.location_id
+		WHERE `+clause+` ORDER BY l.name COLLATE NOCASE`, args...)
+	if err != nil {
+		logger.Error("getCabinetLocations", "error", err)
+		return nil
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var l CabinetLocation
+		if err = row.Scan(&l.ID, &l.Name); err != nil {
+			logger.Error("getCabinetLocations", "error", err)
+			return locations
+		}
+		locations = append(locations, l)
+	}
+
+	return locations
+}
+
+// getCabinet returns every package of the patients by expiry, with their
+// status, alarm, place, warnings and attachments. Packages with unreadable dates are
+// skipped and returned as malformed, not guessed.
+func getCabinet(patients []Patient, location *time.Location, locale *Locale) (entries []CabinetEntry, malformed []string, err error) {
+	clause, args := patientIDsClause("e.patient_id", patients)
+	return queryCabinet(patients, clause, args, "final_at ASC, e.entry_id ASC", time.Now(), location, locale)
+}
+
+// getCabinetPage returns the page of the patients' packages matching the
+// query. The database filters, sorts and pages them, only the search on the
+// sealed names and the alarmed status are left to the memory, which reads
+// the packages the database matched.
+func getCabinetPage(patients []Patient, q CabinetQuery, location *time.Location, locale *Locale) (page CabinetPage, malformed []string, err error) {
+	now := time.Now()
+	clause, args := q.where(patients, now)
+
+	if !q.paged() {
+		entries, malformed, err := queryCabinet(patients, clause, args, "final_at ASC, e.entry_id ASC", now, location, locale)
+		if err != nil {
+			return CabinetPage{}, nil, err
+		}
+		return q.apply(entries), malformed, nil
+	}
+
+	var total int
+	if err = db.QueryRow("SELECT COUNT(*) "+cabinetFromSQL+" WHERE "+clause, args...).Scan(&total); err != nil {
+		return CabinetPage{}, nil, err
+	}
+	page = newCabinetPage(total, q.Page)
+
+	// Ties keep the order of expiry
+	order := cabinetOrderSQL[q.Sort]
+	if q.Desc {
+		order += " DESC"
+	}
+	order += ", final_at ASC, e.entry_id ASC LIMIT ? OFFSET ?"
+	args = append(args, cabinetPageSize, (page.Page-1)*cabinetPageSize)
+
+	entries, malformed, err := queryCabinet(patients, clause, args, order, now, location, locale)
+	if err != nil {
+		return CabinetPage{}, nil, err
+	}
+	if entries != nil {
+		page.Entries = entries
+	}
+
+	return page, malformed, nil
+}
+
+// queryCabinet returns the patients' packages matching the conditions in the
+// order, with their status as of now. Packages with unreadable dates are
+// skipped and returned as malformed, not guessed.
+func queryCabinet(patients []Patient, clause string, args []interface{}, order string, now time.Time, location *time.Location, locale *Locale) (entries []CabinetEntry, malformed []string, err error) {
+	names := patientNames(patients)
+
+	// Get alarms
+	alarms := make(map[int]AlarmData)
+	alarmClause, alarmArgs := patientIDsClause("patient_id", patients)
+
+	row, err := db.Query("SELECT entry_id, timer, timer_type, before_after FROM expire_alarms WHERE "+alarmClause, alarmArgs...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var alarm AlarmData
+		var timerType, beforeAfter sql.NullString
+
+		if err = row.Scan(&alarm.EntryID, &alarm.Time, &timerType, &beforeAfter); err != nil {
+			return nil, nil, err
+		}
+
+		alarm.TimeType, alarm.BeforeAfter = timerType.String, beforeAfter.String
+		if _, ok := alarms[alarm.EntryID]; !ok {
+			alarms[alarm.EntryID] = alarm
+		}
+	}
+	if err = row.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	drugs := getDrugDatabase()
+	profiles := make(map[int]HealthProfile)
+	owned := make(map[int]bool)
+	managed := make(map[int]bool)
+	for _, patient := range patients {
+		profiles[patient.ID] = getHealthProfile(patient.ID)
+		owned[patient.ID] = patient.Permission == permissionOwner
+		managed[patient.ID] = patient.CanManage()
+	}
+	attachmentCounts := getAttachmentCounts(patients)
+
+	row, err = db.Query(`SELECT e.entry_id, e.medicine_id, e.patient_id, e.entry_at, e.expire_at, e.opened_at, `+entryExpireSQL+` AS final_at, m.name, m.producer, m.description, m.ingredients, m.type,
+		m.storage, e.open_days, m.open_days, l.location_id, l.name, l.storage
+		`+cabinetFromSQL+` WHERE `+clause+` ORDER BY `+order, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var entry CabinetEntry
+		var entryAt, expireAt, openedAt, finalAt, openDays, defaultDays sql.NullInt64
+		var producer, description, ingredients, kind, storage, place, placeStorage sql.NullString
+		var placeID sql.NullInt64
+
+		err = row.Scan(&entry.ID, &entry.MedicineID, &entry.PatientID, &entryAt, &expireAt, &openedAt, &finalAt, &entry.Name, &producer, &description, &ingredients, &kind,
+			&storage, &openDays, &defaultDays, &placeID, &place, &placeStorage)
+		if err != nil {
+			logger.Error("getCabinet", "error", err)
+			malformed = append(malformed, "?")
+			continue
+		}
+
+		if !entryAt.Valid || !expireAt.Valid || !finalAt.Valid {
+			malformed = append(malformed, fmt.Sprintf("#%d", entry.ID))
+			continue
+		}
+
+		entry.Patient = names[entry.PatientID]
+		entry.Producer = producer.String
+		entry.Description = description.String
+		entry.Ingredients = ingredients.String
+		entry.Type = normalizeOption("type", kind.String)
+		entry.Storage = normalizeOption("storage", storage.String)
+		entry.LocationID, entry.Location = int(placeID.Int64), place.String
+		entry.EntryAt = fromEpoch(entryAt.Int64).In(location)
+		entry.ExpireAt = fromEpoch(finalAt.Int64).In(location)
+		entry.PrintedAt = fromEpoch(expireAt.Int64).In(location)
+		entry.EntryDate = locale.FormatDateTime(entry.EntryAt)
+		entry.FinalDate = locale.FormatDateTime(entry.ExpireAt)
+		entry.PrintedDate = locale.FormatDateTime(entry.PrintedAt)
+
+		// Opened packages are used until the end of their shelf life after
+		// opening, unopened ones are opened with the shelf life of their medicine
+		// or else the one of its ingredients
+		entry.OpenDays = int(defaultDays.Int64)
+		if entry.OpenDays == 0 {
+			entry.OpenDays = drugs.openDays(entry.Name, entry.Ingredients)
+		}
+		if openedAt.Valid {
+			opened := fromEpoch(openedAt.Int64).In(location)
+			entry.OpenedAt, entry.OpenedDate, entry.OpenDays = &opened, locale.FormatDate(opened), int(openDays.Int64)
+		}
+		entry.Status = cabinetActive
+
+		if alarm, ok := alarms[entry.ID]; ok {
+			entry.Alarm = locale.T("alarm.offset", alarm.Time, locale.Option("timer", alarm.TimeType), locale.Option("when", alarm.BeforeAfter))
+
+			if trigger, ok := expireAlarmTrigger(entry.ExpireAt, alarm.Time, alarm.TimeType, alarm.BeforeAfter); ok && !now.Before(trigger) {
+				entry.Status = cabinetAlarmed
+			}
+		}
+		if entry.ExpireAt.Before(now) {
+			entry.Status = cabinetExpired
+		}
+
+		// Files are attached to and packages moved between the places of the patients the user owns
+		entry.Attachments, entry.Owned = attachmentCounts[entry.MedicineID], owned[entry.PatientID]
+		entry.Managed = managed[entry.PatientID]
+
+		// Check the medicine against the patient's health profile
+		entry.Warnings = checkHealthProfile(profiles[entry.PatientID], drugs.resolveIngredients(entry.Name, entry.Ingredients), locale)
+
+		// and the place it is kept at against how it has to be stored
+		entry.Warnings = append(entry.Warnings, checkStorage(entry.Name, entry.Storage, entry.Location, placeStorage.String, locale)...)
+
+		entries = append(entries, entry)
+	}
+
+	return entries, malformed, row.Err()
+}
+
+// apiMedicinesHandler serves the packages of the listing matching the query as JSON.
+func apiMedicinesHandler(response http.ResponseWriter, request *http.Request) {
+	// Check login status
+	if getUserName(request) == "" {
+		http.Error(response, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+	patients, _ := getSelectedPatients(request, userID, "/")
+	location := getUserLocation(userID)
+	locale := getLocale(request)
+
+	query := parseCabinetQuery(request, locale, location)
+	if query.DateError {
+		http.Error(response, "Dates are read as "+locale.T("format.date.hint"), http.StatusBadRequest)
+		return
+	}
+
+	page, _, err := getCabinetPage(patients, query, location, locale)
+	if err != nil {
+		requestLogger(request).Error("apiMedicinesHandler", "error", err)
+		http.Error(response, "Listing failed", http.StatusInternalServerError)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(response).Encode(page); err != nil {
+		requestLogger(request).Error("apiMedicinesHandler", "error", err)
+	}
+}
+
+// Numbers returns the numbers of every page.
+func (p CabinetPage) Numbers() (numbers []int) {
+	for i := 1; i <= p.Pages; i++ {
+		numbers = append(numbers, i)
+	}
+	return numbers
+}
+
+// Previous returns the number of the page before, 0 on the first page.
+func (p CabinetPage) Previous() int {
+	return p.Page - 1
+}
+
+// Next returns the number of the page after, 0 on the last page.
+func (p CabinetPage) Next() int {
+	if p.Page >= p.Pages {
+		return 0
+	}
+	return p.Page + 1
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// icsDays holds the RRULE weekday names in the order of the use_alarms columns
+var icsDays = [7]string{"MO", "TU", "WE", "TH", "FR", "SA", "SU"}
+
+// icsWriter builds an iCalendar (RFC 5545) document
+type icsWriter struct {
+	buffer bytes.Buffer
+}
+
+// line writes a content line, folded to 75 octets without splitting UTF-8 characters.
+func (w *icsWriter) line(name string, value string) {
+	content := name + ":" + value
+
+	// Continuation lines start with a space, which counts towards their length
+	limit := 75
+	for len(content) > limit {
+		cut := limit
+		for cut > 0 && content[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		w.buffer.WriteString(content[:cut] + "\r\n ")
+		content = content[cut:]
+		limit = 74
+	}
+
+	w.buffer.WriteString(content + "\r\n")
+}
+
+// icsText escapes a TEXT property value.
+func icsText(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+	return replacer.Replace(value)
+}
+
+// icsUTC formats an instant as a UTC DATE-TIME value.
+func icsUTC(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// alarm writes a display alarm going off at the given instant.
+func (w *icsWriter) alarm(at time.Time, description string) {
+	w.line("BEGIN", "VALARM")
+	w.line("ACTION", "DISPLAY")
+	w.line("DESCRIPTION", icsText(description))
+	w.line("TRIGGER;VALUE=DATE-TIME", icsUTC(at))
+	w.line("END", "VALARM")
+}
+
+// getCalendarToken returns the secret token of the user's calendar feed, creating it on first use.
+func getCalendarToken(userID int) string {
+	var token sql.NullString
+
+	result := db.QueryRow("SELECT calendar_token FROM users WHERE user_id=$1", userID)
+	if err := result.Scan(&token); err != nil {
+		logger.Error("getCalendarToken", "user_id", userID, "error", err)
+		return ""
+	}
+
+	if token.String != "" {
+		return token.String
+	}
+
+	return resetCalendarToken(userID)
+}
+
+// resetCalendarToken gives the user a new feed token, so the old URL stops working.
+func resetCalendarToken(userID int) string {
+	token := generateSecret(20)
+
+	if _, err := db.Exec("UPDATE users SET calendar_token=$1 WHERE user_id=$2", token, userID); err != nil {
+		logger.Error("resetCalendarToken", "user_id", userID, "error", err)
+		return ""
+	}
+
+	return token
+}
+
+// getCalendarURL returns the subscription URL of the user's calendar feed.
+func getCalendarURL(userID int) string {
+	token := getCalendarToken(userID)
+	if token == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/calendar/%s.ics", config.BaseURL, token)
+}
+
+// icsDayRule returns the BYDAY value of the weekday in the month, like 2SU or -1SU for the last one.
+func icsDayRule(date time.Time) string {
+	day := icsDays[(int(date.Weekday())+6)%7]
+	if date.AddDate(0, 0, 7).Month() != date.Month() {
+		return "-1" + day
+	}
+	return fmt.Sprintf("%d%s", (date.Day()-1)/7+1, day)
+}
+
+// firstDoseDay returns the first dose time on or after start falling on one of
+// the days, as DTSTART has to be an occurrence of the weekly rule.
+func firstDoseDay(start time.Time, days [7]sql.NullString) time.Time {
+	for i := 0; i < 7; i++ {
+		date := start.AddDate(0, 0, i)
+		if days[(int(date.Weekday())+6)%7].String == "on" {
+			return date
+		}
+	}
+	return start
+}
+
+// icsOffset formats a UTC offset in seconds as +HHMM.
+func icsOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+	return fmt.Sprintf("%s%02d%02d", sign, offset/3600, offset/60%60)
+}
+
+// timezone writes a VTIMEZONE for the zone, with this year's daylight saving rules if it has any.
+func (w *icsWriter) timezone(location *time.Location) {
+	year := time.Now().In(location).Year()
+	current := time.Date(year, 1, 1, 0, 0, 0, 0, location)
+	end := current.AddDate(1, 0, 0)
+
+	w.line("BEGIN", "VTIMEZONE")
+	w.line("TZID", location.String())
+	w.line("X-LIC-LOCATION", location.String())
+
+	name, offset := current.Zone()
+	transitions := 0
+
+	// Look for the changes of the offset hour by hour
+	for t := current; t.Before(end); t = t.Add(time.Hour) {
+		nextName, nextOffset := t.Zone()
+		if nextOffset == offset {
+			continue
+		}
+
+		// Find the exact minute of the change
+		change := t.Add(-time.Hour)
+		for _, o := change.Zone(); o == offset; _, o = change.Zone() {
+			change = change.Add(time.Minute)
+		}
+
+		component := "STANDARD"
+		if change.IsDST() {
+			component = "DAYLIGHT"
+		}
+
+		wall := change.UTC().Add(time.Duration(offset) * time.Second)
+
+		w.line("BEGIN", component)
+		w.line("DTSTART", wall.Format("20060102T150405"))
+		w.line("RRULE", fmt.Sprintf("FREQ=YEARLY;BYMONTH=%d;BYDAY=%s", int(wall.Month()), icsDayRule(wall)))
+		w.line("TZOFFSETFROM", icsOffset(offset))
+		w.line("TZOFFSETTO", icsOffset(nextOffset))
+		w.line("TZNAME", nextName)
+		w.line("END", component)
+
+		name, offset = nextName, nextOffset
+		transitions++
+	}
+
+	// Zones without daylight saving time keep one offset all year
+	if transitions == 0 {
+		w.line("BEGIN", "STANDARD")
+		w.line("DTSTART", "19700101T000000")
+		w.line("TZOFFSETFROM", icsOffset(offset))
+		w.line("TZOFFSETTO", icsOffset(offset))
+		w.line("TZNAME", name)
+		w.line("END", "STANDARD")
+	}
+
+	w.line("END", "VTIMEZONE")
+}
+
+// writeCalendar writes the dose schedules and expiry dates of the patients as a calendar.
+// Dates are shown in the given zone, dose times in the zone of each patient's owner,
+// and texts are written in the given language.
+func writeCalendar(w *icsWriter, patients []Patient, location *time.Location, locale *Locale) {
+	names := patientNames(patients)
+	clause, args := patientIDsClause("e.patient_id", patients)
+	stamp := icsUTC(time.Now())
+
+	locations := make(map[int]*time.Location)
+	zones := make(map[string]*time.Location)
+	for _, patient := range patients {
+		locations[patient.ID] = getUserLocation(patient.OwnerID)
+		zones[locations[patient.ID].String()] = locations[patient.ID]
+	}
+
+	// Prefix events with the patient in a household calendar
+	title := func(patientID int, text string) string {
+		if len(patients) > 1 {
+			return fmt.Sprintf("%s: %s", names[patientID], text)
+		}
+		return text
+	}
+
+	w.line("BEGIN", "VCALENDAR")
+	w.line("VERSION", "2.0")
+	w.line("PRODID", "-//Pill Tracker//Medicine Schedule//EN")
+	w.line("CALSCALE", "GREGORIAN")
+	w.line("METHOD", "PUBLISH")
+	w.line("X-WR-CALNAME", "Pill Tracker")
+	w.line("X-WR-TIMEZONE", location.String())
+
+	for _, zone := range zones {
+		w.timezone(zone)
+	}
+
+	// Dose schedules
+	row, err := db.Query(`SELECT u.use_id, e.entry_id, e.patient_id, m.name, e.entry_at, `+entryExpireSQL+`, u.mon, u.tue, u.wed, u.thu, u.fri, u.sat, u.sun, u.hour, u.dose_count
+		FROM use_alarms u JOIN entries e ON e.entry_id = u.entry_id JOIN medicine m ON m.medicine_id = e.medicine_id
+		WHERE `+clause+` ORDER BY u.use_id`, args...)
+	if err != nil {
+		logger.Error("writeCalendar", "error", err)
+	} else {
+		for row.Next() {
+			var useID, entryID, patientID int
+			var name string
+			var entryAt, expireAt sql.NullInt64
+			var hour, count sql.NullString
+			var days [7]sql.NullString
+
+			if err = row.Scan(&useID, &entryID, &patientID, &name, &entryAt, &expireAt, &days[0], &days[1], &days[2], &days[3], &days[4], &days[5], &days[6], &hour, &count); err != nil {
+				logger.Error("writeCalendar", "error", err)
+				break
+			}
+
+			var byDay []string
+			for i := range days {
+				if days[i].String == "on" {
+					byDay = append(byDay, icsDays[i])
+				}
+			}
+
+			clock, err := time.Parse("15:04", strings.TrimSpace(hour.String))
+			if err != nil || len(byDay) == 0 {
+				continue
+			}
+
+			if !entryAt.Valid {
+				continue
+			}
+			start := fromEpoch(entryAt.Int64)
+			zone := locations[patientID]
+			start = start.In(zone)
+			start = firstDoseDay(time.Date(start.Year(), start.Month(), start.Day(), clock.Hour(), clock.Minute(), 0, 0, zone), days)
+
+			summary := locale.T("calendar.dose.one", name)
+			if dose := parseDoseCount(count.String); dose != 1 {
+				summary = locale.T("calendar.dose.many", locale.FormatNumber(dose), name)
+			}
+
+			rule := "FREQ=WEEKLY;BYDAY=" + strings.Join(byDay, ",")
+			if expireAt.Valid {
+				rule += ";UNTIL=" + icsUTC(fromEpoch(expireAt.Int64))
+			}
+
+			w.line("BEGIN", "VEVENT")
+			w.line("UID", fmt.Sprintf("dose-%d@pilltracker", useID))
+			w.line("DTSTAMP", stamp)
+			w.line("DTSTART;TZID="+zone.String(), start.Format("20060102T150405"))
+			w.line("DURATION", "PT15M")
+			w.line("RRULE", rule)
+			w.line("SUMMARY", icsText(title(patientID, summary)))
+			w.line("CATEGORIES", "Dose")
+			w.line("BEGIN", "VALARM")
+			w.line("ACTION", "DISPLAY")
+			w.line("DESCRIPTION", icsText(summary))
+			w.line("TRIGGER", "PT0M")
+			w.line("END", "VALARM")
+			w.line("END", "VEVENT")
+		}
+		row.Close()
+	}
+
+	// Expiry dates and their alarms
+	row, err = db.Query(`SELECT e.entry_id, e.patient_id, m.name, `+entryExpireSQL+`, a.expire_id, a.timer, a.timer_type, a.before_after
+		FROM entries e JOIN medicine m ON m.medicine_id = e.medicine_id LEFT JOIN expire_alarms a ON a.entry_id = e.entry_id
+		WHERE `+clause+` ORDER BY e.entry_id`, args...)
+	if err != nil {
+		logger.Error("writeCalendar", "error", err)
+	} else {
+		for row.Next() {
+			var entryID, patientID int
+			var name string
+			var timerType, beforeAfter sql.NullString
+			var expireAt, expireID, timer sql.NullInt64
+
+			if err = row.Scan(&entryID, &patientID, &name, &expireAt, &expireID, &timer, &timerType, &beforeAfter); err != nil {
+				logger.Error("writeCalendar", "error", err)
+				break
+			}
+
+			if !expireAt.Valid {
+				continue
+			}
+
+			expire := fromEpoch(expireAt.Int64)
+			day := expire.In(location)
+
+			w.line("BEGIN", "VEVENT")
+			w.line("UID", fmt.Sprintf("expire-%d@pilltracker", entryID))
+			w.line("DTSTAMP", stamp)
+			w.line("DTSTART;VALUE=DATE", day.Format("20060102"))
+			w.line("DTEND;VALUE=DATE", day.AddDate(0, 0, 1).Format("20060102"))
+			w.line("SUMMARY", icsText(title(patientID, locale.T("calendar.expire", name))))
+			w.line("CATEGORIES", "Expiry")
+			w.line("TRANSP", "TRANSPARENT")
+			w.alarm(expire, locale.T("calendar.expire.now", name))
+			w.line("END", "VEVENT")
+
+			if !expireID.Valid {
+				continue
+			}
+
+			trigger, ok := expireAlarmTrigger(expire.In(location), int(timer.Int64), timerType.String, beforeAfter.String)
+			if !ok {
+				continue
+			}
+
+			offset := locale.T("alarm.offset", int(timer.Int64), locale.Option("timer", timerType.String), locale.Option("when", beforeAfter.String))
+			alarm := locale.T("calendar.alarm", name, offset)
+
+			w.line("BEGIN", "VEVENT")
+			w.line("UID", fmt.Sprintf("expire-alarm-%d@pilltracker", expireID.Int64))
+			w.line("DTSTAMP", stamp)
+			w.line("DTSTART;VALUE=DATE", trigger.Format("20060102"))
+			w.line("DTEND;VALUE=DATE", trigger.AddDate(0, 0, 1).Format("20060102"))
+			w.line("SUMMARY", icsText(title(patientID, alarm)))
+			w.line("CATEGORIES", "Expiry alarm")
+			w.line("TRANSP", "TRANSPARENT")
+			w.alarm(trigger, alarm)
+			w.line("END", "VEVENT")
+		}
+		row.Close()
+	}
+
+	w.line("END", "VCALENDAR")
+}
+
+// calendarHandler serves the calendar feed. Calendar apps do not log in, the secret token in the URL identifies the user.
+func calendarHandler(response http.ResponseWriter, request *http.Request) {
+	var userID int
+
+	token := mux.Vars(request)["token"]
+
+	result := db.QueryRow("SELECT user_id FROM users WHERE calendar_token=$1", token)
+	if err := result.Scan(&userID); err != nil || token == "" {
+		http.NotFound(response, request)
+		return
+	}
+
+	var w icsWriter
+	writeCalendar(&w, getPatients(userID), getUserLocation(userID), getRecipientLocale(userID))
+
+	response.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	response.Header().Set("Content-Disposition", `inline; filename="pilltracker.ics"`)
+	response.Header().Set("Cache-Control", "private, max-age=300")
+	response.Write(w.buffer.Bytes())
+}
+
+func postResetCalendarHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	resetCalendarToken(getUserID(getUserName(request)))
+
+	http.Redirect(response, request, urlSettings+"?saved=calendar", 302)
+}
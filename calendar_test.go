@@ -0,0 +1,31 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestFirstDoseDay(t *testing.T) {
+	on := sql.NullString{String: "on", Valid: true}
+	// Mondays and Thursdays
+	days := [7]sql.NullString{on, {}, {}, on, {}, {}, {}}
+
+	tests := []struct {
+		start string
+		want  string
+	}{
+		{"2026-10-19 08:00", "2026-10-19 08:00"}, // Monday
+		{"2026-10-20 08:00", "2026-10-22 08:00"}, // Tuesday
+		{"2026-10-23 08:00", "2026-10-26 08:00"}, // Friday, into the next week
+		{"2026-10-31 08:00", "2026-11-02 08:00"}, // Saturday, into the next month
+	}
+
+	zone := time.FixedZone("UTC+3", 3*60*60)
+	for _, test := range tests {
+		start, _ := time.ParseInLocation("2006-01-02 15:04", test.start, zone)
+		if got := firstDoseDay(start, days).Format("2006-01-02 15:04"); got != test.want {
+			t.Errorf("firstDoseDay(%s) = %s, want %s", test.start, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runCommand runs a command line tool instead of the server and returns its exit status.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "export":
+		return exportCommand(args[1:])
+	case "erase":
+		return eraseCommand(args[1:])
+	case "reencrypt":
+		return reencryptCommand(args[1:])
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\nusage: mws [export|erase|reencrypt] [flags]\n", args[0])
+	return 2
+}
+
+// findUser returns the ID of the account with the user name or e-mail address.
+func findUser(user string) (userID int, err error) {
+	err = db.QueryRow("SELECT user_id FROM users WHERE username=$1 OR email=$1", user).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("no user %q", user)
+	}
+	return userID, err
+}
+
+// exportCommand writes the export of an account, like the export page does.
+func exportCommand(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	user := flags.String("user", "", "user name or e-mail address of the account")
+	format := flags.String("format", exportJSON, "json, csv (zip of CSV files) or fhir (FHIR R4 Bundle)")
+	patientID := flags.Int("patient", 0, "export only this patient")
+	out := flags.String("out", "", "file to write, standard output if empty")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *user == "" {
+		fmt.Fprintln(os.Stderr, "export: -user is required")
+		return 2
+	}
+
+	userID, err := findUser(*user)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export:", err)
+		return 1
+	}
+
+	patients := getPatients(userID)
+	if *patientID != 0 {
+		patient, ok := getPatient(userID, *patientID)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "export: no patient %d for %s\n", *patientID, *user)
+			return 1
+		}
+		patients = []Patient{patient}
+	}
+
+	data, err := getExportData(userID, patients)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export:", err)
+		return 1
+	}
+
+	if *out == "" {
+		err = writeExport(os.Stdout, *format, data, getRecipientLocale(userID))
+	} else {
+		err = writeExportFile(*out, *format, data, getRecipientLocale(userID))
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export:", err)
+		return 1
+	}
+
+	return 0
+}
+
+// eraseCommand erases an account at once, without a grace period.
+func eraseCommand(args []string) int {
+	flags := flag.NewFlagSet("erase", flag.ContinueOnError)
+	user := flags.String("user", "", "user name or e-mail address of the account")
+	confirm := flags.Bool("yes", false, "confirm that the account and all its data are erased")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *user == "" || !*confirm {
+		fmt.Fprintln(os.Stderr, "erase: -user and -yes are required")
+		return 2
+	}
+
+	userID, err := findUser(*user)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "erase:", err)
+		return 1
+	}
+
+	if err = eraseAccount(userID, erasureAdmin, time.Now()); err != nil {
+		fmt.Fprintln(os.Stderr, "erase:", err)
+		return 1
+	}
+
+	fmt.Printf("erased account %d\n", userID)
+	return 0
+}
+
+// reencryptCommand seals the health data with the current keys, after
+// turning encryption on or adding a new master key.
+func reencryptCommand(args []string) int {
+	flags := flag.NewFlagSet("reencrypt", flag.ContinueOnError)
+	rotate := flags.Bool("rotate", false, "give every account a new data key first")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	rows, err := reencryptData(*rotate)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "reencrypt:", err)
+		return 1
+	}
+
+	fmt.Printf("sealed %d rows with master key %s\n", rows, masterKeys.current)
+	return 0
+}
+
+// writeExportFile writes the export into the file, replacing it.
+func writeExportFile(name string, format string, data ExportData, locale *Locale) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	if err = writeExport(file, format, data, locale); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
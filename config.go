@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+)
+
+// Config holds the settings read from the environment
+type Config struct {
+	BaseURL         string
+	SMTPAddr        string
+	SMTPUser        string
+	SMTPPassword    string
+	SMTPFrom        string
+	VAPIDPrivateKey string
+	VAPIDSubject    string
+	Timezone        string
+	Locale          string
+	LogLevel        string
+	LogFormat       string
+	MetricsToken    string
+	Admins          string
+	MasterKeys      string
+	BlobBackend     string
+	BlobDir         string
+	S3Endpoint      string
+	S3Region        string
+	S3Bucket        string
+	S3AccessKey     string
+	S3SecretKey     string
+}
+
+var config Config
+
+// getEnv returns the environment variable or the fallback if it is not set.
+func getEnv(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+func loadConfig() Config {
+	return Config{
+		BaseURL:         getEnv("MWS_BASE_URL", "http://localhost:8090"),
+		SMTPAddr:        getEnv("MWS_SMTP_ADDR", "localhost:1025"),
+		SMTPUser:        getEnv("MWS_SMTP_USER", ""),
+		SMTPPassword:    getEnv("MWS_SMTP_PASSWORD", ""),
+		SMTPFrom:        getEnv("MWS_SMTP_FROM", "Pill Tracker <noreply@pilltracker.local>"),
+		VAPIDPrivateKey: getEnv("MWS_VAPID_PRIVATE_KEY", ""),
+		VAPIDSubject:    getEnv("MWS_VAPID_SUBJECT", "mailto:destek@ilacuyarisistemi.local"),
+		Timezone:        getEnv("MWS_TIMEZONE", "Europe/Istanbul"),
+		Locale:          getEnv("MWS_LOCALE", "en"),
+		LogLevel:        getEnv("MWS_LOG_LEVEL", "info"),
+		LogFormat:       getEnv("MWS_LOG_FORMAT", "text"),
+		MetricsToken:    getEnv("MWS_METRICS_TOKEN", ""),
+		Admins:          getEnv("MWS_ADMINS", ""),
+		MasterKeys:      getEnv("MWS_MASTER_KEYS", ""),
+		BlobBackend:     getEnv("MWS_BLOB_BACKEND", blobBackendLocal),
+		BlobDir:         getEnv("MWS_BLOB_DIR", "./blobs"),
+		S3Endpoint:      getEnv("MWS_S3_ENDPOINT", "http://localhost:9000"),
+		S3Region:        getEnv("MWS_S3_REGION", "us-east-1"),
+		S3Bucket:        getEnv("MWS_S3_BUCKET", "mws"),
+		S3AccessKey:     getEnv("MWS_S3_ACCESS_KEY", ""),
+		S3SecretKey:     getEnv("MWS_S3_SECRET_KEY", ""),
+	}
+}
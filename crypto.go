@@ -0,0 +1,663 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sealedPrefix marks a column value encrypted with a data key, followed by
+// the key's ID and the base64 of the nonce and the ciphertext
+const sealedPrefix = "enc:v1:"
+
+// escapedPrefix marks a plaintext value which starts like a sealed or an
+// escaped one, so it is not mistaken for one when read
+const escapedPrefix = "enc:raw:"
+
+// sealedTable names the sealed columns of a table and its primary key
+type sealedTable struct {
+	Table   string
+	Key     string
+	Columns []string
+}
+
+// sealedColumns lists the health data encrypted at rest, by the key of the
+// account owning the row
+var sealedColumns = []sealedTable{
+	{"medicine", "medicine_id", []string{"name", "description", "ingredients"}},
+	{"use_alarms", "use_id", []string{"hour", "dose_count"}},
+	{"health_profiles", "profile_id", []string{"allergies", "conditions", "pregnant", "birth_date", "weight"}},
+	{"prescriptions", "prescription_id", []string{"prescriber", "pharmacy", "erx_number"}},
+	{"attachments", "attachment_id", []string{"name"}},
+	{"notification_log", "log_id", []string{"title", "body"}},
+}
+
+// appendOnlyColumns are sealed once and never written again, the data keys
+// they were sealed with are kept for them
+var appendOnlyColumns = []sealedTable{
+	{"audit_log", "audit_id", []string{"before_value", "after_value"}},
+}
+
+// masterKeys holds the master keys of MWS_MASTER_KEYS by their ID. The first
+// one wraps new data keys, the others are only kept to unwrap older ones.
+var masterKeys = struct {
+	current string
+	keys    map[string][]byte
+}{keys: map[string][]byte{}}
+
+// dataKeys caches unwrapped data keys by their ID
+var dataKeys = struct {
+	sync.Mutex
+	keys map[int64][]byte
+}{keys: map[int64][]byte{}}
+
+// loadMasterKeys reads a comma separated list of ID:base64 keys of 32 bytes.
+// Without any key, values are written as they are.
+func loadMasterKeys(list string) error {
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("master key %q is not ID:base64", item)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("master key %q is not 32 bytes of base64", parts[0])
+		}
+
+		if masterKeys.current == "" {
+			masterKeys.current = parts[0]
+		}
+		masterKeys.keys[parts[0]] = key
+	}
+	return nil
+}
+
+// encryptionEnabled reports if new values are sealed.
+func encryptionEnabled() bool {
+	return masterKeys.current != ""
+}
+
+// gcmSeal encrypts with AES-256-GCM and returns the nonce followed by the ciphertext.
+func gcmSeal(key []byte, plaintext []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, data), nil
+}
+
+// gcmOpen decrypts what gcmSeal returned.
+func gcmOpen(key []byte, sealed []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed value too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], data)
+}
+
+// wrapKey encrypts a data key of the account with the current master key.
+func wrapKey(userID int, key []byte) (masterID string, wrapped string, err error) {
+	sealed, err := gcmSeal(masterKeys.keys[masterKeys.current], key, []byte("user:"+strconv.Itoa(userID)))
+	if err != nil {
+		return "", "", err
+	}
+	return masterKeys.current, base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// unwrapKey decrypts a data key of the account with the master key it was wrapped by.
+func unwrapKey(userID int, masterID string, wrapped string) ([]byte, error) {
+	master, ok := masterKeys.keys[masterID]
+	if !ok {
+		return nil, fmt.Errorf("master key %q is not configured", masterID)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return gcmOpen(master, sealed, []byte("user:"+strconv.Itoa(userID)))
+}
+
+// createDataKey gives the account a new data key, which seals its values from now on.
+func createDataKey(exec dbExecer, userID int) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	masterID, wrapped, err := wrapKey(userID, key)
+	if err != nil {
+		return err
+	}
+
+	_, err = exec.Exec("INSERT INTO data_keys(user_id,master_id,wrapped_key,create_at) VALUES(?,?,?,?)", userID, masterID, wrapped, nowEpoch())
+	return err
+}
+
+// createDataKeys gives every account the query returns a new data key.
+func createDataKeys(query string) (count int, err error) {
+	var userIDs []int
+
+	row, err := db.Query(query)
+	if err != nil {
+		return 0, err
+	}
+
+	for row.Next() {
+		var userID int
+
+		if err = row.Scan(&userID); err != nil {
+			row.Close()
+			return 0, err
+		}
+
+		userIDs = append(userIDs, userID)
+	}
+	row.Close()
+
+	for _, userID := range userIDs {
+		if err = createDataKey(db, userID); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// ensureDataKeys checks that the master keys of the data keys are configured
+// and gives every account without a data key one. Keys are made ahead, so
+// writes inside a transaction never have to create one.
+func ensureDataKeys() error {
+	// Sealed data cannot be read without the master keys its data keys are wrapped by
+	row, err := db.Query("SELECT DISTINCT master_id FROM data_keys")
+	if err != nil {
+		return err
+	}
+	for row.Next() {
+		var masterID string
+		if err = row.Scan(&masterID); err != nil {
+			row.Close()
+			return err
+		}
+		if _, ok := masterKeys.keys[masterID]; !ok {
+			row.Close()
+			return fmt.Errorf("data keys are wrapped by master key %q, which MWS_MASTER_KEYS does not have", masterID)
+		}
+	}
+	row.Close()
+
+	if !encryptionEnabled() {
+		return nil
+	}
+
+	count, err := createDataKeys("SELECT user_id FROM users WHERE user_id NOT IN (SELECT user_id FROM data_keys)")
+	if count > 0 {
+		logger.Info("created data keys", "accounts", count)
+	}
+	return err
+}
+
+// getDataKey returns the unwrapped data key with the ID.
+func getDataKey(keyID int64) ([]byte, error) {
+	dataKeys.Lock()
+	key, ok := dataKeys.keys[keyID]
+	dataKeys.Unlock()
+
+	if ok {
+		return key, nil
+	}
+
+	var userID int
+	var masterID, wrapped string
+
+	err := db.QueryRow("SELECT user_id, master_id, wrapped_key FROM data_keys WHERE key_id=$1", keyID).Scan(&userID, &masterID, &wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("data key %d: %s", keyID, err)
+	}
+
+	if key, err = unwrapKey(userID, masterID, wrapped); err != nil {
+		return nil, fmt.Errorf("data key %d: %s", keyID, err)
+	}
+
+	dataKeys.Lock()
+	dataKeys.keys[keyID] = key
+	dataKeys.Unlock()
+
+	return key, nil
+}
+
+// getCurrentKeyID returns the ID of the newest data key of the account.
+func getCurrentKeyID(userID int) (keyID int64, err error) {
+	err = db.QueryRow("SELECT MAX(key_id) FROM data_keys WHERE user_id=$1", userID).Scan(&keyID)
+	if err != nil {
+		return 0, fmt.Errorf("no data key for user %d", userID)
+	}
+	return keyID, nil
+}
+
+// sealField encrypts a value with the current data key of the account owning
+// it. Empty values and values written without master keys stay as they are.
+func sealField(userID int, value string) (string, error) {
+	if value == "" || !encryptionEnabled() {
+		return value, nil
+	}
+
+	keyID, err := getCurrentKeyID(userID)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := getDataKey(keyID)
+	if err != nil {
+		return "", err
+	}
+
+	id := strconv.FormatInt(keyID, 10)
+	sealed, err := gcmSeal(key, []byte(value), []byte(id))
+	if err != nil {
+		return "", err
+	}
+
+	return sealedPrefix + id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// sealFields encrypts the values in place.
+func sealFields(userID int, values ...*string) error {
+	for _, value := range values {
+		sealed, err := sealField(userID, *value)
+		if err != nil {
+			return err
+		}
+		*value = sealed
+	}
+	return nil
+}
+
+// openField decrypts a sealed value. Values which are not sealed, written
+// before encryption was turned on, are returned as they are.
+func openField(value string) (string, error) {
+	if !strings.HasPrefix(value, sealedPrefix) {
+		return value, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, sealedPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", errors.New("malformed sealed value")
+	}
+
+	keyID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", errors.New("malformed sealed value")
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.New("malformed sealed value")
+	}
+
+	key, err := getDataKey(keyID)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := gcmOpen(key, sealed, []byte(parts[0]))
+	if err != nil {
+		return "", fmt.Errorf("data key %d: %s", keyID, err)
+	}
+	return string(plaintext), nil
+}
+
+// sealBlob encrypts a file with the data key, bound to the blob key it is
+// stored under. Key 0 leaves files written without master keys as they are.
+func sealBlob(keyID int64, blobKey string, content []byte) ([]byte, error) {
+	if keyID == 0 {
+		return content, nil
+	}
+
+	key, err := getDataKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcmSeal(key, content, []byte(strconv.FormatInt(keyID, 10)+":"+blobKey))
+}
+
+// openBlob decrypts what sealBlob returned.
+func openBlob(keyID int64, blobKey string, sealed []byte) ([]byte, error) {
+	if keyID == 0 {
+		return sealed, nil
+	}
+
+	key, err := getDataKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := gcmOpen(key, sealed, []byte(strconv.FormatInt(keyID, 10)+":"+blobKey))
+	if err != nil {
+		return nil, fmt.Errorf("data key %d: %s", keyID, err)
+	}
+	return content, nil
+}
+
+// openedRows decrypts the sealed values and unescapes the escaped ones of
+// every row read, so queries see the values as they were written.
+type openedRows struct {
+	driver.Rows
+}
+
+// openRows wraps the rows a query returned.
+func openRows(rows driver.Rows, err error) (driver.Rows, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &openedRows{rows}, nil
+}
+
+func (r *openedRows) Next(dest []driver.Value) error {
+	if err := r.Rows.Next(dest); err != nil {
+		return err
+	}
+
+	for i, value := range dest {
+		var text string
+
+		switch v := value.(type) {
+		case string:
+			text = v
+		case []byte:
+			text = string(v)
+		default:
+			continue
+		}
+
+		if strings.HasPrefix(text, escapedPrefix) {
+			dest[i] = strings.TrimPrefix(text, escapedPrefix)
+			continue
+		}
+		if !strings.HasPrefix(text, sealedPrefix) {
+			continue
+		}
+
+		opened, err := openField(text)
+		if err != nil {
+			return err
+		}
+		dest[i] = opened
+	}
+
+	return nil
+}
+
+// escapeArgs escapes the text arguments of a statement which start like a
+// sealed value without being one, such as a name typed or imported that way,
+// so rows holding them still read back as written. Values sealed with a data
+// key are left as they are.
+func escapeArgs(args []driver.NamedValue) []driver.NamedValue {
+	for i, arg := range args {
+		text, ok := arg.Value.(string)
+		if !ok || !strings.HasPrefix(text, sealedPrefix) && !strings.HasPrefix(text, escapedPrefix) {
+			continue
+		}
+
+		if strings.HasPrefix(text, sealedPrefix) {
+			if _, err := openField(text); err == nil {
+				continue
+			}
+		}
+		args[i].Value = escapedPrefix + text
+	}
+	return args
+}
+
+// reencryptData seals every value of the sealed columns with the current
+// data key of its account, so values written before encryption and ones of
+// older keys move to the current keys. Data keys wrapped by an older master
+// key are wrapped again, and data keys nothing refers to any more are deleted.
+func reencryptData(rotate bool) (rows int, err error) {
+	if !encryptionEnabled() {
+		return 0, errors.New("no master key configured")
+	}
+
+	// Rotating gives every account a new key, the old ones go once nothing refers to them
+	if rotate {
+		_, err = createDataKeys("SELECT user_id FROM users")
+	} else {
+		err = ensureDataKeys()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err = rewrapDataKeys(); err != nil {
+		return 0, err
+	}
+
+	for _, table := range sealedColumns {
+		count, err := reencryptTable(table.Table, table.Key, table.Columns)
+		if err != nil {
+			return rows, fmt.Errorf("%s: %s", table.Table, err)
+		}
+		rows += count
+	}
+
+	count, err := reencryptAttachments()
+	if err != nil {
+		return rows, fmt.Errorf("attachments: %s", err)
+	}
+	rows += count
+
+	count, err = reencryptPrescriptionScans()
+	if err != nil {
+		return rows, fmt.Errorf("prescription scans: %s", err)
+	}
+	rows += count
+
+	return rows, deleteUnusedDataKeys()
+}
+
+// rewrapDataKeys wraps the data keys of older master keys with the current one.
+func rewrapDataKeys() error {
+	type dataKey struct {
+		ID       int64
+		UserID   int
+		MasterID string
+		Wrapped  string
+	}
+
+	var keys []dataKey
+
+	row, err := db.Query("SELECT key_id, user_id, master_id, wrapped_key FROM data_keys WHERE master_id <> $1", masterKeys.current)
+	if err != nil {
+		return err
+	}
+	for row.Next() {
+		var key dataKey
+		if err = row.Scan(&key.ID, &key.UserID, &key.MasterID, &key.Wrapped); err != nil {
+			row.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	row.Close()
+
+	for _, key := range keys {
+		plain, err := unwrapKey(key.UserID, key.MasterID, key.Wrapped)
+		if err != nil {
+			return fmt.Errorf("data key %d: %s", key.ID, err)
+		}
+
+		masterID, wrapped, err := wrapKey(key.UserID, plain)
+		if err != nil {
+			return err
+		}
+
+		if _, err = db.Exec("UPDATE data_keys SET master_id=$1, wrapped_key=$2 WHERE key_id=$3", masterID, wrapped, key.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reencryptTable seals the columns of every row of the table again, in one transaction.
+func reencryptTable(table string, key string, columns []string) (int, error) {
+	type sealedRow struct {
+		ID     int
+		UserID int
+		Values []string
+	}
+
+	var rows []sealedRow
+
+	// Rows are read opened, as every query reads them
+	row, err := db.Query(fmt.Sprintf("SELECT %s, user_id, %s FROM %s", key, strings.Join(columns, ", "), table))
+	if err != nil {
+		return 0, err
+	}
+
+	for row.Next() {
+		r := sealedRow{Values: make([]string, len(columns))}
+		values := make([]sql.NullString, len(columns))
+
+		dest := []interface{}{&r.ID, &r.UserID}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+
+		if err = row.Scan(dest...); err != nil {
+			row.Close()
+			return 0, err
+		}
+
+		for i, value := range values {
+			r.Values[i] = value.String
+		}
+		rows = append(rows, r)
+	}
+	row.Close()
+
+	if err = row.Err(); err != nil {
+		return 0, err
+	}
+
+	// Every key is looked up before the transaction holds the database
+	sealed := make([][]interface{}, len(rows))
+	for i, r := range rows {
+		for _, value := range r.Values {
+			s, err := sealField(r.UserID, value)
+			if err != nil {
+				return 0, fmt.Errorf("row %d: %s", r.ID, err)
+			}
+			sealed[i] = append(sealed[i], s)
+		}
+		sealed[i] = append(sealed[i], r.ID)
+	}
+
+	assignments := make([]string, len(columns))
+	for i, column := range columns {
+		assignments[i] = column + "=?"
+	}
+	statement := fmt.Sprintf("UPDATE %s SET %s WHERE %s=?", table, strings.Join(assignments, ", "), key)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, args := range sealed {
+		if _, err = tx.Exec(statement, args...); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	return len(rows), tx.Commit()
+}
+
+// deleteUnusedDataKeys deletes the older data keys no sealed value refers to.
+// The newest key of every account is kept for the values to come.
+func deleteUnusedDataKeys() error {
+	var unused []int64
+
+	row, err := db.Query("SELECT key_id FROM data_keys WHERE key_id NOT IN (SELECT MAX(key_id) FROM data_keys GROUP BY user_id)")
+	if err != nil {
+		return err
+	}
+	for row.Next() {
+		var keyID int64
+		if err = row.Scan(&keyID); err != nil {
+			row.Close()
+			return err
+		}
+		unused = append(unused, keyID)
+	}
+	row.Close()
+
+	for _, keyID := range unused {
+		used := false
+		for _, table := range append(sealedColumns, appendOnlyColumns...) {
+			for _, column := range table.Columns {
+				var count int
+				// The prefix is part of the statement, an argument looking sealed is escaped
+				query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s LIKE '%s' || $1 || ':%%'", table.Table, column, sealedPrefix)
+				if err = db.QueryRow(query, keyID).Scan(&count); err != nil {
+					return err
+				}
+				used = used || count > 0
+			}
+		}
+
+		// Attachments and prescription scans keep the key their files were sealed with
+		var files, scans int
+		if err = db.QueryRow("SELECT COUNT(*) FROM attachments WHERE key_id=$1", keyID).Scan(&files); err != nil {
+			return err
+		}
+		if err = db.QueryRow("SELECT COUNT(*) FROM prescriptions WHERE scan_key IS NOT NULL AND scan_key_id=$1", keyID).Scan(&scans); err != nil {
+			return err
+		}
+		used = used || files > 0 || scans > 0
+
+		if used {
+			continue
+		}
+
+		if _, err = db.Exec("DELETE FROM data_keys WHERE key_id=$1", keyID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// useMasterKey turns encryption on with a test master key for the test.
+func useMasterKey(t *testing.T) {
+	previous := masterKeys
+	masterKeys.current, masterKeys.keys = "", map[string][]byte{}
+
+	if err := loadMasterKeys("test:" + base64.StdEncoding.EncodeToString(make([]byte, 32))); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		masterKeys = previous
+		dataKeys.Lock()
+		dataKeys.keys = map[int64][]byte{}
+		dataKeys.Unlock()
+	})
+}
+
+// TestSealedFieldsRoundTrip writes sealed values and expects the database to
+// hold them encrypted and queries through the driver to return them opened.
+func TestSealedFieldsRoundTrip(t *testing.T) {
+	openTestDatabase(t)
+	useMasterKey(t)
+
+	result, err := db.Exec("INSERT INTO users(username,email,register_date,password) VALUES('test','test@mws.local','2026-01-01','x')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID64, _ := result.LastInsertId()
+	userID := int(userID64)
+
+	if err = createDataKey(db, userID); err != nil {
+		t.Fatalf("createDataKey failed: %s", err)
+	}
+
+	name, description, ingredients := "Parol", "Fever and pain", ""
+	if err = sealFields(userID, &name, &description, &ingredients); err != nil {
+		t.Fatalf("sealFields failed: %s", err)
+	}
+	if !strings.HasPrefix(name, sealedPrefix) || !strings.HasPrefix(description, sealedPrefix) {
+		t.Fatalf("sealFields left %q, %q unsealed", name, description)
+	}
+	if ingredients != "" {
+		t.Errorf("sealFields sealed an empty value as %q", ingredients)
+	}
+
+	result, err = db.Exec("INSERT INTO medicine(user_id,name,producer,description,ingredients) VALUES($1,$2,$3,$4,$5)", userID, name, "Atabay", description, ingredients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	medicineID, _ := result.LastInsertId()
+
+	// The stored value is the sealed one, compared in SQL so the driver does
+	// not open it on the way out
+	var stored bool
+	err = db.QueryRow("SELECT name = $1 AND instr(name, 'Parol') = 0 FROM medicine WHERE medicine_id=$2", name, medicineID).Scan(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored {
+		t.Error("medicine name is not stored sealed")
+	}
+
+	// Cached data keys are unwrapped again from the database
+	dataKeys.Lock()
+	dataKeys.keys = map[int64][]byte{}
+	dataKeys.Unlock()
+
+	var gotName, gotProducer, gotDescription, gotIngredients sql.NullString
+	err = db.QueryRow("SELECT name, producer, description, ingredients FROM medicine WHERE medicine_id=$1", medicineID).
+		Scan(&gotName, &gotProducer, &gotDescription, &gotIngredients)
+	if err != nil {
+		t.Fatalf("reading sealed medicine failed: %s", err)
+	}
+	if gotName.String != "Parol" || gotProducer.String != "Atabay" || gotDescription.String != "Fever and pain" || gotIngredients.String != "" {
+		t.Errorf("read %q, %q, %q, %q, want the written values", gotName.String, gotProducer.String, gotDescription.String, gotIngredients.String)
+	}
+
+	// Values sealed with an older data key still open after a new one is made
+	if err = createDataKey(db, userID); err != nil {
+		t.Fatalf("createDataKey failed: %s", err)
+	}
+	if err = db.QueryRow("SELECT name FROM medicine WHERE medicine_id=$1", medicineID).Scan(&gotName); err != nil || gotName.String != "Parol" {
+		t.Errorf("reading after a new data key = %q, %v, want Parol", gotName.String, err)
+	}
+
+	// Data keys still sealing values are kept
+	if err = deleteUnusedDataKeys(); err != nil {
+		t.Fatalf("deleteUnusedDataKeys failed: %s", err)
+	}
+	dataKeys.Lock()
+	dataKeys.keys = map[int64][]byte{}
+	dataKeys.Unlock()
+	if err = db.QueryRow("SELECT name FROM medicine WHERE medicine_id=$1", medicineID).Scan(&gotName); err != nil || gotName.String != "Parol" {
+		t.Errorf("reading after deleting unused data keys = %q, %v, want Parol", gotName.String, err)
+	}
+
+	// A value altered in the database fails to open instead of reading as garbage
+	if _, err = db.Exec("UPDATE medicine SET name = substr(name, 1, length(name) - 4) || 'AAA=' WHERE medicine_id=$1", medicineID); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.QueryRow("SELECT name FROM medicine WHERE medicine_id=$1", medicineID).Scan(&gotName); err == nil {
+		t.Error("reading a tampered value did not fail")
+	}
+}
+
+// TestSealedLookingPlaintext writes plaintext starting like sealed and
+// escaped values, with and without encryption, and expects it read back as
+// written instead of failing every query returning the row.
+func TestSealedLookingPlaintext(t *testing.T) {
+	openTestDatabase(t)
+
+	values := []string{"enc:v1:1:AAAA", "enc:v1:", "enc:raw:Parol", "enc:raw:enc:v1:1:AAAA"}
+
+	check := func(userID int) {
+		for _, value := range values {
+			name := value
+			if err := sealFields(userID, &name); err != nil {
+				t.Fatalf("sealFields failed: %s", err)
+			}
+
+			result, err := db.Exec("INSERT INTO medicine(user_id,name,producer) VALUES($1,$2,$3)", userID, name, value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			medicineID, _ := result.LastInsertId()
+
+			var gotName, gotProducer string
+			err = db.QueryRow("SELECT name, producer FROM medicine WHERE medicine_id=$1", medicineID).Scan(&gotName, &gotProducer)
+			if err != nil {
+				t.Errorf("reading %q failed: %s", value, err)
+				continue
+			}
+			if gotName != value || gotProducer != value {
+				t.Errorf("read %q, %q, want %q", gotName, gotProducer, value)
+			}
+
+			// Lookups by the value find the row
+			var count int
+			if err = db.QueryRow("SELECT COUNT(*) FROM medicine WHERE producer=$1", value).Scan(&count); err != nil || count == 0 {
+				t.Errorf("looking up %q found %d rows, %v", value, count, err)
+			}
+		}
+	}
+
+	// Without master keys values are written as they are
+	check(1)
+
+	useMasterKey(t)
+	if err := createDataKey(db, 1); err != nil {
+		t.Fatalf("createDataKey failed: %s", err)
+	}
+	check(1)
+}
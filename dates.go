@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// storedDateLayouts holds the layouts dates were written in by earlier versions, the current one first
+var storedDateLayouts = []string{
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05 -0700 MST",
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"02/01/2006 15:04",
+	"02/01/2006",
+}
+
+// parseStoredDate reads a date kept as text. Values without an offset are taken as UTC.
+func parseStoredDate(value string) (date time.Time, err error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return date, errors.New("empty date")
+	}
+
+	for _, layout := range storedDateLayouts {
+		if date, err = time.Parse(layout, value); err == nil {
+			return date.UTC(), nil
+		}
+	}
+
+	return date, err
+}
+
+// toEpoch turns an instant into the Unix seconds dates are stored as.
+func toEpoch(date time.Time) int64 {
+	return date.Unix()
+}
+
+// fromEpoch turns stored Unix seconds back into an instant.
+func fromEpoch(seconds int64) time.Time {
+	return time.Unix(seconds, 0).UTC()
+}
+
+// nowEpoch returns the current instant as Unix seconds.
+func nowEpoch() int64 {
+	return time.Now().Unix()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// weekdayKeys holds the message keys of the weekdays, Monday first
+var weekdayKeys = [7]string{"day.monday", "day.tuesday", "day.wednesday", "day.thursday", "day.friday", "day.saturday", "day.sunday"}
+
+// ScheduledDose holds a use alarm together with what is taken at that time
+type ScheduledDose struct {
+	EntryID     int
+	MedicineID  int
+	Name        string
+	Ingredients []DrugIngredient
+	Days        [7]bool
+	Count       float64
+}
+
+// isMilligram reports if a medicine size type is given in milligrams
+func isMilligram(sizeType string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(sizeType)), "mg")
+}
+
+// parseDoseCount reads the number of units taken per dose, defaulting to one.
+func parseDoseCount(count string) float64 {
+	value, err := strconv.ParseFloat(strings.Replace(strings.TrimSpace(count), ",", ".", 1), 64)
+	if err != nil || value <= 0 {
+		return 1
+	}
+	return value
+}
+
+// newScheduledDose resolves the ingredients of a medicine and their strength
+// per unit. A single ingredient without its own strength uses the medicine size.
+func newScheduledDose(name string, ingredients string, size string, sizeType string) (dose ScheduledDose) {
+	dose.Name = name
+	dose.Ingredients = getDrugDatabase().resolveIngredients(name, ingredients)
+	dose.Count = 1
+
+	if len(dose.Ingredients) == 1 && dose.Ingredients[0].Strength == 0 && isMilligram(sizeType) {
+		if strength, err := strconv.ParseFloat(strings.TrimSpace(size), 64); err == nil {
+			dose.Ingredients[0].Strength = strength
+		}
+	}
+
+	return dose
+}
+
+// getScheduledDoses returns the use alarms of the patient's entries which are not expired yet.
+func getScheduledDoses(patientID int) (doses []ScheduledDose) {
+	row, err := db.Query(`SELECT e.entry_id, m.medicine_id, m.name, m.ingredients, m.size, m.size_type, u.mon, u.tue, u.wed, u.thu, u.fri, u.sat, u.sun, u.dose_count
+		FROM use_alarms u JOIN entries e ON e.entry_id = u.entry_id JOIN medicine m ON m.medicine_id = e.medicine_id
+		WHERE u.patient_id=$1 AND `+entryExpireSQL+` >= $2`, patientID, nowEpoch())
+	if err != nil {
+		logger.Error("getScheduledDoses", "patient_id", patientID, "error", err)
+		return
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var entryID, medicineID int
+		var name string
+		var ingredients, size, sizeType, count sql.NullString
+		var days [7]sql.NullString
+
+		err = row.Scan(&entryID, &medicineID, &name, &ingredients, &size, &sizeType, &days[0], &days[1], &days[2], &days[3], &days[4], &days[5], &days[6], &count)
+		if err != nil {
+			logger.Error("getScheduledDoses", "patient_id", patientID, "error", err)
+			return
+		}
+
+		dose := newScheduledDose(name, ingredients.String, size.String, sizeType.String)
+		dose.EntryID = entryID
+		dose.MedicineID = medicineID
+		dose.Count = parseDoseCount(count.String)
+
+		for i := range days {
+			dose.Days[i] = days[i].String == "on"
+		}
+
+		doses = append(doses, dose)
+	}
+
+	return doses
+}
+
+// checkDailyDoses sums the scheduled intake of every ingredient per weekday and
+// warns when it exceeds the maximum daily dose or comes from several medicines.
+// If added is not nil only the ingredients of the added schedule are reported.
+func checkDailyDoses(doses []ScheduledDose, added *ScheduledDose, locale *Locale) (warnings []Warning) {
+	if added != nil {
+		doses = append(doses, *added)
+	}
+
+	type ingredientDay struct {
+		Total     float64
+		Medicines map[string]bool
+	}
+
+	var order []string
+	ingredients := make(map[string]DrugIngredient)
+	days := make(map[string]*[7]ingredientDay)
+
+	for _, dose := range doses {
+		for _, ingredient := range dose.Ingredients {
+			if _, ok := days[ingredient.Name]; !ok {
+				order = append(order, ingredient.Name)
+				ingredients[ingredient.Name] = ingredient
+				days[ingredient.Name] = &[7]ingredientDay{}
+			}
+
+			for day, scheduled := range dose.Days {
+				if !scheduled {
+					continue
+				}
+
+				total := &days[ingredient.Name][day]
+				total.Total += ingredient.Strength * dose.Count
+
+				if total.Medicines == nil {
+					total.Medicines = make(map[string]bool)
+				}
+				total.Medicines[dose.Name] = true
+			}
+		}
+	}
+
+	for _, name := range order {
+		if added != nil && !added.hasIngredient(name) {
+			continue
+		}
+
+		ingredient := ingredients[name]
+
+		var overDays, duplicateDays []string
+		var highest float64
+		var medicines []string
+		seen := make(map[string]bool)
+
+		for day, total := range days[name] {
+			if ingredient.MaxDailyMg > 0 && total.Total > ingredient.MaxDailyMg {
+				overDays = append(overDays, locale.T(weekdayKeys[day]))
+				if total.Total > highest {
+					highest = total.Total
+				}
+			}
+
+			if len(total.Medicines) > 1 {
+				duplicateDays = append(duplicateDays, locale.T(weekdayKeys[day]))
+				for medicine := range total.Medicines {
+					if !seen[medicine] {
+						seen[medicine] = true
+						medicines = append(medicines, medicine)
+					}
+				}
+			}
+		}
+
+		sort.Strings(medicines)
+
+		if len(overDays) > 0 {
+			warnings = append(warnings, Warning{
+				Severity: "major",
+				Title:    locale.T("warning.dose.title", name),
+				Message:  locale.T("warning.dose.message", locale.FormatNumber(highest), name, strings.Join(overDays, ", "), locale.FormatNumber(ingredient.MaxDailyMg)),
+			})
+		}
+
+		if len(duplicateDays) > 0 {
+			warnings = append(warnings, Warning{
+				Severity: "moderate",
+				Title:    locale.T("warning.duplicate.title", name),
+				Message:  locale.T("warning.duplicate.message", strings.Title(name), strings.Join(medicines, ", "), strings.Join(duplicateDays, ", ")),
+			})
+		}
+	}
+
+	return warnings
+}
+
+func (d ScheduledDose) hasIngredient(name string) bool {
+	for _, ingredient := range d.Ingredients {
+		if ingredient.Name == name {
+			return true
+		}
+	}
+	return false
+}
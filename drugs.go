@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const drugsFile = "data/drugs.json"
+
+// DrugIngredient holds knowledge base data of a single active ingredient. Its
+// advice in pregnancy is the message key of the text in the message catalogs.
+type DrugIngredient struct {
+	Name              string   `json:"name"`
+	Aliases           []string `json:"aliases"`
+	Classes           []string `json:"classes"`
+	Contraindications []string `json:"contraindications"`
+	Pregnancy         string   `json:"pregnancy"`
+	MinAge            int      `json:"min_age"`
+	MaxDailyMg        float64  `json:"max_daily_mg"`
+
+	// OpenDays is how long its liquids, drops and pens keep after opening
+	OpenDays int `json:"open_days"`
+
+	// Strength is the amount in mg per unit, if the medicine states it
+	Strength float64 `json:"-"`
+}
+
+// DrugInteraction holds a known interacting pair of ingredients or classes
+type DrugInteraction struct {
+	A        string `json:"a"`
+	B        string `json:"b"`
+	Severity string `json:"severity"`
+
+	// Message is the message key of what happens when they are taken together
+	Message string `json:"message"`
+}
+
+// DrugDatabase holds the local drug knowledge base
+type DrugDatabase struct {
+	Ingredients  []DrugIngredient  `json:"ingredients"`
+	Interactions []DrugInteraction `json:"interactions"`
+
+	lookup map[string]DrugIngredient
+}
+
+var ingredientStrengthRegex = regexp.MustCompile(`^(.*?)\s*(\d+(?:[.,]\d+)?)\s*(mg|g|mcg|µg)$`)
+
+var drugDB struct {
+	sync.Mutex
+	data    *DrugDatabase
+	modTime time.Time
+}
+
+// getDrugDatabase returns the knowledge base, loading it again whenever the
+// data file has been changed on disk so it can be updated without a restart.
+func getDrugDatabase() *DrugDatabase {
+	drugDB.Lock()
+	defer drugDB.Unlock()
+
+	info, err := os.Stat(drugsFile)
+	if err != nil {
+		logger.Error("getDrugDatabase", "error", err)
+		if drugDB.data == nil {
+			drugDB.data = &DrugDatabase{lookup: make(map[string]DrugIngredient)}
+		}
+		return drugDB.data
+	}
+
+	if drugDB.data != nil && info.ModTime().Equal(drugDB.modTime) {
+		return drugDB.data
+	}
+
+	data, err := loadDrugDatabase(drugsFile)
+	if err != nil {
+		logger.Error("getDrugDatabase", "error", err)
+		if drugDB.data == nil {
+			drugDB.data = &DrugDatabase{lookup: make(map[string]DrugIngredient)}
+		}
+		return drugDB.data
+	}
+
+	drugDB.data = data
+	drugDB.modTime = info.ModTime()
+
+	return drugDB.data
+}
+
+func loadDrugDatabase(path string) (*DrugDatabase, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &DrugDatabase{}
+	if err = json.Unmarshal(content, data); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	data.lookup = make(map[string]DrugIngredient)
+	for _, ingredient := range data.Ingredients {
+		data.lookup[normalizeDrugTerm(ingredient.Name)] = ingredient
+		for _, alias := range ingredient.Aliases {
+			data.lookup[normalizeDrugTerm(alias)] = ingredient
+		}
+	}
+
+	return data, nil
+}
+
+// normalizeDrugTerm lowercases a term and collapses its whitespace for lookups.
+func normalizeDrugTerm(term string) string {
+	return strings.Join(strings.Fields(strings.ToLower(term)), " ")
+}
+
+// splitIngredients splits a free text ingredient list like "Desloratadin / Montelukast".
+func splitIngredients(ingredients string) (terms []string) {
+	for _, term := range strings.FieldsFunc(ingredients, func(r rune) bool {
+		return r == ',' || r == '/' || r == '+' || r == ';'
+	}) {
+		if term = normalizeDrugTerm(term); term != "" {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// parseIngredientStrength splits a term like "paracetamol 500 mg" into the
+// ingredient and its strength in mg. The strength is 0 if none is given.
+func parseIngredientStrength(term string) (name string, strength float64) {
+	match := ingredientStrengthRegex.FindStringSubmatch(term)
+	if match == nil || match[1] == "" {
+		return term, 0
+	}
+
+	strength, err := strconv.ParseFloat(strings.Replace(match[2], ",", ".", 1), 64)
+	if err != nil {
+		return term, 0
+	}
+
+	switch match[3] {
+	case "g":
+		strength *= 1000
+	case "mcg", "µg":
+		strength /= 1000
+	}
+
+	return match[1], strength
+}
+
+// resolveIngredients maps the medicine name and its ingredient list to known
+// ingredients. Unknown ingredients are kept by name so exact rules still match.
+func (d *DrugDatabase) resolveIngredients(name string, ingredients string) (resolved []DrugIngredient) {
+	seen := make(map[string]bool)
+
+	add := func(ingredient DrugIngredient) {
+		if !seen[ingredient.Name] {
+			seen[ingredient.Name] = true
+			resolved = append(resolved, ingredient)
+		}
+	}
+
+	for _, term := range splitIngredients(ingredients) {
+		term, strength := parseIngredientStrength(term)
+
+		ingredient, ok := d.lookup[term]
+		if !ok {
+			ingredient = DrugIngredient{Name: term}
+		}
+		ingredient.Strength = strength
+		add(ingredient)
+	}
+
+	// The medicine name is only used when it is a known brand or ingredient
+	if ingredient, ok := d.lookup[normalizeDrugTerm(name)]; ok {
+		add(ingredient)
+	}
+
+	return resolved
+}
+
+// openDays returns the shortest shelf life after opening of the medicine's
+// known ingredients, 0 when none of them has one.
+func (d *DrugDatabase) openDays(name string, ingredients string) (days int) {
+	for _, ingredient := range d.resolveIngredients(name, ingredients) {
+		if ingredient.OpenDays > 0 && (days == 0 || ingredient.OpenDays < days) {
+			days = ingredient.OpenDays
+		}
+	}
+	return days
+}
+
+// matches reports if the ingredient is the given ingredient or belongs to the given class.
+func (i DrugIngredient) matches(key string) bool {
+	key = normalizeDrugTerm(key)
+
+	if normalizeDrugTerm(i.Name) == key {
+		return true
+	}
+
+	for _, class := range i.Classes {
+		if normalizeDrugTerm(class) == key {
+			return true
+		}
+	}
+
+	return false
+}
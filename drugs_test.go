@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// TestDrugMessages expects every interaction and pregnancy message of the
+// knowledge base in every message catalog, so warnings never show a key.
+func TestDrugMessages(t *testing.T) {
+	drugs, err := loadDrugDatabase(drugsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for _, rule := range drugs.Interactions {
+		keys = append(keys, rule.Message)
+	}
+	for _, ingredient := range drugs.Ingredients {
+		if ingredient.Pregnancy != "" {
+			keys = append(keys, ingredient.Pregnancy)
+		}
+	}
+
+	files, err := filepath.Glob("locales/*.json")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no message catalogs: %v", err)
+	}
+
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var messages map[string]string
+		if err = json.Unmarshal(content, &messages); err != nil {
+			t.Fatalf("%s: %s", file, err)
+		}
+
+		for _, key := range keys {
+			if messages[key] == "" {
+				t.Errorf("%s has no message %q", file, key)
+			}
+		}
+	}
+}
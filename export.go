@@ -0,0 +1,525 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	exportJSON = "json"
+	exportCSV  = "csv"
+	exportFHIR = "fhir"
+
+	// exportVersion is raised when the layout of the JSON bundle changes
+	exportVersion = 1
+)
+
+// weekdayColumns holds the use_alarms day columns from Monday on
+var weekdayColumns = [7]string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"}
+
+// ExportData holds everything of a user which is exported, dates in RFC 3339
+// in the user's timezone and options as their stable codes
+type ExportData struct {
+	Format     string           `json:"format"`
+	Version    int              `json:"version"`
+	ExportedAt string           `json:"exported_at"`
+	User       ExportUser       `json:"user"`
+	Patients   []ExportPatient  `json:"patients"`
+	Medicines  []ExportMedicine `json:"medicines"`
+	Entries    []ExportEntry    `json:"entries"`
+	Schedules  []ExportSchedule `json:"schedules"`
+	Alarms     []ExportAlarm    `json:"alarms"`
+	Doses      []ExportDose     `json:"doses"`
+
+	Prescriptions []ExportPrescription `json:"prescriptions"`
+}
+
+// ExportUser holds the exported account
+type ExportUser struct {
+	Name         string `json:"name"`
+	Email        string `json:"email"`
+	Timezone     string `json:"timezone"`
+	Locale       string `json:"locale"`
+	RegisterDate string `json:"register_date"`
+}
+
+// ExportPatient holds an exported patient and how the user can access it
+type ExportPatient struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	Owner      string `json:"owner"`
+	Permission string `json:"permission"`
+}
+
+// ExportMedicine holds an exported medicine
+type ExportMedicine struct {
+	ID          int    `json:"id"`
+	PatientID   int    `json:"patient_id"`
+	Name        string `json:"name"`
+	Producer    string `json:"producer"`
+	Description string `json:"description"`
+	Size        string `json:"size"`
+	SizeType    string `json:"size_type"`
+	Count       string `json:"count"`
+	Type        string `json:"type"`
+	GTIN        string `json:"gtin"`
+	Ingredients string `json:"ingredients"`
+}
+
+// ExportEntry holds an exported package of a medicine
+type ExportEntry struct {
+	ID           int    `json:"id"`
+	MedicineID   int    `json:"medicine_id"`
+	PatientID    int    `json:"patient_id"`
+	EntryDate    string `json:"entry_date"`
+	ExpireDate   string `json:"expire_date"`
+	LotNumber    string `json:"lot_number"`
+	SerialNumber string `json:"serial_number"`
+}
+
+// ExportSchedule holds an exported dose schedule
+type ExportSchedule struct {
+	ID        int      `json:"id"`
+	EntryID   int      `json:"entry_id"`
+	PatientID int      `json:"patient_id"`
+	Days      []string `json:"days"`
+	Time      string   `json:"time"`
+	DoseCount string   `json:"dose_count"`
+}
+
+// ExportAlarm holds an exported expire alarm
+type ExportAlarm struct {
+	ID          int    `json:"id"`
+	EntryID     int    `json:"entry_id"`
+	PatientID   int    `json:"patient_id"`
+	Timer       int    `json:"timer"`
+	TimerType   string `json:"timer_type"`
+	BeforeAfter string `json:"before_after"`
+	Action      string `json:"action"`
+	FiredDate   string `json:"fired_date"`
+}
+
+// ExportDose holds an exported dose of the history
+type ExportDose struct {
+	ID         int    `json:"id"`
+	ScheduleID int    `json:"schedule_id"`
+	EntryID    int    `json:"entry_id"`
+	PatientID  int    `json:"patient_id"`
+	Scheduled  string `json:"scheduled"`
+	Status     string `json:"status"`
+	TakenDate  string `json:"taken_date"`
+}
+
+// ExportPrescription holds an exported prescription with its scan in base64
+type ExportPrescription struct {
+	ID             int    `json:"id"`
+	PatientID      int    `json:"patient_id"`
+	Prescriber     string `json:"prescriber"`
+	Pharmacy       string `json:"pharmacy"`
+	IssueDate      string `json:"issue_date"`
+	ERxNumber      string `json:"erx_number"`
+	RefillsAllowed int    `json:"refills_allowed"`
+	RefillsUsed    int    `json:"refills_used"`
+	ValidDays      int    `json:"valid_days"`
+	ScanType       string `json:"scan_type,omitempty"`
+	Scan           string `json:"scan,omitempty"`
+}
+
+// scanExtensions maps the content types of prescription scans to the
+// extensions they are zipped with
+var scanExtensions = map[string]string{"image/jpeg": ".jpg", "image/png": ".png", "application/pdf": ".pdf"}
+
+// exportTime formats a stored epoch date for the export, empty if there is none.
+func exportTime(value sql.NullInt64, location *time.Location) string {
+	if !value.Valid {
+		return ""
+	}
+	return fromEpoch(value.Int64).In(location).Format(time.RFC3339)
+}
+
+// exportStoredDate formats a date kept as text for the export, unchanged if it cannot be read.
+func exportStoredDate(value sql.NullString, location *time.Location) string {
+	date, err := parseStoredDate(value.String)
+	if err != nil {
+		return value.String
+	}
+	return date.In(location).Format(time.RFC3339)
+}
+
+// getExportData collects the data of the patients for the user's export.
+func getExportData(userID int, patients []Patient) (data ExportData, err error) {
+	location := getUserLocation(userID)
+
+	data = ExportData{
+		Format:     "mws-export",
+		Version:    exportVersion,
+		ExportedAt: time.Now().In(location).Format(time.RFC3339),
+		Patients:   []ExportPatient{},
+		Medicines:  []ExportMedicine{},
+		Entries:    []ExportEntry{},
+		Schedules:  []ExportSchedule{},
+		Alarms:     []ExportAlarm{},
+		Doses:      []ExportDose{},
+
+		Prescriptions: []ExportPrescription{},
+	}
+
+	var registerDate sql.NullString
+
+	result := db.QueryRow("SELECT username, email, register_date FROM users WHERE user_id=$1", userID)
+	if err = result.Scan(&data.User.Name, &data.User.Email, &registerDate); err != nil {
+		return data, err
+	}
+	data.User.Timezone = location.String()
+	data.User.Locale = getRecipientLocale(userID).Code
+	data.User.RegisterDate = exportStoredDate(registerDate, location)
+
+	for _, patient := range patients {
+		data.Patients = append(data.Patients, ExportPatient{ID: patient.ID, Name: patient.Name, Owner: patient.OwnerName, Permission: patient.Permission})
+	}
+
+	clause, args := patientIDsClause("patient_id", patients)
+
+	// Medicines
+	row, err := db.Query("SELECT medicine_id, patient_id, name, producer, description, size, size_type, med_count, type, gtin, ingredients FROM medicine WHERE "+clause+" ORDER BY medicine_id", args...)
+	if err != nil {
+		return data, err
+	}
+	for row.Next() {
+		var m ExportMedicine
+		var producer, description, size, sizeType, count, medType, gtin, ingredients sql.NullString
+
+		if err = row.Scan(&m.ID, &m.PatientID, &m.Name, &producer, &description, &size, &sizeType, &count, &medType, &gtin, &ingredients); err != nil {
+			row.Close()
+			return data, err
+		}
+
+		m.Producer, m.Description, m.Size, m.Count = producer.String, description.String, size.String, count.String
+		m.SizeType, m.Type = normalizeOption("size", sizeType.String), normalizeOption("type", medType.String)
+		m.GTIN, m.Ingredients = gtin.String, ingredients.String
+		data.Medicines = append(data.Medicines, m)
+	}
+	row.Close()
+
+	// Rows which could not be read, e.g. sealed with a missing key, must not go missing quietly
+	if err = row.Err(); err != nil {
+		return data, err
+	}
+
+	// Entries
+	row, err = db.Query("SELECT entry_id, medicine_id, patient_id, entry_at, expire_at, lot_number, serial_number FROM entries WHERE "+clause+" ORDER BY entry_id", args...)
+	if err != nil {
+		return data, err
+	}
+	for row.Next() {
+		var e ExportEntry
+		var entryAt, expireAt sql.NullInt64
+		var lot, serial sql.NullString
+
+		if err = row.Scan(&e.ID, &e.MedicineID, &e.PatientID, &entryAt, &expireAt, &lot, &serial); err != nil {
+			row.Close()
+			return data, err
+		}
+
+		e.EntryDate, e.ExpireDate = exportTime(entryAt, location), exportTime(expireAt, location)
+		e.LotNumber, e.SerialNumber = lot.String, serial.String
+		data.Entries = append(data.Entries, e)
+	}
+	row.Close()
+	if err = row.Err(); err != nil {
+		return data, err
+	}
+
+	// Schedules
+	row, err = db.Query("SELECT use_id, entry_id, patient_id, mon, tue, wed, thu, fri, sat, sun, hour, dose_count FROM use_alarms WHERE "+clause+" ORDER BY use_id", args...)
+	if err != nil {
+		return data, err
+	}
+	for row.Next() {
+		var s ExportSchedule
+		var days [7]sql.NullString
+		var hour, count sql.NullString
+
+		if err = row.Scan(&s.ID, &s.EntryID, &s.PatientID, &days[0], &days[1], &days[2], &days[3], &days[4], &days[5], &days[6], &hour, &count); err != nil {
+			row.Close()
+			return data, err
+		}
+
+		s.Days = []string{}
+		for i, day := range days {
+			if day.String == "on" {
+				s.Days = append(s.Days, weekdayColumns[i])
+			}
+		}
+		s.Time = strings.TrimSpace(hour.String)
+		s.DoseCount = strconv.FormatFloat(parseDoseCount(count.String), 'f', -1, 64)
+		data.Schedules = append(data.Schedules, s)
+	}
+	row.Close()
+	if err = row.Err(); err != nil {
+		return data, err
+	}
+
+	// Expire alarms
+	row, err = db.Query("SELECT expire_id, entry_id, patient_id, timer, timer_type, before_after, action, fired_date FROM expire_alarms WHERE "+clause+" ORDER BY expire_id", args...)
+	if err != nil {
+		return data, err
+	}
+	for row.Next() {
+		var a ExportAlarm
+		var firedDate sql.NullString
+
+		if err = row.Scan(&a.ID, &a.EntryID, &a.PatientID, &a.Timer, &a.TimerType, &a.BeforeAfter, &a.Action, &firedDate); err != nil {
+			row.Close()
+			return data, err
+		}
+
+		a.TimerType = normalizeOption("timer", a.TimerType)
+		a.BeforeAfter = normalizeOption("when", a.BeforeAfter)
+		a.Action = normalizeOption("action", a.Action)
+		if firedDate.Valid {
+			a.FiredDate = exportStoredDate(firedDate, location)
+		}
+		data.Alarms = append(data.Alarms, a)
+	}
+	row.Close()
+	if err = row.Err(); err != nil {
+		return data, err
+	}
+
+	// Dose history
+	row, err = db.Query("SELECT dose_id, use_id, entry_id, patient_id, scheduled_at, status, taken_date FROM dose_log WHERE "+clause+" ORDER BY scheduled_at, dose_id", args...)
+	if err != nil {
+		return data, err
+	}
+	for row.Next() {
+		var d ExportDose
+		var scheduledAt sql.NullInt64
+		var takenDate sql.NullString
+
+		if err = row.Scan(&d.ID, &d.ScheduleID, &d.EntryID, &d.PatientID, &scheduledAt, &d.Status, &takenDate); err != nil {
+			row.Close()
+			return data, err
+		}
+
+		d.Scheduled = exportTime(scheduledAt, location)
+		if takenDate.Valid {
+			d.TakenDate = exportStoredDate(takenDate, location)
+		}
+		data.Doses = append(data.Doses, d)
+	}
+	row.Close()
+	if err = row.Err(); err != nil {
+		return data, err
+	}
+
+	// Prescriptions, their scans are read from the blob store afterwards
+	scanKeys := make(map[int]string)
+	scanKeyIDs := make(map[int]int64)
+
+	row, err = db.Query("SELECT prescription_id, patient_id, prescriber, pharmacy, issue_at, erx_number, refills_allowed, refills_used, valid_days, scan_type, scan_key, scan_key_id FROM prescriptions WHERE "+clause+" ORDER BY prescription_id", args...)
+	if err != nil {
+		return data, err
+	}
+	for row.Next() {
+		var p ExportPrescription
+		var issueAt, keyID sql.NullInt64
+		var pharmacy, erxNumber, scanType, scanKey sql.NullString
+
+		if err = row.Scan(&p.ID, &p.PatientID, &p.Prescriber, &pharmacy, &issueAt, &erxNumber, &p.RefillsAllowed, &p.RefillsUsed, &p.ValidDays, &scanType, &scanKey, &keyID); err != nil {
+			row.Close()
+			return data, err
+		}
+
+		p.Pharmacy, p.ERxNumber, p.IssueDate = pharmacy.String, erxNumber.String, exportTime(issueAt, location)
+		if scanKey.Valid {
+			p.ScanType, scanKeys[p.ID], scanKeyIDs[p.ID] = scanType.String, scanKey.String, keyID.Int64
+		}
+		data.Prescriptions = append(data.Prescriptions, p)
+	}
+	row.Close()
+	if err = row.Err(); err != nil {
+		return data, err
+	}
+
+	for i, p := range data.Prescriptions {
+		scanKey, ok := scanKeys[p.ID]
+		if !ok {
+			continue
+		}
+
+		sealed, err := blobs.Get(scanKey)
+		if err != nil {
+			return data, fmt.Errorf("prescription %d: %s", p.ID, err)
+		}
+		content, err := openBlob(scanKeyIDs[p.ID], scanKey, sealed)
+		if err != nil {
+			return data, fmt.Errorf("prescription %d: %s", p.ID, err)
+		}
+		data.Prescriptions[i].Scan = base64.StdEncoding.EncodeToString(content)
+	}
+
+	return data, nil
+}
+
+// writeExportJSON writes the export as one JSON document.
+func writeExportJSON(w io.Writer, data ExportData) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(data)
+}
+
+// exportTable holds the rows of one CSV file of the export
+type exportTable struct {
+	Name   string
+	Header []string
+	Rows   [][]string
+}
+
+// exportTables lays the export out as one table per kind of data.
+func exportTables(data ExportData) []exportTable {
+	itoa := strconv.Itoa
+
+	patients := exportTable{Name: "patients.csv", Header: []string{"id", "name", "owner", "permission"}}
+	for _, p := range data.Patients {
+		patients.Rows = append(patients.Rows, []string{itoa(p.ID), p.Name, p.Owner, p.Permission})
+	}
+
+	medicines := exportTable{Name: "medicines.csv", Header: []string{"id", "patient_id", "name", "producer", "description", "size", "size_type", "count", "type", "gtin", "ingredients"}}
+	for _, m := range data.Medicines {
+		medicines.Rows = append(medicines.Rows, []string{itoa(m.ID), itoa(m.PatientID), m.Name, m.Producer, m.Description, m.Size, m.SizeType, m.Count, m.Type, m.GTIN, m.Ingredients})
+	}
+
+	entries := exportTable{Name: "entries.csv", Header: []string{"id", "medicine_id", "patient_id", "entry_date", "expire_date", "lot_number", "serial_number"}}
+	for _, e := range data.Entries {
+		entries.Rows = append(entries.Rows, []string{itoa(e.ID), itoa(e.MedicineID), itoa(e.PatientID), e.EntryDate, e.ExpireDate, e.LotNumber, e.SerialNumber})
+	}
+
+	schedules := exportTable{Name: "schedules.csv", Header: []string{"id", "entry_id", "patient_id", "days", "time", "dose_count"}}
+	for _, s := range data.Schedules {
+		schedules.Rows = append(schedules.Rows, []string{itoa(s.ID), itoa(s.EntryID), itoa(s.PatientID), strings.Join(s.Days, " "), s.Time, s.DoseCount})
+	}
+
+	alarms := exportTable{Name: "alarms.csv", Header: []string{"id", "entry_id", "patient_id", "timer", "timer_type", "before_after", "action", "fired_date"}}
+	for _, a := range data.Alarms {
+		alarms.Rows = append(alarms.Rows, []string{itoa(a.ID), itoa(a.EntryID), itoa(a.PatientID), itoa(a.Timer), a.TimerType, a.BeforeAfter, a.Action, a.FiredDate})
+	}
+
+	doses := exportTable{Name: "doses.csv", Header: []string{"id", "schedule_id", "entry_id", "patient_id", "scheduled", "status", "taken_date"}}
+	for _, d := range data.Doses {
+		doses.Rows = append(doses.Rows, []string{itoa(d.ID), itoa(d.ScheduleID), itoa(d.EntryID), itoa(d.PatientID), d.Scheduled, d.Status, d.TakenDate})
+	}
+
+	prescriptions := exportTable{Name: "prescriptions.csv", Header: []string{"id", "patient_id", "prescriber", "pharmacy", "issue_date", "erx_number", "refills_allowed", "refills_used", "valid_days", "scan_type"}}
+	for _, p := range data.Prescriptions {
+		prescriptions.Rows = append(prescriptions.Rows, []string{itoa(p.ID), itoa(p.PatientID), p.Prescriber, p.Pharmacy, p.IssueDate, p.ERxNumber,
+			itoa(p.RefillsAllowed), itoa(p.RefillsUsed), itoa(p.ValidDays), p.ScanType})
+	}
+
+	return []exportTable{patients, medicines, entries, schedules, alarms, doses, prescriptions}
+}
+
+// writeExportCSV writes the export as a zip of CSV files, one per table.
+func writeExportCSV(w io.Writer, data ExportData) error {
+	archive := zip.NewWriter(w)
+
+	for _, table := range exportTables(data) {
+		file, err := archive.CreateHeader(&zip.FileHeader{Name: table.Name, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+
+		writer := csv.NewWriter(file)
+		writer.Write(table.Header)
+		writer.WriteAll(table.Rows)
+		if err = writer.Error(); err != nil {
+			return err
+		}
+	}
+
+	// Prescription scans are files of their own next to the tables
+	for _, p := range data.Prescriptions {
+		if p.Scan == "" {
+			continue
+		}
+
+		content, err := base64.StdEncoding.DecodeString(p.Scan)
+		if err != nil {
+			return err
+		}
+
+		file, err := archive.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("scans/prescription-%d%s", p.ID, scanExtensions[p.ScanType]), Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		if _, err = file.Write(content); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// writeExport writes the export in the format, "json", "csv" or "fhir".
+func writeExport(w io.Writer, format string, data ExportData, locale *Locale) error {
+	switch format {
+	case exportJSON:
+		return writeExportJSON(w, data)
+	case exportCSV:
+		return writeExportCSV(w, data)
+	case exportFHIR:
+		return writeFHIRBundle(w, data, locale)
+	}
+	return fmt.Errorf("unknown export format %q", format)
+}
+
+// exportFileName returns the name an export is downloaded as.
+func exportFileName(format string) string {
+	extension := map[string]string{exportJSON: ".json", exportCSV: ".zip", exportFHIR: ".fhir.json"}[format]
+	return "mws-export-" + time.Now().Format("20060102") + extension
+}
+
+func exportHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, urlLogin, 302)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+
+	format := request.FormValue("format")
+	if format == "" {
+		format = exportJSON
+	}
+
+	contentType, ok := map[string]string{exportJSON: "application/json", exportCSV: "application/zip", exportFHIR: "application/fhir+json"}[format]
+	if !ok {
+		http.Error(response, "Unknown format", http.StatusBadRequest)
+		return
+	}
+
+	patients, _ := getSelectedPatients(request, userID, urlExport)
+
+	data, err := getExportData(userID, patients)
+	if err != nil {
+		serverError(response, request, "exportHandler", err)
+		return
+	}
+
+	response.Header().Set("Content-Type", contentType)
+	response.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFileName(format)))
+
+	if err = writeExport(response, format, data, getLocale(request)); err != nil {
+		requestLogger(request).Error("exportHandler", "format", format, "error", err)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fhirGTINSystem identifies GS1 trade item numbers as a code system
+const fhirGTINSystem = "https://www.gs1.org/gtin"
+
+// fhirDoseStatus maps the status of a logged dose to the one of a MedicationAdministration
+var fhirDoseStatus = map[string]string{
+	doseStatusTaken:   "completed",
+	doseStatusMissed:  "not-done",
+	doseStatusPending: "in-progress",
+	doseStatusSnoozed: "on-hold",
+}
+
+// fhirBundle is an HL7 FHIR R4 Bundle, only with the elements the export fills
+type fhirBundle struct {
+	ResourceType string      `json:"resourceType"`
+	Type         string      `json:"type"`
+	Timestamp    string      `json:"timestamp"`
+	Entry        []fhirEntry `json:"entry"`
+}
+
+type fhirEntry struct {
+	Resource interface{} `json:"resource"`
+}
+
+type fhirCoding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+type fhirCodeableConcept struct {
+	Coding []fhirCoding `json:"coding,omitempty"`
+	Text   string       `json:"text,omitempty"`
+}
+
+type fhirReference struct {
+	Reference string `json:"reference,omitempty"`
+	Display   string `json:"display,omitempty"`
+}
+
+type fhirQuantity struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit,omitempty"`
+}
+
+type fhirPatient struct {
+	ResourceType string          `json:"resourceType"`
+	ID           string          `json:"id"`
+	Name         []fhirHumanName `json:"name"`
+}
+
+type fhirHumanName struct {
+	Text string `json:"text"`
+}
+
+type fhirMedication struct {
+	ResourceType string               `json:"resourceType"`
+	ID           string               `json:"id"`
+	Code         fhirCodeableConcept  `json:"code"`
+	Manufacturer *fhirReference       `json:"manufacturer,omitempty"`
+	Form         *fhirCodeableConcept `json:"form,omitempty"`
+	Ingredient   []fhirIngredient     `json:"ingredient,omitempty"`
+	Batch        *fhirBatch           `json:"batch,omitempty"`
+}
+
+type fhirIngredient struct {
+	ItemCodeableConcept fhirCodeableConcept `json:"itemCodeableConcept"`
+}
+
+type fhirBatch struct {
+	LotNumber      string `json:"lotNumber,omitempty"`
+	ExpirationDate string `json:"expirationDate,omitempty"`
+}
+
+type fhirMedicationStatement struct {
+	ResourceType        string        `json:"resourceType"`
+	ID                  string        `json:"id"`
+	Status              string        `json:"status"`
+	MedicationReference fhirReference `json:"medicationReference"`
+	Subject             fhirReference `json:"subject"`
+	EffectivePeriod     *fhirPeriod   `json:"effectivePeriod,omitempty"`
+	DateAsserted        string        `json:"dateAsserted"`
+	Dosage              []fhirDosage  `json:"dosage,omitempty"`
+}
+
+type fhirPeriod struct {
+	Start string `json:"start,omitempty"`
+}
+
+type fhirDosage struct {
+	Text        string            `json:"text,omitempty"`
+	Timing      fhirTiming        `json:"timing"`
+	DoseAndRate []fhirDoseAndRate `json:"doseAndRate,omitempty"`
+}
+
+type fhirTiming struct {
+	Repeat fhirTimingRepeat `json:"repeat"`
+}
+
+type fhirTimingRepeat struct {
+	DayOfWeek []string `json:"dayOfWeek,omitempty"`
+	TimeOfDay []string `json:"timeOfDay,omitempty"`
+}
+
+type fhirDoseAndRate struct {
+	DoseQuantity fhirQuantity `json:"doseQuantity"`
+}
+
+type fhirMedicationAdministration struct {
+	ResourceType        string                    `json:"resourceType"`
+	ID                  string                    `json:"id"`
+	Status              string                    `json:"status"`
+	MedicationReference fhirReference             `json:"medicationReference"`
+	Subject             fhirReference             `json:"subject"`
+	EffectiveDateTime   string                    `json:"effectiveDateTime"`
+	Dosage              *fhirAdministrationDosage `json:"dosage,omitempty"`
+}
+
+type fhirAdministrationDosage struct {
+	Dose fhirQuantity `json:"dose"`
+}
+
+// add appends a resource to the bundle. Resources refer to each other by type and ID.
+func (b *fhirBundle) add(resource interface{}) {
+	b.Entry = append(b.Entry, fhirEntry{Resource: resource})
+}
+
+// fhirExpired reports if an export date lies before the moment of the export.
+func fhirExpired(date string, exportedAt string) bool {
+	expire, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return false
+	}
+	exported, _ := time.Parse(time.RFC3339, exportedAt)
+	return expire.Before(exported)
+}
+
+// writeFHIRBundle writes the export as an HL7 FHIR R4 collection Bundle: a
+// Patient for every patient, a Medication for every package with its lot and
+// expiry, a MedicationStatement of how it is taken and a MedicationAdministration
+// for every dose of the history. Display texts are in the language of the locale.
+func writeFHIRBundle(w io.Writer, data ExportData, locale *Locale) error {
+	bundle := fhirBundle{ResourceType: "Bundle", Type: "collection", Timestamp: data.ExportedAt, Entry: []fhirEntry{}}
+
+	patients := make(map[int]fhirReference)
+	for _, p := range data.Patients {
+		id := "patient-" + strconv.Itoa(p.ID)
+		patients[p.ID] = fhirReference{Reference: "Patient/" + id, Display: p.Name}
+		bundle.add(fhirPatient{ResourceType: "Patient", ID: id, Name: []fhirHumanName{{Text: p.Name}}})
+	}
+
+	medicines := make(map[int]ExportMedicine)
+	for _, m := range data.Medicines {
+		medicines[m.ID] = m
+	}
+
+	schedules := make(map[int]ExportSchedule)
+	entrySchedules := make(map[int][]ExportSchedule)
+	for _, s := range data.Schedules {
+		schedules[s.ID] = s
+		entrySchedules[s.EntryID] = append(entrySchedules[s.EntryID], s)
+	}
+
+	// Every package is a Medication of its own, as the batch belongs to the Medication
+	entries := make(map[int]fhirReference)
+	forms := make(map[int]string)
+	for _, e := range data.Entries {
+		m := medicines[e.MedicineID]
+		id := "entry-" + strconv.Itoa(e.ID)
+		entries[e.ID] = fhirReference{Reference: "Medication/" + id, Display: m.Name}
+		forms[e.ID] = locale.Option("type", m.Type)
+
+		medication := fhirMedication{ResourceType: "Medication", ID: id, Code: fhirCodeableConcept{Text: m.Name}}
+		if m.GTIN != "" {
+			medication.Code.Coding = []fhirCoding{{System: fhirGTINSystem, Code: m.GTIN, Display: m.Name}}
+		}
+		if m.Producer != "" {
+			medication.Manufacturer = &fhirReference{Display: m.Producer}
+		}
+		if m.Type != "" {
+			medication.Form = &fhirCodeableConcept{Text: locale.Option("type", m.Type)}
+		}
+		for _, ingredient := range strings.FieldsFunc(m.Ingredients, func(r rune) bool { return r == ',' || r == '/' || r == '+' || r == ';' }) {
+			if ingredient = strings.TrimSpace(ingredient); ingredient != "" {
+				medication.Ingredient = append(medication.Ingredient, fhirIngredient{ItemCodeableConcept: fhirCodeableConcept{Text: ingredient}})
+			}
+		}
+		if e.LotNumber != "" || e.ExpireDate != "" {
+			medication.Batch = &fhirBatch{LotNumber: e.LotNumber, ExpirationDate: e.ExpireDate}
+		}
+		bundle.add(medication)
+
+		statement := fhirMedicationStatement{
+			ResourceType:        "MedicationStatement",
+			ID:                  "statement-" + strconv.Itoa(e.ID),
+			Status:              "active",
+			MedicationReference: entries[e.ID],
+			Subject:             patients[e.PatientID],
+			DateAsserted:        data.ExportedAt,
+		}
+		if e.EntryDate != "" {
+			statement.EffectivePeriod = &fhirPeriod{Start: e.EntryDate}
+		}
+		if fhirExpired(e.ExpireDate, data.ExportedAt) {
+			statement.Status = "completed"
+		}
+
+		for _, s := range entrySchedules[e.ID] {
+			count, _ := strconv.ParseFloat(s.DoseCount, 64)
+			dosage := fhirDosage{DoseAndRate: []fhirDoseAndRate{{DoseQuantity: fhirQuantity{Value: count, Unit: forms[e.ID]}}}}
+
+			var days []string
+			for _, day := range s.Days {
+				for i, column := range weekdayColumns {
+					if column == day {
+						days = append(days, locale.T(weekdayKeys[i]))
+					}
+				}
+			}
+
+			dosage.Timing.Repeat.DayOfWeek = s.Days
+			if s.Time != "" {
+				dosage.Timing.Repeat.TimeOfDay = []string{s.Time + ":00"}
+			}
+			dosage.Text = locale.T("export.dosage", locale.FormatNumber(count), forms[e.ID], strings.Join(days, ", "), s.Time)
+
+			statement.Dosage = append(statement.Dosage, dosage)
+		}
+		bundle.add(statement)
+	}
+
+	for _, d := range data.Doses {
+		administration := fhirMedicationAdministration{
+			ResourceType:        "MedicationAdministration",
+			ID:                  "dose-" + strconv.Itoa(d.ID),
+			Status:              fhirDoseStatus[d.Status],
+			MedicationReference: entries[d.EntryID],
+			Subject:             patients[d.PatientID],
+			EffectiveDateTime:   d.Scheduled,
+		}
+		if administration.Status == "" {
+			administration.Status = "unknown"
+		}
+		if d.TakenDate != "" {
+			administration.EffectiveDateTime = d.TakenDate
+		}
+		if s, ok := schedules[d.ScheduleID]; ok {
+			count, _ := strconv.ParseFloat(s.DoseCount, 64)
+			administration.Dosage = &fhirAdministrationDosage{Dose: fhirQuantity{Value: count, Unit: forms[d.EntryID]}}
+		}
+		bundle.add(administration)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(bundle)
+}
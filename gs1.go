@@ -0,0 +1,278 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gs1GroupSeparator is the ASCII GS character scanners emit for FNC1
+const gs1GroupSeparator = "\x1d"
+
+// GS1Data holds the element strings we use from a pack's GS1 DataMatrix
+type GS1Data struct {
+	GTIN      string
+	Lot       string
+	Serial    string
+	Expiry    time.Time
+	HasExpiry bool
+}
+
+// gs1AI describes how the data following an application identifier is laid out
+type gs1AI struct {
+	Length   int
+	Variable bool
+}
+
+// gs1AIs holds the application identifiers found on medicine packs.
+// Variable length entries use Length as their maximum length.
+var gs1AIs = map[string]gs1AI{
+	"00":   {Length: 18},
+	"01":   {Length: 14},
+	"02":   {Length: 14},
+	"10":   {Length: 20, Variable: true},
+	"11":   {Length: 6},
+	"12":   {Length: 6},
+	"13":   {Length: 6},
+	"15":   {Length: 6},
+	"16":   {Length: 6},
+	"17":   {Length: 6},
+	"20":   {Length: 2},
+	"21":   {Length: 20, Variable: true},
+	"22":   {Length: 20, Variable: true},
+	"240":  {Length: 30, Variable: true},
+	"241":  {Length: 30, Variable: true},
+	"30":   {Length: 8, Variable: true},
+	"710":  {Length: 20, Variable: true},
+	"711":  {Length: 20, Variable: true},
+	"712":  {Length: 20, Variable: true},
+	"713":  {Length: 20, Variable: true},
+	"714":  {Length: 20, Variable: true},
+	"7003": {Length: 10},
+}
+
+var gs1BracketRegex = regexp.MustCompile(`\((\d{2,4})\)([^(]*)`)
+
+// parseGS1 parses a GS1 element string, either raw as read by a scanner
+// (FNC1 as the GS character) or in the human readable "(01)...(17)..." form.
+func parseGS1(code string) (data GS1Data, err error) {
+	code = strings.TrimSpace(code)
+
+	// Drop the symbology identifier some scanners prefix, e.g. "]d2" for DataMatrix
+	if len(code) >= 3 && code[0] == ']' {
+		code = code[3:]
+	}
+
+	code = strings.TrimPrefix(code, gs1GroupSeparator)
+
+	if code == "" {
+		return data, errors.New("empty code")
+	}
+
+	var elements [][2]string
+
+	if strings.HasPrefix(code, "(") {
+		for _, match := range gs1BracketRegex.FindAllStringSubmatch(code, -1) {
+			elements = append(elements, [2]string{match[1], strings.TrimSpace(match[2])})
+		}
+
+		if len(elements) == 0 {
+			return data, errors.New("no application identifiers found")
+		}
+	} else {
+		elements, err = splitGS1(code)
+		if err != nil {
+			return data, err
+		}
+	}
+
+	for _, element := range elements {
+		ai, value := element[0], element[1]
+
+		spec, ok := gs1AIs[ai]
+		if !ok {
+			return data, fmt.Errorf("unknown application identifier (%s)", ai)
+		}
+
+		if (spec.Variable && len(value) > spec.Length) || (!spec.Variable && len(value) != spec.Length) || value == "" {
+			return data, fmt.Errorf("invalid length for (%s)", ai)
+		}
+
+		switch ai {
+		case "01":
+			if !isGTINValid(value) {
+				return data, fmt.Errorf("invalid GTIN check digit (%s)", value)
+			}
+			data.GTIN = value
+		case "10":
+			data.Lot = value
+		case "21":
+			data.Serial = value
+		case "17":
+			data.Expiry, err = parseGS1Date(value)
+			if err != nil {
+				return data, err
+			}
+			data.HasExpiry = true
+		}
+	}
+
+	return data, nil
+}
+
+// splitGS1 splits a raw element string into its application identifiers and values.
+func splitGS1(code string) (elements [][2]string, err error) {
+	for code != "" {
+		var ai string
+
+		for _, size := range []int{2, 3, 4} {
+			if len(code) >= size {
+				if _, ok := gs1AIs[code[:size]]; ok {
+					ai = code[:size]
+					break
+				}
+			}
+		}
+
+		if ai == "" {
+			return nil, fmt.Errorf("unknown application identifier at %q", code)
+		}
+
+		spec := gs1AIs[ai]
+		code = code[len(ai):]
+
+		var value string
+
+		if spec.Variable {
+			end := strings.Index(code, gs1GroupSeparator)
+			if end < 0 {
+				end = len(code)
+			}
+			value = code[:end]
+			code = strings.TrimPrefix(code[end:], gs1GroupSeparator)
+		} else {
+			if len(code) < spec.Length {
+				return nil, fmt.Errorf("truncated value for (%s)", ai)
+			}
+			value = code[:spec.Length]
+			code = strings.TrimPrefix(code[spec.Length:], gs1GroupSeparator)
+		}
+
+		elements = append(elements, [2]string{ai, value})
+	}
+
+	return elements, nil
+}
+
+// isGTINValid checks the modulo 10 check digit of a GTIN.
+func isGTINValid(gtin string) bool {
+	if len(gtin) != 8 && len(gtin) != 12 && len(gtin) != 13 && len(gtin) != 14 {
+		return false
+	}
+
+	sum := 0
+	for i := len(gtin) - 2; i >= 0; i-- {
+		digit := int(gtin[i] - '0')
+		if digit < 0 || digit > 9 {
+			return false
+		}
+
+		if (len(gtin)-2-i)%2 == 0 {
+			digit *= 3
+		}
+		sum += digit
+	}
+
+	return int(gtin[len(gtin)-1]-'0') == (10-sum%10)%10
+}
+
+// parseGS1Date turns a YYMMDD value into a date. A day of "00" stands for the
+// last day of the month and the century follows the GS1 sliding window.
+func parseGS1Date(value string) (date time.Time, err error) {
+	yy, err := strconv.Atoi(value[0:2])
+	if err != nil {
+		return date, fmt.Errorf("invalid date (%s)", value)
+	}
+
+	month, err := strconv.Atoi(value[2:4])
+	if err != nil || month < 1 || month > 12 {
+		return date, fmt.Errorf("invalid date (%s)", value)
+	}
+
+	day, err := strconv.Atoi(value[4:6])
+	if err != nil || day > 31 {
+		return date, fmt.Errorf("invalid date (%s)", value)
+	}
+
+	currentYear := time.Now().UTC().Year()
+	year := currentYear - currentYear%100 + yy
+
+	if diff := yy - currentYear%100; diff >= 51 {
+		year -= 100
+	} else if diff <= -50 {
+		year += 100
+	}
+
+	if day == 0 {
+		// Day zero of the next month is the last day of this month
+		return time.Date(year, time.Month(month)+1, 0, 0, 0, 0, 0, time.UTC), nil
+	}
+
+	date = time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if date.Day() != day {
+		return date, fmt.Errorf("invalid date (%s)", value)
+	}
+
+	return date, nil
+}
+
+// getMedicineFormFromGTIN fills the medicine fields of the add form from the
+// last box with the same GTIN the user has added.
+func getMedicineFormFromGTIN(userID int, gtin string, form *AddFormData) bool {
+	var producer, description, ingredients, size, sizeType, medCount, medType sql.NullString
+	var openDays sql.NullInt64
+
+	result := db.QueryRow("SELECT name, producer, description, ingredients, size, size_type, med_count, type, open_days FROM medicine WHERE user_id=$1 AND gtin=$2 ORDER BY medicine_id DESC LIMIT 1", userID, gtin)
+	err := result.Scan(&form.Name, &producer, &description, &ingredients, &size, &sizeType, &medCount, &medType, &openDays)
+
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logger.Error("getMedicineFormFromGTIN", "gtin", gtin, "error", err)
+		}
+		return false
+	}
+
+	form.Producer = producer.String
+	form.Description = description.String
+	form.Ingredients = ingredients.String
+	form.Size = size.String
+	form.SizeType = sizeType.String
+	form.Count = medCount.String
+	form.Type = medType.String
+	if openDays.Valid {
+		form.OpenDays = strconv.FormatInt(openDays.Int64, 10)
+	} else if days := getDrugDatabase().openDays(form.Name, form.Ingredients); days != 0 {
+		form.OpenDays = strconv.Itoa(days)
+	}
+
+	return true
+}
+
+func scanHandler(response http.ResponseWriter, request *http.Request) {
+	// Check login status
+	if getUserName(request) == "" {
+		http.Redirect(response, request, urlHello, 302)
+		return
+	}
+
+	err := renderTemplate(response, request, tmplScan, nil)
+
+	if err != nil {
+		return
+	}
+}
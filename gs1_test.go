@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIsGTINValid(t *testing.T) {
+	tests := []struct {
+		gtin string
+		want bool
+	}{
+		{"08699536090030", true},
+		{"8699536090030", true},
+		{"04006381333931", true},
+		{"86800013", true},
+		{"08699536090031", false},
+		{"0869953609003X", false},
+		{"0869953609003", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if got := isGTINValid(test.gtin); got != test.want {
+			t.Errorf("isGTINValid(%q) = %v, want %v", test.gtin, got, test.want)
+		}
+	}
+}
+
+func TestParseGS1Date(t *testing.T) {
+	// The century follows the sliding window around the current year
+	yy := time.Now().UTC().Year() % 100
+	century := time.Now().UTC().Year() - yy
+
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"251231", time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC)},
+		{fmt.Sprintf("%02d0615", yy), time.Date(century+yy, 6, 15, 0, 0, 0, 0, time.UTC)},
+		{fmt.Sprintf("%02d0101", (yy+50)%100), time.Date(century+yy+50, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{fmt.Sprintf("%02d0101", (yy+51)%100), time.Date(century+yy+51-100, 1, 1, 0, 0, 0, 0, time.UTC)},
+
+		// A day of "00" is the last day of the month
+		{"250200", time.Date(2025, 2, 28, 0, 0, 0, 0, time.UTC)},
+		{"280200", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"251200", time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		got, err := parseGS1Date(test.value)
+		if err != nil {
+			t.Errorf("parseGS1Date(%q) failed: %s", test.value, err)
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("parseGS1Date(%q) = %s, want %s", test.value, got.Format("2006-01-02"), test.want.Format("2006-01-02"))
+		}
+	}
+
+	for _, value := range []string{"251301", "250001", "250132", "250231", "2x0101"} {
+		if _, err := parseGS1Date(value); err == nil {
+			t.Errorf("parseGS1Date(%q) did not fail", value)
+		}
+	}
+}
+
+func TestSplitGS1(t *testing.T) {
+	tests := []struct {
+		code string
+		want [][2]string
+	}{
+		{"010869953609003017251231", [][2]string{{"01", "08699536090030"}, {"17", "251231"}}},
+		{"0108699536090030" + "10AB12" + gs1GroupSeparator + "17251231", [][2]string{{"01", "08699536090030"}, {"10", "AB12"}, {"17", "251231"}}},
+		{"0108699536090030" + "21SN1" + gs1GroupSeparator + "10LOT", [][2]string{{"01", "08699536090030"}, {"21", "SN1"}, {"10", "LOT"}}},
+		{"0108699536090030" + gs1GroupSeparator + "17251231", [][2]string{{"01", "08699536090030"}, {"17", "251231"}}},
+		{"7003250101123010LOT", [][2]string{{"7003", "2501011230"}, {"10", "LOT"}}},
+	}
+
+	for _, test := range tests {
+		got, err := splitGS1(test.code)
+		if err != nil {
+			t.Errorf("splitGS1(%q) failed: %s", test.code, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitGS1(%q) = %v, want %v", test.code, got, test.want)
+		}
+	}
+
+	for _, code := range []string{"99123", "010869953609", "17"} {
+		if _, err := splitGS1(code); err == nil {
+			t.Errorf("splitGS1(%q) did not fail", code)
+		}
+	}
+}
+
+func TestParseGS1(t *testing.T) {
+	expiry := time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		code string
+		want GS1Data
+	}{
+		{"0108699536090030" + "17251231" + "10LOT1" + gs1GroupSeparator + "21SN1", GS1Data{GTIN: "08699536090030", Lot: "LOT1", Serial: "SN1", Expiry: expiry, HasExpiry: true}},
+
+		// Symbology identifier and leading FNC1 as scanners send them
+		{"]d2" + "0108699536090030" + "21SN1" + gs1GroupSeparator + "17251231", GS1Data{GTIN: "08699536090030", Serial: "SN1", Expiry: expiry, HasExpiry: true}},
+		{"]d2" + gs1GroupSeparator + "0108699536090030" + "10LOT1", GS1Data{GTIN: "08699536090030", Lot: "LOT1"}},
+		{gs1GroupSeparator + "0108699536090030", GS1Data{GTIN: "08699536090030"}},
+
+		// Human readable form
+		{"(01)08699536090030(17)251200(10)LOT1", GS1Data{GTIN: "08699536090030", Lot: "LOT1", Expiry: expiry, HasExpiry: true}},
+		{"  (01)08699536090030 (21)SN1  ", GS1Data{GTIN: "08699536090030", Serial: "SN1"}},
+	}
+
+	for _, test := range tests {
+		got, err := parseGS1(test.code)
+		if err != nil {
+			t.Errorf("parseGS1(%q) failed: %s", test.code, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseGS1(%q) = %+v, want %+v", test.code, got, test.want)
+		}
+	}
+
+	for _, code := range []string{
+		"",
+		"]d2",
+		"0108699536090031",
+		"(01)08699536090030(99)X",
+		"(17)251301",
+		"(10)" + "LOT456789012345678901",
+		"no identifiers",
+	} {
+		if _, err := parseGS1(code); err == nil {
+			t.Errorf("parseGS1(%q) did not fail", code)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// healthHandler tells that the process is up and serving requests.
+func healthHandler(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	response.Write([]byte("ok\n"))
+}
+
+// readyHandler tells if the server can do its work: the database answers,
+// every migration is applied, the scheduler is running and the blob store
+// can be reached.
+func readyHandler(response http.ResponseWriter, request *http.Request) {
+	checks := map[string]error{
+		"database":   checkDatabase(request),
+		"migrations": checkMigrations(),
+		"scheduler":  checkScheduler(),
+		"blobs":      blobs.Check(),
+	}
+
+	var names []string
+	status := http.StatusOK
+
+	for name, err := range checks {
+		names = append(names, name)
+		if err != nil {
+			status = http.StatusServiceUnavailable
+			requestLogger(request).Warn("readyHandler", "check", name, "error", err)
+		}
+	}
+	sort.Strings(names)
+
+	response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	response.WriteHeader(status)
+
+	for _, name := range names {
+		if checks[name] != nil {
+			fmt.Fprintf(response, "%s: %s\n", name, checks[name])
+		} else {
+			fmt.Fprintf(response, "%s: ok\n", name)
+		}
+	}
+}
+
+func checkDatabase(request *http.Request) error {
+	return db.PingContext(request.Context())
+}
+
+// checkMigrations reports if the database is at the version of the last migration.
+func checkMigrations() error {
+	var version int
+
+	if err := db.QueryRow("SELECT IFNULL(MAX(version),0) FROM schema_migrations").Scan(&version); err != nil {
+		return err
+	}
+
+	if latest := migrations[len(migrations)-1].Version; version < latest {
+		return fmt.Errorf("at version %d of %d", version, latest)
+	}
+
+	return nil
+}
+
+func checkScheduler() error {
+	if !schedulerAlive() {
+		return fmt.Errorf("no run in the last %s", schedulerStale)
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// localeCookie remembers the language picked in the header for visitors who are not logged in
+const localeCookie = "lang"
+
+// Locale holds the message catalog of one language
+type Locale struct {
+	Code     string
+	Messages map[string]string
+}
+
+var locales = make(map[string]*Locale)
+
+// loadLocales reads every message catalog in the directory, one <code>.json file per language.
+func loadLocales(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		locale := &Locale{Code: strings.TrimSuffix(filepath.Base(file), ".json")}
+		if err = json.Unmarshal(content, &locale.Messages); err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+
+		locales[locale.Code] = locale
+	}
+
+	if _, ok := locales[config.Locale]; !ok {
+		return fmt.Errorf("no message catalog for the default locale %q", config.Locale)
+	}
+
+	return nil
+}
+
+// getLocaleByCode returns the catalog of the language or the default one.
+func getLocaleByCode(code string) *Locale {
+	if locale, ok := locales[code]; ok {
+		return locale
+	}
+	return locales[config.Locale]
+}
+
+// localeCodes returns the codes of every loaded language.
+func localeCodes() (codes []string) {
+	for code := range locales {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// T returns the message of the key, formatted with the arguments if there are any.
+// Missing messages fall back to the default language and then to the key itself.
+func (l *Locale) T(key string, args ...interface{}) string {
+	message, ok := l.Messages[key]
+	if !ok {
+		if message, ok = locales[config.Locale].Messages[key]; !ok {
+			message = key
+		}
+	}
+
+	if len(args) > 0 {
+		return fmt.Sprintf(message, args...)
+	}
+	return message
+}
+
+// Option returns the display name of a stored option code, e.g. "day" of the "timer" group.
+func (l *Locale) Option(group string, code string) string {
+	key := "option." + group + "." + code
+	if message := l.T(key); message != key {
+		return message
+	}
+	return code
+}
+
+// FormatNumber writes the number with the language's decimal separator and
+// without trailing zeros. Values which are not numbers are returned unchanged.
+func (l *Locale) FormatNumber(value interface{}) string {
+	var number float64
+
+	switch v := value.(type) {
+	case float64:
+		number = v
+	case int:
+		number = float64(v)
+	case string:
+		parsed, err := strconv.ParseFloat(strings.Replace(strings.TrimSpace(v), ",", ".", 1), 64)
+		if err != nil {
+			return v
+		}
+		number = parsed
+	default:
+		return fmt.Sprint(value)
+	}
+
+	return strings.Replace(strconv.FormatFloat(number, 'f', -1, 64), ".", l.T("format.decimal"), 1)
+}
+
+// FormatDateTime writes a date and time the way the language does.
+func (l *Locale) FormatDateTime(date time.Time) string {
+	return date.Format(l.T("format.datetime"))
+}
+
+// FormatDate writes a date without the time the way the language does.
+func (l *Locale) FormatDate(date time.Time) string {
+	return date.Format(l.T("format.date"))
+}
+
+// ParseDateTime reads a date and time entered in a form, in the language's
+// layout or in the day/month/year one the forms always accepted.
+func (l *Locale) ParseDateTime(value string, location *time.Location) (time.Time, error) {
+	date, err := time.ParseInLocation(l.T("format.datetime"), value, location)
+	if err != nil {
+		return time.ParseInLocation("02/01/2006 15:04", value, location)
+	}
+	return date, nil
+}
+
+// ParseDate reads a date entered in a form like ParseDateTime does.
+func (l *Locale) ParseDate(value string) (time.Time, error) {
+	date, err := time.Parse(l.T("format.date"), value)
+	if err != nil {
+		return time.Parse("02/01/2006", value)
+	}
+	return date, nil
+}
+
+// negotiateLocale picks the best supported language of an Accept-Language header.
+func negotiateLocale(header string) (code string, ok bool) {
+	best := 0.0
+
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		quality := 1.0
+
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+
+		// Regional variants like tr-TR use the catalog of their language
+		if i := strings.Index(tag, "-"); i > 0 {
+			tag = tag[:i]
+		}
+
+		if _, supported := locales[tag]; supported && quality > best {
+			code, best, ok = tag, quality, true
+		}
+	}
+
+	return code, ok
+}
+
+// getUserLocale returns the language the user picked, or "" if they did not.
+func getUserLocale(userID int) string {
+	var code string
+
+	db.QueryRow("SELECT IFNULL(locale,'') FROM users WHERE user_id=$1", userID).Scan(&code)
+
+	return code
+}
+
+// getLocale returns the language of a request: the user's preference, the
+// language picked in the header, the browser's languages and then the default.
+func getLocale(request *http.Request) *Locale {
+	if userName := getUserName(request); userName != "" {
+		if locale, ok := locales[getUserLocale(getUserID(userName))]; ok {
+			return locale
+		}
+	}
+
+	if cookie, err := request.Cookie(localeCookie); err == nil {
+		if locale, ok := locales[cookie.Value]; ok {
+			return locale
+		}
+	}
+
+	if code, ok := negotiateLocale(request.Header.Get("Accept-Language")); ok {
+		return locales[code]
+	}
+
+	return locales[config.Locale]
+}
+
+// getRecipientLocale returns the language notifications to the user are written in.
+func getRecipientLocale(userID int) *Locale {
+	return getLocaleByCode(getUserLocale(userID))
+}
+
+// localeFuncs returns the template functions writing text in the language.
+func localeFuncs(locale *Locale) template.FuncMap {
+	return template.FuncMap{
+		"t":       locale.T,
+		"option":  locale.Option,
+		"number":  locale.FormatNumber,
+		"locale":  func() string { return locale.Code },
+		"locales": localeCodes,
+	}
+}
+
+// parseTemplate parses a page with the shared parts. The functions are bound
+// to the language of each request when the page is rendered.
+func parseTemplate(name string) *template.Template {
+	return template.Must(template.New(filepath.Base(name)).Funcs(localeFuncs(&Locale{})).ParseFiles(name, tmplParts))
+}
+
+// renderTemplate writes the page in the language of the request.
+func renderTemplate(response http.ResponseWriter, request *http.Request, name string, data interface{}) error {
+	page, err := tmpl[name].Clone()
+	if err != nil {
+		return err
+	}
+
+	return page.Funcs(localeFuncs(getLocale(request))).Execute(response, data)
+}
+
+func localeHandler(response http.ResponseWriter, request *http.Request) {
+	code := mux.Vars(request)["code"]
+
+	if _, ok := locales[code]; !ok {
+		http.NotFound(response, request)
+		return
+	}
+
+	http.SetCookie(response, &http.Cookie{Name: localeCookie, Value: code, Path: "/", MaxAge: 365 * 24 * 60 * 60})
+
+	// The choice is kept with the account too
+	if userName := getUserName(request); userName != "" {
+		if _, err := db.Exec("UPDATE users SET locale=$1 WHERE user_id=$2", code, getUserID(userName)); err != nil {
+			requestLogger(request).Error("localeHandler", "error", err)
+		}
+	}
+
+	// Go back to the page the language was picked on
+	target := "/"
+	if referer, err := url.Parse(request.Referer()); err == nil && referer.Host == request.Host && referer.Path != "" {
+		target = referer.RequestURI()
+	}
+
+	http.Redirect(response, request, target, 302)
+}
+
+// optionCodes maps the display strings older versions stored, in either
+// language, to the stable codes options are kept as now
+var optionCodes = map[string]map[string]string{
+	"size": {
+		"mg (Miligram)": "mg", "mg (Milligram)": "mg",
+		"ml (Mililitre)": "ml", "ml (Milliliter)": "ml",
+	},
+	"type": {
+		"Tablet": "tablet",
+		"Syrup":  "syrup", "Şurup": "syrup",
+		"Spray": "spray", "Sprey": "spray",
+		"Capsule": "capsule", "Kapsül": "capsule",
+	},
+	"timer": {
+		"Day": "day", "Gün": "day",
+		"Week": "week", "Hafta": "week",
+		"Month": "month", "Ay": "month",
+		"Year": "year", "Yıl": "year",
+	},
+	"when": {
+		"Before": "before", "Önce": "before",
+		"After": "after", "Sonra": "after",
+	},
+	"action": {
+		"Alarm":       "alarm",
+		"Auto-delete": "delete", "Otomatik sil": "delete",
+	},
+	"storage": {
+		"No special storage": "none", "Özel saklama yok": "none",
+		"Below 25 °C": "below25", "25 °C altında": "below25",
+		"Refrigerated": "refrigerated", "Buzdolabında": "refrigerated",
+	},
+}
+
+// normalizeOption returns the stable code of an option value. Codes are
+// returned unchanged, unknown values as they are.
+func normalizeOption(group string, value string) string {
+	if code, ok := optionCodes[group][strings.TrimSpace(value)]; ok {
+		return code
+	}
+	return value
+}
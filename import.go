@@ -0,0 +1,635 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// importMaxSize limits the size of an uploaded file
+	importMaxSize = 2 << 20
+	// importPreviewRows is how many rows the column mapping step shows
+	importPreviewRows = 5
+
+	importCreated = "created"
+	importSkipped = "skipped"
+	importFailed  = "failed"
+)
+
+// importFields holds the fields CSV columns can be mapped to, in the order of the mapping form
+var importFields = []string{
+	"name", "producer", "expire_date", "size", "size_type", "count", "type", "description", "ingredients",
+	"gtin", "lot_number", "serial_number", "days", "time", "dose_count", "timer", "timer_type", "before_after", "action",
+}
+
+// importDefaults holds what fields without a column are filled with, the presets of the add form
+var importDefaults = map[string]string{
+	"size_type":    "mg",
+	"type":         "tablet",
+	"dose_count":   "1",
+	"timer":        "30",
+	"timer_type":   "day",
+	"before_after": "before",
+	"action":       "alarm",
+}
+
+// ImportPageData holds all data of the import page, in one of its steps
+type ImportPageData struct {
+	Patients  []Patient
+	PatientID int
+	Error     string
+	Preview   *ImportPreview
+	Report    *ImportReport
+}
+
+// ImportPreview holds an uploaded CSV file waiting for its columns to be mapped
+type ImportPreview struct {
+	Content  string
+	Header   []string
+	Rows     [][]string
+	Total    int
+	Mappings []ImportMapping
+}
+
+// ImportMapping holds the column a field is read from, -1 for none, and the value used without one
+type ImportMapping struct {
+	Field   string
+	Column  int
+	Default string
+}
+
+// ImportReport holds the outcome of an import
+type ImportReport struct {
+	Created int
+	Skipped int
+	Failed  int
+	Rows    []ImportRow
+}
+
+// ImportRow holds a row of the import which was not created and why
+type ImportRow struct {
+	Line    int
+	Name    string
+	Result  string
+	Message string
+}
+
+// add counts a row and keeps it for the report unless it was created.
+func (r *ImportReport) add(line int, name string, result string, message string) {
+	switch result {
+	case importCreated:
+		r.Created++
+		return
+	case importSkipped:
+		r.Skipped++
+	case importFailed:
+		r.Failed++
+	}
+	r.Rows = append(r.Rows, ImportRow{Line: line, Name: name, Result: result, Message: message})
+}
+
+// importItem holds a medicine read from a file and the line it was read from
+type importItem struct {
+	Line      int
+	Input     MedicineInput
+	Empty     bool
+	Err       error
+	EntryDate time.Time
+}
+
+// parseCSV reads a CSV file as spreadsheets save it, with commas, semicolons or tabs.
+func parseCSV(content string) ([][]string, error) {
+	content = strings.TrimPrefix(content, "\ufeff")
+
+	firstLine := content
+	if i := strings.IndexAny(content, "\r\n"); i >= 0 {
+		firstLine = content[:i]
+	}
+
+	reader := csv.NewReader(strings.NewReader(content))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+
+	// The separator used most in the header is the one of the file
+	for _, separator := range []rune{';', '\t'} {
+		if strings.Count(firstLine, string(separator)) > strings.Count(firstLine, string(reader.Comma)) {
+			reader.Comma = separator
+		}
+	}
+
+	return reader.ReadAll()
+}
+
+// importFieldNames returns the names a header can give a field, in every language.
+func importFieldNames(field string) []string {
+	names := []string{field, strings.Replace(field, "_", " ", -1)}
+	for _, locale := range locales {
+		names = append(names, strings.ToLower(locale.T("field."+field)))
+	}
+	return names
+}
+
+// guessMappings maps every field to the column with a matching header.
+func guessMappings(header []string) (mappings []ImportMapping) {
+	for _, field := range importFields {
+		mapping := ImportMapping{Field: field, Column: -1, Default: importDefaults[field]}
+
+		for i, title := range header {
+			title = strings.ToLower(strings.TrimSpace(title))
+			for _, name := range importFieldNames(field) {
+				if title == name && mapping.Column < 0 {
+					mapping.Column = i
+				}
+			}
+		}
+
+		mappings = append(mappings, mapping)
+	}
+	return mappings
+}
+
+// getImportMappings reads the mapping form.
+func getImportMappings(request *http.Request) (mappings []ImportMapping) {
+	for _, field := range importFields {
+		column, err := strconv.Atoi(request.FormValue("column_" + field))
+		if err != nil {
+			column = -1
+		}
+		mappings = append(mappings, ImportMapping{Field: field, Column: column, Default: request.FormValue("default_" + field)})
+	}
+	return mappings
+}
+
+// parseImportOption returns the code of an option written as a code, in an
+// older stored form or as its name in any language.
+func parseImportOption(group string, value string) string {
+	value = normalizeOption(group, value)
+	if isOptionCode(group, value) {
+		return value
+	}
+
+	for _, code := range optionCodes[group] {
+		for _, locale := range locales {
+			if strings.EqualFold(value, code) || strings.EqualFold(value, locale.Option(group, code)) {
+				return code
+			}
+		}
+	}
+	return value
+}
+
+// parseImportDays reads weekdays written as codes like "mon" or as names in any
+// language, separated by commas or spaces. No days at all means every day.
+func parseImportDays(value string) (days [7]string, ok bool) {
+	words := strings.FieldsFunc(strings.ToLower(value), func(r rune) bool { return !unicode.IsLetter(r) })
+	if len(words) == 0 {
+		return [7]string{"on", "on", "on", "on", "on", "on", "on"}, true
+	}
+
+	for _, word := range words {
+		found := false
+
+		for i, column := range weekdayColumns {
+			names := []string{column}
+			for _, locale := range locales {
+				names = append(names, strings.ToLower(locale.T(weekdayKeys[i])))
+			}
+
+			for _, name := range names {
+				if word == name || (len([]rune(word)) >= 3 && strings.HasPrefix(name, word)) {
+					days[i], found = "on", true
+				}
+			}
+		}
+
+		if !found {
+			return days, false
+		}
+	}
+
+	return days, true
+}
+
+// csvImportItems turns the rows of a CSV file into medicines with the mapping.
+func csvImportItems(records [][]string, mappings []ImportMapping) (items []importItem) {
+	for i, record := range records {
+		value := func(field string) string {
+			for _, mapping := range mappings {
+				if mapping.Field != field {
+					continue
+				}
+				if mapping.Column >= 0 && mapping.Column < len(record) && strings.TrimSpace(record[mapping.Column]) != "" {
+					return strings.TrimSpace(record[mapping.Column])
+				}
+				return strings.TrimSpace(mapping.Default)
+			}
+			return ""
+		}
+
+		item := importItem{Line: i + 2, EntryDate: time.Now()}
+		item.Input = MedicineInput{
+			Name:        value("name"),
+			Producer:    value("producer"),
+			ExpDate:     value("expire_date"),
+			Count:       "1",
+			Description: value("description"),
+			Ingredients: value("ingredients"),
+			Size:        value("size"),
+			SizeType:    parseImportOption("size", value("size_type")),
+			MedCount:    value("count"),
+			Type:        parseImportOption("type", value("type")),
+			GTIN:        value("gtin"),
+			Lot:         value("lot_number"),
+			Serial:      value("serial_number"),
+			AlarmName:   "import",
+			AlarmTimer:  value("timer"),
+			AlarmType:   parseImportOption("timer", value("timer_type")),
+			AlarmWhen:   parseImportOption("when", value("before_after")),
+			AlarmAction: parseImportOption("action", value("action")),
+			Time:        value("time"),
+			DoseCount:   value("dose_count"),
+		}
+
+		// Rows without anything in them are left out, like the blank lines spreadsheets end with
+		item.Empty = strings.TrimSpace(strings.Join(record, "")) == ""
+
+		var ok bool
+		if item.Input.Days, ok = parseImportDays(value("days")); !ok {
+			item.Err = InputError{Key: "input.error.option", Field: "days"}
+		}
+
+		items = append(items, item)
+	}
+
+	return items
+}
+
+// importErrorMessage returns why a row could not be imported in the language of the locale.
+func importErrorMessage(err error, locale *Locale) string {
+	if inputErr, ok := err.(InputError); ok {
+		return inputErr.Message(locale)
+	}
+	return err.Error()
+}
+
+// isDuplicateEntry reports if the patient already has a package of the medicine with the expiry and lot.
+func isDuplicateEntry(tx *sql.Tx, patientID int, m MedicineInput) (bool, error) {
+	// Names are sealed, so they are compared once read
+	row, err := tx.Query(`SELECT m.name FROM entries e JOIN medicine m ON m.medicine_id = e.medicine_id
+		WHERE e.patient_id=$1 AND e.expire_at=$2 AND IFNULL(e.lot_number,'')=$3`,
+		patientID, toEpoch(m.Expire), m.Lot)
+	if err != nil {
+		return false, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var name string
+
+		if err = row.Scan(&name); err != nil {
+			return false, err
+		}
+
+		if name == m.Name {
+			return true, nil
+		}
+	}
+
+	return false, row.Err()
+}
+
+// importMedicines validates every item with the rules of the add form and
+// creates the valid ones for the patient in one transaction, as made by the
+// actor. Packages the patient already has are skipped, so an import can be
+// repeated.
+func importMedicines(actor Actor, patient Patient, items []importItem, locale *Locale, location *time.Location) (report ImportReport, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return report, err
+	}
+
+	for _, item := range items {
+		if item.Empty {
+			report.add(item.Line, "", importSkipped, locale.T("import.skipped.empty"))
+			continue
+		}
+
+		if item.Err == nil {
+			item.Err = item.Input.validate(locale, location)
+		}
+		if item.Err != nil {
+			report.add(item.Line, item.Input.Name, importFailed, importErrorMessage(item.Err, locale))
+			continue
+		}
+
+		duplicate, err := isDuplicateEntry(tx, patient.ID, item.Input)
+		if err != nil {
+			tx.Rollback()
+			return report, err
+		}
+		if duplicate {
+			report.add(item.Line, item.Input.Name, importSkipped, locale.T("import.skipped.duplicate"))
+			continue
+		}
+
+		if _, _, err = insertMedicine(tx, actor, patient.OwnerID, patient.ID, item.Input, item.EntryDate); err != nil {
+			tx.Rollback()
+			return report, err
+		}
+		report.add(item.Line, item.Input.Name, importCreated, "")
+	}
+
+	return report, tx.Commit()
+}
+
+// restoreExport creates the packages of an export of this application with
+// their alarms, schedules and dose history. Patients are matched by name with
+// the ones the user manages and created under the user's account if missing.
+func restoreExport(actor Actor, userID int, data ExportData, locale *Locale, location *time.Location) (report ImportReport, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return report, err
+	}
+
+	managed := make(map[string]Patient)
+	for _, patient := range getManagedPatients(userID) {
+		managed[patient.Name] = patient
+	}
+
+	patients := make(map[int]Patient)
+	for _, p := range data.Patients {
+		patient, ok := managed[p.Name]
+		if !ok {
+			patientID, err := createPatient(tx, userID, p.Name)
+			if err != nil {
+				tx.Rollback()
+				return report, err
+			}
+			patient = Patient{ID: int(patientID), OwnerID: userID, Name: p.Name, Permission: permissionOwner}
+			managed[p.Name] = patient
+		}
+		patients[p.ID] = patient
+	}
+
+	medicines := make(map[int]ExportMedicine)
+	for _, m := range data.Medicines {
+		medicines[m.ID] = m
+	}
+
+	// The application keeps one alarm and one schedule per package
+	alarms := make(map[int]ExportAlarm)
+	for _, a := range data.Alarms {
+		if _, ok := alarms[a.EntryID]; !ok {
+			alarms[a.EntryID] = a
+		}
+	}
+	schedules := make(map[int]ExportSchedule)
+	for _, s := range data.Schedules {
+		if _, ok := schedules[s.EntryID]; !ok {
+			schedules[s.EntryID] = s
+		}
+	}
+
+	// Schedules of the file mapped to the ones created
+	restored := make(map[int]int64)
+	restoredEntries := make(map[int]int64)
+
+	for i, e := range data.Entries {
+		m := medicines[e.MedicineID]
+		alarm, hasAlarm := alarms[e.ID]
+		schedule := schedules[e.ID]
+
+		input := MedicineInput{
+			Name: m.Name, Producer: m.Producer, ExpDate: e.ExpireDate, Count: "1", Description: m.Description,
+			Ingredients: m.Ingredients, Size: m.Size, SizeType: parseImportOption("size", m.SizeType), MedCount: m.Count,
+			Type: parseImportOption("type", m.Type), GTIN: m.GTIN, Lot: e.LotNumber, Serial: e.SerialNumber,
+			AlarmName: "import", AlarmTimer: importDefaults["timer"], AlarmType: importDefaults["timer_type"],
+			AlarmWhen: importDefaults["before_after"], AlarmAction: importDefaults["action"],
+			Time: schedule.Time, DoseCount: schedule.DoseCount,
+		}
+		if hasAlarm {
+			input.AlarmTimer = strconv.Itoa(alarm.Timer)
+			input.AlarmType = parseImportOption("timer", alarm.TimerType)
+			input.AlarmWhen = parseImportOption("when", alarm.BeforeAfter)
+			input.AlarmAction = parseImportOption("action", alarm.Action)
+		}
+		for _, day := range schedule.Days {
+			for d, column := range weekdayColumns {
+				if day == column {
+					input.Days[d] = "on"
+				}
+			}
+		}
+
+		if err := input.validate(locale, location); err != nil {
+			report.add(i+1, m.Name, importFailed, importErrorMessage(err, locale))
+			continue
+		}
+
+		patient := patients[e.PatientID]
+
+		duplicate, err := isDuplicateEntry(tx, patient.ID, input)
+		if err != nil {
+			tx.Rollback()
+			return report, err
+		}
+		if duplicate {
+			report.add(i+1, m.Name, importSkipped, locale.T("import.skipped.duplicate"))
+			continue
+		}
+
+		entryDate, err := time.Parse(time.RFC3339, e.EntryDate)
+		if err != nil {
+			entryDate = time.Now()
+		}
+
+		entryID, useID, err := insertMedicine(tx, actor, patient.OwnerID, patient.ID, input, entryDate)
+		if err != nil {
+			tx.Rollback()
+			return report, err
+		}
+		restored[schedule.ID] = useID
+		restoredEntries[e.ID] = entryID
+
+		// Alarms which already went off stay quiet
+		if fired, err := time.Parse(time.RFC3339, alarm.FiredDate); hasAlarm && err == nil {
+			if _, err = tx.Exec("UPDATE expire_alarms SET fired_date=$1 WHERE entry_id=$2", formatStoredDate(fired), entryID); err != nil {
+				tx.Rollback()
+				return report, err
+			}
+		}
+
+		report.add(i+1, m.Name, importCreated, "")
+	}
+
+	// Dose history of the restored schedules
+	for _, d := range data.Doses {
+		useID, ok := restored[d.ScheduleID]
+		scheduled, err := time.Parse(time.RFC3339, d.Scheduled)
+		if !ok || err != nil || !isDoseStatus(d.Status) {
+			continue
+		}
+
+		var takenDate interface{}
+		if taken, err := time.Parse(time.RFC3339, d.TakenDate); err == nil {
+			takenDate = formatStoredDate(taken)
+		}
+
+		_, err = tx.Exec("INSERT OR IGNORE INTO dose_log(use_id,entry_id,patient_id,scheduled_date,scheduled_at,status,token,taken_date,create_date) VALUES(?,?,?,?,?,?,?,?,?)",
+			useID, restoredEntries[d.EntryID], patients[d.PatientID].ID, formatStoredDate(scheduled), toEpoch(scheduled), d.Status, generateSecret(16), takenDate, getDate())
+		if err != nil {
+			tx.Rollback()
+			return report, err
+		}
+	}
+
+	return report, tx.Commit()
+}
+
+// isDoseStatus reports if the value is a status a logged dose can have.
+func isDoseStatus(status string) bool {
+	switch status {
+	case doseStatusPending, doseStatusSnoozed, doseStatusTaken, doseStatusMissed:
+		return true
+	}
+	return false
+}
+
+// renderImport writes the import page in the given step.
+func renderImport(response http.ResponseWriter, request *http.Request, data ImportPageData) {
+	data.Patients = getManagedPatients(getUserID(getUserName(request)))
+
+	if err := renderTemplate(response, request, tmplImport, data); err != nil {
+		requestLogger(request).Error("renderImport", "error", err)
+	}
+}
+
+func importHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, urlLogin, 302)
+		return
+	}
+
+	patientID, _ := strconv.Atoi(request.FormValue("patient"))
+
+	renderImport(response, request, ImportPageData{PatientID: patientID})
+}
+
+// getImportPatient returns the patient picked in the import form if the user manages it.
+func getImportPatient(request *http.Request, userID int) (patient Patient, ok bool) {
+	patientID, _ := strconv.Atoi(request.FormValue("patientID"))
+
+	patient, ok = getPatient(userID, patientID)
+	return patient, ok && patient.CanManage()
+}
+
+func postImportHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, urlLogin, 302)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+	patientID, _ := strconv.Atoi(request.FormValue("patientID"))
+
+	request.Body = http.MaxBytesReader(response, request.Body, importMaxSize+4096)
+
+	file, _, err := request.FormFile("file")
+	if err != nil {
+		renderImport(response, request, ImportPageData{PatientID: patientID, Error: "file"})
+		return
+	}
+	defer file.Close()
+
+	content, err := ioutil.ReadAll(io.LimitReader(file, importMaxSize+1))
+	if err != nil || len(content) > importMaxSize {
+		renderImport(response, request, ImportPageData{PatientID: patientID, Error: "size"})
+		return
+	}
+
+	// An export of this application is restored as it is
+	if trimmed := bytes.TrimSpace(content); len(trimmed) > 0 && trimmed[0] == '{' {
+		var data ExportData
+		if err = json.Unmarshal(trimmed, &data); err != nil || data.Format != "mws-export" || data.Version > exportVersion {
+			renderImport(response, request, ImportPageData{PatientID: patientID, Error: "format"})
+			return
+		}
+
+		report, err := restoreExport(requestActor(request), userID, data, getLocale(request), getUserLocation(userID))
+		if err != nil {
+			serverError(response, request, "postImportHandler", err)
+			return
+		}
+
+		renderImport(response, request, ImportPageData{Report: &report})
+		return
+	}
+
+	if _, ok := getImportPatient(request, userID); !ok {
+		renderImport(response, request, ImportPageData{PatientID: patientID, Error: "patient"})
+		return
+	}
+
+	records, err := parseCSV(string(content))
+	if err != nil || len(records) < 2 {
+		renderImport(response, request, ImportPageData{PatientID: patientID, Error: "format"})
+		return
+	}
+
+	// Show the first rows to map the columns to the fields of the add form
+	preview := &ImportPreview{Content: string(content), Header: records[0], Total: len(records) - 1, Mappings: guessMappings(records[0])}
+	for _, record := range records[1:] {
+		if len(preview.Rows) == importPreviewRows {
+			break
+		}
+		preview.Rows = append(preview.Rows, record)
+	}
+
+	renderImport(response, request, ImportPageData{PatientID: patientID, Preview: preview})
+}
+
+func postImportCSVHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, urlLogin, 302)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+
+	request.Body = http.MaxBytesReader(response, request.Body, 3*importMaxSize)
+
+	patient, ok := getImportPatient(request, userID)
+	if !ok {
+		renderImport(response, request, ImportPageData{Error: "patient"})
+		return
+	}
+
+	records, err := parseCSV(request.FormValue("content"))
+	if err != nil || len(records) < 2 {
+		renderImport(response, request, ImportPageData{PatientID: patient.ID, Error: "format"})
+		return
+	}
+
+	items := csvImportItems(records[1:], getImportMappings(request))
+
+	report, err := importMedicines(requestActor(request), patient, items, getLocale(request), getUserLocation(userID))
+	if err != nil {
+		serverError(response, request, "postImportCSVHandler", err)
+		return
+	}
+
+	renderImport(response, request, ImportPageData{PatientID: patient.ID, Report: &report})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+)
+
+// ActiveMedicine holds a medicine the user currently keeps in use
+type ActiveMedicine struct {
+	EntryID     int
+	MedicineID  int
+	Name        string
+	Ingredients []DrugIngredient
+}
+
+// getActiveMedicines returns the medicines of the patient's entries which are not expired yet.
+func getActiveMedicines(patientID int) (medicines []ActiveMedicine) {
+	drugs := getDrugDatabase()
+
+	row, err := db.Query("SELECT e.entry_id, m.medicine_id, m.name, m.ingredients FROM entries e JOIN medicine m ON m.medicine_id = e.medicine_id WHERE e.patient_id=$1 AND "+entryExpireSQL+" >= $2", patientID, nowEpoch())
+	if err != nil {
+		logger.Error("getActiveMedicines", "patient_id", patientID, "error", err)
+		return
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var medicine ActiveMedicine
+		var ingredients sql.NullString
+
+		if err = row.Scan(&medicine.EntryID, &medicine.MedicineID, &medicine.Name, &ingredients); err != nil {
+			logger.Error("getActiveMedicines", "patient_id", patientID, "error", err)
+			return
+		}
+
+		medicine.Ingredients = drugs.resolveIngredients(medicine.Name, ingredients.String)
+		medicines = append(medicines, medicine)
+	}
+
+	return medicines
+}
+
+// findInteraction returns the first rule matching the pair of medicines.
+func (d *DrugDatabase) findInteraction(a ActiveMedicine, b ActiveMedicine) (rule DrugInteraction, found bool) {
+	for _, rule = range d.Interactions {
+		for _, x := range a.Ingredients {
+			for _, y := range b.Ingredients {
+				if (x.matches(rule.A) && y.matches(rule.B)) || (x.matches(rule.B) && y.matches(rule.A)) {
+					return rule, true
+				}
+			}
+		}
+	}
+	return rule, false
+}
+
+// checkInteractions returns warnings for every interacting pair among the
+// medicines. If added is not nil only pairs with the added medicine are checked.
+func checkInteractions(medicines []ActiveMedicine, added *ActiveMedicine, locale *Locale) (warnings []Warning) {
+	drugs := getDrugDatabase()
+	seen := make(map[string]bool)
+
+	warn := func(a ActiveMedicine, b ActiveMedicine) {
+		if a.MedicineID != 0 && a.MedicineID == b.MedicineID {
+			return
+		}
+
+		rule, found := drugs.findInteraction(a, b)
+		if !found {
+			return
+		}
+
+		title := fmt.Sprintf("%s + %s", a.Name, b.Name)
+		if seen[title] || seen[fmt.Sprintf("%s + %s", b.Name, a.Name)] {
+			return
+		}
+		seen[title] = true
+
+		warnings = append(warnings, Warning{Severity: rule.Severity, Title: title, Message: locale.T(rule.Message)})
+	}
+
+	if added != nil {
+		for i := range medicines {
+			warn(*added, medicines[i])
+		}
+		return warnings
+	}
+
+	for i := range medicines {
+		for j := i + 1; j < len(medicines); j++ {
+			warn(medicines[i], medicines[j])
+		}
+	}
+
+	return warnings
+}
+
+// renderConfirm shows warnings for a submitted form and lets the user submit
+// it again unchanged with confirmWarnings set.
+func renderConfirm(response http.ResponseWriter, request *http.Request, action string, warnings []Warning) {
+	fields := make(map[string][]string)
+	for key, values := range request.PostForm {
+		if key != "confirmWarnings" {
+			fields[key] = values
+		}
+	}
+
+	err := renderTemplate(response, request, tmplConfirm, ConfirmData{Action: action, Warnings: warnings, Fields: fields})
+
+	if err != nil {
+		return
+	}
+}
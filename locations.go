@@ -0,0 +1,463 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage conditions of medicines and of the places they are kept
+const (
+	storageNone   = "none"
+	storageCool   = "below25"
+	storageFridge = "refrigerated"
+)
+
+// storageConditions holds the conditions from the least to the most controlled
+var storageConditions = []string{storageNone, storageCool, storageFridge}
+
+// locationMovesShown is how many moves the locations page lists
+const locationMovesShown = 50
+
+// StorageLocation holds a place of the account medicines are kept at, with
+// the packages kept there counted by status
+type StorageLocation struct {
+	ID       int
+	OwnerID  int
+	Name     string
+	Storage  string
+	Expired  int
+	Alarmed  int
+	Active   int
+	Warnings []Warning
+}
+
+// count adds a package to the counts of its status.
+func (l *StorageLocation) count(entry CabinetEntry) {
+	switch entry.Status {
+	case cabinetExpired:
+		l.Expired++
+	case cabinetAlarmed:
+		l.Alarmed++
+	default:
+		l.Active++
+	}
+}
+
+// LocationMove holds a package having moved from one place to another
+type LocationMove struct {
+	EntryID int
+	Name    string
+	From    string
+	To      string
+	Date    string
+}
+
+// LocationsPageData holds all data of the locations page
+type LocationsPageData struct {
+	Filter     PatientFilter
+	Patient    Patient
+	Locations  []StorageLocation
+	Unassigned StorageLocation
+	Entries    []CabinetEntry
+	Moves      []LocationMove
+	Storages   []string
+	EntryID    int
+	Error      string
+	Saved      string
+}
+
+// storageRank returns how controlled the condition is, higher is colder.
+func storageRank(storage string) int {
+	for i, condition := range storageConditions {
+		if condition == storage {
+			return i
+		}
+	}
+	return 0
+}
+
+// checkStorage warns when a medicine is kept somewhere not as cold as it has
+// to be. Packages not assigned to a place are not checked.
+func checkStorage(name string, storage string, location string, locationStorage string, locale *Locale) []Warning {
+	if location == "" || storageRank(locationStorage) >= storageRank(storage) {
+		return nil
+	}
+
+	severity := "minor"
+	if storage == storageFridge {
+		severity = "moderate"
+	}
+
+	return []Warning{{
+		Severity: severity,
+		Title:    locale.T("locations.warning.title", name),
+		Message:  locale.T("locations.warning.message", locale.Option("storage", storage), location, locale.Option("storage", locationStorage)),
+	}}
+}
+
+// getLocations returns the places of the account by name.
+func getLocations(ownerID int) (locations []StorageLocation) {
+	row, err := db.Query("SELECT location_id, user_id, name, storage FROM storage_locations WHERE user_id=$1 ORDER BY name COLLATE NOCASE", ownerID)
+	if err != nil {
+		logger.Error("getLocations", "user_id", ownerID, "error", err)
+		return
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var l StorageLocation
+		if err = row.Scan(&l.ID, &l.OwnerID, &l.Name, &l.Storage); err != nil {
+			logger.Error("getLocations", "user_id", ownerID, "error", err)
+			return
+		}
+		locations = append(locations, l)
+	}
+
+	return locations
+}
+
+// getPatientsLocations returns the places of the accounts the patients belong to.
+func getPatientsLocations(patients []Patient) (locations []StorageLocation) {
+	seen := make(map[int]bool)
+	for _, patient := range patients {
+		if !seen[patient.OwnerID] {
+			seen[patient.OwnerID] = true
+			locations = append(locations, getLocations(patient.OwnerID)...)
+		}
+	}
+	return locations
+}
+
+// getLocationPatient returns the patient picked for the locations page, the
+// first one the user manages by default, and the patients of its account the
+// user manages. Places belong to the account of the patient.
+func getLocationPatient(request *http.Request, userID int) (patient Patient, account []Patient, filter PatientFilter, ok bool) {
+	filter = PatientFilter{URL: urlLocations, Patients: getManagedPatients(userID)}
+	if len(filter.Patients) == 0 {
+		return Patient{}, nil, filter, false
+	}
+
+	patient = filter.Patients[0]
+	if selected, err := strconv.Atoi(request.FormValue("patient")); err == nil {
+		for _, p := range filter.Patients {
+			if p.ID == selected {
+				patient = p
+			}
+		}
+	}
+	filter.Selected = patient.ID
+
+	for _, p := range filter.Patients {
+		if p.OwnerID == patient.OwnerID {
+			account = append(account, p)
+		}
+	}
+
+	return patient, account, filter, true
+}
+
+// isOwnerLocation reports if the place belongs to the account.
+func isOwnerLocation(ownerID int, locationID int) bool {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM storage_locations WHERE location_id=$1 AND user_id=$2", locationID, ownerID).Scan(&count)
+	return count > 0
+}
+
+// getLocation returns the name and condition of the place.
+func getLocation(locationID int) (name string, storage string) {
+	if err := db.QueryRow("SELECT name, storage FROM storage_locations WHERE location_id=$1", locationID).Scan(&name, &storage); err != nil && err != sql.ErrNoRows {
+		logger.Error("getLocation", "location_id", locationID, "error", err)
+	}
+	return name, storage
+}
+
+// getLocationMoves returns the latest moves of the patients' packages.
+// Places not assigned are left empty.
+func getLocationMoves(patients []Patient, location *time.Location, locale *Locale) (moves []LocationMove) {
+	clause, args := patientIDsClause("e.patient_id", patients)
+
+	row, err := db.Query(`SELECT mv.entry_id, m.name, mv.from_location_id, f.name, mv.to_location_id, t.name, mv.moved_at FROM location_moves mv
+		JOIN entries e ON e.entry_id = mv.entry_id JOIN medicine m ON m.medicine_id = e.medicine_id
+		LEFT JOIN storage_locations f ON f.location_id = mv.from_location_id
+		LEFT JOIN storage_locations t ON t.location_id = mv.to_location_id
+		WHERE `+clause+` ORDER BY mv.moved_at DESC, mv.move_id DESC LIMIT ?`, append(args, locationMovesShown)...)
+	if err != nil {
+		logger.Error("getLocationMoves", "error", err)
+		return
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var move LocationMove
+		var fromID, toID sql.NullInt64
+		var from, to sql.NullString
+		var movedAt int64
+
+		if err = row.Scan(&move.EntryID, &move.Name, &fromID, &from, &toID, &to, &movedAt); err != nil {
+			logger.Error("getLocationMoves", "error", err)
+			return
+		}
+
+		// Places deleted since are told apart from no place
+		move.From, move.To = from.String, to.String
+		if fromID.Valid && !from.Valid {
+			move.From = locale.T("locations.deleted")
+		}
+		if toID.Valid && !to.Valid {
+			move.To = locale.T("locations.deleted")
+		}
+		move.Date = locale.FormatDateTime(fromEpoch(movedAt).In(location))
+		moves = append(moves, move)
+	}
+
+	return moves
+}
+
+// getEntryPatient returns the patient and place of the package if the user has access to it.
+func getEntryPatient(userID int, entryID int) (patient Patient, locationID int, ok bool) {
+	var patientID int
+	var current sql.NullInt64
+	if err := db.QueryRow("SELECT patient_id, location_id FROM entries WHERE entry_id=$1", entryID).Scan(&patientID, &current); err != nil {
+		return Patient{}, 0, false
+	}
+
+	patient, ok = getPatient(userID, patientID)
+	return patient, int(current.Int64), ok
+}
+
+// moveEntry puts the package at the place, none when 0, keeping the move in
+// the history and the audit log.
+func moveEntry(actor Actor, patient Patient, entryID int, from int, to int) error {
+	var fromID, toID interface{}
+	if from != 0 {
+		fromID = from
+	}
+	if to != 0 {
+		toID = to
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("UPDATE entries SET location_id=$1 WHERE entry_id=$2", toID, entryID); err == nil {
+		_, err = tx.Exec("INSERT INTO location_moves(user_id,entry_id,from_location_id,to_location_id,moved_by,moved_at) VALUES(?,?,?,?,?,?)",
+			patient.OwnerID, entryID, fromID, toID, actor.UserID, nowEpoch())
+	}
+	if err == nil {
+		err = writeAudit(tx, actor, AuditEvent{
+			OwnerID: patient.OwnerID, PatientID: patient.ID, Action: auditUpdate, Entity: auditEntry, EntityID: int64(entryID),
+			Before: map[string]interface{}{"location_id": fromID}, After: map[string]interface{}{"location_id": toID},
+		})
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func locationsHandler(response http.ResponseWriter, request *http.Request) {
+	// Check login status
+	if getUserName(request) == "" {
+		http.Redirect(response, request, urlHello, 302)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+	location := getUserLocation(userID)
+	locale := getLocale(request)
+
+	// Places are kept by the account of the patient picked
+	patient, account, filter, ok := getLocationPatient(request, userID)
+	if !ok {
+		http.Redirect(response, request, urlPatients, 302)
+		return
+	}
+
+	data := LocationsPageData{
+		Filter:    filter,
+		Patient:   patient,
+		Locations: getLocations(patient.OwnerID),
+		Moves:     getLocationMoves(account, location, locale),
+		Storages:  storageConditions,
+		Error:     request.FormValue("error"),
+		Saved:     request.FormValue("saved"),
+	}
+	data.EntryID, _ = strconv.Atoi(request.FormValue("entry"))
+
+	// Count the packages of the account's patients at every place
+	entries, _, err := getCabinet(account, location, locale)
+	if err != nil {
+		serverError(response, request, "locationsHandler", err)
+		return
+	}
+
+	places := make(map[int]*StorageLocation)
+	for i := range data.Locations {
+		places[data.Locations[i].ID] = &data.Locations[i]
+	}
+
+	for _, entry := range entries {
+		place, ok := places[entry.LocationID]
+		if !ok {
+			data.Unassigned.count(entry)
+			continue
+		}
+		place.count(entry)
+		place.Warnings = append(place.Warnings, checkStorage(entry.Name, entry.Storage, place.Name, place.Storage, locale)...)
+	}
+
+	data.Entries = entries
+
+	err = renderTemplate(response, request, tmplLocations, data)
+
+	if err != nil {
+		return
+	}
+}
+
+func postLocationHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	actor := requestActor(request)
+	patientID, _ := strconv.Atoi(request.FormValue("patientID"))
+	name := strings.TrimSpace(request.FormValue("name"))
+	storage := normalizeOption("storage", request.FormValue("storage"))
+
+	// Places are added to the account of a patient the user manages
+	patient, ok := getPatient(actor.UserID, patientID)
+	if !ok || !patient.CanManage() {
+		http.Redirect(response, request, urlLocations, 302)
+		return
+	}
+
+	if name == "" || !isOneOf(storage, storageConditions) {
+		http.Redirect(response, request, fmt.Sprintf("%s?patient=%d&error=form", urlLocations, patientID), 302)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		serverError(response, request, "postLocationHandler", err)
+		return
+	}
+
+	result, err := tx.Exec("INSERT INTO storage_locations(user_id,name,storage,create_at) VALUES(?,?,?,?)", patient.OwnerID, name, storage, nowEpoch())
+	if err == nil {
+		var locationID int64
+		if locationID, err = result.LastInsertId(); err == nil {
+			err = writeAudit(tx, actor, AuditEvent{
+				OwnerID: patient.OwnerID, Action: auditCreate, Entity: auditLocation, EntityID: locationID,
+				After: map[string]interface{}{"name": name, "storage": storage},
+			})
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		serverError(response, request, "postLocationHandler", err)
+		return
+	}
+
+	http.Redirect(response, request, fmt.Sprintf("%s?patient=%d&saved=add", urlLocations, patientID), 302)
+}
+
+func postLocationDelHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	actor := requestActor(request)
+	patientID, _ := strconv.Atoi(request.FormValue("patientID"))
+	locationID, _ := strconv.Atoi(request.FormValue("locationID"))
+
+	// Places are deleted from the account of a patient the user manages
+	patient, ok := getPatient(actor.UserID, patientID)
+	if !ok || !patient.CanManage() || !isOwnerLocation(patient.OwnerID, locationID) {
+		http.Redirect(response, request, urlLocations, 302)
+		return
+	}
+
+	name, storage := getLocation(locationID)
+
+	tx, err := db.Begin()
+	if err != nil {
+		serverError(response, request, "postLocationDelHandler", err)
+		return
+	}
+
+	// The packages kept there are moved out of it, so the history tells where they were
+	_, err = tx.Exec(`INSERT INTO location_moves(user_id,entry_id,from_location_id,to_location_id,moved_by,moved_at)
+		SELECT $1, entry_id, location_id, NULL, $2, $3 FROM entries WHERE location_id=$4`, patient.OwnerID, actor.UserID, nowEpoch(), locationID)
+	if err == nil {
+		_, err = tx.Exec("UPDATE entries SET location_id=NULL WHERE location_id=$1", locationID)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM storage_locations WHERE location_id=$1", locationID)
+	}
+	if err == nil {
+		err = writeAudit(tx, actor, AuditEvent{
+			OwnerID: patient.OwnerID, Action: auditDelete, Entity: auditLocation, EntityID: int64(locationID),
+			Before: map[string]interface{}{"name": name, "storage": storage},
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		serverError(response, request, "postLocationDelHandler", err)
+		return
+	}
+
+	http.Redirect(response, request, fmt.Sprintf("%s?patient=%d&saved=delete", urlLocations, patientID), 302)
+}
+
+func postMoveHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	actor := requestActor(request)
+	entryID, _ := strconv.Atoi(request.FormValue("entryID"))
+	locationID, _ := strconv.Atoi(request.FormValue("locationID"))
+
+	// Packages are moved by who manages the patient, between the places of the patient's account
+	patient, from, ok := getEntryPatient(actor.UserID, entryID)
+	if !ok || !patient.CanManage() {
+		http.Redirect(response, request, urlLocations+"?error=entry", 302)
+		return
+	}
+	if locationID != 0 && !isOwnerLocation(patient.OwnerID, locationID) {
+		http.Redirect(response, request, fmt.Sprintf("%s?patient=%d&entry=%d&error=location", urlLocations, patient.ID, entryID), 302)
+		return
+	}
+
+	if from != locationID {
+		if err := moveEntry(actor, patient, entryID, from, locationID); err != nil {
+			serverError(response, request, "postMoveHandler", err)
+			return
+		}
+	}
+
+	http.Redirect(response, request, fmt.Sprintf("%s?patient=%d&saved=move", urlLocations, patient.ID), 302)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels, messages below the configured level are dropped
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// requestIDHeader carries the request ID in and out, so proxies in front can pass theirs on
+const requestIDHeader = "X-Request-ID"
+
+type contextKey string
+
+const requestIDKey contextKey = "requestID"
+
+// validRequestID limits IDs taken over from a client to something safe to log
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// ErrorPageData holds all data of the error page
+type ErrorPageData struct {
+	RequestID string
+}
+
+// Logger writes leveled messages with key/value fields as text or JSON lines
+type Logger struct {
+	level  int
+	json   bool
+	out    io.Writer
+	mu     *sync.Mutex
+	fields []interface{}
+}
+
+var logger = newLogger(os.Stdout, "info", "text")
+
+// newLogger returns a logger writing messages from the named level upwards in the format, "text" or "json".
+func newLogger(out io.Writer, level string, format string) *Logger {
+	l := &Logger{level: levelInfo, json: format == "json", out: out, mu: &sync.Mutex{}}
+
+	for i, name := range levelNames {
+		if strings.EqualFold(name, level) {
+			l.level = i
+		}
+	}
+
+	return l
+}
+
+// With returns a logger adding the key/value pairs to every message.
+func (l *Logger) With(fields ...interface{}) *Logger {
+	child := *l
+	child.fields = append(append([]interface{}{}, l.fields...), fields...)
+	return &child
+}
+
+func (l *Logger) Debug(msg string, fields ...interface{}) { l.write(levelDebug, msg, fields) }
+func (l *Logger) Info(msg string, fields ...interface{})  { l.write(levelInfo, msg, fields) }
+func (l *Logger) Warn(msg string, fields ...interface{})  { l.write(levelWarn, msg, fields) }
+func (l *Logger) Error(msg string, fields ...interface{}) { l.write(levelError, msg, fields) }
+
+func (l *Logger) write(level int, msg string, fields []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	fields = append(append([]interface{}{}, l.fields...), fields...)
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+
+	var line bytes.Buffer
+
+	if l.json {
+		entry := map[string]interface{}{"time": now, "level": levelNames[level], "msg": msg}
+		for i := 0; i+1 < len(fields); i += 2 {
+			entry[fmt.Sprint(fields[i])] = logValue(fields[i+1])
+		}
+
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			encoded, _ = json.Marshal(map[string]string{"time": now, "level": levelNames[level], "msg": msg, "log_error": err.Error()})
+		}
+		line.Write(encoded)
+	} else {
+		fmt.Fprintf(&line, "%s %-5s %s", now, strings.ToUpper(levelNames[level]), msg)
+		for i := 0; i+1 < len(fields); i += 2 {
+			fmt.Fprintf(&line, " %s=%s", fields[i], textValue(logValue(fields[i+1])))
+		}
+	}
+	line.WriteByte('\n')
+
+	l.mu.Lock()
+	l.out.Write(line.Bytes())
+	l.mu.Unlock()
+}
+
+// logValue turns errors into values every format can write.
+func logValue(value interface{}) interface{} {
+	if err, ok := value.(error); ok {
+		return err.Error()
+	}
+	return value
+}
+
+// textValue quotes a text field when it would otherwise be ambiguous.
+func textValue(value interface{}) string {
+	text := fmt.Sprint(value)
+	if text == "" || strings.ContainsAny(text, " \t\n\"=") {
+		return strconv.Quote(text)
+	}
+	return text
+}
+
+// getRequestID returns the ID the request is logged with.
+func getRequestID(request *http.Request) string {
+	id, _ := request.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// requestLogger returns a logger adding the ID of the request to every message.
+func requestLogger(request *http.Request) *Logger {
+	return logger.With("request_id", getRequestID(request))
+}
+
+// requestIDMiddleware gives every request an ID, the one sent by the client if it is usable.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = generateSecret(8)
+		}
+
+		response.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(response, request.WithContext(context.WithValue(request.Context(), requestIDKey, id)))
+	})
+}
+
+// statusRecorder keeps the status and size of a response for the access log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(data)
+	r.bytes += n
+	return n, err
+}
+
+// accessLogMiddleware logs every request with its status, size, latency and user.
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: response}
+
+		next.ServeHTTP(recorder, request)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		fields := []interface{}{"method", request.Method, "path", request.URL.Path, "status", recorder.status,
+			"bytes", recorder.bytes, "duration_ms", time.Since(start).Milliseconds(), "remote", request.RemoteAddr}
+		// The user is named by the session cookie, without a query on every request
+		if userName := getUserName(request); userName != "" {
+			fields = append(fields, "user", userName)
+		}
+
+		requestLogger(request).Info("request", fields...)
+	})
+}
+
+// recoverMiddleware turns a panicking handler into a logged error and a 500 page
+// instead of a dropped connection.
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+				requestLogger(request).Error("panic", "error", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+				renderServerError(response, request)
+			}
+		}()
+
+		next.ServeHTTP(response, request)
+	})
+}
+
+// serverError logs a failure of a handler and answers with the 500 page.
+func serverError(response http.ResponseWriter, request *http.Request, msg string, err error) {
+	requestLogger(request).Error(msg, "error", err)
+	renderServerError(response, request)
+}
+
+// renderServerError writes the 500 page, naming the request ID to quote to support.
+func renderServerError(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	response.WriteHeader(http.StatusInternalServerError)
+
+	if err := renderTemplate(response, request, tmplError, ErrorPageData{RequestID: getRequestID(request)}); err != nil {
+		requestLogger(request).Error("renderServerError", "error", err)
+	}
+}
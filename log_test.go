@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestAccessLog expects a request to be logged with its status, size and
+// duration in whole milliseconds.
+func TestAccessLog(t *testing.T) {
+	var out bytes.Buffer
+
+	previous := logger
+	logger = newLogger(&out, "info", "json")
+	defer func() { logger = previous }()
+
+	handler := accessLogMiddleware(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		response.WriteHeader(http.StatusTeapot)
+		response.Write([]byte("tea"))
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/week", nil))
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("access log %q is not JSON: %s", out.String(), err)
+	}
+
+	duration, ok := entry["duration_ms"].(float64)
+	if !ok || duration < 5 || duration != float64(int64(duration)) {
+		t.Errorf("duration_ms = %v, want whole milliseconds of at least 5", entry["duration_ms"])
+	}
+	if entry["status"] != float64(http.StatusTeapot) || entry["bytes"] != float64(3) || entry["path"] != "/week" {
+		t.Errorf("access log = %v", entry)
+	}
+}
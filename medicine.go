@@ -0,0 +1,346 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MedicineInput holds a medicine with its package, expire alarm and dose
+// schedule as entered in the add form or read from an import
+type MedicineInput struct {
+	Name        string
+	Producer    string
+	ExpDate     string
+	Count       string
+	Description string
+	Ingredients string
+	Size        string
+	SizeType    string
+	MedCount    string
+	Type        string
+	GTIN        string
+	Lot         string
+	Serial      string
+
+	// PrescriptionID is the prescription the package came with, 0 for none
+	PrescriptionID int
+
+	// LocationID is where the package is kept, 0 when not assigned
+	LocationID int
+	Storage    string
+
+	// OpenDays is the shelf life after opening, OpenedDate when the package was opened
+	OpenDays   string
+	OpenedDate string
+
+	AlarmName   string
+	AlarmTimer  string
+	AlarmType   string
+	AlarmWhen   string
+	AlarmAction string
+
+	Days      [7]string
+	Time      string
+	DoseCount string
+
+	// Expire is set by validate from ExpDate
+	Expire time.Time
+
+	// OpenFor, Opened and OpenExpire are set by validate from OpenDays and
+	// OpenedDate, OpenExpire only for packages opened with a shelf life
+	OpenFor    int
+	Opened     time.Time
+	OpenExpire time.Time
+}
+
+// InputError tells which field of a medicine input is wrong and why, as a message key
+type InputError struct {
+	Key   string
+	Field string
+}
+
+func (e InputError) Error() string {
+	return e.Key + ": " + e.Field
+}
+
+// Message returns the error in the language of the locale.
+func (e InputError) Message(locale *Locale) string {
+	return locale.T(e.Key, locale.T("field."+e.Field))
+}
+
+// dbExecer is what inserting needs of a database or a transaction
+type dbExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// getMedicineInput reads the add form.
+func getMedicineInput(request *http.Request) MedicineInput {
+	prescriptionID, _ := strconv.Atoi(request.FormValue("entryPrescription"))
+	locationID, _ := strconv.Atoi(request.FormValue("entryLocation"))
+
+	return MedicineInput{
+		Name:        request.FormValue("medicineName"),
+		Producer:    request.FormValue("medicineFirm"),
+		ExpDate:     request.FormValue("medicineExpDate"),
+		Count:       request.FormValue("entryCount"),
+		Description: request.FormValue("medicineDescription"),
+		Ingredients: request.FormValue("medicineIngredients"),
+		Size:        request.FormValue("medicineSizePerBox"),
+		SizeType:    normalizeOption("size", request.FormValue("medicineSizeType")),
+		MedCount:    request.FormValue("medicineCountPerBox"),
+		Type:        normalizeOption("type", request.FormValue("medicineType")),
+		GTIN:        request.FormValue("medicineGTIN"),
+		Lot:         request.FormValue("entryLot"),
+		Serial:      request.FormValue("entrySerial"),
+
+		PrescriptionID: prescriptionID,
+		LocationID:     locationID,
+		Storage:        normalizeOption("storage", request.FormValue("medicineStorage")),
+		OpenDays:       strings.TrimSpace(request.FormValue("medicineOpenDays")),
+		OpenedDate:     strings.TrimSpace(request.FormValue("entryOpened")),
+
+		AlarmName:   request.FormValue("expireAlarmName"),
+		AlarmTimer:  request.FormValue("expireAlarmTime"),
+		AlarmType:   normalizeOption("timer", request.FormValue("expireAlarmTimeType")),
+		AlarmWhen:   normalizeOption("when", request.FormValue("expireAlarmBeforeAfter")),
+		AlarmAction: normalizeOption("action", request.FormValue("expireAlarmAction")),
+
+		Days: [7]string{
+			request.FormValue("useAlarmMonday"),
+			request.FormValue("useAlarmTuesday"),
+			request.FormValue("useAlarmWednesday"),
+			request.FormValue("useAlarmThursday"),
+			request.FormValue("useAlarmFriday"),
+			request.FormValue("useAlarmSaturday"),
+			request.FormValue("useAlarmSunday"),
+		},
+		Time:      request.FormValue("useAlarmTime"),
+		DoseCount: request.FormValue("useAlarmDoseCount"),
+	}
+}
+
+// isOptionCode reports if the value is one of the stable codes of the option group.
+func isOptionCode(group string, value string) bool {
+	for _, code := range optionCodes[group] {
+		if code == value {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the input with the rules of the add form and reads its
+// expiry date, entered in the language of the locale and the timezone.
+func (m *MedicineInput) validate(locale *Locale, location *time.Location) error {
+	// Check if any of necessary fields are empty
+	required := []struct {
+		Field string
+		Value string
+	}{
+		{"name", m.Name}, {"producer", m.Producer}, {"expire_date", m.ExpDate}, {"entry_count", m.Count},
+		{"size", m.Size}, {"size_type", m.SizeType}, {"count", m.MedCount}, {"type", m.Type},
+		{"alarm_name", m.AlarmName}, {"timer", m.AlarmTimer}, {"timer_type", m.AlarmType},
+		{"before_after", m.AlarmWhen}, {"action", m.AlarmAction}, {"time", m.Time},
+	}
+	for _, r := range required {
+		if strings.TrimSpace(r.Value) == "" {
+			return InputError{Key: "input.error.required", Field: r.Field}
+		}
+	}
+
+	// Medicines without storage needs are kept anywhere
+	if m.Storage == "" {
+		m.Storage = storageNone
+	}
+
+	// Options have to be one of the choices of the form
+	options := []struct {
+		Field string
+		Group string
+		Value string
+	}{
+		{"size_type", "size", m.SizeType}, {"type", "type", m.Type}, {"timer_type", "timer", m.AlarmType},
+		{"before_after", "when", m.AlarmWhen}, {"action", "action", m.AlarmAction}, {"storage", "storage", m.Storage},
+	}
+	for _, o := range options {
+		if !isOptionCode(o.Group, o.Value) {
+			return InputError{Key: "input.error.option", Field: o.Field}
+		}
+	}
+
+	// Turn expiration date into proper time data, entered in the user's timezone and language
+	expire, err := locale.ParseDateTime(m.ExpDate, location)
+
+	// Imports may also carry dates the way exports and spreadsheets write them
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04", "2006-01-02"} {
+		if err == nil {
+			break
+		}
+		expire, err = time.ParseInLocation(layout, m.ExpDate, location)
+	}
+
+	if err != nil {
+		return InputError{Key: "input.error.date", Field: "expire_date"}
+	}
+	m.Expire = expire
+
+	// The shelf life after opening is counted in whole days, by default the
+	// one the drug catalog knows for its ingredients
+	if m.OpenFor, err = parseOpenDays(m.OpenDays); err != nil {
+		return InputError{Key: "input.error.number", Field: "open_days"}
+	}
+	if m.OpenFor == 0 {
+		m.OpenFor = getDrugDatabase().openDays(m.Name, m.Ingredients)
+	}
+
+	// A package is opened on a day in the user's timezone, not after today
+	if m.OpenedDate != "" {
+		opened, err := locale.ParseDate(m.OpenedDate)
+		if err != nil {
+			return InputError{Key: "input.error.date", Field: "opened_date"}
+		}
+
+		m.Opened = time.Date(opened.Year(), opened.Month(), opened.Day(), 0, 0, 0, 0, location)
+		if m.Opened.After(time.Now()) {
+			return InputError{Key: "input.error.date", Field: "opened_date"}
+		}
+		if m.OpenFor != 0 {
+			m.OpenExpire = openExpiry(m.Opened, m.OpenFor, location)
+		}
+	}
+
+	// A GTIN has to carry a valid check digit
+	if m.GTIN != "" && !isGTINValid(m.GTIN) {
+		return InputError{Key: "input.error.gtin", Field: "gtin"}
+	}
+
+	// The alarm offset is counted in whole units
+	if _, err = strconv.Atoi(m.AlarmTimer); err != nil {
+		return InputError{Key: "input.error.number", Field: "timer"}
+	}
+
+	// Turn alarm clock into proper time data (only for checking)
+	if _, err = time.Parse("15:04", m.Time); err != nil {
+		return InputError{Key: "input.error.time", Field: "time"}
+	}
+
+	return nil
+}
+
+// insertMedicine stores a validated input for the patient, owned by the
+// patient's account, records it in the audit log as created by the actor and
+// returns the IDs of the package and its schedule.
+func insertMedicine(exec dbExecer, actor Actor, ownerID int, patientID int, m MedicineInput, entryDate time.Time) (entryID int64, useID int64, err error) {
+	plain := m
+
+	// Health data is stored sealed with the owner's key
+	doseCount := fmt.Sprintf("%g", parseDoseCount(m.DoseCount))
+	if err = sealFields(ownerID, &m.Name, &m.Description, &m.Ingredients, &m.Time, &doseCount); err != nil {
+		return 0, 0, err
+	}
+
+	// Prepare medicine data
+	medResult, err := exec.Exec(`INSERT INTO medicine(user_id,patient_id,name,producer,description,size,size_type,med_count,type,gtin,ingredients,storage,open_days) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+		ownerID, patientID, m.Name, m.Producer, m.Description, m.Size, m.SizeType, m.MedCount, m.Type, m.GTIN, m.Ingredients, m.Storage, nullDays(m.OpenFor))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	medID, err := medResult.LastInsertId()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Prepare entry data, the epoch columns are the ones dates are compared on
+	var prescriptionID, locationID interface{}
+	if m.PrescriptionID != 0 {
+		prescriptionID = m.PrescriptionID
+	}
+	if m.LocationID != 0 {
+		locationID = m.LocationID
+	}
+
+	// Packages added already opened keep when, and until when they are used
+	var openedAt, openedDate, openDays, openExpireAt interface{}
+	if !m.Opened.IsZero() {
+		openedAt, openedDate, openDays = toEpoch(m.Opened), m.Opened.Format(time.RFC3339), nullDays(m.OpenFor)
+		if !m.OpenExpire.IsZero() {
+			openExpireAt = toEpoch(m.OpenExpire)
+		}
+	}
+
+	entryResult, err := exec.Exec(`INSERT INTO entries(medicine_id,user_id,patient_id,entry_date,expire_date,entry_at,expire_at,lot_number,serial_number,prescription_id,location_id,opened_at,open_days,open_expire_at)
+		VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+		medID, ownerID, patientID, formatStoredDate(entryDate), formatStoredDate(m.Expire), toEpoch(entryDate), toEpoch(m.Expire), m.Lot, m.Serial, prescriptionID, locationID,
+		openedAt, openDays, openExpireAt)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if entryID, err = entryResult.LastInsertId(); err != nil {
+		return 0, 0, err
+	}
+
+	// Prepare expire alarm
+	alarmResult, err := exec.Exec(`INSERT INTO expire_alarms(entry_id,user_id,patient_id,timer,timer_type,before_after,action) VALUES(?,?,?,?,?,?,?)`,
+		entryID, ownerID, patientID, m.AlarmTimer, m.AlarmType, m.AlarmWhen, m.AlarmAction)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	alarmID, err := alarmResult.LastInsertId()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Prepare use alarm
+	useResult, err := exec.Exec(`INSERT INTO use_alarms(entry_id,user_id,patient_id,mon,tue,wed,thu,fri,sat,sun,hour,dose_count) VALUES(?,?,?,?,?,?,?,?,?,?,?,?)`,
+		entryID, ownerID, patientID, m.Days[0], m.Days[1], m.Days[2], m.Days[3], m.Days[4], m.Days[5], m.Days[6], m.Time, doseCount)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if useID, err = useResult.LastInsertId(); err != nil {
+		return 0, 0, err
+	}
+
+	var days []string
+	for i, day := range plain.Days {
+		if day == "on" {
+			days = append(days, weekdayColumns[i])
+		}
+	}
+
+	// Every row is recorded with the values it was created with
+	events := []AuditEvent{
+		{Entity: auditMedicine, EntityID: medID, After: map[string]interface{}{
+			"name": plain.Name, "producer": plain.Producer, "description": plain.Description, "ingredients": plain.Ingredients,
+			"size": plain.Size, "size_type": plain.SizeType, "count": plain.MedCount, "type": plain.Type, "gtin": plain.GTIN, "storage": plain.Storage,
+			"open_days": nullDays(plain.OpenFor),
+		}},
+		{Entity: auditEntry, EntityID: entryID, After: map[string]interface{}{
+			"medicine_id": medID, "entry_date": entryDate.Format(time.RFC3339), "expire_date": plain.Expire.Format(time.RFC3339),
+			"lot_number": plain.Lot, "serial_number": plain.Serial, "prescription_id": prescriptionID, "location_id": locationID,
+			"opened_date": openedDate, "open_days": openDays,
+		}},
+		{Entity: auditAlarm, EntityID: alarmID, After: map[string]interface{}{
+			"entry_id": entryID, "timer": plain.AlarmTimer, "timer_type": plain.AlarmType, "before_after": plain.AlarmWhen, "action": plain.AlarmAction,
+		}},
+		{Entity: auditSchedule, EntityID: useID, After: map[string]interface{}{
+			"entry_id": entryID, "days": days, "time": plain.Time, "dose_count": fmt.Sprintf("%g", parseDoseCount(plain.DoseCount)),
+		}},
+	}
+
+	for _, event := range events {
+		event.OwnerID, event.PatientID, event.Action = ownerID, patientID, auditCreate
+		if err = writeAudit(exec, actor, event); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return entryID, useID, nil
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// medListAdherenceDays is how far back the medication list looks for adherence
+const medListAdherenceDays = 30
+
+// medListPDF is the format parameter asking for the list as a PDF
+const medListPDF = "pdf"
+
+// medListShareDays holds how long a shared link can stay valid
+var medListShareDays = []int{1, 7, 30}
+
+// MedListItem holds an active package as a doctor reads it
+type MedListItem struct {
+	EntryID    int
+	Name       string
+	Strength   string
+	Form       string
+	Dose       string
+	Schedule   string
+	Since      string
+	Expire     string
+	Prescriber string
+	Adherence  string
+}
+
+// MedListShare holds a link giving access to a patient's medication list for a while
+type MedListShare struct {
+	ID       int
+	Token    string
+	URL      string
+	ExpireAt string
+}
+
+// MedListData holds all data of the medication list, printed or as PDF
+type MedListData struct {
+	Patient   Patient
+	Profile   HealthProfile
+	Generated string
+	Items     []MedListItem
+	Adherence string
+	Days      int
+
+	// Only set for the signed in user, not on a shared link
+	Filter    PatientFilter
+	Shares    []MedListShare
+	ShareDays []int
+	Token     string
+}
+
+// medListSchedule describes the days and hour of a use alarm.
+func medListSchedule(days [7]sql.NullString, hour string, locale *Locale) string {
+	var names []string
+	for i, day := range days {
+		if day.String == "on" {
+			names = append(names, locale.T(weekdayKeys[i]))
+		}
+	}
+
+	switch len(names) {
+	case 0:
+		return ""
+	case 7:
+		return locale.T("medlist.daily", hour)
+	default:
+		return strings.Join(names, ", ") + " " + hour
+	}
+}
+
+// getMedList returns the medication list of the patient, in the timezone and language given.
+func getMedList(patient Patient, location *time.Location, locale *Locale) (data MedListData, err error) {
+	data.Patient = patient
+	data.Profile = getHealthProfile(patient.ID)
+	data.Generated = locale.FormatDateTime(time.Now().In(location))
+	data.Days = medListAdherenceDays
+
+	report, err := getReport([]Patient{patient}, medListAdherenceDays, location)
+	if err != nil {
+		return data, err
+	}
+
+	adherence := make(map[int]Adherence)
+	for _, medicine := range report.Medicines {
+		adherence[medicine.MedicineID] = medicine.Adherence
+	}
+	data.Adherence = medListAdherence(report.Overall, locale)
+
+	row, err := db.Query(`SELECT e.entry_id, m.medicine_id, m.name, m.size, m.size_type, m.type, e.entry_at, `+entryExpireSQL+`,
+		u.mon, u.tue, u.wed, u.thu, u.fri, u.sat, u.sun, u.hour, u.dose_count, p.prescriber
+		FROM entries e JOIN medicine m ON m.medicine_id = e.medicine_id LEFT JOIN use_alarms u ON u.entry_id = e.entry_id
+		LEFT JOIN prescriptions p ON p.prescription_id = e.prescription_id
+		WHERE e.patient_id=$1 AND `+entryExpireSQL+` >= $2 ORDER BY e.entry_id`, patient.ID, nowEpoch())
+	if err != nil {
+		return data, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var item MedListItem
+		var medicineID int
+		var size, sizeType, kind, hour, doseCount, prescriber sql.NullString
+		var entryAt, expireAt sql.NullInt64
+		var days [7]sql.NullString
+
+		err = row.Scan(&item.EntryID, &medicineID, &item.Name, &size, &sizeType, &kind, &entryAt, &expireAt,
+			&days[0], &days[1], &days[2], &days[3], &days[4], &days[5], &days[6], &hour, &doseCount, &prescriber)
+		if err != nil {
+			return data, err
+		}
+
+		if size.String != "" {
+			item.Strength = locale.FormatNumber(size.String) + " " + locale.Option("size", sizeType.String)
+		}
+		item.Form = locale.Option("type", kind.String)
+		item.Schedule = medListSchedule(days, strings.TrimSpace(hour.String), locale)
+		if item.Schedule != "" {
+			item.Dose = locale.FormatNumber(parseDoseCount(doseCount.String))
+		}
+		if entryAt.Valid {
+			item.Since = locale.FormatDate(fromEpoch(entryAt.Int64).In(location))
+		}
+		if expireAt.Valid {
+			item.Expire = locale.FormatDate(fromEpoch(expireAt.Int64).In(location))
+		}
+		item.Prescriber = prescriber.String
+		item.Adherence = medListAdherence(adherence[medicineID], locale)
+
+		data.Items = append(data.Items, item)
+	}
+
+	return data, row.Err()
+}
+
+// medListAdherence writes the adherence as a percentage, or a dash without closed doses.
+func medListAdherence(adherence Adherence, locale *Locale) string {
+	if !adherence.Closed() {
+		return "—"
+	}
+	return locale.FormatNumber(adherence.Percent) + "%"
+}
+
+// writeMedListPDF lays the medication list out on A4 pages.
+func writeMedListPDF(data MedListData, locale *Locale) []byte {
+	w := newPDF()
+
+	w.paragraph(18, true, locale.T("medlist.page")+": "+data.Patient.Name)
+	w.paragraph(9, false, locale.T("medlist.generated", data.Generated))
+	w.y += 6
+
+	if data.Profile.Allergies != "" {
+		w.paragraph(10, false, locale.T("profile.allergies")+": "+data.Profile.Allergies)
+	}
+	if data.Profile.Conditions != "" {
+		w.paragraph(10, false, locale.T("profile.conditions")+": "+data.Profile.Conditions)
+	}
+	w.paragraph(10, false, locale.T("medlist.adherence.overall", data.Days, data.Adherence))
+	w.y += 10
+
+	widths := []float64{95, 55, 50, 30, 95, 50, 50, 65, 25}
+	w.row(widths, 8, true, []string{
+		locale.T("col.medicine.name"), locale.T("medlist.strength"), locale.T("medlist.form"), locale.T("medlist.dose"),
+		locale.T("medlist.schedule"), locale.T("medlist.since"), locale.T("col.expire"), locale.T("medlist.prescriber"), "%",
+	})
+	for _, item := range data.Items {
+		w.row(widths, 8, false, []string{item.Name, item.Strength, item.Form, item.Dose, item.Schedule, item.Since, item.Expire, item.Prescriber, item.Adherence})
+	}
+
+	if len(data.Items) == 0 {
+		w.paragraph(10, false, locale.T("medlist.empty"))
+	}
+
+	return w.bytes()
+}
+
+// getMedListShares returns the links of the patient which are still valid.
+func getMedListShares(patientID int, location *time.Location, locale *Locale) (shares []MedListShare) {
+	row, err := db.Query("SELECT share_id, token, expire_at FROM medlist_shares WHERE patient_id=$1 AND expire_at > $2 ORDER BY expire_at",
+		patientID, nowEpoch())
+	if err != nil {
+		logger.Error("getMedListShares", "patient_id", patientID, "error", err)
+		return
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var share MedListShare
+		var expireAt int64
+
+		if err = row.Scan(&share.ID, &share.Token, &expireAt); err != nil {
+			logger.Error("getMedListShares", "patient_id", patientID, "error", err)
+			return
+		}
+
+		share.URL = config.BaseURL + strings.Replace(urlShared, "{token:[0-9a-f]+}", share.Token, 1)
+		share.ExpireAt = locale.FormatDateTime(fromEpoch(expireAt).In(location))
+		shares = append(shares, share)
+	}
+
+	return shares
+}
+
+// getSharedPatient returns the patient a link is valid for, with the account that shared it.
+func getSharedPatient(token string) (patient Patient, userID int, ok bool) {
+	var patientID int
+
+	result := db.QueryRow("SELECT patient_id, user_id FROM medlist_shares WHERE token=$1 AND expire_at > $2", token, nowEpoch())
+	if err := result.Scan(&patientID, &userID); err != nil || token == "" {
+		return Patient{}, 0, false
+	}
+
+	patient, ok = getPatient(userID, patientID)
+	return patient, userID, ok
+}
+
+// getMedListPatient returns the patient picked for the list, the first one by default.
+func getMedListPatient(request *http.Request, userID int) (patient Patient, filter PatientFilter, ok bool) {
+	patients, filter := getSelectedPatients(request, userID, urlMedList)
+	filter.AllowAll = false
+
+	if len(patients) == 0 {
+		return Patient{}, filter, false
+	}
+
+	filter.Selected = patients[0].ID
+	return patients[0], filter, true
+}
+
+// serveMedListPDF sends the list as a PDF download.
+func serveMedListPDF(response http.ResponseWriter, data MedListData, locale *Locale) {
+	response.Header().Set("Content-Type", "application/pdf")
+	response.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", "medication-list-"+time.Now().Format("20060102")+".pdf"))
+	response.Header().Set("Cache-Control", "private, no-store")
+	response.Write(writeMedListPDF(data, locale))
+}
+
+func medListHandler(response http.ResponseWriter, request *http.Request) {
+	// Check login status
+	if getUserName(request) == "" {
+		http.Redirect(response, request, urlHello, 302)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+	location := getUserLocation(userID)
+	locale := getLocale(request)
+
+	patient, filter, ok := getMedListPatient(request, userID)
+	if !ok {
+		http.Redirect(response, request, urlPatients, 302)
+		return
+	}
+
+	data, err := getMedList(patient, location, locale)
+	if err != nil {
+		serverError(response, request, "medListHandler", err)
+		return
+	}
+
+	if request.FormValue("format") == medListPDF {
+		serveMedListPDF(response, data, locale)
+		return
+	}
+
+	data.Filter = filter
+	data.ShareDays = medListShareDays
+	if patient.CanManage() {
+		data.Shares = getMedListShares(patient.ID, location, locale)
+	}
+
+	err = renderTemplate(response, request, tmplMedList, data)
+
+	if err != nil {
+		return
+	}
+}
+
+// sharedMedListHandler shows a shared medication list. Doctors do not log
+// in, the secret token in the URL gives access until it expires.
+func sharedMedListHandler(response http.ResponseWriter, request *http.Request) {
+	token := mux.Vars(request)["token"]
+
+	patient, userID, ok := getSharedPatient(token)
+	if !ok {
+		http.NotFound(response, request)
+		return
+	}
+
+	locale := getLocale(request)
+
+	data, err := getMedList(patient, getUserLocation(userID), locale)
+	if err != nil {
+		serverError(response, request, "sharedMedListHandler", err)
+		return
+	}
+
+	if request.FormValue("format") == medListPDF {
+		serveMedListPDF(response, data, locale)
+		return
+	}
+
+	data.Token = token
+
+	response.Header().Set("Cache-Control", "private, no-store")
+	err = renderTemplate(response, request, tmplMedList, data)
+
+	if err != nil {
+		return
+	}
+}
+
+func postMedListShareHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+	patientID, _ := strconv.Atoi(request.FormValue("patientID"))
+
+	// Only who may change the patient's data may hand it out
+	patient, ok := getPatient(userID, patientID)
+	if !ok || !patient.CanManage() {
+		http.Redirect(response, request, urlMedList, 302)
+		return
+	}
+
+	days, _ := strconv.Atoi(request.FormValue("days"))
+	valid := false
+	for _, d := range medListShareDays {
+		valid = valid || d == days
+	}
+	if !valid {
+		http.Redirect(response, request, fmt.Sprintf("%s?patient=%d", urlMedList, patientID), 302)
+		return
+	}
+
+	_, err := db.Exec("INSERT INTO medlist_shares(token,user_id,patient_id,expire_at,create_at) VALUES(?,?,?,?,?)",
+		generateSecret(20), userID, patientID, toEpoch(time.Now().AddDate(0, 0, days)), nowEpoch())
+	if err != nil {
+		serverError(response, request, "postMedListShareHandler", err)
+		return
+	}
+
+	http.Redirect(response, request, fmt.Sprintf("%s?patient=%d", urlMedList, patientID), 302)
+}
+
+func postMedListRevokeHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+	patientID, _ := strconv.Atoi(request.FormValue("patientID"))
+
+	patient, ok := getPatient(userID, patientID)
+	if !ok || !patient.CanManage() {
+		http.Redirect(response, request, urlMedList, 302)
+		return
+	}
+
+	_, err := db.Exec("DELETE FROM medlist_shares WHERE share_id=$1 AND patient_id=$2", request.FormValue("shareID"), patientID)
+	if err != nil {
+		serverError(response, request, "postMedListRevokeHandler", err)
+		return
+	}
+
+	http.Redirect(response, request, fmt.Sprintf("%s?patient=%d", urlMedList, patientID), 302)
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mattn/go-sqlite3"
+)
+
+// metricsDriver is the SQLite driver timing every statement for /metrics
+const metricsDriver = "sqlite3_metrics"
+
+// activeUserWindow is how recently a user must have made a request to count as active
+const activeUserWindow = 15 * time.Minute
+
+var (
+	httpBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	dbBuckets   = []float64{0.0001, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 1}
+)
+
+var (
+	httpRequests = newCounter("mws_http_requests_total", "HTTP requests by route, method and status.", "route", "method", "status")
+	httpDuration = newHistogram("mws_http_request_duration_seconds", "HTTP request latency by route and method.", httpBuckets, "route", "method")
+	dbDuration   = newHistogram("mws_db_query_duration_seconds", "Database statement latency by operation.", dbBuckets, "operation")
+	alarmsFired  = newCounter("mws_alarms_fired_total", "Alarms which went off, by kind.", "kind")
+	notifyResult = newCounter("mws_notifications_total", "Notification delivery attempts by kind and result.", "kind", "result")
+	schedRuns    = newCounter("mws_scheduler_runs_total", "Scheduler runs.")
+	schedLag     = newGauge("mws_scheduler_lag_seconds", "How late the last scheduler run started.")
+	schedLastRun = newGauge("mws_scheduler_last_run_timestamp_seconds", "When the last scheduler run finished.")
+	schedRunTime = newGauge("mws_scheduler_run_duration_seconds", "How long the last scheduler run took.")
+)
+
+// metric is one family of series written to /metrics
+type metric interface {
+	write(w io.Writer)
+}
+
+var registry []metric
+
+// series holds the values of a family by their joined label values
+type series struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mu     sync.Mutex
+}
+
+func (s *series) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", s.name, s.help, s.name, s.kind)
+}
+
+// labelPairs writes the label names with the values kept in the key, and the extra pair if there is one.
+func (s *series) labelPairs(key string, extra ...string) string {
+	var pairs []string
+
+	if len(s.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, s.labels[i]+`="`+escapeLabel(value)+`"`)
+		}
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, extra[0]+`="`+escapeLabel(extra[1])+`"`)
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Counter is a value which only goes up
+type Counter struct {
+	series
+	values map[string]float64
+}
+
+func newCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{series: series{name: name, help: help, kind: "counter", labels: labels}, values: make(map[string]float64)}
+	registry = append(registry, c)
+	return c
+}
+
+// Inc adds one to the series of the label values.
+func (c *Counter) Inc(values ...string) {
+	key := strings.Join(values, "\xff")
+
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.header(w)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(key), formatValue(c.values[key]))
+	}
+}
+
+// Gauge is a value which goes up and down, read from a function if it has one
+type Gauge struct {
+	series
+	value float64
+	read  func() float64
+}
+
+func newGauge(name string, help string) *Gauge {
+	g := &Gauge{series: series{name: name, help: help, kind: "gauge"}}
+	registry = append(registry, g)
+	return g
+}
+
+func newGaugeFunc(name string, help string, read func() float64) *Gauge {
+	g := newGauge(name, help)
+	g.read = read
+	return g
+}
+
+// Set replaces the value.
+func (g *Gauge) Set(value float64) {
+	g.mu.Lock()
+	g.value = value
+	g.mu.Unlock()
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.mu.Lock()
+	value := g.value
+	g.mu.Unlock()
+
+	if g.read != nil {
+		value = g.read()
+	}
+
+	g.header(w)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(value))
+}
+
+// Histogram counts observations into buckets by their upper bound
+type Histogram struct {
+	series
+	buckets []float64
+	values  map[string]*histogramValues
+}
+
+type histogramValues struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{series: series{name: name, help: help, kind: "histogram", labels: labels}, buckets: buckets, values: make(map[string]*histogramValues)}
+	registry = append(registry, h)
+	return h
+}
+
+// Observe records a duration in the series of the label values.
+func (h *Histogram) Observe(duration time.Duration, values ...string) {
+	key := strings.Join(values, "\xff")
+	seconds := duration.Seconds()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValues{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+
+	for i, bound := range h.buckets {
+		if seconds <= bound {
+			v.counts[i]++
+		}
+	}
+	v.sum += seconds
+	v.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.header(w)
+	for _, key := range sortedKeys(h.values) {
+		v := h.values[key]
+
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, "le", formatValue(bound)), v.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, "le", "+Inf"), v.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(key), formatValue(v.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(key), v.count)
+	}
+}
+
+// sortedKeys returns the keys of a series map in a stable order.
+func sortedKeys(values interface{}) (keys []string) {
+	switch m := values.(type) {
+	case map[string]float64:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]*histogramValues:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// activeUsers keeps when each user last made a request
+var activeUsers = struct {
+	sync.Mutex
+	seen map[string]time.Time
+}{seen: make(map[string]time.Time)}
+
+// countActiveUsers returns how many users made a request lately and forgets the others.
+func countActiveUsers() float64 {
+	since := time.Now().Add(-activeUserWindow)
+
+	activeUsers.Lock()
+	defer activeUsers.Unlock()
+
+	for userName, seen := range activeUsers.seen {
+		if seen.Before(since) {
+			delete(activeUsers.seen, userName)
+		}
+	}
+
+	return float64(len(activeUsers.seen))
+}
+
+// countUsers returns how many accounts are registered.
+func countUsers() float64 {
+	var count int
+
+	if err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count); err != nil {
+		logger.Error("countUsers", "error", err)
+	}
+
+	return float64(count)
+}
+
+// metricsMiddleware counts every request and its latency by the route it matched,
+// so paths with IDs in them do not make a series each.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: response}
+
+		next.ServeHTTP(recorder, request)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		route := "unknown"
+		if current := mux.CurrentRoute(request); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		httpRequests.Inc(route, request.Method, strconv.Itoa(recorder.status))
+		httpDuration.Observe(time.Since(start), route, request.Method)
+
+		if userName := getUserName(request); userName != "" {
+			activeUsers.Lock()
+			activeUsers.seen[userName] = time.Now()
+			activeUsers.Unlock()
+		}
+	})
+}
+
+func metricsHandler(response http.ResponseWriter, request *http.Request) {
+	// The metrics are only readable with the token if one is configured
+	if config.MetricsToken != "" {
+		given := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(config.MetricsToken)) != 1 {
+			http.Error(response, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	response.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	for _, m := range registry {
+		m.write(response)
+	}
+}
+
+func init() {
+	newGaugeFunc("mws_active_users", "Users who made a request in the last 15 minutes.", countActiveUsers)
+	newGaugeFunc("mws_registered_users", "Registered accounts.", countUsers)
+
+	sql.Register(metricsDriver, &timedDriver{&sqlite3.SQLiteDriver{}})
+}
+
+// timedDriver wraps the SQLite driver to time the statements of every connection,
+// to escape plaintext arguments looking sealed and to open the sealed values of
+// the rows they read
+type timedDriver struct {
+	driver.Driver
+}
+
+// sqliteConn lists what database/sql uses of a SQLite connection
+type sqliteConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+	driver.Pinger
+}
+
+// sqliteStmt lists what database/sql uses of a SQLite statement
+type sqliteStmt interface {
+	driver.Stmt
+	driver.StmtExecContext
+	driver.StmtQueryContext
+}
+
+func (d *timedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{conn.(sqliteConn)}, nil
+}
+
+type timedConn struct {
+	sqliteConn
+}
+
+func (c *timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	defer func() { dbDuration.Observe(time.Since(start), "exec") }()
+	return c.sqliteConn.ExecContext(ctx, query, escapeArgs(args))
+}
+
+func (c *timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	defer func() { dbDuration.Observe(time.Since(start), "query") }()
+	return openRows(c.sqliteConn.QueryContext(ctx, query, escapeArgs(args)))
+}
+
+func (c *timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.sqliteConn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &timedStmt{stmt.(sqliteStmt)}, nil
+}
+
+func (c *timedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+type timedStmt struct {
+	sqliteStmt
+}
+
+func (s *timedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	defer func() { dbDuration.Observe(time.Since(start), "exec") }()
+	return s.sqliteStmt.ExecContext(ctx, escapeArgs(args))
+}
+
+func (s *timedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	defer func() { dbDuration.Observe(time.Since(start), "query") }()
+	return openRows(s.sqliteStmt.QueryContext(ctx, escapeArgs(args)))
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Migration holds a single versioned schema change
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+}
+
+// migrations lists every schema change in the order it has to be applied.
+// Never edit or reorder an entry once released, append a new one instead.
+var migrations = []Migration{
+	{Version: 1, Name: "gs1 product and batch data", Up: execStatements(
+		`ALTER TABLE medicine ADD COLUMN gtin TEXT`,
+		`ALTER TABLE entries ADD COLUMN lot_number TEXT`,
+		`ALTER TABLE entries ADD COLUMN serial_number TEXT`,
+	)},
+	{Version: 2, Name: "medicine active ingredients", Up: execStatements(
+		`ALTER TABLE medicine ADD COLUMN ingredients TEXT`,
+	)},
+	{Version: 3, Name: "health profiles", Up: execStatements(
+		`CREATE TABLE "health_profiles" (
+	"profile_id"	INTEGER NOT NULL UNIQUE,
+	"user_id"	INTEGER NOT NULL UNIQUE,
+	"allergies"	TEXT,
+	"conditions"	TEXT,
+	"pregnant"	TEXT,
+	"birth_date"	TEXT,
+	"weight"	TEXT,
+	"update_date"	TEXT NOT NULL,
+	PRIMARY KEY("profile_id" AUTOINCREMENT)
+)`,
+	)},
+	{Version: 4, Name: "use alarm dose count", Up: execStatements(
+		`ALTER TABLE use_alarms ADD COLUMN dose_count TEXT`,
+	)},
+	{Version: 5, Name: "household patients", Up: execStatements(
+		`CREATE TABLE "patients" (
+	"patient_id"	INTEGER NOT NULL UNIQUE,
+	"owner_id"	INTEGER NOT NULL,
+	"name"	TEXT NOT NULL,
+	"create_date"	TEXT NOT NULL,
+	PRIMARY KEY("patient_id" AUTOINCREMENT)
+)`,
+		`CREATE TABLE "patient_shares" (
+	"share_id"	INTEGER NOT NULL UNIQUE,
+	"patient_id"	INTEGER NOT NULL,
+	"user_id"	INTEGER NOT NULL,
+	"permission"	TEXT NOT NULL,
+	"create_date"	TEXT NOT NULL,
+	PRIMARY KEY("share_id" AUTOINCREMENT),
+	UNIQUE("patient_id","user_id")
+)`,
+		// Every existing account manages one patient, the account holder
+		`INSERT INTO patients(owner_id,name,create_date) SELECT user_id, username, register_date FROM users`,
+		`ALTER TABLE medicine ADD COLUMN patient_id INTEGER`,
+		`ALTER TABLE entries ADD COLUMN patient_id INTEGER`,
+		`ALTER TABLE use_alarms ADD COLUMN patient_id INTEGER`,
+		`ALTER TABLE expire_alarms ADD COLUMN patient_id INTEGER`,
+		`UPDATE medicine SET patient_id = (SELECT MIN(patient_id) FROM patients WHERE owner_id = medicine.user_id)`,
+		`UPDATE entries SET patient_id = (SELECT MIN(patient_id) FROM patients WHERE owner_id = entries.user_id)`,
+		`UPDATE use_alarms SET patient_id = (SELECT MIN(patient_id) FROM patients WHERE owner_id = use_alarms.user_id)`,
+		`UPDATE expire_alarms SET patient_id = (SELECT MIN(patient_id) FROM patients WHERE owner_id = expire_alarms.user_id)`,
+		// Health profiles belong to patients from now on
+		`CREATE TABLE "health_profiles_new" (
+	"profile_id"	INTEGER NOT NULL UNIQUE,
+	"patient_id"	INTEGER NOT NULL UNIQUE,
+	"user_id"	INTEGER NOT NULL,
+	"allergies"	TEXT,
+	"conditions"	TEXT,
+	"pregnant"	TEXT,
+	"birth_date"	TEXT,
+	"weight"	TEXT,
+	"update_date"	TEXT NOT NULL,
+	PRIMARY KEY("profile_id" AUTOINCREMENT)
+)`,
+		`INSERT INTO health_profiles_new(profile_id,patient_id,user_id,allergies,conditions,pregnant,birth_date,weight,update_date)
+	SELECT h.profile_id, (SELECT MIN(patient_id) FROM patients WHERE owner_id = h.user_id), h.user_id, h.allergies, h.conditions, h.pregnant, h.birth_date, h.weight, h.update_date FROM health_profiles h`,
+		`DROP TABLE health_profiles`,
+		`ALTER TABLE health_profiles_new RENAME TO health_profiles`,
+	)},
+	{Version: 6, Name: "notification channels", Up: execStatements(
+		`CREATE TABLE "app_settings" (
+	"key"	TEXT NOT NULL UNIQUE,
+	"value"	TEXT,
+	PRIMARY KEY("key")
+)`,
+		`CREATE TABLE "notification_channels" (
+	"channel_id"	INTEGER NOT NULL UNIQUE,
+	"user_id"	INTEGER NOT NULL,
+	"channel"	TEXT NOT NULL,
+	"target"	TEXT NOT NULL,
+	"secret"	TEXT,
+	"enabled"	TEXT,
+	"create_date"	TEXT NOT NULL,
+	PRIMARY KEY("channel_id" AUTOINCREMENT)
+)`,
+		`CREATE TABLE "notification_settings" (
+	"user_id"	INTEGER NOT NULL UNIQUE,
+	"quiet_start"	TEXT,
+	"quiet_end"	TEXT,
+	PRIMARY KEY("user_id")
+)`,
+		`CREATE TABLE "notification_log" (
+	"log_id"	INTEGER NOT NULL UNIQUE,
+	"user_id"	INTEGER NOT NULL,
+	"channel_id"	INTEGER NOT NULL,
+	"channel"	TEXT NOT NULL,
+	"kind"	TEXT NOT NULL,
+	"entry_id"	INTEGER,
+	"title"	TEXT NOT NULL,
+	"body"	TEXT,
+	"url"	TEXT,
+	"status"	TEXT NOT NULL,
+	"attempts"	INTEGER NOT NULL DEFAULT 0,
+	"error"	TEXT,
+	"next_attempt"	TEXT NOT NULL,
+	"create_date"	TEXT NOT NULL,
+	"update_date"	TEXT NOT NULL,
+	PRIMARY KEY("log_id" AUTOINCREMENT)
+)`,
+		`CREATE INDEX "notification_log_pending" ON "notification_log" ("status","next_attempt")`,
+		// Remember which expire alarms went out so they fire only once
+		`ALTER TABLE expire_alarms ADD COLUMN fired_date TEXT`,
+	)},
+	{Version: 7, Name: "dose log", Up: execStatements(
+		`CREATE TABLE "dose_log" (
+	"dose_id"	INTEGER NOT NULL UNIQUE,
+	"use_id"	INTEGER NOT NULL,
+	"entry_id"	INTEGER NOT NULL,
+	"patient_id"	INTEGER NOT NULL,
+	"scheduled_date"	TEXT NOT NULL,
+	"status"	TEXT NOT NULL,
+	"token"	TEXT NOT NULL UNIQUE,
+	"snooze_until"	TEXT,
+	"taken_date"	TEXT,
+	"create_date"	TEXT NOT NULL,
+	PRIMARY KEY("dose_id" AUTOINCREMENT),
+	UNIQUE("use_id","scheduled_date")
+)`,
+		`ALTER TABLE notification_log ADD COLUMN action_token TEXT`,
+	)},
+	{Version: 8, Name: "calendar feed token", Up: execStatements(
+		`ALTER TABLE users ADD COLUMN calendar_token TEXT`,
+		`CREATE UNIQUE INDEX "users_calendar_token" ON "users" ("calendar_token")`,
+	)},
+	{Version: 9, Name: "user timezone", Up: execStatements(
+		`ALTER TABLE users ADD COLUMN timezone TEXT`,
+	)},
+	{Version: 10, Name: "epoch timestamps", Up: migrateEpochTimestamps},
+	{Version: 11, Name: "user locale and option codes", Up: migrateOptionCodes},
+	{Version: 12, Name: "account deletion and data requests", Up: execStatements(
+		`ALTER TABLE users ADD COLUMN delete_requested_at INTEGER`,
+		`CREATE TABLE "data_requests" (
+	"request_id"	INTEGER NOT NULL UNIQUE,
+	"user_id"	INTEGER NOT NULL,
+	"kind"	TEXT NOT NULL,
+	"status"	TEXT NOT NULL,
+	"details"	TEXT,
+	"response"	TEXT,
+	"handled_by"	INTEGER,
+	"create_at"	INTEGER NOT NULL,
+	"update_at"	INTEGER NOT NULL,
+	PRIMARY KEY("request_id" AUTOINCREMENT)
+)`,
+		// Only that an account was erased is kept, never what it held
+		`CREATE TABLE "erasure_log" (
+	"erasure_id"	INTEGER NOT NULL UNIQUE,
+	"user_id"	INTEGER NOT NULL,
+	"reason"	TEXT NOT NULL,
+	"requested_at"	INTEGER NOT NULL,
+	"erased_at"	INTEGER NOT NULL,
+	"row_counts"	TEXT,
+	PRIMARY KEY("erasure_id" AUTOINCREMENT)
+)`,
+	)},
+	{Version: 13, Name: "data keys", Up: execStatements(
+		`CREATE TABLE "data_keys" (
+	"key_id"	INTEGER NOT NULL UNIQUE,
+	"user_id"	INTEGER NOT NULL,
+	"master_id"	TEXT NOT NULL,
+	"wrapped_key"	TEXT NOT NULL,
+	"create_at"	INTEGER NOT NULL,
+	PRIMARY KEY("key_id" AUTOINCREMENT)
+)`,
+		`CREATE INDEX "data_keys_user" ON "data_keys" ("user_id")`,
+	)},
+	{Version: 14, Name: "audit log", Up: execStatements(
+		`CREATE TABLE "audit_log" (
+	"audit_id"	INTEGER NOT NULL UNIQUE,
+	"actor_id"	INTEGER,
+	"owner_id"	INTEGER NOT NULL,
+	"patient_id"	INTEGER,
+	"action"	TEXT NOT NULL,
+	"entity"	TEXT NOT NULL,
+	"entity_id"	INTEGER,
+	"before_value"	TEXT,
+	"after_value"	TEXT,
+	"ip"	TEXT,
+	"request_id"	TEXT,
+	"create_at"	INTEGER NOT NULL,
+	PRIMARY KEY("audit_id" AUTOINCREMENT)
+)`,
+		`CREATE INDEX "audit_log_owner" ON "audit_log" ("owner_id","audit_id")`,
+		// Events are never changed, and only go when the account they belong to is erased
+		`CREATE TRIGGER "audit_log_no_update" BEFORE UPDATE ON "audit_log"
+	BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END`,
+		`CREATE TRIGGER "audit_log_no_delete" BEFORE DELETE ON "audit_log" WHEN OLD.owner_id IN (SELECT user_id FROM users)
+	BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END`,
+	)},
+	{Version: 15, Name: "medication list links", Up: execStatements(
+		`CREATE TABLE "medlist_shares" (
+	"share_id"	INTEGER NOT NULL UNIQUE,
+	"token"	TEXT NOT NULL UNIQUE,
+	"user_id"	INTEGER NOT NULL,
+	"patient_id"	INTEGER NOT NULL,
+	"expire_at"	INTEGER NOT NULL,
+	"create_at"	INTEGER NOT NULL,
+	PRIMARY KEY("share_id" AUTOINCREMENT)
+)`,
+	)},
+	{Version: 16, Name: "prescriptions", Up: execStatements(
+		`CREATE TABLE "prescriptions" (
+	"prescription_id"	INTEGER NOT NULL UNIQUE,
+	"user_id"	INTEGER NOT NULL,
+	"patient_id"	INTEGER NOT NULL,
+	"prescriber"	TEXT NOT NULL,
+	"pharmacy"	TEXT,
+	"issue_at"	INTEGER NOT NULL,
+	"erx_number"	TEXT,
+	"refills_allowed"	INTEGER NOT NULL DEFAULT 0,
+	"refills_used"	INTEGER NOT NULL DEFAULT 0,
+	"valid_days"	INTEGER NOT NULL,
+	"scan_key"	TEXT,
+	"scan_key_id"	INTEGER NOT NULL DEFAULT 0,
+	"scan_type"	TEXT,
+	"create_at"	INTEGER NOT NULL,
+	PRIMARY KEY("prescription_id" AUTOINCREMENT)
+)`,
+		`ALTER TABLE entries ADD COLUMN prescription_id INTEGER`,
+	)},
+	{Version: 17, Name: "attachments", Up: execStatements(
+		`CREATE TABLE "attachments" (
+	"attachment_id"	INTEGER NOT NULL UNIQUE,
+	"user_id"	INTEGER NOT NULL,
+	"patient_id"	INTEGER NOT NULL,
+	"medicine_id"	INTEGER NOT NULL,
+	"entry_id"	INTEGER,
+	"name"	TEXT NOT NULL,
+	"content_type"	TEXT NOT NULL,
+	"size"	INTEGER NOT NULL,
+	"blob_key"	TEXT NOT NULL UNIQUE,
+	"thumb_key"	TEXT,
+	"key_id"	INTEGER NOT NULL DEFAULT 0,
+	"create_at"	INTEGER NOT NULL,
+	PRIMARY KEY("attachment_id" AUTOINCREMENT)
+)`,
+		`CREATE INDEX "attachments_medicine" ON "attachments" ("medicine_id")`,
+	)},
+	{Version: 18, Name: "storage locations", Up: execStatements(
+		`CREATE TABLE "storage_locations" (
+	"location_id"	INTEGER NOT NULL UNIQUE,
+	"user_id"	INTEGER NOT NULL,
+	"name"	TEXT NOT NULL,
+	"storage"	TEXT NOT NULL DEFAULT 'none',
+	"create_at"	INTEGER NOT NULL,
+	PRIMARY KEY("location_id" AUTOINCREMENT)
+)`,
+		`CREATE TABLE "location_moves" (
+	"move_id"	INTEGER NOT NULL UNIQUE,
+	"user_id"	INTEGER NOT NULL,
+	"entry_id"	INTEGER NOT NULL,
+	"from_location_id"	INTEGER,
+	"to_location_id"	INTEGER,
+	"moved_by"	INTEGER NOT NULL,
+	"moved_at"	INTEGER NOT NULL,
+	PRIMARY KEY("move_id" AUTOINCREMENT)
+)`,
+		`CREATE INDEX "location_moves_user" ON "location_moves" ("user_id","moved_at")`,
+		`ALTER TABLE entries ADD COLUMN location_id INTEGER`,
+		`ALTER TABLE medicine ADD COLUMN storage TEXT NOT NULL DEFAULT 'none'`,
+	)},
+	{Version: 19, Name: "after opening expiry", Up: execStatements(
+		`ALTER TABLE medicine ADD COLUMN open_days INTEGER`,
+		`ALTER TABLE entries ADD COLUMN opened_at INTEGER`,
+		`ALTER TABLE entries ADD COLUMN open_days INTEGER`,
+		`ALTER TABLE entries ADD COLUMN open_expire_at INTEGER`,
+	)},
+}
+
+// execStatements returns a migration step running the given SQL statements in order.
+func execStatements(statements ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// epochColumns maps the text date columns to the Unix epoch columns replacing them
+var epochColumns = []struct {
+	Table, Key, Text, Epoch string
+}{
+	{"entries", "entry_id", "entry_date", "entry_at"},
+	{"entries", "entry_id", "expire_date", "expire_at"},
+	{"notification_log", "log_id", "next_attempt", "next_attempt_at"},
+	{"dose_log", "dose_id", "scheduled_date", "scheduled_at"},
+	{"dose_log", "dose_id", "snooze_until", "snooze_until_at"},
+}
+
+// migrateEpochTimestamps adds Unix epoch columns next to the text dates and
+// fills them from every row that can be parsed. Rows that cannot are left
+// NULL, listings report them instead of guessing.
+func migrateEpochTimestamps(tx *sql.Tx) error {
+	for _, column := range epochColumns {
+		if _, err := tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s INTEGER`, column.Table, column.Epoch)); err != nil {
+			return err
+		}
+
+		type conversion struct {
+			Key   int
+			Epoch int64
+		}
+
+		var conversions []conversion
+		var malformed int
+
+		row, err := tx.Query(fmt.Sprintf(`SELECT %s, %s FROM %s WHERE %s IS NOT NULL AND %s <> ''`, column.Key, column.Text, column.Table, column.Text, column.Text))
+		if err != nil {
+			return err
+		}
+
+		for row.Next() {
+			var key int
+			var value string
+
+			if err = row.Scan(&key, &value); err != nil {
+				row.Close()
+				return err
+			}
+
+			date, err := parseStoredDate(value)
+			if err != nil {
+				malformed++
+				continue
+			}
+
+			conversions = append(conversions, conversion{Key: key, Epoch: toEpoch(date)})
+		}
+		row.Close()
+
+		for _, c := range conversions {
+			if _, err = tx.Exec(fmt.Sprintf(`UPDATE %s SET %s=? WHERE %s=?`, column.Table, column.Epoch, column.Key), c.Epoch, c.Key); err != nil {
+				return err
+			}
+		}
+
+		if malformed > 0 {
+			logger.Warn("unreadable dates", "table", column.Table, "column", column.Text, "rows", malformed)
+		}
+	}
+
+	return execStatements(
+		`CREATE INDEX "entries_expire_at" ON "entries" ("expire_at")`,
+		`CREATE INDEX "notification_log_pending_at" ON "notification_log" ("status","next_attempt_at")`,
+	)(tx)
+}
+
+// optionColumns maps the columns holding option values to their option group
+var optionColumns = []struct {
+	Table, Column, Group string
+}{
+	{"medicine", "size_type", "size"},
+	{"medicine", "type", "type"},
+	{"expire_alarms", "timer_type", "timer"},
+	{"expire_alarms", "before_after", "when"},
+	{"expire_alarms", "action", "action"},
+}
+
+// migrateOptionCodes adds the user's language and replaces the option display
+// strings stored so far, English and Turkish ones, with stable codes.
+func migrateOptionCodes(tx *sql.Tx) error {
+	if _, err := tx.Exec(`ALTER TABLE users ADD COLUMN locale TEXT`); err != nil {
+		return err
+	}
+
+	for _, column := range optionColumns {
+		for value, code := range optionCodes[column.Group] {
+			statement := fmt.Sprintf(`UPDATE %s SET %s=? WHERE %s=?`, column.Table, column.Column, column.Column)
+			if _, err := tx.Exec(statement, code, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// migrateDatabase applies every migration which is not yet recorded in schema_migrations.
+func migrateDatabase() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS "schema_migrations" (
+	"version"	INTEGER NOT NULL UNIQUE,
+	"name"	TEXT NOT NULL,
+	"applied_date"	TEXT NOT NULL,
+	PRIMARY KEY("version")
+)`)
+	if err != nil {
+		return err
+	}
+
+	applied := make(map[int]bool)
+
+	row, err := db.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return err
+	}
+
+	for row.Next() {
+		var version int
+
+		if err = row.Scan(&version); err != nil {
+			row.Close()
+			return err
+		}
+
+		applied[version] = true
+	}
+	row.Close()
+
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if err = m.Up(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %s", m.Version, m.Name, err)
+		}
+
+		if _, err = tx.Exec("INSERT INTO schema_migrations(version,name,applied_date) VALUES(?,?,?)", m.Version, m.Name, getDate()); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+
+		logger.Info("applied migration", "version", m.Version, "name", m.Name)
+	}
+
+	return nil
+}
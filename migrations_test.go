@@ -0,0 +1,65 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// openTestDatabase copies mws.db into a temporary directory and opens the
+// copy with every migration applied as db for the test.
+func openTestDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mws.db")
+
+	base, err := sql.Open("sqlite3", "file:mws.db?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+
+	if _, err = base.Exec("VACUUM INTO ?", path); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := db
+	if db, err = sql.Open(metricsDriver, path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		db = previous
+	})
+
+	if err = migrateDatabase(); err != nil {
+		t.Fatalf("migrateDatabase failed: %s", err)
+	}
+}
+
+func TestMigrationVersions(t *testing.T) {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %q has version %d, want %d", m.Name, m.Version, i+1)
+		}
+		if m.Name == "" || m.Up == nil {
+			t.Errorf("migration %d has no name or step", m.Version)
+		}
+	}
+}
+
+// TestMigrateDatabase applies every migration to a copy of mws.db and expects
+// each to be recorded once, running them again changing nothing.
+func TestMigrateDatabase(t *testing.T) {
+	openTestDatabase(t)
+
+	if err := migrateDatabase(); err != nil {
+		t.Fatalf("migrateDatabase on a migrated database failed: %s", err)
+	}
+
+	var count, latest int
+	if err := db.QueryRow("SELECT COUNT(*), MAX(version) FROM schema_migrations").Scan(&count, &latest); err != nil {
+		t.Fatal(err)
+	}
+	if count != len(migrations) || latest != migrations[len(migrations)-1].Version {
+		t.Errorf("schema_migrations holds %d versions up to %d, want %d up to %d", count, latest, len(migrations), migrations[len(migrations)-1].Version)
+	}
+}
@@ -1,5 +1,5 @@
 /*
-	All rights reserved. (c) 2021
+All rights reserved. (c) 2021
 */
 package main
 
@@ -8,7 +8,10 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"os"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -30,6 +33,64 @@ const (
 	urlPrivacy      = "/privacy"
 	urlTerms        = "/terms"
 	urlSupport      = "/support"
+	urlScan         = "/scan"
+	urlProfile      = "/profile"
+	urlPostProfile  = "/post/profile"
+	urlPatients     = "/patients"
+	urlPostPatient  = "/post/patients/add"
+	urlPostShare    = "/post/patients/share"
+	urlPostUnshare  = "/post/patients/unshare"
+	urlSettings     = "/settings"
+	urlPostChannel  = "/post/settings/channel"
+	urlPostDelChan  = "/post/settings/channel/delete"
+	urlPostQuiet    = "/post/settings/quiet"
+	urlPostNotify   = "/post/settings/test"
+	urlPushKey      = "/push/key"
+	urlPushSub      = "/push/subscribe"
+	urlPushUnsub    = "/push/unsubscribe"
+	urlPushAction   = "/push/action"
+	urlCalendar     = "/calendar/{token:[0-9a-f]+}.ics"
+	urlPostCalendar = "/post/settings/calendar"
+	urlPostTimezone = "/post/settings/timezone"
+	urlLocale       = "/locale/{code:[a-z]+}"
+	urlHealth       = "/healthz"
+	urlReady        = "/readyz"
+	urlMetrics      = "/metrics"
+	urlExport       = "/export"
+	urlImport       = "/import"
+	urlPostImport   = "/post/import"
+	urlPostImpCSV   = "/post/import/csv"
+	urlAccount      = "/account"
+	urlPostDelete   = "/post/account/delete"
+	urlPostRestore  = "/post/account/restore"
+	urlPostRequest  = "/post/account/request"
+	urlAdmin        = "/admin/requests"
+	urlAdminExport  = "/admin/requests/export"
+	urlPostAdmAdd   = "/post/admin/requests"
+	urlPostAdmDone  = "/post/admin/requests/handle"
+	urlPostPassword = "/post/account/password"
+	urlAudit        = "/audit"
+	urlReports      = "/reports"
+	urlAPIReports   = "/api/reports"
+	urlMedList      = "/medlist"
+	urlPostMedShare = "/post/medlist/share"
+	urlPostMedRevok = "/post/medlist/revoke"
+	urlShared       = "/shared/{token:[0-9a-f]+}"
+	urlPrescription = "/prescriptions"
+	urlPrescScan    = "/prescriptions/scan"
+	urlPostPresc    = "/post/prescriptions"
+	urlPostRefill   = "/post/prescriptions/refill"
+	urlAttachments  = "/attachments"
+	urlAttachFile   = "/attachments/file"
+	urlPostAttach   = "/post/attachments"
+	urlPostUnattach = "/post/attachments/delete"
+	urlAPIMedicines = "/api/medicines"
+	urlLocations    = "/locations"
+	urlPostLocation = "/post/locations"
+	urlPostLocDel   = "/post/locations/delete"
+	urlPostMove     = "/post/locations/move"
+	urlPostOpen     = "/post/entries/open"
+	localeDir       = "locales/"
 	tmplBase        = "templates/"
 	tmplIndex       = tmplBase + "index.html"
 	tmplAdd         = tmplBase + "add.html"
@@ -41,6 +102,21 @@ const (
 	tmplPrivacy     = tmplBase + "privacy.html"
 	tmplTerms       = tmplBase + "terms.html"
 	tmplSupport     = tmplBase + "support.html"
+	tmplScan        = tmplBase + "scan.html"
+	tmplConfirm     = tmplBase + "confirm.html"
+	tmplProfile     = tmplBase + "profile.html"
+	tmplPatients    = tmplBase + "patients.html"
+	tmplSettings    = tmplBase + "settings.html"
+	tmplError       = tmplBase + "error.html"
+	tmplImport      = tmplBase + "import.html"
+	tmplAccount     = tmplBase + "account.html"
+	tmplAdmin       = tmplBase + "admin.html"
+	tmplAudit       = tmplBase + "audit.html"
+	tmplReports     = tmplBase + "reports.html"
+	tmplMedList     = tmplBase + "medlist.html"
+	tmplPrescript   = tmplBase + "prescriptions.html"
+	tmplAttachment  = tmplBase + "attachments.html"
+	tmplLocations   = tmplBase + "locations.html"
 )
 
 // MedicineData holds all medicine database columns
@@ -52,33 +128,62 @@ type MedicineData struct {
 	Size     string
 }
 
-// MedicineEntryData holds instance data
-type MedicineEntryData struct {
-	ID          int
-	MedicineID  int
-	EntryDate   string
-	FinalDate   string
+// AddFormData holds the values the add form is pre-filled with
+type AddFormData struct {
 	Name        string
 	Producer    string
+	ExpDate     string
 	Description string
+	Ingredients string
+	Size        string
+	SizeType    string
+	Count       string
+	Type        string
+	GTIN        string
+	Lot         string
+	Serial      string
+	OpenDays    string
+	ScanError   string
+	PatientID   int
+	Patients    []Patient
+
+	PrescriptionID int
+	Prescriptions  []Prescription
+
+	Locations []StorageLocation
+	Storages  []string
 }
 
-// MedicineAlarmedEntryData holds instance data
-type MedicineAlarmedEntryData struct {
-	ID          int
-	MedicineID  int
-	EntryDate   string
-	FinalDate   string
-	Name        string
-	Producer    string
-	Description string
-	Alarm       string
+// Warning holds a safety warning shown to the user
+type Warning struct {
+	Severity string
+	Title    string
+	Message  string
+}
+
+// AlertClass returns the bootstrap alert class matching the warning severity
+func (w Warning) AlertClass() string {
+	switch w.Severity {
+	case "contraindicated", "major":
+		return "alert-danger"
+	case "moderate":
+		return "alert-warning"
+	}
+	return "alert-info"
+}
+
+// ConfirmData holds a submitted form waiting for the user to confirm its warnings
+type ConfirmData struct {
+	Action   string
+	Warnings []Warning
+	Fields   map[string][]string
 }
 
 // MedicineUseAlarmEntryData holds instance data
 type MedicineUseAlarmEntryData struct {
 	ID         int
 	MedicineID int
+	Patient    string
 	Name       string
 	Size       string
 	Count      string
@@ -87,20 +192,26 @@ type MedicineUseAlarmEntryData struct {
 
 // MedicineListingData holds all listing data
 type MedicineListingData struct {
-	Alarmed    []MedicineAlarmedEntryData
-	Expired    []MedicineEntryData
-	NotExpired []MedicineEntryData
+	Filter    PatientFilter
+	Warnings  []Warning
+	Query     CabinetQuery
+	Page      CabinetPage
+	Types     []string
+	Statuses  []string
+	Locations []CabinetLocation
 }
 
 // MedicineWeekListingData holds all listing data
 type MedicineWeekListingData struct {
-	Mon []MedicineUseAlarmEntryData
-	Tue []MedicineUseAlarmEntryData
-	Wed []MedicineUseAlarmEntryData
-	Thu []MedicineUseAlarmEntryData
-	Fri []MedicineUseAlarmEntryData
-	Sat []MedicineUseAlarmEntryData
-	Sun []MedicineUseAlarmEntryData
+	Filter   PatientFilter
+	Warnings []Warning
+	Mon      []MedicineUseAlarmEntryData
+	Tue      []MedicineUseAlarmEntryData
+	Wed      []MedicineUseAlarmEntryData
+	Thu      []MedicineUseAlarmEntryData
+	Fri      []MedicineUseAlarmEntryData
+	Sat      []MedicineUseAlarmEntryData
+	Sun      []MedicineUseAlarmEntryData
 }
 
 // AlarmData holds alarm entry data
@@ -139,28 +250,12 @@ func getDate() string {
 	return current.Format("2006-01-02 15:04:05 -0700")
 }
 
-func getDateDaysAfter(days int) string {
-	return time.Now().UTC().AddDate(0, 0, days).Format("2006-01-02 15:04:05 -0700")
-}
-
-func getDateWeeksAfter(weeks int) string {
-	return time.Now().UTC().AddDate(0, 0, 7*weeks).Format("2006-01-02 15:04:05 -0700")
-}
-
-func getDateMonthsAfter(months int) string {
-	return time.Now().UTC().AddDate(0, months, 0).Format("2006-01-02 15:04:05 -0700")
-}
-
-func getDateYearsAfter(years int) string {
-	return time.Now().UTC().AddDate(years, 0, 0).Format("2006-01-02 15:04:05 -0700")
-}
-
 func getMedicineNameFromID(medID int) (medName string) {
 	result := db.QueryRow("SELECT name FROM medicine WHERE medicine_id=$1", medID)
 	err := result.Scan(&medName)
 
 	if err != nil {
-		fmt.Printf("ERROR getMedicineNameFromID(%d): %s\n", medID, err)
+		logger.Error("getMedicineNameFromID", "medicine_id", medID, "error", err)
 		return
 	}
 
@@ -172,7 +267,7 @@ func getMedicineSizeFromID(medID int) (medName string) {
 	err := result.Scan(&medName)
 
 	if err != nil {
-		fmt.Printf("ERROR getMedicineSizeFromID(%d): %s\n", medID, err)
+		logger.Error("getMedicineSizeFromID", "medicine_id", medID, "error", err)
 		return
 	}
 
@@ -184,7 +279,7 @@ func getMedicineSizeTypeFromID(medID int) (medName string) {
 	err := result.Scan(&medName)
 
 	if err != nil {
-		fmt.Printf("ERROR getMedicineSizeTypeFromID(%d): %s\n", medID, err)
+		logger.Error("getMedicineSizeTypeFromID", "medicine_id", medID, "error", err)
 		return
 	}
 
@@ -196,7 +291,7 @@ func getMedicineCountFromID(medID int) (medName string) {
 	err := result.Scan(&medName)
 
 	if err != nil {
-		fmt.Printf("ERROR getMedicineCountFromID(%d): %s\n", medID, err)
+		logger.Error("getMedicineCountFromID", "medicine_id", medID, "error", err)
 		return
 	}
 
@@ -208,7 +303,7 @@ func getMedicineTypeFromID(medID int) (medName string) {
 	err := result.Scan(&medName)
 
 	if err != nil {
-		fmt.Printf("ERROR getMedicineTypeFromID(%d): %s\n", medID, err)
+		logger.Error("getMedicineTypeFromID", "medicine_id", medID, "error", err)
 		return
 	}
 
@@ -220,7 +315,7 @@ func getMedicineProducerFromID(medID int) (medName string) {
 	err := result.Scan(&medName)
 
 	if err != nil {
-		fmt.Printf("ERROR getMedicineTypeFromID(%d): %s\n", medID, err)
+		logger.Error("getMedicineTypeFromID", "medicine_id", medID, "error", err)
 		return
 	}
 
@@ -232,31 +327,104 @@ func getMedicineDescFromID(medID int) (medName string) {
 	err := result.Scan(&medName)
 
 	if err != nil {
-		fmt.Printf("ERROR getMedicineTypeFromID(%d): %s\n", medID, err)
+		logger.Error("getMedicineTypeFromID", "medicine_id", medID, "error", err)
 		return
 	}
 
 	return medName
 }
 
+func getMedicineIngredientsFromID(medID int) (medIngredients string) {
+	var ingredients sql.NullString
+
+	result := db.QueryRow("SELECT ingredients FROM medicine WHERE medicine_id=$1", medID)
+	err := result.Scan(&ingredients)
+
+	if err != nil {
+		logger.Error("getMedicineIngredientsFromID", "medicine_id", medID, "error", err)
+		return
+	}
+
+	return ingredients.String
+}
+
 func main() {
 	var err error
 
+	// Configuration
+	config = loadConfig()
+
+	// Command line tools keep the standard output for their results
+	logOut := os.Stdout
+	if len(os.Args) > 1 {
+		logOut = os.Stderr
+	}
+	logger = newLogger(logOut, config.LogLevel, config.LogFormat)
+
+	// Keys of the health data encrypted at rest
+	if err = loadMasterKeys(config.MasterKeys); err != nil {
+		logger.Error("loading master keys", "error", err)
+		os.Exit(1)
+	}
+
 	// Database
-	if db, err = sql.Open("sqlite3", "./mws.db"); err != nil {
-		panic(err)
+	if db, err = sql.Open(metricsDriver, "./mws.db"); err != nil {
+		logger.Error("opening database", "error", err)
+		os.Exit(1)
+	}
+
+	if err = migrateDatabase(); err != nil {
+		logger.Error("migrating database", "error", err)
+		os.Exit(1)
+	}
+
+	if err = ensureDataKeys(); err != nil {
+		logger.Error("preparing data keys", "error", err)
+		os.Exit(1)
+	}
+
+	// Attached files and prescription scans
+	if blobs, err = newBlobStore(config); err != nil {
+		logger.Error("opening blob store", "error", err)
+		os.Exit(1)
+	}
+
+	// Message catalogs
+	if err = loadLocales(localeDir); err != nil {
+		logger.Error("loading message catalogs", "error", err)
+		os.Exit(1)
+	}
+
+	// Command line tools
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
 	}
 
 	// Prepare templates
-	tmpl[tmplIndex] = template.Must(template.ParseFiles(tmplIndex, tmplParts))
-	tmpl[tmplAdd] = template.Must(template.ParseFiles(tmplAdd, tmplParts))
-	tmpl[tmplHello] = template.Must(template.ParseFiles(tmplHello, tmplParts))
-	tmpl[tmplWeeklyUse] = template.Must(template.ParseFiles(tmplWeeklyUse, tmplParts))
-	tmpl[tmplRegister] = template.Must(template.ParseFiles(tmplRegister, tmplParts))
-	tmpl[tmplLogin] = template.Must(template.ParseFiles(tmplLogin, tmplParts))
-	tmpl[tmplPrivacy] = template.Must(template.ParseFiles(tmplPrivacy, tmplParts))
-	tmpl[tmplTerms] = template.Must(template.ParseFiles(tmplTerms, tmplParts))
-	tmpl[tmplSupport] = template.Must(template.ParseFiles(tmplSupport, tmplParts))
+	tmpl[tmplIndex] = parseTemplate(tmplIndex)
+	tmpl[tmplAdd] = parseTemplate(tmplAdd)
+	tmpl[tmplHello] = parseTemplate(tmplHello)
+	tmpl[tmplWeeklyUse] = parseTemplate(tmplWeeklyUse)
+	tmpl[tmplRegister] = parseTemplate(tmplRegister)
+	tmpl[tmplLogin] = parseTemplate(tmplLogin)
+	tmpl[tmplPrivacy] = parseTemplate(tmplPrivacy)
+	tmpl[tmplTerms] = parseTemplate(tmplTerms)
+	tmpl[tmplSupport] = parseTemplate(tmplSupport)
+	tmpl[tmplScan] = parseTemplate(tmplScan)
+	tmpl[tmplConfirm] = parseTemplate(tmplConfirm)
+	tmpl[tmplProfile] = parseTemplate(tmplProfile)
+	tmpl[tmplPatients] = parseTemplate(tmplPatients)
+	tmpl[tmplSettings] = parseTemplate(tmplSettings)
+	tmpl[tmplError] = parseTemplate(tmplError)
+	tmpl[tmplImport] = parseTemplate(tmplImport)
+	tmpl[tmplAccount] = parseTemplate(tmplAccount)
+	tmpl[tmplAdmin] = parseTemplate(tmplAdmin)
+	tmpl[tmplAudit] = parseTemplate(tmplAudit)
+	tmpl[tmplReports] = parseTemplate(tmplReports)
+	tmpl[tmplMedList] = parseTemplate(tmplMedList)
+	tmpl[tmplPrescript] = parseTemplate(tmplPrescript)
+	tmpl[tmplAttachment] = parseTemplate(tmplAttachment)
+	tmpl[tmplLocations] = parseTemplate(tmplLocations)
 
 	// Function pages
 	router.HandleFunc(urlLogin, loginHandler)
@@ -264,6 +432,63 @@ func main() {
 	router.HandleFunc(urlRegister, registerHandler)
 	router.HandleFunc(urlPostLogin, postLoginHandler).Methods("POST")
 	router.HandleFunc(urlPostRegister, postRegisterHandler).Methods("POST")
+	router.HandleFunc(urlScan, scanHandler)
+	router.HandleFunc(urlProfile, profileHandler)
+	router.HandleFunc(urlPostProfile, postProfileHandler).Methods("POST")
+	router.HandleFunc(urlPatients, patientsHandler)
+	router.HandleFunc(urlPostPatient, postAddPatientHandler).Methods("POST")
+	router.HandleFunc(urlPostShare, postSharePatientHandler).Methods("POST")
+	router.HandleFunc(urlPostUnshare, postUnsharePatientHandler).Methods("POST")
+	router.HandleFunc(urlSettings, settingsHandler)
+	router.HandleFunc(urlPostChannel, postAddChannelHandler).Methods("POST")
+	router.HandleFunc(urlPostDelChan, postDeleteChannelHandler).Methods("POST")
+	router.HandleFunc(urlPostQuiet, postQuietHoursHandler).Methods("POST")
+	router.HandleFunc(urlPostNotify, postTestNotificationHandler).Methods("POST")
+	router.HandleFunc(urlPushKey, pushKeyHandler)
+	router.HandleFunc(urlPushSub, pushSubscribeHandler).Methods("POST")
+	router.HandleFunc(urlPushUnsub, pushUnsubscribeHandler).Methods("POST")
+	router.HandleFunc(urlPushAction, pushActionHandler).Methods("POST")
+	router.HandleFunc(urlCalendar, calendarHandler)
+	router.HandleFunc(urlPostCalendar, postResetCalendarHandler).Methods("POST")
+	router.HandleFunc(urlPostTimezone, postTimezoneHandler).Methods("POST")
+	router.HandleFunc(urlLocale, localeHandler)
+	router.HandleFunc(urlHealth, healthHandler)
+	router.HandleFunc(urlReady, readyHandler)
+	router.HandleFunc(urlMetrics, metricsHandler)
+	router.HandleFunc(urlExport, exportHandler)
+	router.HandleFunc(urlImport, importHandler)
+	router.HandleFunc(urlPostImport, postImportHandler).Methods("POST")
+	router.HandleFunc(urlPostImpCSV, postImportCSVHandler).Methods("POST")
+	router.HandleFunc(urlAccount, accountHandler)
+	router.HandleFunc(urlPostDelete, postDeleteAccountHandler).Methods("POST")
+	router.HandleFunc(urlPostRestore, postRestoreAccountHandler).Methods("POST")
+	router.HandleFunc(urlPostRequest, postDataRequestHandler).Methods("POST")
+	router.HandleFunc(urlAdmin, adminHandler)
+	router.HandleFunc(urlAdminExport, adminExportHandler)
+	router.HandleFunc(urlPostAdmAdd, postAdminAddHandler).Methods("POST")
+	router.HandleFunc(urlPostAdmDone, postAdminHandleHandler).Methods("POST")
+	router.HandleFunc(urlPostPassword, postPasswordHandler).Methods("POST")
+	router.HandleFunc(urlAudit, auditHandler)
+	router.HandleFunc(urlReports, reportsHandler)
+	router.HandleFunc(urlAPIReports, apiReportsHandler)
+	router.HandleFunc(urlMedList, medListHandler)
+	router.HandleFunc(urlPostMedShare, postMedListShareHandler).Methods("POST")
+	router.HandleFunc(urlPostMedRevok, postMedListRevokeHandler).Methods("POST")
+	router.HandleFunc(urlShared, sharedMedListHandler)
+	router.HandleFunc(urlPrescription, prescriptionsHandler)
+	router.HandleFunc(urlPrescScan, prescriptionScanHandler)
+	router.HandleFunc(urlPostPresc, postPrescriptionHandler).Methods("POST")
+	router.HandleFunc(urlPostRefill, postRefillHandler).Methods("POST")
+	router.HandleFunc(urlAttachments, attachmentsHandler)
+	router.HandleFunc(urlAttachFile, attachmentFileHandler)
+	router.HandleFunc(urlPostAttach, postAttachmentHandler).Methods("POST")
+	router.HandleFunc(urlPostUnattach, postUnattachHandler).Methods("POST")
+	router.HandleFunc(urlAPIMedicines, apiMedicinesHandler)
+	router.HandleFunc(urlLocations, locationsHandler)
+	router.HandleFunc(urlPostLocation, postLocationHandler).Methods("POST")
+	router.HandleFunc(urlPostLocDel, postLocationDelHandler).Methods("POST")
+	router.HandleFunc(urlPostMove, postMoveHandler).Methods("POST")
+	router.HandleFunc(urlPostOpen, postOpenHandler).Methods("POST")
 
 	// Pages
 	router.HandleFunc("/", func(response http.ResponseWriter, request *http.Request) {
@@ -273,99 +498,46 @@ func main() {
 			return
 		}
 
-		// Get alarms
-		var alarms []AlarmData
-
-		row, err := db.Query("SELECT entry_id, timer, timer_type, before_after FROM expire_alarms WHERE user_id=$1", getUserID(getUserName(request)))
-		if err != nil {
-			panic(err)
-		}
-		defer row.Close()
-
-		for row.Next() {
-			var entryID int
-			var timer int
-			var timerType sql.NullString
-			var beforeAfter sql.NullString
-
-			err = row.Scan(&entryID, &timer, &timerType, &beforeAfter)
-			if err != nil {
-				panic(err)
-			}
-
-			alarms = append(alarms, AlarmData{EntryID: entryID, Time: timer, TimeType: timerType.String, BeforeAfter: beforeAfter.String})
-		}
+		// Get the patients to list
+		patients, filter := getSelectedPatients(request, getUserID(getUserName(request)), "/")
 
-		// Get entries
-		var listingData MedicineListingData
+		// Dates are shown in the user's timezone and language
+		location := getUserLocation(getUserID(getUserName(request)))
+		locale := getLocale(request)
 
-		row, err = db.Query("SELECT entry_id, medicine_id, entry_date, expire_date FROM entries WHERE user_id=$1 ORDER BY expire_date ASC", getUserID(getUserName(request)))
+		// Get the page of entries searched, filtered and sorted
+		query := parseCabinetQuery(request, locale, location)
+		page, malformed, err := getCabinetPage(patients, query, location, locale)
 		if err != nil {
-			panic(err)
+			serverError(response, request, "listingHandler", err)
+			return
 		}
-		defer row.Close()
-
-		for row.Next() {
-			var id int
-			var medicineID int
-			var entryDate sql.NullString
-			var finalDate sql.NullString
-
-			err = row.Scan(&id, &medicineID, &entryDate, &finalDate)
-			if err != nil {
-				panic(err)
-			}
-
-			// Find alarm
-			var alarmStr string
-			var myAlarmDate string
-
-			for i := range alarms {
-				if alarms[i].EntryID == id {
-					alarmStr = fmt.Sprintf("%d %s %s", alarms[i].Time, alarms[i].TimeType, alarms[i].BeforeAfter)
-
-					if alarms[i].TimeType == "Day" {
-						myAlarmDate = getDateDaysAfter(alarms[i].Time)
-					} else if alarms[i].TimeType == "Week" {
-						myAlarmDate = getDateWeeksAfter(alarms[i].Time)
-					} else if alarms[i].TimeType == "Month" {
-						myAlarmDate = getDateMonthsAfter(alarms[i].Time)
-					} else if alarms[i].TimeType == "Year" {
-						myAlarmDate = getDateYearsAfter(alarms[i].Time)
-					}
-
-					break
-				}
-			}
-
-			// Separate them
-			if finalDate.Valid {
-				myEntryDate, err := time.Parse("2006-01-02 15:04:05 -0700", entryDate.String)
-				if err != nil {
-					return
-				}
 
-				outEntryDate := myEntryDate.Format("02/01/2006 15:04")
-
-				myFinalDate, err := time.Parse("2006-01-02 15:04:05 -0700", finalDate.String)
-				if err != nil {
-					return
-				}
+		listingData := MedicineListingData{Filter: filter, Query: query, Page: page, Types: getCabinetTypes(patients), Statuses: cabinetStatuses, Locations: getCabinetLocations(patients)}
 
-				outFinalDate := myFinalDate.Format("02/01/2006 15:04")
+		if len(malformed) > 0 {
+			listingData.Warnings = append(listingData.Warnings, Warning{
+				Severity: "minor",
+				Title:    locale.T("warning.malformed.title"),
+				Message:  locale.T("warning.malformed.message", strings.Join(malformed, ", ")),
+			})
+		}
 
-				if finalDate.String < getDate() {
-					listingData.Expired = append(listingData.Expired, MedicineEntryData{ID: id, MedicineID: medicineID, EntryDate: outEntryDate, FinalDate: outFinalDate, Name: getMedicineNameFromID(medicineID), Producer: getMedicineProducerFromID(medicineID), Description: getMedicineDescFromID(medicineID)})
-				} else if finalDate.String < myAlarmDate {
-					listingData.Alarmed = append(listingData.Alarmed, MedicineAlarmedEntryData{ID: id, MedicineID: medicineID, EntryDate: outEntryDate, FinalDate: outFinalDate, Name: getMedicineNameFromID(medicineID), Producer: getMedicineProducerFromID(medicineID), Description: getMedicineDescFromID(medicineID), Alarm: alarmStr})
-				} else {
-					listingData.NotExpired = append(listingData.NotExpired, MedicineEntryData{ID: id, MedicineID: medicineID, EntryDate: outEntryDate, FinalDate: outFinalDate, Name: getMedicineNameFromID(medicineID), Producer: getMedicineProducerFromID(medicineID), Description: getMedicineDescFromID(medicineID)})
+		// Check the medicines in use of every patient against each other
+		for _, patient := range patients {
+			for _, warning := range checkInteractions(getActiveMedicines(patient.ID), nil, locale) {
+				if len(patients) > 1 {
+					warning.Title = patient.Name + ": " + warning.Title
 				}
+				listingData.Warnings = append(listingData.Warnings, warning)
 			}
 		}
 
+		// Prescriptions about to lapse or without refills
+		listingData.Warnings = append(listingData.Warnings, checkPrescriptions(getPrescriptions(patients, location, locale), locale)...)
+
 		// Execute template with prepared data
-		err = tmpl[tmplIndex].Execute(response, listingData)
+		err = renderTemplate(response, request, tmplIndex, listingData)
 
 		if err != nil {
 			return
@@ -379,12 +551,20 @@ func main() {
 			return
 		}
 
+		// Get the patients to list
+		patients, filter := getSelectedPatients(request, getUserID(getUserName(request)), urlWeeklyUse)
+		names := patientNames(patients)
+		locale := getLocale(request)
+
 		// Get use alarms
 		var useAlarms []UseAlarmData
 
-		row, err := db.Query("SELECT entry_id, mon, tue, wed, thu, fri, sat, sun, hour FROM use_alarms WHERE user_id=$1 ORDER BY hour ASC", getUserID(getUserName(request)))
+		clause, args := patientIDsClause("patient_id", patients)
+
+		row, err := db.Query("SELECT entry_id, mon, tue, wed, thu, fri, sat, sun, hour FROM use_alarms WHERE "+clause, args...)
 		if err != nil {
-			panic(err)
+			serverError(response, request, "weeklyHandler", err)
+			return
 		}
 		defer row.Close()
 
@@ -401,30 +581,35 @@ func main() {
 
 			err = row.Scan(&entryID, &mon, &tue, &wed, &thu, &fri, &sat, &sun, &hour)
 			if err != nil {
-				panic(err)
+				serverError(response, request, "weeklyHandler", err)
+				return
 			}
 
 			useAlarms = append(useAlarms, UseAlarmData{EntryID: entryID, Mon: mon.String, Tue: tue.String, Wed: wed.String, Thu: thu.String, Fri: fri.String, Sat: sat.String, Sun: sun.String, Hour: hour.String})
 		}
 
+		// Hours are sealed in the database, so they are sorted once read
+		sort.SliceStable(useAlarms, func(i, j int) bool { return useAlarms[i].Hour < useAlarms[j].Hour })
+
 		// Get entries
-		var weekListData MedicineWeekListingData
+		weekListData := MedicineWeekListingData{Filter: filter}
 
-		row, err = db.Query("SELECT entry_id, medicine_id, entry_date, expire_date FROM entries WHERE user_id=$1", getUserID(getUserName(request)))
+		row, err = db.Query("SELECT entry_id, medicine_id, patient_id FROM entries WHERE "+clause, args...)
 		if err != nil {
-			panic(err)
+			serverError(response, request, "weeklyHandler", err)
+			return
 		}
 		defer row.Close()
 
 		for row.Next() {
 			var id int
 			var medicineID int
-			var entryDate sql.NullString
-			var finalDate sql.NullString
+			var patientID int
 
-			err = row.Scan(&id, &medicineID, &entryDate, &finalDate)
+			err = row.Scan(&id, &medicineID, &patientID)
 			if err != nil {
-				panic(err)
+				serverError(response, request, "weeklyHandler", err)
+				return
 			}
 
 			// Find alarm
@@ -440,31 +625,31 @@ func main() {
 
 			// Separate them
 			if myAlarm.Mon == "on" {
-				weekListData.Mon = append(weekListData.Mon, MedicineUseAlarmEntryData{ID: id, MedicineID: medicineID, Name: getMedicineNameFromID(medicineID), Size: fmt.Sprintf("%s %s", getMedicineSizeFromID(medicineID), getMedicineSizeTypeFromID(medicineID)), Count: fmt.Sprintf("%s %s", getMedicineCountFromID(medicineID), getMedicineTypeFromID(medicineID)), Hour: myAlarm.Hour})
+				weekListData.Mon = append(weekListData.Mon, MedicineUseAlarmEntryData{ID: id, MedicineID: medicineID, Patient: names[patientID], Name: getMedicineNameFromID(medicineID), Size: locale.FormatNumber(getMedicineSizeFromID(medicineID)) + " " + locale.Option("size", getMedicineSizeTypeFromID(medicineID)), Count: locale.FormatNumber(getMedicineCountFromID(medicineID)) + " " + locale.Option("type", getMedicineTypeFromID(medicineID)), Hour: myAlarm.Hour})
 			}
 
 			if myAlarm.Tue == "on" {
-				weekListData.Tue = append(weekListData.Tue, MedicineUseAlarmEntryData{ID: id, MedicineID: medicineID, Name: getMedicineNameFromID(medicineID), Size: fmt.Sprintf("%s %s", getMedicineSizeFromID(medicineID), getMedicineSizeTypeFromID(medicineID)), Count: fmt.Sprintf("%s %s", getMedicineCountFromID(medicineID), getMedicineTypeFromID(medicineID)), Hour: myAlarm.Hour})
+				weekListData.Tue = append(weekListData.Tue, MedicineUseAlarmEntryData{ID: id, MedicineID: medicineID, Patient: names[patientID], Name: getMedicineNameFromID(medicineID), Size: locale.FormatNumber(getMedicineSizeFromID(medicineID)) + " " + locale.Option("size", getMedicineSizeTypeFromID(medicineID)), Count: locale.FormatNumber(getMedicineCountFromID(medicineID)) + " " + locale.Option("type", getMedicineTypeFromID(medicineID)), Hour: myAlarm.Hour})
 			}
 
 			if myAlarm.Wed == "on" {
-				weekListData.Wed = append(weekListData.Wed, MedicineUseAlarmEntryData{ID: id, MedicineID: medicineID, Name: getMedicineNameFromID(medicineID), Size: fmt.Sprintf("%s %s", getMedicineSizeFromID(medicineID), getMedicineSizeTypeFromID(medicineID)), Count: fmt.Sprintf("%s %s", getMedicineCountFromID(medicineID), getMedicineTypeFromID(medicineID)), Hour: myAlarm.Hour})
+				weekListData.Wed = append(weekListData.Wed, MedicineUseAlarmEntryData{ID: id, MedicineID: medicineID, Patient: names[patientID], Name: getMedicineNameFromID(medicineID), Size: locale.FormatNumber(getMedicineSizeFromID(medicineID)) + " " + locale.Option("size", getMedicineSizeTypeFromID(medicineID)), Count: locale.FormatNumber(getMedicineCountFromID(medicineID)) + " " + locale.Option("type", getMedicineTypeFromID(medicineID)), Hour: myAlarm.Hour})
 			}
 
 			if myAlarm.Thu == "on" {
-				weekListData.Thu = append(weekListData.Thu, MedicineUseAlarmEntryData{ID: id, MedicineID: medicineID, Name: getMedicineNameFromID(medicineID), Size: fmt.Sprintf("%s %s", getMedicineSizeFromID(medicineID), getMedicineSizeTypeFromID(medicineID)), Count: fmt.Sprintf("%s %s", getMedicineCountFromID(medicineID), getMedicineTypeFromID(medicineID)), Hour: myAlarm.Hour})
+				weekListData.Thu = append(weekListData.Thu, MedicineUseAlarmEntryData{ID: id, MedicineID: medicineID, Patient: names[patientID], Name: getMedicineNameFromID(medicineID), Size: locale.FormatNumber(getMedicineSizeFromID(medicineID)) + " " + locale.Option("size", getMedicineSizeTypeFromID(medicineID)), Count: locale.FormatNumber(getMedicineCountFromID(medicineID)) + " " + locale.Option("type", getMedicineTypeFromID(medicineID)), Hour: myAlarm.Hour})
 			}
 
 			if myAlarm.Fri == "on" {
-				weekListData.Fri = append(weekListData.Fri, MedicineUseAlarmEntryData{ID: id, MedicineID: medicineID, Name: getMedicineNameFromID(medicineID), Size: fmt.Sprintf("%s %s", getMedicineSizeFromID(medicineID), getMedicineSizeTypeFromID(medicineID)), Count: fmt.Sprintf("%s %s", getMedicineCountFromID(medicineID), getMedicineTypeFromID(medicineID)), Hour: myAlarm.Hour})
+				weekListData.Fri = append(weekListData.Fri, MedicineUseAlarmEntryData{ID: id, MedicineID: medicineID, Patient: names[patientID], Name: getMedicineNameFromID(medicineID), Size: locale.FormatNumber(getMedicineSizeFromID(medicineID)) + " " + locale.Option("size", getMedicineSizeTypeFromID(medicineID)), Count: locale.FormatNumber(getMedicineCountFromID(medicineID)) + " " + locale.Option("type", getMedicineTypeFromID(medicineID)), Hour: myAlarm.Hour})
 			}
 
 			if myAlarm.Sat == "on" {
-				weekListData.Sat = append(weekListData.Sat, MedicineUseAlarmEntryData{ID: id, MedicineID: medicineID, Name: getMedicineNameFromID(medicineID), Size: fmt.Sprintf("%s %s", getMedicineSizeFromID(medicineID), getMedicineSizeTypeFromID(medicineID)), Count: fmt.Sprintf("%s %s", getMedicineCountFromID(medicineID), getMedicineTypeFromID(medicineID)), Hour: myAlarm.Hour})
+				weekListData.Sat = append(weekListData.Sat, MedicineUseAlarmEntryData{ID: id, MedicineID: medicineID, Patient: names[patientID], Name: getMedicineNameFromID(medicineID), Size: locale.FormatNumber(getMedicineSizeFromID(medicineID)) + " " + locale.Option("size", getMedicineSizeTypeFromID(medicineID)), Count: locale.FormatNumber(getMedicineCountFromID(medicineID)) + " " + locale.Option("type", getMedicineTypeFromID(medicineID)), Hour: myAlarm.Hour})
 			}
 
 			if myAlarm.Sun == "on" {
-				weekListData.Sun = append(weekListData.Sun, MedicineUseAlarmEntryData{ID: id, MedicineID: medicineID, Name: getMedicineNameFromID(medicineID), Size: fmt.Sprintf("%s %s", getMedicineSizeFromID(medicineID), getMedicineSizeTypeFromID(medicineID)), Count: fmt.Sprintf("%s %s", getMedicineCountFromID(medicineID), getMedicineTypeFromID(medicineID)), Hour: myAlarm.Hour})
+				weekListData.Sun = append(weekListData.Sun, MedicineUseAlarmEntryData{ID: id, MedicineID: medicineID, Patient: names[patientID], Name: getMedicineNameFromID(medicineID), Size: locale.FormatNumber(getMedicineSizeFromID(medicineID)) + " " + locale.Option("size", getMedicineSizeTypeFromID(medicineID)), Count: locale.FormatNumber(getMedicineCountFromID(medicineID)) + " " + locale.Option("type", getMedicineTypeFromID(medicineID)), Hour: myAlarm.Hour})
 			}
 		}
 
@@ -477,8 +662,18 @@ func main() {
 		sort.Sort(ByHour(weekListData.Sat))
 		sort.Sort(ByHour(weekListData.Sun))
 
+		// Check the scheduled daily intake of every patient
+		for _, patient := range patients {
+			for _, warning := range checkDailyDoses(getScheduledDoses(patient.ID), nil, locale) {
+				if len(patients) > 1 {
+					warning.Title = patient.Name + ": " + warning.Title
+				}
+				weekListData.Warnings = append(weekListData.Warnings, warning)
+			}
+		}
+
 		// Execute template with prepared data
-		err = tmpl[tmplWeeklyUse].Execute(response, weekListData)
+		err = renderTemplate(response, request, tmplWeeklyUse, weekListData)
 
 		if err != nil {
 			return
@@ -492,7 +687,37 @@ func main() {
 			return
 		}
 
-		err := tmpl[tmplAdd].Execute(response, nil)
+		userID := getUserID(getUserName(request))
+		form := AddFormData{Patients: getManagedPatients(userID)}
+		form.PatientID, _ = strconv.Atoi(request.FormValue("patient"))
+		form.PrescriptionID, _ = strconv.Atoi(request.FormValue("prescription"))
+		form.Prescriptions = getPrescriptions(form.Patients, getUserLocation(userID), getLocale(request))
+		form.Locations = getPatientsLocations(form.Patients)
+		form.Storages = storageConditions
+
+		// Pre-fill the form from a scanned GS1 DataMatrix code
+		if code := request.FormValue("code"); code != "" {
+			scanned, err := parseGS1(code)
+
+			if err != nil {
+				form.ScanError = err.Error()
+			} else {
+				form.GTIN = scanned.GTIN
+				form.Lot = scanned.Lot
+				form.Serial = scanned.Serial
+
+				if scanned.HasExpiry {
+					// A pack may be used until the end of its expiry day
+					form.ExpDate = getLocale(request).FormatDate(scanned.Expiry) + " 23:59"
+				}
+
+				if scanned.GTIN != "" {
+					getMedicineFormFromGTIN(userID, scanned.GTIN, &form)
+				}
+			}
+		}
+
+		err := renderTemplate(response, request, tmplAdd, form)
 
 		if err != nil {
 			return
@@ -507,134 +732,84 @@ func main() {
 		}
 
 		// Get the form data
-		name := request.FormValue("medicineName")
-		firm := request.FormValue("medicineFirm")
-		expDate := request.FormValue("medicineExpDate")
-		count := request.FormValue("entryCount")
-		desc := request.FormValue("medicineDescription")
-		size := request.FormValue("medicineSizePerBox")
-		sizeType := request.FormValue("medicineSizeType")
-		medCount := request.FormValue("medicineCountPerBox")
-		medType := request.FormValue("medicineType")
-
-		expName := request.FormValue("expireAlarmName")
-		expTime := request.FormValue("expireAlarmTime")
-		expType := request.FormValue("expireAlarmTimeType")
-		expBeforeAfter := request.FormValue("expireAlarmBeforeAfter")
-		expAction := request.FormValue("expireAlarmAction")
-
-		mon := request.FormValue("useAlarmMonday")
-		tue := request.FormValue("useAlarmTuesday")
-		wed := request.FormValue("useAlarmWednesday")
-		thu := request.FormValue("useAlarmThursday")
-		fri := request.FormValue("useAlarmFriday")
-		sat := request.FormValue("useAlarmSaturday")
-		sun := request.FormValue("useAlarmSunday")
-		useTime := request.FormValue("useAlarmTime")
-
-		// Check if any of necessary fields are empty
-		if name == "" || firm == "" || expDate == "" ||
-			count == "" || size == "" || sizeType == "" ||
-			medCount == "" || medType == "" || expName == "" ||
-			expTime == "" || expType == "" || expBeforeAfter == "" ||
-			expAction == "" || useTime == "" {
+		input := getMedicineInput(request)
+		userID := getUserID(getUserName(request))
+
+		// Check the fields and turn the expiration date into proper time data
+		if err := input.validate(getLocale(request), getUserLocation(userID)); err != nil {
 			http.Redirect(response, request, urlAdd, 302)
 			return
 		}
 
-		// Turn expiration date into proper time data
-		realExpDate, err := time.Parse("02/01/2006 15:04", expDate)
+		// The medicine has to be added for a patient the user manages
+		patientID, _ := strconv.Atoi(request.FormValue("patientID"))
 
-		if err != nil {
-			fmt.Println("error 1")
+		patient, ok := getPatient(userID, patientID)
+		if !ok || !patient.CanManage() {
 			http.Redirect(response, request, urlAdd, 302)
 			return
 		}
 
-		// Turn alarm clock into proper time data (only for checking)
-		_, err = time.Parse("15:04", useTime)
-
-		if err != nil {
-			fmt.Println("error 2")
+		// A package can only come with a prescription of its patient
+		if input.PrescriptionID != 0 && !isPatientPrescription(patientID, input.PrescriptionID) {
 			http.Redirect(response, request, urlAdd, 302)
 			return
 		}
 
-		// Insert the data into DB
-		redirectTarget := "/"
-		userID := getUserID(getUserName(request))
-
-		// Prepare medicine data
-		medicineSQLStatement := `INSERT INTO medicine(user_id,name,producer,description,size,size_type,med_count,type) VALUES(?,?,?,?,?,?,?,?)`
-		medicineStatement, err := db.Prepare(medicineSQLStatement)
-		if err != nil {
-			fmt.Println(err.Error())
+		// and be kept at a place of the patient's account
+		if input.LocationID != 0 && !isOwnerLocation(patient.OwnerID, input.LocationID) {
+			http.Redirect(response, request, urlAdd, 302)
 			return
 		}
 
-		medResult, err := medicineStatement.Exec(userID, name, firm, desc, size, sizeType, medCount, medType)
-		if err != nil {
-			fmt.Println(err.Error())
-			return
-		}
+		// Insert the data into DB, owned by the patient's account
+		redirectTarget := fmt.Sprintf("/?patient=%d", patientID)
 
-		medID, err := medResult.LastInsertId()
-		if err != nil {
-			fmt.Println(err.Error())
-			return
-		}
+		// Warn about interactions and the health profile before saving
+		if request.FormValue("confirmWarnings") != "on" {
+			added := ActiveMedicine{Name: input.Name, Ingredients: getDrugDatabase().resolveIngredients(input.Name, input.Ingredients)}
 
-		// Prepare entry data
-		entrySQLStatement := `INSERT INTO entries(medicine_id,user_id,entry_date,expire_date) VALUES(?,?,?,?)`
-		entryStatement, err := db.Prepare(entrySQLStatement)
-		if err != nil {
-			fmt.Println(err.Error())
-			return
-		}
+			schedule := newScheduledDose(input.Name, input.Ingredients, input.Size, input.SizeType)
+			schedule.Count = parseDoseCount(input.DoseCount)
+			for i, day := range input.Days {
+				schedule.Days[i] = day == "on"
+			}
 
-		entryResult, err := entryStatement.Exec(medID, userID, getDate(), realExpDate.Format("2006-01-02 15:04:05 -0700"))
-		if err != nil {
-			fmt.Println(err.Error())
-			return
-		}
+			locale := getLocale(request)
+			warnings := checkInteractions(getActiveMedicines(patientID), &added, locale)
+			warnings = append(warnings, checkHealthProfile(getHealthProfile(patientID), added.Ingredients, locale)...)
+			warnings = append(warnings, checkDailyDoses(getScheduledDoses(patientID), &schedule, locale)...)
 
-		entryID, err := entryResult.LastInsertId()
-		if err != nil {
-			fmt.Println(err.Error())
-			return
-		}
+			if input.LocationID != 0 {
+				location, locationStorage := getLocation(input.LocationID)
+				warnings = append(warnings, checkStorage(input.Name, input.Storage, location, locationStorage, locale)...)
+			}
 
-		// Prepare expire alarm
-		expireSQLStatement := `INSERT INTO expire_alarms(entry_id,user_id,timer,timer_type,before_after,action) VALUES(?,?,?,?,?,?)`
-		expireStatement, err := db.Prepare(expireSQLStatement)
-		if err != nil {
-			fmt.Println(err.Error())
-			return
+			if len(warnings) > 0 {
+				renderConfirm(response, request, urlPostAdd, warnings)
+				return
+			}
 		}
 
-		_, err = expireStatement.Exec(entryID, userID, expTime, expType, expBeforeAfter, expAction)
+		// The medicine, its package, alarms and audit entry are stored together or not at all
+		tx, err := db.Begin()
 		if err != nil {
-			fmt.Println(err.Error())
+			serverError(response, request, "postAddHandler", err)
 			return
 		}
 
-		// Prepare use alarm
-		useSQLStatement := `INSERT INTO use_alarms(entry_id,user_id,mon,tue,wed,thu,fri,sat,sun,hour) VALUES(?,?,?,?,?,?,?,?,?,?)`
-		useStatement, err := db.Prepare(useSQLStatement)
-		if err != nil {
-			fmt.Println(err.Error())
+		if _, _, err = insertMedicine(tx, requestActor(request), patient.OwnerID, patientID, input, time.Now()); err != nil {
+			tx.Rollback()
+			serverError(response, request, "postAddHandler", err)
 			return
 		}
 
-		_, err = useStatement.Exec(entryID, userID, mon, tue, wed, thu, fri, sat, sun, useTime)
-		if err != nil {
-			fmt.Println(err.Error())
+		if err = tx.Commit(); err != nil {
+			serverError(response, request, "postAddHandler", err)
 			return
 		}
 
-		// Redirect user to login page
-		fmt.Println("DEBUG: Successful entry record")
-
+		// Redirect user to the listing
 		http.Redirect(response, request, redirectTarget, 302)
 	})
 
@@ -645,7 +820,7 @@ func main() {
 			return
 		}
 
-		err := tmpl[tmplHello].Execute(response, nil)
+		err := renderTemplate(response, request, tmplHello, nil)
 
 		if err != nil {
 			return
@@ -653,7 +828,7 @@ func main() {
 	})
 
 	router.HandleFunc(urlPrivacy, func(response http.ResponseWriter, request *http.Request) {
-		err := tmpl[tmplPrivacy].Execute(response, nil)
+		err := renderTemplate(response, request, tmplPrivacy, nil)
 
 		if err != nil {
 			return
@@ -661,7 +836,7 @@ func main() {
 	})
 
 	router.HandleFunc(urlTerms, func(response http.ResponseWriter, request *http.Request) {
-		err := tmpl[tmplTerms].Execute(response, nil)
+		err := renderTemplate(response, request, tmplTerms, nil)
 
 		if err != nil {
 			return
@@ -669,18 +844,27 @@ func main() {
 	})
 
 	router.HandleFunc(urlSupport, func(response http.ResponseWriter, request *http.Request) {
-		err := tmpl[tmplSupport].Execute(response, nil)
+		err := renderTemplate(response, request, tmplSupport, nil)
 
 		if err != nil {
 			return
 		}
 	})
 
+	// Every request gets an ID, is logged, counted and survives a panicking handler
+	router.Use(requestIDMiddleware, accessLogMiddleware, metricsMiddleware, recoverMiddleware)
+
 	// File server
 	router.PathPrefix("/res/").Handler(http.StripPrefix("/res/", http.FileServer(http.Dir("static"))))
 
+	// Alarms and notifications
+	go runScheduler()
+
 	// Server
-	http.ListenAndServe(":8090", router)
+	logger.Info("listening", "addr", ":8090")
+	if err = http.ListenAndServe(":8090", router); err != nil {
+		logger.Error("serving", "error", err)
+	}
 
 	// Shutting down
 	db.Close()
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	channelEmail   = "email"
+	channelWebhook = "webhook"
+	channelWebPush = "webpush"
+
+	notificationPending   = "pending"
+	notificationDelivered = "delivered"
+	notificationFailed    = "failed"
+
+	notificationMaxAttempts = 6
+)
+
+// Notification holds a message for a user, independent of the channel it goes out on
+type Notification struct {
+	UserID  int
+	EntryID int
+	Kind    string
+	Title   string
+	Body    string
+	URL     string
+	// Channel limits delivery to one kind of channel when set
+	Channel string
+	// Token lets the recipient act on the notification, e.g. mark a dose taken
+	Token string
+}
+
+// NotificationChannel holds a destination a user receives notifications on
+type NotificationChannel struct {
+	ID         int
+	UserID     int
+	Channel    string
+	Target     string
+	Secret     string
+	Enabled    bool
+	CreateDate string
+}
+
+// NotificationLogEntry holds a single delivery of a notification over a channel
+type NotificationLogEntry struct {
+	ID          int
+	ChannelID   int
+	Channel     string
+	Kind        string
+	Title       string
+	Status      string
+	Attempts    int
+	Error       string
+	CreateDate  string
+	UpdateDate  string
+	NextAttempt string
+}
+
+// Notifier delivers notifications over a single kind of channel
+type Notifier interface {
+	Send(channel NotificationChannel, notification Notification) error
+}
+
+// notifyClient posts webhooks and web pushes. It only connects to public
+// addresses, checked again when dialing as a name can resolve differently
+// than when the target was saved.
+var notifyClient = &http.Client{
+	Timeout: 15 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: dialPublic}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		ForceAttemptHTTP2:   true,
+	},
+}
+
+// internalNetworks holds the private, shared and reserved address ranges
+// which are not reachable from the internet
+var internalNetworks []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16", "198.18.0.0/15", "240.0.0.0/4", "fc00::/7"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		internalNetworks = append(internalNetworks, network)
+	}
+}
+
+// isInternalIP reports if the address is the server itself or on a network
+// of its own, like the metrics endpoint or other services next to it.
+func isInternalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, network := range internalNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPublicHost reports if the host is a public address or a name resolving
+// to public addresses only.
+func isPublicHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return !isInternalIP(ip)
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if isInternalIP(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialPublic refuses connections of the notification client to internal addresses.
+func dialPublic(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || isInternalIP(ip) {
+		return fmt.Errorf("connecting to internal address %s is not allowed", host)
+	}
+	return nil
+}
+
+var notifiers = map[string]Notifier{
+	channelEmail:   emailNotifier{},
+	channelWebhook: webhookNotifier{client: notifyClient},
+	channelWebPush: webPushNotifier{client: notifyClient},
+}
+
+// emailNotifier sends notifications as plain text e-mail over SMTP
+type emailNotifier struct{}
+
+func (emailNotifier) Send(channel NotificationChannel, notification Notification) error {
+	from, err := mail.ParseAddress(config.SMTPFrom)
+	if err != nil {
+		return fmt.Errorf("invalid sender address: %s", err)
+	}
+
+	to, err := mail.ParseAddress(channel.Target)
+	if err != nil {
+		return fmt.Errorf("invalid recipient address: %s", err)
+	}
+
+	message := emailMessage(from, to, notification, time.Now())
+
+	connection, err := net.DialTimeout("tcp", config.SMTPAddr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	connection.SetDeadline(time.Now().Add(30 * time.Second))
+
+	host, _, _ := net.SplitHostPort(config.SMTPAddr)
+
+	client, err := smtp.NewClient(connection, host)
+	if err != nil {
+		connection.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err = client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+
+	if config.SMTPUser != "" {
+		if err = client.Auth(smtp.PlainAuth("", config.SMTPUser, config.SMTPPassword, host)); err != nil {
+			return err
+		}
+	}
+
+	if err = client.Mail(from.Address); err != nil {
+		return err
+	}
+
+	if err = client.Rcpt(to.Address); err != nil {
+		return err
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err = writer.Write(message); err != nil {
+		return err
+	}
+
+	if err = writer.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// emailMessage writes the headers and the plain text body of the e-mail.
+func emailMessage(from *mail.Address, to *mail.Address, notification Notification, date time.Time) []byte {
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", from.String())
+	fmt.Fprintf(&message, "To: %s\r\n", to.String())
+	fmt.Fprintf(&message, "Subject: %s\r\n", mimeHeader(notification.Title))
+	fmt.Fprintf(&message, "Date: %s\r\n", date.UTC().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	fmt.Fprintf(&message, "%s\r\n", strings.Replace(notification.Body, "\n", "\r\n", -1))
+	if notification.URL != "" {
+		fmt.Fprintf(&message, "\r\n%s%s\r\n", config.BaseURL, notification.URL)
+	}
+	return message.Bytes()
+}
+
+// mimeHeader encodes a header value as an RFC 2047 word if it is not plain
+// ASCII. Line breaks become spaces, so names in the value, which may come from
+// an import, cannot start headers of their own.
+func mimeHeader(value string) string {
+	value = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(value)
+
+	for _, r := range value {
+		if r > 127 {
+			return fmt.Sprintf("=?utf-8?b?%s?=", base64.StdEncoding.EncodeToString([]byte(value)))
+		}
+	}
+	return value
+}
+
+// webhookNotifier posts notifications as JSON, signed with the channel's secret
+type webhookNotifier struct {
+	client *http.Client
+}
+
+func (w webhookNotifier) Send(channel NotificationChannel, notification Notification) error {
+	timestamp := time.Now().UTC().Unix()
+
+	body, err := json.Marshal(map[string]interface{}{
+		"event":     notification.Kind,
+		"title":     notification.Title,
+		"body":      notification.Body,
+		"url":       config.BaseURL + notification.URL,
+		"entry_id":  notification.EntryID,
+		"timestamp": timestamp,
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", channel.Target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	// The signature covers the timestamp as well so old deliveries cannot be replayed
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-PillTracker-Timestamp", fmt.Sprintf("%d", timestamp))
+	request.Header.Set("X-PillTracker-Signature", "sha256="+signWebhook(channel.Secret, timestamp, body))
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("webhook returned %d: %s", response.StatusCode, strings.TrimSpace(string(message)))
+	}
+
+	return nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "timestamp.body" keyed with the secret.
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webPushNotifier sends notifications to a subscribed browser
+type webPushNotifier struct {
+	client *http.Client
+}
+
+func (w webPushNotifier) Send(channel NotificationChannel, notification Notification) error {
+	var subscription PushSubscription
+	if err := json.Unmarshal([]byte(channel.Target), &subscription); err != nil {
+		return fmt.Errorf("invalid subscription: %s", err)
+	}
+
+	// The buttons of a dose reminder are labelled in the recipient's language
+	locale := getRecipientLocale(notification.UserID)
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"title":   notification.Title,
+		"body":    notification.Body,
+		"url":     notification.URL,
+		"tag":     fmt.Sprintf("%s-%d", notification.Kind, notification.EntryID),
+		"kind":    notification.Kind,
+		"entryID": notification.EntryID,
+		"token":   notification.Token,
+		"actions": map[string]string{
+			"taken":  locale.T("push.taken"),
+			"snooze": locale.T("push.snooze"),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// A dose reminder is of no use once the next one is due
+	ttl := 24 * 60 * 60
+	if notification.Kind == "dose" {
+		ttl = 60 * 60
+	}
+
+	gone, err := sendWebPush(w.client, subscription, payload, ttl)
+	if gone {
+		// The browser dropped the subscription, stop using it
+		db.Exec("UPDATE notification_channels SET enabled='' WHERE channel_id=$1", channel.ID)
+	}
+
+	return err
+}
+
+// generateSecret returns a random hex string of the given number of bytes.
+func generateSecret(size int) string {
+	secret := make([]byte, size)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(secret)
+}
+
+func getNotificationChannels(userID int) (channels []NotificationChannel) {
+	row, err := db.Query("SELECT channel_id, user_id, channel, target, secret, enabled, create_date FROM notification_channels WHERE user_id=$1 ORDER BY channel_id", userID)
+	if err != nil {
+		logger.Error("getNotificationChannels", "user_id", userID, "error", err)
+		return
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var channel NotificationChannel
+		var secret, enabled sql.NullString
+
+		if err = row.Scan(&channel.ID, &channel.UserID, &channel.Channel, &channel.Target, &secret, &enabled, &channel.CreateDate); err != nil {
+			logger.Error("getNotificationChannels", "user_id", userID, "error", err)
+			return
+		}
+
+		channel.Secret = secret.String
+		channel.Enabled = enabled.String == "on"
+		channels = append(channels, channel)
+	}
+
+	return channels
+}
+
+func getNotificationChannel(channelID int) (channel NotificationChannel, err error) {
+	var secret, enabled sql.NullString
+
+	result := db.QueryRow("SELECT channel_id, user_id, channel, target, secret, enabled, create_date FROM notification_channels WHERE channel_id=$1", channelID)
+	err = result.Scan(&channel.ID, &channel.UserID, &channel.Channel, &channel.Target, &secret, &enabled, &channel.CreateDate)
+
+	channel.Secret = secret.String
+	channel.Enabled = enabled.String == "on"
+
+	return channel, err
+}
+
+func addNotificationChannel(userID int, channel string, target string) (channelID int64, err error) {
+	sqlStatement := `INSERT INTO notification_channels(user_id,channel,target,secret,enabled,create_date) VALUES(?,?,?,?,?,?)`
+	statement, err := db.Prepare(sqlStatement)
+	if err != nil {
+		return 0, err
+	}
+
+	var secret string
+	if channel == channelWebhook {
+		secret = generateSecret(32)
+	}
+
+	result, err := statement.Exec(userID, channel, target, secret, "on", getDate())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// queueNotification stores the notification for delivery on each enabled channel of the user.
+func queueNotification(notification Notification) {
+	// Titles and bodies name medicines and patients, they are sealed with the recipient's key
+	title, body := notification.Title, notification.Body
+	if err := sealFields(notification.UserID, &title, &body); err != nil {
+		logger.Error("queueNotification", "user_id", notification.UserID, "error", err)
+		return
+	}
+
+	for _, channel := range getNotificationChannels(notification.UserID) {
+		if !channel.Enabled || (notification.Channel != "" && notification.Channel != channel.Channel) {
+			continue
+		}
+
+		sqlStatement := `INSERT INTO notification_log(user_id,channel_id,channel,kind,entry_id,title,body,url,action_token,status,attempts,next_attempt,next_attempt_at,create_date,update_date) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`
+		statement, err := db.Prepare(sqlStatement)
+		if err != nil {
+			logger.Error("queueNotification", "user_id", notification.UserID, "error", err)
+			return
+		}
+
+		_, err = statement.Exec(notification.UserID, channel.ID, channel.Channel, notification.Kind, notification.EntryID, title, body, notification.URL, notification.Token, notificationPending, 0, getDate(), nowEpoch(), getDate(), getDate())
+		if err != nil {
+			logger.Error("queueNotification", "user_id", notification.UserID, "error", err)
+		}
+	}
+}
+
+// notificationBackoff returns how long to wait before retrying after the given number of failed attempts.
+func notificationBackoff(attempts int) time.Duration {
+	return time.Minute << uint(attempts-1)
+}
+
+// processNotifications delivers every pending notification which is due,
+// holding back those falling into the user's quiet hours.
+func processNotifications() {
+	type pendingNotification struct {
+		ID           int
+		ChannelID    int
+		Attempts     int
+		Notification Notification
+	}
+
+	var pending []pendingNotification
+
+	row, err := db.Query("SELECT log_id, user_id, channel_id, kind, entry_id, title, body, url, action_token, attempts FROM notification_log WHERE status=$1 AND next_attempt_at <= $2 ORDER BY log_id", notificationPending, nowEpoch())
+	if err != nil {
+		logger.Error("processNotifications", "error", err)
+		return
+	}
+
+	for row.Next() {
+		var p pendingNotification
+		var body, url, token sql.NullString
+
+		if err = row.Scan(&p.ID, &p.Notification.UserID, &p.ChannelID, &p.Notification.Kind, &p.Notification.EntryID, &p.Notification.Title, &body, &url, &token, &p.Attempts); err != nil {
+			logger.Error("processNotifications", "error", err)
+			break
+		}
+
+		p.Notification.Body = body.String
+		p.Notification.URL = url.String
+		p.Notification.Token = token.String
+		pending = append(pending, p)
+	}
+	row.Close()
+
+	for _, p := range pending {
+		now := time.Now().UTC()
+
+		if until, quiet := inQuietHours(p.Notification.UserID, now); quiet {
+			db.Exec("UPDATE notification_log SET next_attempt=$1, next_attempt_at=$2, update_date=$3 WHERE log_id=$4", formatStoredDate(until), toEpoch(until), getDate(), p.ID)
+			continue
+		}
+
+		err := deliverNotification(p.ChannelID, p.Notification)
+		attempts := p.Attempts + 1
+
+		if err == nil {
+			notifyResult.Inc(p.Notification.Kind, notificationDelivered)
+			db.Exec("UPDATE notification_log SET status=$1, attempts=$2, error='', update_date=$3 WHERE log_id=$4", notificationDelivered, attempts, getDate(), p.ID)
+			continue
+		}
+
+		logger.Warn("deliverNotification", "log_id", p.ID, "attempt", attempts, "error", err)
+
+		if attempts >= notificationMaxAttempts {
+			notifyResult.Inc(p.Notification.Kind, notificationFailed)
+			db.Exec("UPDATE notification_log SET status=$1, attempts=$2, error=$3, update_date=$4 WHERE log_id=$5", notificationFailed, attempts, err.Error(), getDate(), p.ID)
+			continue
+		}
+
+		notifyResult.Inc(p.Notification.Kind, "retry")
+		next := now.Add(notificationBackoff(attempts))
+		db.Exec("UPDATE notification_log SET attempts=$1, error=$2, next_attempt=$3, next_attempt_at=$4, update_date=$5 WHERE log_id=$6", attempts, err.Error(), formatStoredDate(next), toEpoch(next), getDate(), p.ID)
+	}
+}
+
+func deliverNotification(channelID int, notification Notification) error {
+	channel, err := getNotificationChannel(channelID)
+	if err != nil {
+		return fmt.Errorf("channel %d: %s", channelID, err)
+	}
+
+	if !channel.Enabled {
+		return errors.New("channel is disabled")
+	}
+
+	notifier, ok := notifiers[channel.Channel]
+	if !ok {
+		return fmt.Errorf("unknown channel %s", channel.Channel)
+	}
+
+	return notifier.Send(channel, notification)
+}
+
+// getQuietHours returns the user's quiet hours as "15:04" strings, empty if none are set.
+func getQuietHours(userID int) (start string, end string) {
+	var quietStart, quietEnd sql.NullString
+
+	result := db.QueryRow("SELECT quiet_start, quiet_end FROM notification_settings WHERE user_id=$1", userID)
+	if err := result.Scan(&quietStart, &quietEnd); err != nil && err != sql.ErrNoRows {
+		logger.Error("getQuietHours", "user_id", userID, "error", err)
+	}
+
+	return quietStart.String, quietEnd.String
+}
+
+// inQuietHours reports if the moment falls into the user's quiet hours and when they end.
+func inQuietHours(userID int, now time.Time) (until time.Time, quiet bool) {
+	start, end := getQuietHours(userID)
+	if start == "" || end == "" {
+		return until, false
+	}
+
+	// Quiet hours are wall clock times of the user
+	now = now.In(getUserLocation(userID))
+
+	startClock, err := time.Parse("15:04", start)
+	if err != nil {
+		return until, false
+	}
+
+	endClock, err := time.Parse("15:04", end)
+	if err != nil {
+		return until, false
+	}
+
+	minutes := now.Hour()*60 + now.Minute()
+	startMinutes := startClock.Hour()*60 + startClock.Minute()
+	endMinutes := endClock.Hour()*60 + endClock.Minute()
+
+	if startMinutes == endMinutes {
+		return until, false
+	}
+
+	// Quiet hours may wrap around midnight, e.g. 22:00 - 07:00
+	if startMinutes < endMinutes {
+		quiet = minutes >= startMinutes && minutes < endMinutes
+	} else {
+		quiet = minutes >= startMinutes || minutes < endMinutes
+	}
+
+	if !quiet {
+		return until, false
+	}
+
+	until = time.Date(now.Year(), now.Month(), now.Day(), endClock.Hour(), endClock.Minute(), 0, 0, now.Location())
+	if !until.After(now) {
+		until = until.AddDate(0, 0, 1)
+	}
+
+	return until, true
+}
+
+func getNotificationLog(userID int, limit int) (log []NotificationLogEntry) {
+	row, err := db.Query("SELECT log_id, channel_id, channel, kind, title, status, attempts, error, create_date, update_date, next_attempt FROM notification_log WHERE user_id=$1 ORDER BY log_id DESC LIMIT $2", userID, limit)
+	if err != nil {
+		logger.Error("getNotificationLog", "user_id", userID, "error", err)
+		return
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var entry NotificationLogEntry
+		var message sql.NullString
+
+		if err = row.Scan(&entry.ID, &entry.ChannelID, &entry.Channel, &entry.Kind, &entry.Title, &entry.Status, &entry.Attempts, &message, &entry.CreateDate, &entry.UpdateDate, &entry.NextAttempt); err != nil {
+			logger.Error("getNotificationLog", "user_id", userID, "error", err)
+			return
+		}
+
+		entry.Error = message.String
+		log = append(log, entry)
+	}
+
+	return log
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestEmailMessageHeaders expects line breaks in a title to stay within the
+// subject instead of adding headers of their own.
+func TestEmailMessageHeaders(t *testing.T) {
+	from := &mail.Address{Address: "mws@mws.local"}
+	to := &mail.Address{Address: "user@mws.local"}
+
+	for _, title := range []string{
+		"Parol\r\nBcc: victim@example.com",
+		"Parol\nBcc: victim@example.com",
+		"Parol\rBcc: victim@example.com",
+		"İlaç\r\nBcc: victim@example.com",
+	} {
+		message := string(emailMessage(from, to, Notification{Title: title, Body: "Take 1"}, time.Now()))
+		headers := strings.SplitN(message, "\r\n\r\n", 2)[0]
+
+		for _, line := range strings.Split(headers, "\r\n") {
+			if strings.HasPrefix(line, "Bcc:") || strings.ContainsAny(line, "\r\n") {
+				t.Errorf("title %q added the header line %q", title, line)
+			}
+		}
+		if strings.Count(headers, "\r\n") != 6 {
+			t.Errorf("title %q wrote the headers %q", title, headers)
+		}
+	}
+}
+
+func TestMimeHeader(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"Dose reminder", "Dose reminder"},
+		{"Dose\r\nreminder", "Dose reminder"},
+		{"İlaç", "=?utf-8?b?xLBsYcOn?="},
+	}
+
+	for _, test := range tests {
+		if got := mimeHeader(test.value); got != test.want {
+			t.Errorf("mimeHeader(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestIsInternalIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"0.0.0.0", true},
+		{"10.1.2.3", true},
+		{"172.20.0.1", true},
+		{"192.168.1.10", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"8.8.8.8", false},
+		{"172.32.0.1", false},
+		{"2001:4860:4860::8888", false},
+	}
+
+	for _, test := range tests {
+		if got := isInternalIP(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("isInternalIP(%s) = %v, want %v", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestValidateWebhookTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{"https://8.8.8.8/hook", true},
+		{"http://127.0.0.1:8080/metrics", false},
+		{"http://[::1]/hook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"https://192.168.1.2/hook", false},
+		{"https://mws.invalid/hook", false},
+		{"ftp://8.8.8.8/hook", false},
+	}
+
+	for _, test := range tests {
+		if got := validateChannelTarget(channelWebhook, test.target); got != test.want {
+			t.Errorf("validateChannelTarget(%q) = %v, want %v", test.target, got, test.want)
+		}
+	}
+}
+
+// TestNotifyClientInternal expects the client to refuse internal addresses
+// even when the target passed the check when it was saved.
+func TestNotifyClientInternal(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {}))
+	defer server.Close()
+
+	if _, err := notifyClient.Get(server.URL); err == nil {
+		t.Errorf("posting to %s did not fail", server.URL)
+	}
+}
+
+func TestValidatePushTarget(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     bool
+	}{
+		{"https://8.8.8.8/push/abc", true},
+		{"https://127.0.0.1/push/abc", false},
+		{"https://10.0.0.5/push/abc", false},
+		{"https://push.invalid/abc", false},
+		{"http://8.8.8.8/push/abc", false},
+	}
+
+	for _, test := range tests {
+		var subscription PushSubscription
+		subscription.Endpoint = test.endpoint
+		subscription.Keys.P256dh, subscription.Keys.Auth = "BCVxsr7N", "BTBZMqHH"
+
+		target, _ := json.Marshal(subscription)
+		if got := validateChannelTarget(channelWebPush, string(target)); got != test.want {
+			t.Errorf("validateChannelTarget with endpoint %q = %v, want %v", test.endpoint, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// entryExpireSQL is the expiry packages are used until, the printed one or the
+// end of their shelf life after opening if that comes first. Either is used
+// alone when the other is missing. It reads the entries table as e.
+const entryExpireSQL = "COALESCE(MIN(e.expire_at, e.open_expire_at), e.expire_at, e.open_expire_at)"
+
+// openExpiry returns when a package opened on the day is used until, the end
+// of the last day of its shelf life after opening.
+func openExpiry(opened time.Time, days int, location *time.Location) time.Time {
+	opened = opened.In(location)
+	return time.Date(opened.Year(), opened.Month(), opened.Day()+days, 23, 59, 0, 0, location)
+}
+
+// parseOpenDays reads a shelf life after opening, 0 when none is given.
+func parseOpenDays(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	days, err := strconv.Atoi(value)
+	if err != nil || days < 1 {
+		return 0, fmt.Errorf("invalid shelf life after opening %q", value)
+	}
+	return days, nil
+}
+
+// nullDays returns the days for a column, NULL when 0.
+func nullDays(days int) interface{} {
+	if days == 0 {
+		return nil
+	}
+	return days
+}
+
+// openEntry records the package as opened on the day with its shelf life
+// after opening, keeping the change in the audit log.
+func openEntry(actor Actor, patient Patient, entryID int, opened time.Time, days int, location *time.Location) error {
+	var openExpireAt interface{}
+	if days != 0 {
+		openExpireAt = toEpoch(openExpiry(opened, days, location))
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE entries SET opened_at=$1, open_days=$2, open_expire_at=$3 WHERE entry_id=$4", toEpoch(opened), nullDays(days), openExpireAt, entryID)
+	if err == nil {
+		err = writeAudit(tx, actor, AuditEvent{
+			OwnerID: patient.OwnerID, PatientID: patient.ID, Action: auditUpdate, Entity: auditEntry, EntityID: int64(entryID),
+			Before: map[string]interface{}{"opened_date": nil},
+			After:  map[string]interface{}{"opened_date": opened.Format(time.RFC3339), "open_days": nullDays(days)},
+		})
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// postOpenHandler marks a package as opened today, by default with the shelf
+// life after opening of its medicine or else the one of its ingredients.
+func postOpenHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	actor := requestActor(request)
+	entryID, _ := strconv.Atoi(request.FormValue("entryID"))
+
+	// Packages are opened by who manages the patient
+	patient, _, ok := getEntryPatient(actor.UserID, entryID)
+	if !ok || !patient.CanManage() {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	redirectTarget := fmt.Sprintf("/?patient=%d", patient.ID)
+
+	var openedAt, defaultDays sql.NullInt64
+	var name, ingredients sql.NullString
+	err := db.QueryRow("SELECT e.opened_at, m.open_days, m.name, m.ingredients FROM entries e JOIN medicine m ON m.medicine_id = e.medicine_id WHERE e.entry_id=$1", entryID).
+		Scan(&openedAt, &defaultDays, &name, &ingredients)
+	if err != nil {
+		serverError(response, request, "postOpenHandler", err)
+		return
+	}
+
+	// A package is opened once
+	if openedAt.Valid {
+		http.Redirect(response, request, redirectTarget, 302)
+		return
+	}
+
+	days := int(defaultDays.Int64)
+	if days == 0 {
+		days = getDrugDatabase().openDays(name.String, ingredients.String)
+	}
+	if value := request.FormValue("openDays"); value != "" {
+		if days, err = parseOpenDays(value); err != nil {
+			http.Redirect(response, request, redirectTarget, 302)
+			return
+		}
+	}
+
+	// The day of opening is today in the user's timezone
+	location := getUserLocation(actor.UserID)
+	now := time.Now().In(location)
+	opened := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+
+	if err = openEntry(actor, patient, entryID, opened, days, location); err != nil {
+		serverError(response, request, "postOpenHandler", err)
+		return
+	}
+
+	http.Redirect(response, request, redirectTarget, 302)
+}
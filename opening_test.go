@@ -0,0 +1,83 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// TestEntryExpireSQL evaluates the effective expiry for printed and after
+// opening expiry dates.
+func TestEntryExpireSQL(t *testing.T) {
+	conn, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		expireAt     interface{}
+		openExpireAt interface{}
+		want         sql.NullInt64
+	}{
+		{1000, 500, sql.NullInt64{Int64: 500, Valid: true}},
+		{1000, 2000, sql.NullInt64{Int64: 1000, Valid: true}},
+		{1000, nil, sql.NullInt64{Int64: 1000, Valid: true}},
+		{nil, 500, sql.NullInt64{Int64: 500, Valid: true}},
+		{nil, nil, sql.NullInt64{}},
+	}
+
+	for _, test := range tests {
+		var got sql.NullInt64
+		err = conn.QueryRow("SELECT "+entryExpireSQL+" FROM (SELECT $1 AS expire_at, $2 AS open_expire_at) e", test.expireAt, test.openExpireAt).Scan(&got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("expiry of %v and %v after opening = %v, want %v", test.expireAt, test.openExpireAt, got, test.want)
+		}
+	}
+}
+
+func TestOpenExpiry(t *testing.T) {
+	location, err := time.LoadLocation("Europe/Istanbul")
+	if err != nil {
+		t.Skip("no time zone database")
+	}
+
+	opened := time.Date(2026, 3, 10, 0, 0, 0, 0, location)
+	want := time.Date(2026, 4, 7, 23, 59, 0, 0, location)
+
+	if got := openExpiry(opened, 28, location); !got.Equal(want) {
+		t.Errorf("openExpiry(%s, 28) = %s, want %s", opened, got, want)
+	}
+
+	// Opened late in the evening UTC is already the next day in Istanbul
+	opened = time.Date(2026, 3, 10, 22, 30, 0, 0, time.UTC)
+	want = time.Date(2026, 3, 18, 23, 59, 0, 0, location)
+
+	if got := openExpiry(opened, 7, location); !got.Equal(want) {
+		t.Errorf("openExpiry(%s, 7) = %s, want %s", opened, got, want)
+	}
+}
+
+func TestParseOpenDays(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+		fail  bool
+	}{
+		{"", 0, false},
+		{"28", 28, false},
+		{"0", 0, true},
+		{"-3", 0, true},
+		{"x", 0, true},
+	}
+
+	for _, test := range tests {
+		got, err := parseOpenDays(test.value)
+		if got != test.want || (err != nil) != test.fail {
+			t.Errorf("parseOpenDays(%q) = %d, %v", test.value, got, err)
+		}
+	}
+}
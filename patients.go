@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	permissionOwner  = "owner"
+	permissionManage = "manage"
+	permissionView   = "view"
+)
+
+// Patient holds a person whose medicines are kept under an account
+type Patient struct {
+	ID         int
+	OwnerID    int
+	OwnerName  string
+	Name       string
+	Permission string
+}
+
+// CanManage reports if the current user may change the patient's data
+func (p Patient) CanManage() bool {
+	return p.Permission == permissionOwner || p.Permission == permissionManage
+}
+
+// PatientShare holds an account a patient is shared with
+type PatientShare struct {
+	PatientID  int
+	UserID     int
+	UserName   string
+	Email      string
+	Permission string
+}
+
+// PatientFilter holds the patient selection shown above a listing
+type PatientFilter struct {
+	URL      string
+	Patients []Patient
+	Selected int
+	AllowAll bool
+}
+
+// PatientsPageData holds all data of the patients page
+type PatientsPageData struct {
+	Patients []Patient
+	Shares   map[int][]PatientShare
+	Error    string
+}
+
+// getPatients returns the patients of the user's account followed by the ones shared with them.
+func getPatients(userID int) (patients []Patient) {
+	row, err := db.Query(`SELECT p.patient_id, p.owner_id, p.name, 'owner' FROM patients p WHERE p.owner_id=$1
+		UNION ALL
+		SELECT p.patient_id, p.owner_id, p.name, s.permission FROM patients p JOIN patient_shares s ON s.patient_id = p.patient_id WHERE s.user_id=$1
+		ORDER BY 1`, userID)
+	if err != nil {
+		logger.Error("getPatients", "user_id", userID, "error", err)
+		return
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var patient Patient
+
+		if err = row.Scan(&patient.ID, &patient.OwnerID, &patient.Name, &patient.Permission); err != nil {
+			logger.Error("getPatients", "user_id", userID, "error", err)
+			return
+		}
+
+		patients = append(patients, patient)
+	}
+
+	for i := range patients {
+		patients[i].OwnerName = getUserNameFromID(patients[i].OwnerID)
+	}
+
+	return patients
+}
+
+// getPatient returns the patient if the user has access to it.
+func getPatient(userID int, patientID int) (patient Patient, ok bool) {
+	for _, patient = range getPatients(userID) {
+		if patient.ID == patientID {
+			return patient, true
+		}
+	}
+	return Patient{}, false
+}
+
+// getManagedPatients returns the patients the user may add and change data of.
+func getManagedPatients(userID int) (patients []Patient) {
+	for _, patient := range getPatients(userID) {
+		if patient.CanManage() {
+			patients = append(patients, patient)
+		}
+	}
+	return patients
+}
+
+// getSelectedPatients returns the patient picked with the patient parameter,
+// or every accessible patient for the combined household view.
+func getSelectedPatients(request *http.Request, userID int, url string) (patients []Patient, filter PatientFilter) {
+	filter = PatientFilter{URL: url, Patients: getPatients(userID), AllowAll: true}
+
+	if selected, err := strconv.Atoi(request.FormValue("patient")); err == nil {
+		for _, patient := range filter.Patients {
+			if patient.ID == selected {
+				filter.Selected = selected
+				return []Patient{patient}, filter
+			}
+		}
+	}
+
+	return filter.Patients, filter
+}
+
+// patientIDsClause builds a "column IN (...)" condition matching the patients.
+func patientIDsClause(column string, patients []Patient) (clause string, args []interface{}) {
+	if len(patients) == 0 {
+		return "1=0", nil
+	}
+
+	placeholders := make([]string, len(patients))
+	for i, patient := range patients {
+		placeholders[i] = "?"
+		args = append(args, patient.ID)
+	}
+
+	return fmt.Sprintf("%s IN (%s)", column, strings.Join(placeholders, ",")), args
+}
+
+// patientNames maps patient IDs to names for listings.
+func patientNames(patients []Patient) map[int]string {
+	names := make(map[int]string)
+	for _, patient := range patients {
+		names[patient.ID] = patient.Name
+	}
+	return names
+}
+
+func createPatient(exec dbExecer, ownerID int, name string) (patientID int64, err error) {
+	sqlStatement := `INSERT INTO patients(owner_id,name,create_date) VALUES(?,?,?)`
+
+	result, err := exec.Exec(sqlStatement, ownerID, name, getDate())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+func getPatientShares(patientID int) (shares []PatientShare) {
+	row, err := db.Query("SELECT s.user_id, u.username, u.email, s.permission FROM patient_shares s JOIN users u ON u.user_id = s.user_id WHERE s.patient_id=$1 ORDER BY u.username", patientID)
+	if err != nil {
+		logger.Error("getPatientShares", "patient_id", patientID, "error", err)
+		return
+	}
+	defer row.Close()
+
+	for row.Next() {
+		share := PatientShare{PatientID: patientID}
+
+		if err = row.Scan(&share.UserID, &share.UserName, &share.Email, &share.Permission); err != nil {
+			logger.Error("getPatientShares", "patient_id", patientID, "error", err)
+			return
+		}
+
+		shares = append(shares, share)
+	}
+
+	return shares
+}
+
+func patientsHandler(response http.ResponseWriter, request *http.Request) {
+	// Check login status
+	if getUserName(request) == "" {
+		http.Redirect(response, request, urlHello, 302)
+		return
+	}
+
+	data := PatientsPageData{
+		Patients: getPatients(getUserID(getUserName(request))),
+		Shares:   make(map[int][]PatientShare),
+		Error:    request.FormValue("error"),
+	}
+
+	for _, patient := range data.Patients {
+		if patient.Permission == permissionOwner {
+			data.Shares[patient.ID] = getPatientShares(patient.ID)
+		}
+	}
+
+	err := renderTemplate(response, request, tmplPatients, data)
+
+	if err != nil {
+		return
+	}
+}
+
+func postAddPatientHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	name := strings.TrimSpace(request.FormValue("patientName"))
+
+	if name == "" {
+		http.Redirect(response, request, urlPatients+"?error=name", 302)
+		return
+	}
+
+	if _, err := createPatient(db, getUserID(getUserName(request)), name); err != nil {
+		serverError(response, request, "postAddPatientHandler", err)
+		return
+	}
+
+	http.Redirect(response, request, urlPatients, 302)
+}
+
+func postSharePatientHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+	patientID, _ := strconv.Atoi(request.FormValue("patientID"))
+	email := strings.TrimSpace(request.FormValue("shareEmail"))
+	permission := request.FormValue("sharePermission")
+
+	// Only the owner may share a patient
+	patient, ok := getPatient(userID, patientID)
+	if !ok || patient.Permission != permissionOwner {
+		http.Redirect(response, request, urlPatients, 302)
+		return
+	}
+
+	if permission != permissionView && permission != permissionManage {
+		http.Redirect(response, request, urlPatients+"?error=permission", 302)
+		return
+	}
+
+	var shareUserID int
+
+	result := db.QueryRow("SELECT user_id FROM users WHERE email=$1", email)
+	if err := result.Scan(&shareUserID); err != nil || shareUserID == userID {
+		http.Redirect(response, request, urlPatients+"?error=email", 302)
+		return
+	}
+
+	sqlStatement := `INSERT INTO patient_shares(patient_id,user_id,permission,create_date) VALUES(?,?,?,?)
+		ON CONFLICT(patient_id,user_id) DO UPDATE SET permission=excluded.permission`
+	statement, err := db.Prepare(sqlStatement)
+	if err != nil {
+		serverError(response, request, "postSharePatientHandler", err)
+		return
+	}
+
+	_, err = statement.Exec(patientID, shareUserID, permission, getDate())
+	if err != nil {
+		serverError(response, request, "postSharePatientHandler", err)
+		return
+	}
+
+	http.Redirect(response, request, urlPatients, 302)
+}
+
+func postUnsharePatientHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+	patientID, _ := strconv.Atoi(request.FormValue("patientID"))
+	shareUserID, err := strconv.Atoi(request.FormValue("shareUserID"))
+	if err != nil {
+		// Without an account given the user leaves a patient shared with them
+		shareUserID = userID
+	}
+
+	// The owner may remove anyone, everyone else only themselves
+	patient, ok := getPatient(userID, patientID)
+	if !ok || (patient.Permission != permissionOwner && shareUserID != userID) {
+		http.Redirect(response, request, urlPatients, 302)
+		return
+	}
+
+	_, err = db.Exec("DELETE FROM patient_shares WHERE patient_id=$1 AND user_id=$2", patientID, shareUserID)
+	if err != nil {
+		serverError(response, request, "postUnsharePatientHandler", err)
+		return
+	}
+
+	http.Redirect(response, request, urlPatients, 302)
+}
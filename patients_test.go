@@ -0,0 +1,104 @@
+package main
+
+import "testing"
+
+func TestPatientCanManage(t *testing.T) {
+	tests := []struct {
+		permission string
+		want       bool
+	}{
+		{permissionOwner, true},
+		{permissionManage, true},
+		{permissionView, false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if got := (Patient{Permission: test.permission}).CanManage(); got != test.want {
+			t.Errorf("CanManage with %q = %v, want %v", test.permission, got, test.want)
+		}
+	}
+}
+
+// TestHouseholdMigration expects every account of mws.db to hold a patient
+// and all of its medicines, entries and alarms to belong to it.
+func TestHouseholdMigration(t *testing.T) {
+	openTestDatabase(t)
+
+	var users, patients int
+	if err := db.QueryRow("SELECT (SELECT COUNT(*) FROM users), (SELECT COUNT(DISTINCT owner_id) FROM patients)").Scan(&users, &patients); err != nil {
+		t.Fatal(err)
+	}
+	if users != patients {
+		t.Errorf("%d accounts hold patients, want all %d", patients, users)
+	}
+
+	for _, table := range []string{"medicine", "entries", "use_alarms", "expire_alarms"} {
+		var count int
+		err := db.QueryRow("SELECT COUNT(*) FROM " + table + " t LEFT JOIN patients p ON p.patient_id = t.patient_id AND p.owner_id = t.user_id WHERE p.patient_id IS NULL").Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Errorf("%d rows of %s have no patient of their account", count, table)
+		}
+	}
+}
+
+// TestGetPatient expects patients to be reachable by their owner and the
+// accounts they are shared with only, managed by the owner and managers.
+func TestGetPatient(t *testing.T) {
+	openTestDatabase(t)
+
+	var userIDs []int
+	for _, name := range []string{"owner", "manager", "viewer", "stranger"} {
+		result, err := db.Exec("INSERT INTO users(username,email,register_date,password) VALUES($1,$2,'2026-01-01','x')", name, name+"@mws.local")
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := result.LastInsertId()
+		userIDs = append(userIDs, int(id))
+	}
+	owner, manager, viewer, stranger := userIDs[0], userIDs[1], userIDs[2], userIDs[3]
+
+	result, err := db.Exec("INSERT INTO patients(owner_id,name,create_date) VALUES($1,'Grandma','2026-01-01')", owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+	patientID := int(id)
+
+	for userID, permission := range map[int]string{manager: permissionManage, viewer: permissionView} {
+		_, err = db.Exec("INSERT INTO patient_shares(patient_id,user_id,permission,create_date) VALUES($1,$2,$3,'2026-01-01')", patientID, userID, permission)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		userID     int
+		ok         bool
+		permission string
+		manage     bool
+	}{
+		{owner, true, permissionOwner, true},
+		{manager, true, permissionManage, true},
+		{viewer, true, permissionView, false},
+		{stranger, false, "", false},
+	}
+
+	for _, test := range tests {
+		patient, ok := getPatient(test.userID, patientID)
+		if ok != test.ok || patient.Permission != test.permission || patient.CanManage() != test.manage {
+			t.Errorf("getPatient(%d) = %q, %v, managing %v, want %q, %v, managing %v", test.userID, patient.Permission, ok, patient.CanManage(), test.permission, test.ok, test.manage)
+		}
+
+		managed := false
+		for _, patient := range getManagedPatients(test.userID) {
+			managed = managed || patient.ID == patientID
+		}
+		if managed != test.manage {
+			t.Errorf("getManagedPatients(%d) includes the patient = %v, want %v", test.userID, managed, test.manage)
+		}
+	}
+}
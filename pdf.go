@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// A4 page size and margin in points
+const (
+	pdfWidth  = 595.0
+	pdfHeight = 842.0
+	pdfMargin = 40.0
+)
+
+// pdfFold writes the letters the standard fonts lack the way they are read without accents
+var pdfFold = map[rune]byte{
+	'ğ': 'g', 'Ğ': 'G', 'ş': 's', 'Ş': 'S', 'ı': 'i', 'İ': 'I',
+	'–': '-', '—': '-', '‘': '\'', '’': '\'', '“': '"', '”': '"', '…': '.',
+}
+
+// pdfWriter builds a text document with the Helvetica fonts every PDF reader
+// has, so nothing needs to be embedded. Positions are from the top left.
+type pdfWriter struct {
+	pages [][]byte
+	page  bytes.Buffer
+	y     float64
+}
+
+// newPDF starts a document with an empty page.
+func newPDF() *pdfWriter {
+	return &pdfWriter{y: pdfMargin}
+}
+
+// pdfText encodes the text for the standard fonts, which read Windows-1252.
+func pdfText(text string) string {
+	var b strings.Builder
+
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", r)
+		case pdfFold[r] != 0:
+			b.WriteByte(pdfFold[r])
+		case r == '\n' || r == '\t':
+			b.WriteByte(' ')
+		default:
+			b.WriteByte('?')
+		}
+	}
+
+	return b.String()
+}
+
+// pdfWrap splits the text into lines fitting the width, estimating the
+// width of a letter as half the font size.
+func pdfWrap(text string, width float64, size float64) (lines []string) {
+	limit := int(width / (size * 0.5))
+	if limit < 1 {
+		limit = 1
+	}
+
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			for len([]rune(word)) > limit {
+				if line != "" {
+					lines = append(lines, line)
+					line = ""
+				}
+				lines = append(lines, string([]rune(word)[:limit]))
+				word = string([]rune(word)[limit:])
+			}
+
+			switch {
+			case line == "":
+				line = word
+			case len([]rune(line))+1+len([]rune(word)) <= limit:
+				line += " " + word
+			default:
+				lines = append(lines, line)
+				line = word
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// text writes a line at the position, in the bold font if asked.
+func (w *pdfWriter) text(x float64, y float64, size float64, bold bool, text string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(&w.page, "BT /%s %.1f Tf %.1f %.1f Td (%s) Tj ET\n", font, size, x, pdfHeight-y-size, pdfText(text))
+}
+
+// rule draws a thin horizontal line across the page.
+func (w *pdfWriter) rule(y float64) {
+	fmt.Fprintf(&w.page, "0.5 w %.1f %.1f m %.1f %.1f l S\n", pdfMargin, pdfHeight-y, pdfWidth-pdfMargin, pdfHeight-y)
+}
+
+// space makes sure the height fits on the page, starting a new one if not.
+func (w *pdfWriter) space(height float64) {
+	if w.y+height > pdfHeight-pdfMargin {
+		w.pages = append(w.pages, append([]byte(nil), w.page.Bytes()...))
+		w.page.Reset()
+		w.y = pdfMargin
+	}
+}
+
+// paragraph writes the text wrapped over the width of the page.
+func (w *pdfWriter) paragraph(size float64, bold bool, text string) {
+	for _, line := range pdfWrap(text, pdfWidth-2*pdfMargin, size) {
+		w.space(size * 1.4)
+		w.text(pdfMargin, w.y, size, bold, line)
+		w.y += size * 1.4
+	}
+}
+
+// row writes the cells in columns of the widths, wrapping each cell, and
+// draws a line below.
+func (w *pdfWriter) row(widths []float64, size float64, bold bool, cells []string) {
+	var wrapped [][]string
+	height := 0.0
+
+	for i, cell := range cells {
+		lines := pdfWrap(cell, widths[i]-6, size)
+		wrapped = append(wrapped, lines)
+		if h := float64(len(lines)) * size * 1.3; h > height {
+			height = h
+		}
+	}
+
+	w.space(height + 6)
+
+	x := pdfMargin
+	for i, lines := range wrapped {
+		for j, line := range lines {
+			w.text(x, w.y+3+float64(j)*size*1.3, size, bold, line)
+		}
+		x += widths[i]
+	}
+
+	w.y += height + 6
+	w.rule(w.y)
+}
+
+// bytes returns the finished document.
+func (w *pdfWriter) bytes() []byte {
+	pages := append(w.pages, w.page.Bytes())
+
+	var out bytes.Buffer
+	var offsets []int
+
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n")
+
+	// Catalog, page tree and fonts come first, every page is then a page and its content
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+
+	for i, content := range pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfWidth, pdfHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", len(content), content))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return out.Bytes()
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// prescriptionScanMax limits the size of a scanned prescription
+	prescriptionScanMax = 5 << 20
+
+	// prescriptionLapseDays is how long before the end of its validity a prescription is warned about
+	prescriptionLapseDays = 14
+)
+
+// prescriptionScanTypes holds the content types a scan may have
+var prescriptionScanTypes = []string{"image/jpeg", "image/png", "application/pdf"}
+
+// Prescription holds where the packages of a patient came from
+type Prescription struct {
+	ID             int
+	PatientID      int
+	Patient        string
+	Prescriber     string
+	Pharmacy       string
+	IssueDate      string
+	ERxNumber      string
+	RefillsAllowed int
+	RefillsUsed    int
+	ValidDays      int
+	ValidUntil     string
+	Entries        int
+	HasScan        bool
+
+	// ExpireAt is the end of the validity period
+	ExpireAt time.Time
+}
+
+// RefillsLeft returns how many more times the prescription can be filled.
+func (p Prescription) RefillsLeft() int {
+	if p.RefillsUsed >= p.RefillsAllowed {
+		return 0
+	}
+	return p.RefillsAllowed - p.RefillsUsed
+}
+
+// Lapsed reports if the validity period is over.
+func (p Prescription) Lapsed() bool {
+	return !time.Now().Before(p.ExpireAt)
+}
+
+// PrescriptionsPageData holds all data of the prescriptions page
+type PrescriptionsPageData struct {
+	Filter        PatientFilter
+	Prescriptions []Prescription
+	Warnings      []Warning
+	Patients      []Patient
+	Error         string
+	Saved         string
+}
+
+// getPrescriptions returns the prescriptions of the patients, newest first.
+func getPrescriptions(patients []Patient, location *time.Location, locale *Locale) (prescriptions []Prescription) {
+	names := patientNames(patients)
+	clause, args := patientIDsClause("p.patient_id", patients)
+
+	row, err := db.Query(`SELECT p.prescription_id, p.patient_id, p.prescriber, p.pharmacy, p.issue_at, p.erx_number, p.refills_allowed, p.refills_used,
+		p.valid_days, p.scan_type, (SELECT COUNT(*) FROM entries e WHERE e.prescription_id = p.prescription_id)
+		FROM prescriptions p WHERE `+clause+` ORDER BY p.issue_at DESC, p.prescription_id DESC`, args...)
+	if err != nil {
+		logger.Error("getPrescriptions", "error", err)
+		return
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var p Prescription
+		var pharmacy, erxNumber, scanType sql.NullString
+		var issueAt int64
+
+		err = row.Scan(&p.ID, &p.PatientID, &p.Prescriber, &pharmacy, &issueAt, &erxNumber, &p.RefillsAllowed, &p.RefillsUsed,
+			&p.ValidDays, &scanType, &p.Entries)
+		if err != nil {
+			logger.Error("getPrescriptions", "error", err)
+			return
+		}
+
+		issued := fromEpoch(issueAt).In(location)
+		p.Patient = names[p.PatientID]
+		p.Pharmacy = pharmacy.String
+		p.ERxNumber = erxNumber.String
+		p.HasScan = scanType.String != ""
+		p.IssueDate = locale.FormatDate(issued)
+		p.ExpireAt = issued.AddDate(0, 0, p.ValidDays)
+		p.ValidUntil = locale.FormatDate(p.ExpireAt)
+
+		prescriptions = append(prescriptions, p)
+	}
+
+	return prescriptions
+}
+
+// checkPrescriptions warns about prescriptions running out of validity soon
+// and valid ones without refills left.
+func checkPrescriptions(prescriptions []Prescription, locale *Locale) (warnings []Warning) {
+	now := time.Now()
+
+	for _, p := range prescriptions {
+		if p.Lapsed() {
+			continue
+		}
+
+		if p.ExpireAt.Sub(now) <= prescriptionLapseDays*24*time.Hour {
+			warnings = append(warnings, Warning{
+				Severity: "moderate",
+				Title:    locale.T("prescription.warning.lapse.title", p.Prescriber),
+				Message:  locale.T("prescription.warning.lapse.message", p.Patient, p.ValidUntil),
+			})
+		}
+
+		if p.RefillsAllowed > 0 && p.RefillsLeft() == 0 {
+			warnings = append(warnings, Warning{
+				Severity: "minor",
+				Title:    locale.T("prescription.warning.refills.title", p.Prescriber),
+				Message:  locale.T("prescription.warning.refills.message", p.Patient),
+			})
+		}
+	}
+
+	return warnings
+}
+
+// isPatientPrescription reports if the prescription was written for the patient.
+func isPatientPrescription(patientID int, prescriptionID int) bool {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM prescriptions WHERE prescription_id=$1 AND patient_id=$2", prescriptionID, patientID).Scan(&count)
+	return count > 0
+}
+
+// getPrescriptionPatient returns the patient of the prescription if the user has access to it.
+func getPrescriptionPatient(userID int, prescriptionID int) (patient Patient, ok bool) {
+	var patientID int
+	if err := db.QueryRow("SELECT patient_id FROM prescriptions WHERE prescription_id=$1", prescriptionID).Scan(&patientID); err != nil {
+		return Patient{}, false
+	}
+	return getPatient(userID, patientID)
+}
+
+// readPrescriptionScan reads the uploaded scan, if any, as its content type and content.
+func readPrescriptionScan(request *http.Request) (scanType string, content []byte, err error) {
+	file, _, err := request.FormFile("scan")
+	if err == http.ErrMissingFile {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	content, err = ioutil.ReadAll(io.LimitReader(file, prescriptionScanMax+1))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(content) > prescriptionScanMax {
+		return "", nil, fmt.Errorf("scan larger than %d bytes", prescriptionScanMax)
+	}
+
+	// The type is told by the content, not by the name of the file
+	scanType = strings.Split(http.DetectContentType(content), ";")[0]
+	for _, allowed := range prescriptionScanTypes {
+		if scanType == allowed {
+			return scanType, content, nil
+		}
+	}
+
+	return "", nil, fmt.Errorf("scan of type %s", scanType)
+}
+
+// newScanKey returns a key for a new prescription scan of the account.
+func newScanKey(ownerID int) string {
+	return fmt.Sprintf("prescriptions/%d/%s", ownerID, generateSecret(16))
+}
+
+// getScanKeys returns the blob keys of the prescription scans the query selects.
+func getScanKeys(query string, args ...interface{}) (keys []string, err error) {
+	row, err := db.Query("SELECT scan_key FROM prescriptions WHERE scan_key IS NOT NULL AND ("+query+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var key string
+		if err = row.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, row.Err()
+}
+
+// reencryptPrescriptionScans seals the scans not sealed with the current data
+// key of their account, under new blob keys like the files of attachments.
+func reencryptPrescriptionScans() (count int, err error) {
+	type sealedScan struct {
+		ID      int
+		UserID  int
+		ScanKey string
+		KeyID   int64
+	}
+
+	var stale []sealedScan
+
+	row, err := db.Query(`SELECT p.prescription_id, p.user_id, p.scan_key, p.scan_key_id FROM prescriptions p
+		WHERE p.scan_key IS NOT NULL AND p.scan_key_id != IFNULL((SELECT MAX(k.key_id) FROM data_keys k WHERE k.user_id = p.user_id), 0)`)
+	if err != nil {
+		return 0, err
+	}
+	for row.Next() {
+		var s sealedScan
+		if err = row.Scan(&s.ID, &s.UserID, &s.ScanKey, &s.KeyID); err != nil {
+			row.Close()
+			return 0, err
+		}
+		stale = append(stale, s)
+	}
+	row.Close()
+
+	for _, s := range stale {
+		keyID, err := getCurrentKeyID(s.UserID)
+		if err != nil {
+			return count, err
+		}
+
+		sealed, err := blobs.Get(s.ScanKey)
+		if err != nil {
+			return count, fmt.Errorf("prescription %d: %s", s.ID, err)
+		}
+		content, err := openBlob(s.KeyID, s.ScanKey, sealed)
+		if err != nil {
+			return count, fmt.Errorf("prescription %d: %s", s.ID, err)
+		}
+
+		scanKey := newScanKey(s.UserID)
+		if err = putBlobs(keyID, map[string][]byte{scanKey: content}, ""); err != nil {
+			return count, err
+		}
+
+		if _, err = db.Exec("UPDATE prescriptions SET scan_key=$1, scan_key_id=$2 WHERE prescription_id=$3", scanKey, keyID, s.ID); err != nil {
+			deleteBlobs([]string{scanKey})
+			return count, err
+		}
+
+		deleteBlobs([]string{s.ScanKey})
+		count++
+	}
+
+	return count, nil
+}
+
+func prescriptionsHandler(response http.ResponseWriter, request *http.Request) {
+	// Check login status
+	if getUserName(request) == "" {
+		http.Redirect(response, request, urlHello, 302)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+	locale := getLocale(request)
+
+	patients, filter := getSelectedPatients(request, userID, urlPrescription)
+
+	data := PrescriptionsPageData{
+		Filter:        filter,
+		Prescriptions: getPrescriptions(patients, getUserLocation(userID), locale),
+		Patients:      getManagedPatients(userID),
+		Error:         request.FormValue("error"),
+		Saved:         request.FormValue("saved"),
+	}
+	data.Warnings = checkPrescriptions(data.Prescriptions, locale)
+
+	err := renderTemplate(response, request, tmplPrescript, data)
+
+	if err != nil {
+		return
+	}
+}
+
+func postPrescriptionHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	request.Body = http.MaxBytesReader(response, request.Body, prescriptionScanMax+64<<10)
+
+	actor := requestActor(request)
+	patientID, _ := strconv.Atoi(request.FormValue("patientID"))
+
+	// Prescriptions are kept for patients the user manages
+	patient, ok := getPatient(actor.UserID, patientID)
+	if !ok || !patient.CanManage() {
+		http.Redirect(response, request, urlPrescription+"?error=patient", 302)
+		return
+	}
+
+	prescriber := strings.TrimSpace(request.FormValue("prescriber"))
+	pharmacy := strings.TrimSpace(request.FormValue("pharmacy"))
+	erxNumber := strings.TrimSpace(request.FormValue("erxNumber"))
+
+	issued, err := getLocale(request).ParseDate(request.FormValue("issueDate"))
+	refills, refillsErr := strconv.Atoi(request.FormValue("refills"))
+	validDays, validErr := strconv.Atoi(request.FormValue("validDays"))
+
+	if prescriber == "" || err != nil || refillsErr != nil || refills < 0 || validErr != nil || validDays < 1 {
+		http.Redirect(response, request, urlPrescription+"?error=form", 302)
+		return
+	}
+
+	scanType, scan, err := readPrescriptionScan(request)
+	if err != nil {
+		requestLogger(request).Warn("postPrescriptionHandler", "error", err)
+		http.Redirect(response, request, urlPrescription+"?error=scan", 302)
+		return
+	}
+
+	// The issue date is a day in the user's timezone
+	location := getUserLocation(actor.UserID)
+	issued = time.Date(issued.Year(), issued.Month(), issued.Day(), 0, 0, 0, 0, location)
+
+	// The audit log keeps what was written, sealed on its own
+	after := map[string]interface{}{
+		"prescriber": prescriber, "pharmacy": pharmacy, "issue_date": issued.Format(time.RFC3339), "erx_number": erxNumber,
+		"refills_allowed": refills, "valid_days": validDays, "scan_type": scanType,
+	}
+
+	// Prescriptions are health data sealed with the owner's key
+	if err = sealFields(patient.OwnerID, &prescriber, &pharmacy, &erxNumber); err != nil {
+		serverError(response, request, "postPrescriptionHandler", err)
+		return
+	}
+
+	// and so are their scans, kept in the blob store like attachments
+	var scanKey sql.NullString
+	var keyID int64
+	if scan != nil {
+		if encryptionEnabled() {
+			if keyID, err = getCurrentKeyID(patient.OwnerID); err != nil {
+				serverError(response, request, "postPrescriptionHandler", err)
+				return
+			}
+		}
+
+		scanKey = sql.NullString{String: newScanKey(patient.OwnerID), Valid: true}
+		if err = putBlobs(keyID, map[string][]byte{scanKey.String: scan}, scanType); err != nil {
+			serverError(response, request, "postPrescriptionHandler", err)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		deleteBlobs([]string{scanKey.String})
+		serverError(response, request, "postPrescriptionHandler", err)
+		return
+	}
+
+	result, err := tx.Exec(`INSERT INTO prescriptions(user_id,patient_id,prescriber,pharmacy,issue_at,erx_number,refills_allowed,refills_used,valid_days,scan_key,scan_key_id,scan_type,create_at)
+		VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+		patient.OwnerID, patientID, prescriber, pharmacy, toEpoch(issued), erxNumber, refills, 0, validDays, scanKey, keyID, scanType, nowEpoch())
+	if err == nil {
+		var prescriptionID int64
+		if prescriptionID, err = result.LastInsertId(); err == nil {
+			err = writeAudit(tx, actor, AuditEvent{
+				OwnerID: patient.OwnerID, PatientID: patient.ID, Action: auditCreate, Entity: auditPrescript, EntityID: prescriptionID,
+				After: after,
+			})
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		deleteBlobs([]string{scanKey.String})
+		serverError(response, request, "postPrescriptionHandler", err)
+		return
+	}
+
+	http.Redirect(response, request, fmt.Sprintf("%s?patient=%d&saved=add", urlPrescription, patientID), 302)
+}
+
+func postRefillHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	actor := requestActor(request)
+	prescriptionID, _ := strconv.Atoi(request.FormValue("prescriptionID"))
+
+	patient, ok := getPrescriptionPatient(actor.UserID, prescriptionID)
+	if !ok || !patient.CanManage() {
+		http.Redirect(response, request, urlPrescription, 302)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		serverError(response, request, "postRefillHandler", err)
+		return
+	}
+
+	var used int
+	if err = tx.QueryRow("SELECT refills_used FROM prescriptions WHERE prescription_id=$1", prescriptionID).Scan(&used); err != nil {
+		tx.Rollback()
+		serverError(response, request, "postRefillHandler", err)
+		return
+	}
+
+	// A refill is only recorded while there are some left
+	result, err := tx.Exec("UPDATE prescriptions SET refills_used = refills_used + 1 WHERE prescription_id=$1 AND refills_used < refills_allowed", prescriptionID)
+	if err == nil {
+		if count, _ := result.RowsAffected(); count == 0 {
+			tx.Rollback()
+			http.Redirect(response, request, fmt.Sprintf("%s?patient=%d&error=refill", urlPrescription, patient.ID), 302)
+			return
+		}
+
+		err = writeAudit(tx, actor, AuditEvent{
+			OwnerID: patient.OwnerID, PatientID: patient.ID, Action: auditUpdate, Entity: auditPrescript, EntityID: int64(prescriptionID),
+			Before: map[string]interface{}{"refills_used": used},
+			After:  map[string]interface{}{"refills_used": used + 1},
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		serverError(response, request, "postRefillHandler", err)
+		return
+	}
+
+	http.Redirect(response, request, fmt.Sprintf("%s?patient=%d&saved=refill", urlPrescription, patient.ID), 302)
+}
+
+// prescriptionScanHandler serves the scan of a prescription to who may see the patient.
+func prescriptionScanHandler(response http.ResponseWriter, request *http.Request) {
+	// Check login status
+	if getUserName(request) == "" {
+		http.Redirect(response, request, urlHello, 302)
+		return
+	}
+
+	prescriptionID, _ := strconv.Atoi(request.FormValue("id"))
+
+	if _, ok := getPrescriptionPatient(getUserID(getUserName(request)), prescriptionID); !ok {
+		http.NotFound(response, request)
+		return
+	}
+
+	var scanKey, scanType sql.NullString
+	var keyID int64
+	err := db.QueryRow("SELECT scan_key, scan_key_id, scan_type FROM prescriptions WHERE prescription_id=$1", prescriptionID).Scan(&scanKey, &keyID, &scanType)
+	if err != nil || !scanKey.Valid {
+		http.NotFound(response, request)
+		return
+	}
+
+	sealed, err := blobs.Get(scanKey.String)
+	if err == errBlobNotFound {
+		requestLogger(request).Error("prescriptionScanHandler", "prescription_id", prescriptionID, "key", scanKey.String, "error", err)
+		http.NotFound(response, request)
+		return
+	}
+	if err != nil {
+		serverError(response, request, "prescriptionScanHandler", err)
+		return
+	}
+
+	content, err := openBlob(keyID, scanKey.String, sealed)
+	if err != nil {
+		serverError(response, request, "prescriptionScanHandler", err)
+		return
+	}
+
+	response.Header().Set("Content-Type", scanType.String)
+	response.Header().Set("X-Content-Type-Options", "nosniff")
+	response.Header().Set("Cache-Control", "private, no-store")
+	response.Write(content)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HealthProfile holds the health data used for the safety checks of a user
+type HealthProfile struct {
+	Allergies  string
+	Conditions string
+	Pregnant   bool
+	BirthDate  string
+	Weight     string
+}
+
+// ProfilePageData holds all data of the health profile page
+type ProfilePageData struct {
+	Profile HealthProfile
+	Patient Patient
+	Filter  PatientFilter
+	Saved   bool
+}
+
+// Age returns the age in full years, or -1 if no birth date is known
+func (p HealthProfile) Age() int {
+	birth, err := time.Parse("02/01/2006", p.BirthDate)
+	if err != nil {
+		return -1
+	}
+
+	now := time.Now().UTC()
+	age := now.Year() - birth.Year()
+	if now.Month() < birth.Month() || (now.Month() == birth.Month() && now.Day() < birth.Day()) {
+		age--
+	}
+
+	return age
+}
+
+func getHealthProfile(patientID int) (profile HealthProfile) {
+	var allergies, conditions, pregnant, birthDate, weight sql.NullString
+
+	result := db.QueryRow("SELECT allergies, conditions, pregnant, birth_date, weight FROM health_profiles WHERE patient_id=$1", patientID)
+	err := result.Scan(&allergies, &conditions, &pregnant, &birthDate, &weight)
+
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logger.Error("getHealthProfile", "patient_id", patientID, "error", err)
+		}
+		return
+	}
+
+	profile.Allergies = allergies.String
+	profile.Conditions = conditions.String
+	profile.Pregnant = pregnant.String == "on"
+	profile.BirthDate = birthDate.String
+	profile.Weight = weight.String
+
+	return profile
+}
+
+// checkHealthProfile returns warnings for ingredients the user is allergic to
+// or which are contraindicated by their conditions, pregnancy or age.
+func checkHealthProfile(profile HealthProfile, ingredients []DrugIngredient, locale *Locale) (warnings []Warning) {
+	drugs := getDrugDatabase()
+
+	for _, allergy := range splitIngredients(profile.Allergies) {
+		key := allergy
+		if known, ok := drugs.lookup[allergy]; ok {
+			key = known.Name
+		}
+
+		for _, ingredient := range ingredients {
+			if ingredient.matches(key) {
+				warnings = append(warnings, Warning{
+					Severity: "contraindicated",
+					Title:    locale.T("warning.allergy.title", allergy),
+					Message:  locale.T("warning.allergy.message", ingredient.Name),
+				})
+			}
+		}
+	}
+
+	conditions := splitIngredients(profile.Conditions)
+	age := profile.Age()
+
+	for _, ingredient := range ingredients {
+		for _, contraindication := range ingredient.Contraindications {
+			for _, condition := range conditions {
+				if normalizeDrugTerm(contraindication) == condition {
+					warnings = append(warnings, Warning{
+						Severity: "major",
+						Title:    locale.T("warning.contraindication.title", condition),
+						Message:  locale.T("warning.contraindication.message", strings.Title(ingredient.Name), condition),
+					})
+				}
+			}
+		}
+
+		if profile.Pregnant && ingredient.Pregnancy != "" {
+			warnings = append(warnings, Warning{
+				Severity: "major",
+				Title:    locale.T("warning.pregnancy.title", ingredient.Name),
+				Message:  locale.T(ingredient.Pregnancy),
+			})
+		}
+
+		if age >= 0 && ingredient.MinAge > 0 && age < ingredient.MinAge {
+			warnings = append(warnings, Warning{
+				Severity: "major",
+				Title:    locale.T("warning.age.title", ingredient.Name),
+				Message:  locale.T("warning.age.message", strings.Title(ingredient.Name), ingredient.MinAge),
+			})
+		}
+	}
+
+	return warnings
+}
+
+func profileHandler(response http.ResponseWriter, request *http.Request) {
+	// Check login status
+	if getUserName(request) == "" {
+		http.Redirect(response, request, urlHello, 302)
+		return
+	}
+
+	// A profile always belongs to a single patient, the first one by default
+	patients, filter := getSelectedPatients(request, getUserID(getUserName(request)), urlProfile)
+	if len(patients) == 0 {
+		http.Redirect(response, request, urlPatients, 302)
+		return
+	}
+
+	filter.AllowAll = false
+	filter.Selected = patients[0].ID
+
+	data := ProfilePageData{
+		Profile: getHealthProfile(patients[0].ID),
+		Patient: patients[0],
+		Filter:  filter,
+		Saved:   request.FormValue("saved") != "",
+	}
+
+	// Birth dates are kept as day/month/year and shown the way the language writes them
+	if birth, err := time.Parse("02/01/2006", data.Profile.BirthDate); err == nil {
+		data.Profile.BirthDate = getLocale(request).FormatDate(birth)
+	}
+
+	err := renderTemplate(response, request, tmplProfile, data)
+
+	if err != nil {
+		return
+	}
+}
+
+func postProfileHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	// Only patients the user manages can be changed
+	patientID, _ := strconv.Atoi(request.FormValue("patientID"))
+
+	patient, ok := getPatient(getUserID(getUserName(request)), patientID)
+	if !ok || !patient.CanManage() {
+		http.Redirect(response, request, urlProfile, 302)
+		return
+	}
+
+	redirectTarget := fmt.Sprintf("%s?patient=%d", urlProfile, patientID)
+
+	allergies := strings.TrimSpace(request.FormValue("profileAllergies"))
+	conditions := strings.TrimSpace(request.FormValue("profileConditions"))
+	pregnant := request.FormValue("profilePregnant")
+	birthDate := strings.TrimSpace(request.FormValue("profileBirthDate"))
+	weight := strings.Replace(strings.TrimSpace(request.FormValue("profileWeight")), ",", ".", 1)
+
+	// Birth date and weight are optional but have to be valid when given
+	if birthDate != "" {
+		birth, err := getLocale(request).ParseDate(birthDate)
+		if err != nil {
+			http.Redirect(response, request, redirectTarget, 302)
+			return
+		}
+		birthDate = birth.Format("02/01/2006")
+	}
+
+	if weight != "" {
+		if value, err := strconv.ParseFloat(weight, 64); err != nil || value <= 0 {
+			http.Redirect(response, request, redirectTarget, 302)
+			return
+		}
+	}
+
+	// Health data is stored sealed with the owner's key
+	if err := sealFields(patient.OwnerID, &allergies, &conditions, &pregnant, &birthDate, &weight); err != nil {
+		serverError(response, request, "postProfileHandler", err)
+		return
+	}
+
+	sqlStatement := `INSERT INTO health_profiles(patient_id,user_id,allergies,conditions,pregnant,birth_date,weight,update_date) VALUES(?,?,?,?,?,?,?,?)
+		ON CONFLICT(patient_id) DO UPDATE SET allergies=excluded.allergies, conditions=excluded.conditions, pregnant=excluded.pregnant,
+		birth_date=excluded.birth_date, weight=excluded.weight, update_date=excluded.update_date`
+	statement, err := db.Prepare(sqlStatement)
+	if err != nil {
+		serverError(response, request, "postProfileHandler", err)
+		return
+	}
+
+	_, err = statement.Exec(patientID, patient.OwnerID, allergies, conditions, pregnant, birthDate, weight, getDate())
+	if err != nil {
+		serverError(response, request, "postProfileHandler", err)
+		return
+	}
+
+	http.Redirect(response, request, redirectTarget+"&saved=1", 302)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	doseStatusPending = "pending"
+	doseStatusSnoozed = "snoozed"
+	doseStatusTaken   = "taken"
+	doseStatusMissed  = "missed"
+
+	// doseReminderWindow is how late a reminder is still sent, e.g. after a restart
+	doseReminderWindow = 15 * time.Minute
+	// doseSnooze is how long a snoozed reminder waits
+	doseSnooze = 10 * time.Minute
+	// doseMissedAfter is when a dose nobody reacted to counts as missed
+	doseMissedAfter = 6 * time.Hour
+	// doseBackfillDays is how far back doses due while the server was down are logged as missed
+	doseBackfillDays = 7
+	// doseLogMigration is the migration which started logging doses
+	doseLogMigration = 7
+)
+
+// PushActionData holds an action taken from a notification's button
+type PushActionData struct {
+	Token  string `json:"token"`
+	Action string `json:"action"`
+}
+
+func pushKeyHandler(response http.ResponseWriter, request *http.Request) {
+	key, err := getVAPIDPublicKey()
+	if err != nil {
+		requestLogger(request).Error("pushKeyHandler", "error", err)
+		http.Error(response, "Push is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	response.Header().Set("Content-Type", "text/plain")
+	response.Write([]byte(key))
+}
+
+func pushSubscribeHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Error(response, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+
+	var subscription PushSubscription
+	if err := json.NewDecoder(http.MaxBytesReader(response, request.Body, 4096)).Decode(&subscription); err != nil {
+		http.Error(response, "Invalid subscription", http.StatusBadRequest)
+		return
+	}
+
+	target, _ := json.Marshal(subscription)
+	if !validateChannelTarget(channelWebPush, string(target)) {
+		http.Error(response, "Invalid subscription", http.StatusBadRequest)
+		return
+	}
+
+	// A browser subscribing again replaces its old keys
+	for _, channel := range getNotificationChannels(userID) {
+		if channel.Channel == channelWebPush && pushEndpoint(channel.Target) == subscription.Endpoint {
+			_, err := db.Exec("UPDATE notification_channels SET target=$1, enabled='on' WHERE channel_id=$2", string(target), channel.ID)
+			if err != nil {
+				requestLogger(request).Error("pushSubscribeHandler", "error", err)
+				http.Error(response, "Subscription failed", http.StatusInternalServerError)
+				return
+			}
+			response.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	if _, err := addNotificationChannel(userID, channelWebPush, string(target)); err != nil {
+		requestLogger(request).Error("pushSubscribeHandler", "error", err)
+		http.Error(response, "Subscription failed", http.StatusInternalServerError)
+		return
+	}
+
+	response.WriteHeader(http.StatusCreated)
+}
+
+func pushUnsubscribeHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Error(response, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	var subscription PushSubscription
+	if err := json.NewDecoder(http.MaxBytesReader(response, request.Body, 4096)).Decode(&subscription); err != nil || subscription.Endpoint == "" {
+		http.Error(response, "Invalid subscription", http.StatusBadRequest)
+		return
+	}
+
+	for _, channel := range getNotificationChannels(getUserID(getUserName(request))) {
+		if channel.Channel == channelWebPush && pushEndpoint(channel.Target) == subscription.Endpoint {
+			if _, err := db.Exec("DELETE FROM notification_channels WHERE channel_id=$1", channel.ID); err != nil {
+				requestLogger(request).Error("pushUnsubscribeHandler", "error", err)
+			}
+		}
+	}
+
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// pushEndpoint returns the push service endpoint of a stored subscription.
+func pushEndpoint(target string) string {
+	var subscription PushSubscription
+	json.Unmarshal([]byte(target), &subscription)
+	return subscription.Endpoint
+}
+
+// pushActionHandler handles the buttons of a dose reminder. It is called by the
+// service worker, so the dose's token authorizes it instead of the session.
+func pushActionHandler(response http.ResponseWriter, request *http.Request) {
+	var action PushActionData
+	if err := json.NewDecoder(http.MaxBytesReader(response, request.Body, 1024)).Decode(&action); err != nil || action.Token == "" {
+		http.Error(response, "Invalid action", http.StatusBadRequest)
+		return
+	}
+
+	var sqlStatement string
+	var args []interface{}
+
+	switch action.Action {
+	case "taken":
+		sqlStatement = "UPDATE dose_log SET status=$1, taken_date=$2 WHERE token=$3"
+		args = []interface{}{doseStatusTaken, getDate(), action.Token}
+	case "snooze":
+		until := time.Now().Add(doseSnooze)
+		sqlStatement = "UPDATE dose_log SET status=$1, snooze_until=$2, snooze_until_at=$3 WHERE token=$4 AND status<>$5"
+		args = []interface{}{doseStatusSnoozed, formatStoredDate(until), toEpoch(until), action.Token, doseStatusTaken}
+	default:
+		http.Error(response, "Invalid action", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(sqlStatement, args...)
+	if err != nil {
+		requestLogger(request).Error("pushActionHandler", "error", err)
+		http.Error(response, "Action failed", http.StatusInternalServerError)
+		return
+	}
+
+	if count, _ := result.RowsAffected(); count == 0 {
+		http.Error(response, "Unknown dose", http.StatusNotFound)
+		return
+	}
+
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// sendDoseReminder sends a dose's reminder to the browsers of everyone caring for the patient.
+func sendDoseReminder(entryID int, patientID int, token string) {
+	var name string
+	var size, sizeType, count sql.NullString
+
+	result := db.QueryRow(`SELECT m.name, m.size, m.size_type, u.dose_count FROM dose_log d
+		JOIN use_alarms u ON u.use_id = d.use_id JOIN entries e ON e.entry_id = d.entry_id JOIN medicine m ON m.medicine_id = e.medicine_id
+		WHERE d.token=$1`, token)
+	if err := result.Scan(&name, &size, &sizeType, &count); err != nil {
+		logger.Error("sendDoseReminder", "entry_id", entryID, "error", err)
+		return
+	}
+
+	var patient string
+	db.QueryRow("SELECT name FROM patients WHERE patient_id=$1", patientID).Scan(&patient)
+
+	for _, userID := range getPatientRecipients(patientID) {
+		locale := getRecipientLocale(userID)
+
+		body := locale.T("notify.dose.one", name)
+		if dose := parseDoseCount(count.String); dose != 1 {
+			body = locale.T("notify.dose.many", locale.FormatNumber(dose), name)
+		}
+
+		queueNotification(Notification{
+			UserID:  userID,
+			EntryID: entryID,
+			Kind:    "dose",
+			Title:   fmt.Sprintf("%s: %s", patient, name),
+			Body:    body,
+			URL:     fmt.Sprintf("%s?patient=%d", urlWeeklyUse, patientID),
+			Channel: channelWebPush,
+			Token:   token,
+		})
+	}
+}
+
+// checkDoseReminders logs every dose which is due now and sends its reminder,
+// logs doses which fell due while the server was down as missed, sends
+// snoozed reminders again and marks doses nobody reacted to as missed.
+func checkDoseReminders() {
+	type dueDose struct {
+		UseID     int
+		EntryID   int
+		PatientID int
+		Scheduled time.Time
+	}
+
+	var due, unlogged []dueDose
+	now := time.Now()
+	locations := make(map[int]*time.Location)
+
+	// Doses are only known to be missed since they are logged at all
+	since := now.AddDate(0, 0, -doseBackfillDays)
+	var logged string
+	if err := db.QueryRow("SELECT applied_date FROM schema_migrations WHERE version=$1", doseLogMigration).Scan(&logged); err == nil {
+		if start, err := parseStoredDate(logged); err == nil && start.After(since) {
+			since = start
+		}
+	}
+
+	row, err := db.Query(`SELECT u.use_id, u.entry_id, u.patient_id, u.mon, u.tue, u.wed, u.thu, u.fri, u.sat, u.sun, u.hour, e.entry_at, `+entryExpireSQL+`
+		FROM use_alarms u JOIN entries e ON e.entry_id = u.entry_id WHERE `+entryExpireSQL+` >= $1`, toEpoch(since))
+	if err != nil {
+		logger.Error("checkDoseReminders", "error", err)
+		return
+	}
+
+	for row.Next() {
+		var dose dueDose
+		var days [7]sql.NullString
+		var hour sql.NullString
+		var entryAt sql.NullInt64
+		var expireAt int64
+
+		if err = row.Scan(&dose.UseID, &dose.EntryID, &dose.PatientID, &days[0], &days[1], &days[2], &days[3], &days[4], &days[5], &days[6], &hour, &entryAt, &expireAt); err != nil {
+			logger.Error("checkDoseReminders", "error", err)
+			break
+		}
+
+		clock, err := time.Parse("15:04", strings.TrimSpace(hour.String))
+		if err != nil {
+			continue
+		}
+
+		// Dose times are wall clock times in the zone of the patient's owner
+		location, ok := locations[dose.PatientID]
+		if !ok {
+			location = getPatientLocation(dose.PatientID)
+			locations[dose.PatientID] = location
+		}
+		local := now.In(location)
+
+		for day := 0; day <= doseBackfillDays; day++ {
+			date := local.AddDate(0, 0, -day)
+			if days[(int(date.Weekday())+6)%7].String != "on" {
+				continue
+			}
+
+			dose.Scheduled = time.Date(date.Year(), date.Month(), date.Day(), clock.Hour(), clock.Minute(), 0, 0, location)
+			if dose.Scheduled.After(now) || dose.Scheduled.Before(since) || toEpoch(dose.Scheduled) > expireAt {
+				continue
+			}
+			// No doses before the package was added
+			if entryAt.Valid && toEpoch(dose.Scheduled) < entryAt.Int64 {
+				continue
+			}
+
+			if now.Sub(dose.Scheduled) <= doseReminderWindow {
+				due = append(due, dose)
+			} else {
+				unlogged = append(unlogged, dose)
+			}
+		}
+	}
+	row.Close()
+
+	for _, dose := range due {
+		token := generateSecret(16)
+
+		// The unique schedule keeps a dose from being logged and sent twice
+		result, err := db.Exec("INSERT OR IGNORE INTO dose_log(use_id,entry_id,patient_id,scheduled_date,scheduled_at,status,token,create_date) VALUES(?,?,?,?,?,?,?,?)",
+			dose.UseID, dose.EntryID, dose.PatientID, formatStoredDate(dose.Scheduled), toEpoch(dose.Scheduled), doseStatusPending, token, getDate())
+		if err != nil {
+			logger.Error("checkDoseReminders", "use_id", dose.UseID, "error", err)
+			continue
+		}
+
+		if count, _ := result.RowsAffected(); count > 0 {
+			alarmsFired.Inc("dose")
+			sendDoseReminder(dose.EntryID, dose.PatientID, token)
+		}
+	}
+
+	// Doses which fell due while no reminder could be sent, logged without one
+	for _, dose := range unlogged {
+		_, err := db.Exec("INSERT OR IGNORE INTO dose_log(use_id,entry_id,patient_id,scheduled_date,scheduled_at,status,token,create_date) VALUES(?,?,?,?,?,?,?,?)",
+			dose.UseID, dose.EntryID, dose.PatientID, formatStoredDate(dose.Scheduled), toEpoch(dose.Scheduled), doseStatusMissed, generateSecret(16), getDate())
+		if err != nil {
+			logger.Error("checkDoseReminders", "use_id", dose.UseID, "error", err)
+		}
+	}
+
+	// Snoozed reminders which are due again
+	var snoozed []dueDose
+	var tokens []string
+
+	row, err = db.Query("SELECT entry_id, patient_id, token FROM dose_log WHERE status=$1 AND snooze_until_at <= $2", doseStatusSnoozed, nowEpoch())
+	if err != nil {
+		logger.Error("checkDoseReminders", "error", err)
+		return
+	}
+
+	for row.Next() {
+		var dose dueDose
+		var token string
+
+		if err = row.Scan(&dose.EntryID, &dose.PatientID, &token); err != nil {
+			logger.Error("checkDoseReminders", "error", err)
+			break
+		}
+
+		snoozed = append(snoozed, dose)
+		tokens = append(tokens, token)
+	}
+	row.Close()
+
+	for i, dose := range snoozed {
+		db.Exec("UPDATE dose_log SET status=$1, snooze_until=NULL, snooze_until_at=NULL WHERE token=$2", doseStatusPending, tokens[i])
+		sendDoseReminder(dose.EntryID, dose.PatientID, tokens[i])
+	}
+
+	missed := toEpoch(now.Add(-doseMissedAfter))
+	if _, err = db.Exec("UPDATE dose_log SET status=$1 WHERE status IN ($2,$3) AND scheduled_at < $4", doseStatusMissed, doseStatusPending, doseStatusSnoozed, missed); err != nil {
+		logger.Error("checkDoseReminders", "error", err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestCheckDoseMissedBackfill expects doses which fell due while the
+// scheduler was not running to be logged as missed once, from when doses
+// were logged and the package was added on.
+func TestCheckDoseMissedBackfill(t *testing.T) {
+	openTestDatabase(t)
+
+	result, err := db.Exec("INSERT INTO users(username,email,register_date,password,timezone) VALUES('test','test@mws.local','2026-01-01','x','UTC')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, _ := result.LastInsertId()
+
+	patientID, err := createPatient(db, int(userID), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	result, err = db.Exec("INSERT INTO entries(medicine_id,user_id,patient_id,entry_date,expire_date,entry_at,expire_at) VALUES(1,$1,$2,$3,$4,$5,$6)",
+		userID, patientID, formatStoredDate(now.AddDate(0, 0, -3)), formatStoredDate(now.AddDate(0, 1, 0)), toEpoch(now.AddDate(0, 0, -3)), toEpoch(now.AddDate(0, 1, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entryID, _ := result.LastInsertId()
+
+	// Every day two hours ago, long past the reminder window
+	hour := now.UTC().Add(-2 * time.Hour).Format("15:04")
+	_, err = db.Exec("INSERT INTO use_alarms(entry_id,user_id,patient_id,mon,tue,wed,thu,fri,sat,sun,hour) VALUES($1,$2,$3,'on','on','on','on','on','on','on',$4)",
+		entryID, userID, patientID, hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missed := func() (count int) {
+		if err := db.QueryRow("SELECT COUNT(*) FROM dose_log WHERE entry_id=$1 AND status=$2", entryID, doseStatusMissed).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	// Doses before logging started are not known to be missed
+	if _, err = db.Exec("UPDATE schema_migrations SET applied_date=$1 WHERE version=$2", formatStoredDate(now.Add(-25*time.Hour)), doseLogMigration); err != nil {
+		t.Fatal(err)
+	}
+	checkDoseReminders()
+	if got := missed(); got != 1 {
+		t.Errorf("%d doses logged as missed since logging started, want 1", got)
+	}
+
+	// Doses before the package was added are not either
+	if _, err = db.Exec("UPDATE schema_migrations SET applied_date=$1 WHERE version=$2", formatStoredDate(now.AddDate(0, -1, 0)), doseLogMigration); err != nil {
+		t.Fatal(err)
+	}
+	checkDoseReminders()
+	checkDoseReminders()
+	if got := missed(); got != 3 {
+		t.Errorf("%d doses logged as missed since the package was added, want 3", got)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reportRanges holds the days a report can look back
+var reportRanges = []int{7, 30, 90, 365}
+
+// reportDefaultDays is the range shown when none is picked
+const reportDefaultDays = 30
+
+// Days the expiry forecast looks ahead
+const (
+	reportSoonDays     = 30
+	reportForecastDays = 90
+)
+
+// Adherence holds how many of the closed doses were taken. Pending and
+// snoozed doses are still open and not counted.
+type Adherence struct {
+	Taken   int     `json:"taken"`
+	Missed  int     `json:"missed"`
+	Percent float64 `json:"percent"`
+}
+
+// add counts a dose of the status.
+func (a *Adherence) add(status string) {
+	switch status {
+	case doseStatusTaken:
+		a.Taken++
+	case doseStatusMissed:
+		a.Missed++
+	}
+
+	if a.Taken+a.Missed > 0 {
+		a.Percent = float64(a.Taken*1000/(a.Taken+a.Missed)) / 10
+	}
+}
+
+// Closed reports if any dose was taken or missed.
+func (a Adherence) Closed() bool {
+	return a.Taken+a.Missed > 0
+}
+
+// MedicineAdherence holds the adherence of one medicine
+type MedicineAdherence struct {
+	MedicineID int    `json:"medicine_id"`
+	Name       string `json:"name"`
+	Patient    string `json:"patient"`
+	Adherence
+}
+
+// HourMisses holds the missed doses scheduled at an hour of the day
+type HourMisses struct {
+	Hour   int `json:"hour"`
+	Missed int `json:"missed"`
+	Total  int `json:"total"`
+}
+
+// HeatDay holds the doses of a day of the heat map, an empty date pads the first week
+type HeatDay struct {
+	Date   string `json:"date"`
+	Taken  int    `json:"taken"`
+	Missed int    `json:"missed"`
+}
+
+// Level returns the colour class of the day.
+func (d HeatDay) Level() string {
+	switch {
+	case d.Taken+d.Missed == 0:
+		return "bg-light"
+	case d.Missed == 0:
+		return "bg-success"
+	case d.Taken == 0:
+		return "bg-danger"
+	default:
+		return "bg-warning"
+	}
+}
+
+// ExpiryForecast holds a package expiring soon and what of it is used until then
+type ExpiryForecast struct {
+	EntryID    int     `json:"entry_id"`
+	Name       string  `json:"name"`
+	Patient    string  `json:"patient"`
+	ExpireDate string  `json:"expire_date"`
+	DaysLeft   int     `json:"days_left"`
+	Units      float64 `json:"units"`
+	Needed     float64 `json:"needed"`
+	LeftOver   float64 `json:"left_over"`
+}
+
+// ReportData holds the aggregates of a report, as shown and served by the API
+type ReportData struct {
+	Days          int                 `json:"days"`
+	From          string              `json:"from"`
+	To            string              `json:"to"`
+	Overall       Adherence           `json:"overall"`
+	Medicines     []MedicineAdherence `json:"medicines"`
+	CurrentStreak int                 `json:"current_streak"`
+	LongestStreak int                 `json:"longest_streak"`
+	MissedHours   []HourMisses        `json:"missed_hours"`
+	Heatmap       []HeatDay           `json:"heatmap"`
+	ExpiringSoon  int                 `json:"expiring_30"`
+	Expiring      []ExpiryForecast    `json:"expiring_90"`
+}
+
+// ReportsPageData holds all data of the reports page
+type ReportsPageData struct {
+	Filter PatientFilter
+	Report ReportData
+	Ranges []int
+	Weeks  [][]HeatDay
+}
+
+// getReportDays returns the range picked with the days parameter.
+func getReportDays(request *http.Request) int {
+	days, _ := strconv.Atoi(request.FormValue("days"))
+	for _, r := range reportRanges {
+		if r == days {
+			return days
+		}
+	}
+	return reportDefaultDays
+}
+
+// getReport computes the adherence of the patients over the last days and
+// the forecast of their packages expiring soon, in the user's timezone.
+func getReport(patients []Patient, days int, location *time.Location) (report ReportData, err error) {
+	names := patientNames(patients)
+	clause, args := patientIDsClause("d.patient_id", patients)
+
+	now := time.Now().In(location)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	from := today.AddDate(0, 0, 1-days)
+
+	// Lists are empty rather than null for the API
+	report = ReportData{Days: days, From: from.Format("2006-01-02"), To: today.Format("2006-01-02"),
+		Medicines: []MedicineAdherence{}, MissedHours: []HourMisses{}, Expiring: []ExpiryForecast{}}
+
+	row, err := db.Query(`SELECT d.patient_id, d.scheduled_at, d.status, m.medicine_id, m.name
+		FROM dose_log d JOIN entries e ON e.entry_id = d.entry_id JOIN medicine m ON m.medicine_id = e.medicine_id
+		WHERE `+clause+` AND d.scheduled_at >= ? ORDER BY d.scheduled_at`, append(args, toEpoch(from))...)
+	if err != nil {
+		return report, err
+	}
+	defer row.Close()
+
+	medicines := make(map[int]*MedicineAdherence)
+	var hours [24]HourMisses
+	heat := make(map[string]*HeatDay)
+
+	for row.Next() {
+		var patientID, medicineID int
+		var scheduledAt int64
+		var status, name string
+
+		if err = row.Scan(&patientID, &scheduledAt, &status, &medicineID, &name); err != nil {
+			return report, err
+		}
+
+		report.Overall.add(status)
+
+		medicine, ok := medicines[medicineID]
+		if !ok {
+			medicine = &MedicineAdherence{MedicineID: medicineID, Name: name, Patient: names[patientID]}
+			medicines[medicineID] = medicine
+		}
+		medicine.add(status)
+
+		scheduled := fromEpoch(scheduledAt).In(location)
+
+		if status == doseStatusTaken || status == doseStatusMissed {
+			hour := &hours[scheduled.Hour()]
+			hour.Total++
+			if status == doseStatusMissed {
+				hour.Missed++
+			}
+		}
+
+		date := scheduled.Format("2006-01-02")
+		day, ok := heat[date]
+		if !ok {
+			day = &HeatDay{Date: date}
+			heat[date] = day
+		}
+		switch status {
+		case doseStatusTaken:
+			day.Taken++
+		case doseStatusMissed:
+			day.Missed++
+		}
+	}
+	if err = row.Err(); err != nil {
+		return report, err
+	}
+
+	for _, medicine := range medicines {
+		report.Medicines = append(report.Medicines, *medicine)
+	}
+	sort.Slice(report.Medicines, func(i, j int) bool {
+		a, b := report.Medicines[i], report.Medicines[j]
+		if a.Percent != b.Percent {
+			return a.Percent < b.Percent
+		}
+		return a.Name < b.Name
+	})
+
+	// Most missed hours first
+	for i, hour := range hours {
+		if hour.Missed > 0 {
+			hour.Hour = i
+			report.MissedHours = append(report.MissedHours, hour)
+		}
+	}
+	sort.SliceStable(report.MissedHours, func(i, j int) bool { return report.MissedHours[i].Missed > report.MissedHours[j].Missed })
+
+	// A streak is a run of days with every dose taken, days without doses do not break it
+	streak := 0
+	for date := from; !date.After(today); date = date.AddDate(0, 0, 1) {
+		day := HeatDay{Date: date.Format("2006-01-02")}
+		if d, ok := heat[day.Date]; ok {
+			day = *d
+		}
+		report.Heatmap = append(report.Heatmap, day)
+
+		if day.Missed > 0 {
+			streak = 0
+		} else if day.Taken > 0 {
+			streak++
+		}
+		if streak > report.LongestStreak {
+			report.LongestStreak = streak
+		}
+	}
+	report.CurrentStreak = streak
+
+	forecasts, err := getExpiryForecast(patients, today, location)
+	report.Expiring = append(report.Expiring, forecasts...)
+	for _, forecast := range report.Expiring {
+		if forecast.DaysLeft <= reportSoonDays {
+			report.ExpiringSoon++
+		}
+	}
+
+	return report, err
+}
+
+// getExpiryForecast returns the packages expiring within the forecast days
+// with the units their schedule uses until then.
+func getExpiryForecast(patients []Patient, today time.Time, location *time.Location) (forecasts []ExpiryForecast, err error) {
+	names := patientNames(patients)
+	clause, args := patientIDsClause("e.patient_id", patients)
+
+	until := today.AddDate(0, 0, reportForecastDays+1)
+
+	row, err := db.Query(`SELECT e.entry_id, e.patient_id, `+entryExpireSQL+` AS expire_at, m.name, m.med_count, u.mon, u.tue, u.wed, u.thu, u.fri, u.sat, u.sun, u.dose_count
+		FROM entries e JOIN medicine m ON m.medicine_id = e.medicine_id LEFT JOIN use_alarms u ON u.entry_id = e.entry_id
+		WHERE `+clause+` AND `+entryExpireSQL+` >= ? AND `+entryExpireSQL+` < ? ORDER BY expire_at`, append(args, nowEpoch(), toEpoch(until))...)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var forecast ExpiryForecast
+		var patientID int
+		var expireAt int64
+		var count, doseCount sql.NullString
+		var days [7]sql.NullString
+
+		err = row.Scan(&forecast.EntryID, &patientID, &expireAt, &forecast.Name, &count,
+			&days[0], &days[1], &days[2], &days[3], &days[4], &days[5], &days[6], &doseCount)
+		if err != nil {
+			return nil, err
+		}
+
+		expire := fromEpoch(expireAt).In(location)
+		forecast.Patient = names[patientID]
+		forecast.ExpireDate = expire.Format("2006-01-02")
+		forecast.DaysLeft = int(expire.Sub(today).Hours() / 24)
+		forecast.Units, _ = strconv.ParseFloat(strings.TrimSpace(count.String), 64)
+
+		// Doses scheduled from today until the package expires
+		perDose := parseDoseCount(doseCount.String)
+		for date := today; date.Before(expire); date = date.AddDate(0, 0, 1) {
+			if days[(int(date.Weekday())+6)%7].String == "on" {
+				forecast.Needed += perDose
+			}
+		}
+
+		if forecast.Units > forecast.Needed {
+			forecast.LeftOver = forecast.Units - forecast.Needed
+		}
+
+		forecasts = append(forecasts, forecast)
+	}
+
+	return forecasts, row.Err()
+}
+
+// heatWeeks splits the heat map into weeks from Monday on.
+func heatWeeks(heatmap []HeatDay) (weeks [][]HeatDay) {
+	if len(heatmap) == 0 {
+		return nil
+	}
+
+	first, err := time.Parse("2006-01-02", heatmap[0].Date)
+	if err != nil {
+		return nil
+	}
+
+	week := make([]HeatDay, (int(first.Weekday())+6)%7)
+	for _, day := range heatmap {
+		week = append(week, day)
+		if len(week) == 7 {
+			weeks = append(weeks, week)
+			week = nil
+		}
+	}
+	if len(week) > 0 {
+		weeks = append(weeks, week)
+	}
+
+	return weeks
+}
+
+func reportsHandler(response http.ResponseWriter, request *http.Request) {
+	// Check login status
+	if getUserName(request) == "" {
+		http.Redirect(response, request, urlHello, 302)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+	patients, filter := getSelectedPatients(request, userID, urlReports)
+
+	report, err := getReport(patients, getReportDays(request), getUserLocation(userID))
+	if err != nil {
+		serverError(response, request, "reportsHandler", err)
+		return
+	}
+
+	data := ReportsPageData{Filter: filter, Report: report, Ranges: reportRanges, Weeks: heatWeeks(report.Heatmap)}
+
+	err = renderTemplate(response, request, tmplReports, data)
+
+	if err != nil {
+		return
+	}
+}
+
+// apiReportsHandler serves the aggregates of the reports page as JSON.
+func apiReportsHandler(response http.ResponseWriter, request *http.Request) {
+	// Check login status
+	if getUserName(request) == "" {
+		http.Error(response, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+	patients, _ := getSelectedPatients(request, userID, urlReports)
+
+	report, err := getReport(patients, getReportDays(request), getUserLocation(userID))
+	if err != nil {
+		requestLogger(request).Error("apiReportsHandler", "error", err)
+		http.Error(response, "Report failed", http.StatusInternalServerError)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(response).Encode(report); err != nil {
+		requestLogger(request).Error("apiReportsHandler", "error", err)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// schedulerInterval is how often alarms are checked and notifications delivered
+const schedulerInterval = 30 * time.Second
+
+// schedulerStale is how long the scheduler may go without a run before it counts as stuck
+const schedulerStale = 3 * schedulerInterval
+
+// runScheduler checks for due alarms and delivers queued notifications until the program exits.
+func runScheduler() {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		startSchedulerRun()
+
+		checkExpireAlarms()
+		checkDoseReminders()
+		processNotifications()
+		eraseDueAccounts()
+
+		finishSchedulerRun()
+
+		<-ticker.C
+	}
+}
+
+// schedulerRuns keeps when the scheduler last started and finished a run
+var schedulerRuns = struct {
+	sync.Mutex
+	started  time.Time
+	finished time.Time
+}{}
+
+// startSchedulerRun records the start of a run and how much later than planned it is.
+func startSchedulerRun() {
+	now := time.Now()
+
+	schedulerRuns.Lock()
+	defer schedulerRuns.Unlock()
+
+	if !schedulerRuns.started.IsZero() {
+		schedLag.Set(math.Max(now.Sub(schedulerRuns.started.Add(schedulerInterval)).Seconds(), 0))
+	}
+	schedulerRuns.started = now
+}
+
+// finishSchedulerRun records the end of a run.
+func finishSchedulerRun() {
+	now := time.Now()
+
+	schedulerRuns.Lock()
+	defer schedulerRuns.Unlock()
+
+	schedulerRuns.finished = now
+	schedRuns.Inc()
+	schedRunTime.Set(now.Sub(schedulerRuns.started).Seconds())
+	schedLastRun.Set(float64(now.Unix()))
+}
+
+// schedulerAlive reports if the scheduler started or finished a run lately.
+func schedulerAlive() bool {
+	schedulerRuns.Lock()
+	defer schedulerRuns.Unlock()
+
+	last := schedulerRuns.finished
+	if schedulerRuns.started.After(last) {
+		last = schedulerRuns.started
+	}
+
+	return !last.IsZero() && time.Since(last) < schedulerStale
+}
+
+// expireAlarmTrigger returns when an expire alarm goes off, based on the
+// expiry date and the alarm's offset.
+func expireAlarmTrigger(expireDate time.Time, timer int, timerType string, beforeAfter string) (trigger time.Time, ok bool) {
+	switch normalizeOption("when", beforeAfter) {
+	case "before":
+		timer = -timer
+	case "after":
+	default:
+		return trigger, false
+	}
+
+	switch normalizeOption("timer", timerType) {
+	case "day":
+		return expireDate.AddDate(0, 0, timer), true
+	case "week":
+		return expireDate.AddDate(0, 0, 7*timer), true
+	case "month":
+		return expireDate.AddDate(0, timer, 0), true
+	case "year":
+		return expireDate.AddDate(timer, 0, 0), true
+	}
+
+	return trigger, false
+}
+
+// getPatientRecipients returns the accounts to notify about a patient, the owner and everyone it is shared with.
+func getPatientRecipients(patientID int) (userIDs []int) {
+	row, err := db.Query("SELECT owner_id FROM patients WHERE patient_id=$1 UNION SELECT user_id FROM patient_shares WHERE patient_id=$1", patientID)
+	if err != nil {
+		logger.Error("getPatientRecipients", "patient_id", patientID, "error", err)
+		return
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var userID int
+
+		if err = row.Scan(&userID); err != nil {
+			logger.Error("getPatientRecipients", "patient_id", patientID, "error", err)
+			return
+		}
+
+		userIDs = append(userIDs, userID)
+	}
+
+	return userIDs
+}
+
+// checkExpireAlarms queues a notification for every expire alarm which is due and has not fired yet.
+func checkExpireAlarms() {
+	type dueAlarm struct {
+		ID        int
+		EntryID   int
+		OwnerID   int
+		PatientID int
+		Name      string
+		Expire    time.Time
+	}
+
+	var due []dueAlarm
+	now := time.Now()
+
+	row, err := db.Query(`SELECT a.expire_id, a.entry_id, e.user_id, e.patient_id, m.name, ` + entryExpireSQL + `, a.timer, a.timer_type, a.before_after, a.action
+		FROM expire_alarms a JOIN entries e ON e.entry_id = a.entry_id JOIN medicine m ON m.medicine_id = e.medicine_id
+		WHERE a.fired_date IS NULL`)
+	if err != nil {
+		logger.Error("checkExpireAlarms", "error", err)
+		return
+	}
+
+	for row.Next() {
+		var alarm dueAlarm
+		var timerType, beforeAfter, action sql.NullString
+		var expireAt sql.NullInt64
+		var timer int
+
+		if err = row.Scan(&alarm.ID, &alarm.EntryID, &alarm.OwnerID, &alarm.PatientID, &alarm.Name, &expireAt, &timer, &timerType, &beforeAfter, &action); err != nil {
+			logger.Error("checkExpireAlarms", "error", err)
+			break
+		}
+
+		if normalizeOption("action", action.String) == "delete" {
+			continue
+		}
+
+		// Entries without a readable expiry date are reported by the listing
+		if !expireAt.Valid {
+			continue
+		}
+		alarm.Expire = fromEpoch(expireAt.Int64)
+
+		trigger, ok := expireAlarmTrigger(alarm.Expire.In(getPatientLocation(alarm.PatientID)), timer, timerType.String, beforeAfter.String)
+		if !ok || trigger.After(now) {
+			continue
+		}
+
+		due = append(due, alarm)
+	}
+	row.Close()
+
+	for _, alarm := range due {
+		for _, userID := range getPatientRecipients(alarm.PatientID) {
+			// Every recipient reads the date in their own timezone and language
+			locale := getRecipientLocale(userID)
+			expire := locale.FormatDateTime(alarm.Expire.In(getUserLocation(userID)))
+
+			body := locale.T("notify.expire.future", alarm.Name, expire)
+			if alarm.Expire.Before(now) {
+				body = locale.T("notify.expire.past", alarm.Name, expire)
+			}
+
+			queueNotification(Notification{
+				UserID:  userID,
+				EntryID: alarm.EntryID,
+				Kind:    "expire",
+				Title:   locale.T("notify.expire.title", alarm.Name),
+				Body:    body,
+				URL:     fmt.Sprintf("/?patient=%d", alarm.PatientID),
+			})
+		}
+
+		alarmsFired.Inc("expire")
+
+		firedDate := getDate()
+		if _, err = db.Exec("UPDATE expire_alarms SET fired_date=$1 WHERE expire_id=$2", firedDate, alarm.ID); err != nil {
+			logger.Error("checkExpireAlarms", "expire_id", alarm.ID, "error", err)
+			continue
+		}
+
+		err = writeAudit(db, systemActor, AuditEvent{
+			OwnerID: alarm.OwnerID, PatientID: alarm.PatientID, Action: auditUpdate, Entity: auditAlarm, EntityID: int64(alarm.ID),
+			Before: map[string]interface{}{"fired_date": nil}, After: map[string]string{"fired_date": firedDate},
+		})
+		if err != nil {
+			logger.Error("checkExpireAlarms", "expire_id", alarm.ID, "error", err)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SettingsPageData holds all data of the notification settings page
+type SettingsPageData struct {
+	Channels    []NotificationChannel
+	Log         []NotificationLogEntry
+	QuietStart  string
+	QuietEnd    string
+	CalendarURL string
+	Timezone    string
+	Timezones   []string
+	Error       string
+	Saved       string
+}
+
+func settingsHandler(response http.ResponseWriter, request *http.Request) {
+	// Check login status
+	if getUserName(request) == "" {
+		http.Redirect(response, request, urlHello, 302)
+		return
+	}
+
+	userID := getUserID(getUserName(request))
+
+	data := SettingsPageData{
+		Channels: getNotificationChannels(userID),
+		Log:      getNotificationLog(userID, 50),
+		Error:    request.FormValue("error"),
+		Saved:    request.FormValue("saved"),
+	}
+
+	data.QuietStart, data.QuietEnd = getQuietHours(userID)
+	data.CalendarURL = getCalendarURL(userID)
+
+	// Show the log in the user's timezone and language
+	location := getUserLocation(userID)
+	locale := getLocale(request)
+	data.Timezone = location.String()
+	data.Timezones = timezones
+
+	for i := range data.Log {
+		data.Log[i].CreateDate = formatDate(data.Log[i].CreateDate, location, locale)
+		data.Log[i].NextAttempt = formatDate(data.Log[i].NextAttempt, location, locale)
+	}
+
+	err := renderTemplate(response, request, tmplSettings, data)
+
+	if err != nil {
+		return
+	}
+}
+
+// validateChannelTarget checks the destination entered for a channel. Webhooks
+// and web pushes are only posted to public addresses.
+func validateChannelTarget(channel string, target string) bool {
+	switch channel {
+	case channelEmail:
+		address, err := mail.ParseAddress(target)
+		return err == nil && address.Address == target
+	case channelWebhook:
+		u, err := url.Parse(target)
+		return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && isPublicHost(u.Hostname())
+	case channelWebPush:
+		var subscription PushSubscription
+		if err := json.Unmarshal([]byte(target), &subscription); err != nil {
+			return false
+		}
+		u, err := url.Parse(subscription.Endpoint)
+		return err == nil && u.Scheme == "https" && isPublicHost(u.Hostname()) && subscription.Keys.P256dh != "" && subscription.Keys.Auth != ""
+	}
+	return false
+}
+
+func postAddChannelHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	channel := request.FormValue("channel")
+	target := strings.TrimSpace(request.FormValue("channelTarget"))
+
+	if !validateChannelTarget(channel, target) {
+		http.Redirect(response, request, urlSettings+"?error=target", 302)
+		return
+	}
+
+	if _, err := addNotificationChannel(getUserID(getUserName(request)), channel, target); err != nil {
+		serverError(response, request, "postAddChannelHandler", err)
+		return
+	}
+
+	http.Redirect(response, request, urlSettings+"?saved=channel", 302)
+}
+
+func postDeleteChannelHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	channelID, _ := strconv.Atoi(request.FormValue("channelID"))
+
+	_, err := db.Exec("DELETE FROM notification_channels WHERE channel_id=$1 AND user_id=$2", channelID, getUserID(getUserName(request)))
+	if err != nil {
+		serverError(response, request, "postDeleteChannelHandler", err)
+		return
+	}
+
+	http.Redirect(response, request, urlSettings, 302)
+}
+
+func postQuietHoursHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	quietStart := strings.TrimSpace(request.FormValue("quietStart"))
+	quietEnd := strings.TrimSpace(request.FormValue("quietEnd"))
+
+	// Both ends are needed, leaving both empty turns quiet hours off
+	if (quietStart == "") != (quietEnd == "") {
+		http.Redirect(response, request, urlSettings+"?error=quiet", 302)
+		return
+	}
+
+	for _, clock := range []string{quietStart, quietEnd} {
+		if clock == "" {
+			continue
+		}
+		if _, err := time.Parse("15:04", clock); err != nil {
+			http.Redirect(response, request, urlSettings+"?error=quiet", 302)
+			return
+		}
+	}
+
+	sqlStatement := `INSERT INTO notification_settings(user_id,quiet_start,quiet_end) VALUES(?,?,?)
+		ON CONFLICT(user_id) DO UPDATE SET quiet_start=excluded.quiet_start, quiet_end=excluded.quiet_end`
+	statement, err := db.Prepare(sqlStatement)
+	if err != nil {
+		serverError(response, request, "postQuietHoursHandler", err)
+		return
+	}
+
+	_, err = statement.Exec(getUserID(getUserName(request)), quietStart, quietEnd)
+	if err != nil {
+		serverError(response, request, "postQuietHoursHandler", err)
+		return
+	}
+
+	http.Redirect(response, request, urlSettings+"?saved=quiet", 302)
+}
+
+func postTestNotificationHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	locale := getLocale(request)
+
+	queueNotification(Notification{
+		UserID: getUserID(getUserName(request)),
+		Kind:   "test",
+		Title:  locale.T("notify.test.title"),
+		Body:   locale.T("notify.test.body"),
+		URL:    urlSettings,
+	})
+
+	http.Redirect(response, request, urlSettings+"?saved=test", 302)
+}
+
+func postTimezoneHandler(response http.ResponseWriter, request *http.Request) {
+	// Check if user logged in
+	if getUserName(request) == "" {
+		http.Redirect(response, request, "/", 302)
+		return
+	}
+
+	timezone := strings.TrimSpace(request.FormValue("timezone"))
+
+	if _, err := loadTimezone(timezone); err != nil {
+		http.Redirect(response, request, urlSettings+"?error=timezone", 302)
+		return
+	}
+
+	_, err := db.Exec("UPDATE users SET timezone=$1 WHERE user_id=$2", timezone, getUserID(getUserName(request)))
+	if err != nil {
+		serverError(response, request, "postTimezoneHandler", err)
+		return
+	}
+
+	http.Redirect(response, request, urlSettings+"?saved=timezone", 302)
+}
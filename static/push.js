@@ -0,0 +1,78 @@
+// Subscribes this browser to Web Push notifications and saves it as a channel
+(function () {
+  'use strict'
+
+  var button = document.getElementById('pushButton')
+  var status = document.getElementById('pushStatus')
+
+  if (!('serviceWorker' in navigator) || !('PushManager' in window)) {
+    button.disabled = true
+    status.textContent = status.dataset.unsupported
+    return
+  }
+
+  var decodeKey = function (value) {
+    var padded = (value + '===='.slice(value.length % 4)).replace(/-/g, '+').replace(/_/g, '/')
+    var raw = window.atob(padded)
+    var key = new Uint8Array(raw.length)
+    for (var i = 0; i < raw.length; i++) {
+      key[i] = raw.charCodeAt(i)
+    }
+    return key
+  }
+
+  var post = function (url, subscription) {
+    return fetch(url, {
+      method: 'POST',
+      credentials: 'same-origin',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify(subscription)
+    }).then(function (response) {
+      if (!response.ok) {
+        throw new Error(response.statusText)
+      }
+    })
+  }
+
+  var registration = navigator.serviceWorker.register('/res/sw.js')
+    .then(function () { return navigator.serviceWorker.ready })
+
+  var update = function (subscription) {
+    button.disabled = false
+    button.dataset.subscribed = subscription ? 'on' : ''
+    button.textContent = subscription ? button.dataset.unsubscribe : button.dataset.subscribe
+  }
+
+  registration
+    .then(function (reg) { return reg.pushManager.getSubscription() })
+    .then(update)
+
+  button.addEventListener('click', function () {
+    button.disabled = true
+    status.textContent = ''
+
+    registration.then(function (reg) {
+      if (button.dataset.subscribed) {
+        return reg.pushManager.getSubscription().then(function (subscription) {
+          return post('/push/unsubscribe', subscription)
+            .then(function () { return subscription.unsubscribe() })
+            .then(function () { update(null) })
+        })
+      }
+
+      return fetch('/push/key')
+        .then(function (response) { return response.text() })
+        .then(function (key) {
+          return reg.pushManager.subscribe({ userVisibleOnly: true, applicationServerKey: decodeKey(key) })
+        })
+        .then(function (subscription) {
+          return post('/push/subscribe', subscription).then(function () { update(subscription) })
+        })
+    }).then(function () {
+      window.location.reload()
+    }).catch(function (err) {
+      button.disabled = false
+      status.textContent = status.dataset.failed + ' ' + err.message
+    })
+  })
+})()
@@ -0,0 +1,46 @@
+// Reads GS1 DataMatrix codes with the browser's BarcodeDetector, where available
+(function () {
+  'use strict'
+
+  var button = document.getElementById('scanCamera')
+  var video = document.getElementById('scanVideo')
+  var status = document.getElementById('scanStatus')
+  var form = document.getElementById('scanForm')
+  var input = document.getElementById('code')
+
+  if (!('BarcodeDetector' in window) || !navigator.mediaDevices) {
+    button.disabled = true
+    status.textContent = status.dataset.unsupported
+    return
+  }
+
+  button.addEventListener('click', function () {
+    var detector = new BarcodeDetector({ formats: ['data_matrix', 'qr_code', 'code_128'] })
+
+    navigator.mediaDevices.getUserMedia({ video: { facingMode: 'environment' } })
+      .then(function (stream) {
+        video.srcObject = stream
+        video.classList.remove('d-none')
+        button.classList.add('d-none')
+        status.textContent = status.dataset.point
+
+        var scan = function () {
+          detector.detect(video).then(function (codes) {
+            if (codes.length > 0) {
+              stream.getTracks().forEach(function (track) { track.stop() })
+              input.value = codes[0].rawValue
+              form.submit()
+              return
+            }
+            window.requestAnimationFrame(scan)
+          }).catch(function () {
+            window.requestAnimationFrame(scan)
+          })
+        }
+        scan()
+      })
+      .catch(function (err) {
+        status.textContent = status.dataset.failed + ' ' + err
+      })
+  })
+})()
@@ -0,0 +1,55 @@
+// Shows Web Push notifications sent by Pill Tracker and handles their buttons
+'use strict'
+
+self.addEventListener('push', function (event) {
+  var data = event.data ? event.data.json() : {}
+  var options = {
+    body: data.body,
+    tag: data.tag,
+    data: { url: data.url || '/', token: data.token }
+  }
+
+  // Dose reminders can be answered right from the notification
+  if (data.token) {
+    var labels = data.actions || {}
+    options.actions = [
+      { action: 'taken', title: labels.taken || 'Taken' },
+      { action: 'snooze', title: labels.snooze || 'Snooze 10 min' }
+    ]
+    options.requireInteraction = true
+  }
+
+  event.waitUntil(self.registration.showNotification(data.title || 'Pill Tracker', options))
+})
+
+self.addEventListener('notificationclick', function (event) {
+  var data = event.notification.data
+  event.notification.close()
+
+  if (event.action && data.token) {
+    event.waitUntil(fetch('/push/action', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ token: data.token, action: event.action })
+    }))
+    return
+  }
+
+  event.waitUntil(self.clients.openWindow(data.url))
+})
+
+self.addEventListener('pushsubscriptionchange', function (event) {
+  var options = event.oldSubscription ? event.oldSubscription.options : null
+  if (!options) {
+    return
+  }
+
+  event.waitUntil(self.registration.pushManager.subscribe(options).then(function (subscription) {
+    return fetch('/push/subscribe', {
+      method: 'POST',
+      credentials: 'include',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify(subscription)
+    })
+  }))
+})
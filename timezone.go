@@ -0,0 +1,79 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	// Zones are looked up on hosts without a zoneinfo database too
+	_ "time/tzdata"
+)
+
+// timezones holds the zones offered on the settings page, any other IANA name is accepted as well
+var timezones = []string{
+	"Europe/Istanbul", "Europe/London", "Europe/Berlin", "Europe/Paris", "Europe/Amsterdam", "Europe/Athens", "Europe/Moscow",
+	"Asia/Baku", "Asia/Dubai", "Asia/Tehran", "Asia/Kolkata", "Asia/Shanghai", "Asia/Tokyo",
+	"America/New_York", "America/Chicago", "America/Denver", "America/Los_Angeles", "America/Sao_Paulo",
+	"Australia/Sydney", "Africa/Cairo", "UTC",
+}
+
+// loadTimezone returns the named zone. Names like "Local" are not accepted since
+// they depend on the host.
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "" || name == "Local" {
+		return nil, fmt.Errorf("invalid timezone %q", name)
+	}
+	return time.LoadLocation(name)
+}
+
+// defaultLocation returns the zone of users who did not pick one.
+func defaultLocation() *time.Location {
+	location, err := loadTimezone(config.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// getUserLocation returns the user's zone which dates are entered and shown in.
+func getUserLocation(userID int) *time.Location {
+	var name sql.NullString
+
+	result := db.QueryRow("SELECT timezone FROM users WHERE user_id=$1", userID)
+	if err := result.Scan(&name); err != nil && err != sql.ErrNoRows {
+		logger.Error("getUserLocation", "user_id", userID, "error", err)
+	}
+
+	location, err := loadTimezone(name.String)
+	if err != nil {
+		return defaultLocation()
+	}
+	return location
+}
+
+// getPatientLocation returns the zone dose times of the patient are kept in, the one of the patient's owner.
+func getPatientLocation(patientID int) *time.Location {
+	var ownerID int
+
+	result := db.QueryRow("SELECT owner_id FROM patients WHERE patient_id=$1", patientID)
+	if err := result.Scan(&ownerID); err != nil {
+		logger.Error("getPatientLocation", "patient_id", patientID, "error", err)
+		return defaultLocation()
+	}
+
+	return getUserLocation(ownerID)
+}
+
+// formatDate turns a stored date into the form shown to a user in the given zone and language.
+func formatDate(value string, location *time.Location, locale *Locale) string {
+	date, err := time.Parse("2006-01-02 15:04:05 -0700", value)
+	if err != nil {
+		return value
+	}
+	return locale.FormatDateTime(date.In(location))
+}
+
+// formatStoredDate turns a date into the form it is stored and compared in, always in UTC.
+func formatStoredDate(date time.Time) string {
+	return date.UTC().Format("2006-01-02 15:04:05 -0700")
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// webPushRecordSize is the record size announced in the aes128gcm header
+const webPushRecordSize = 4096
+
+// PushSubscription holds a browser's push subscription as sent by PushManager.subscribe()
+type PushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+var vapidKey struct {
+	sync.Mutex
+	key *ecdsa.PrivateKey
+}
+
+// decodeBase64URL decodes base64url with or without padding, as browsers send both.
+func decodeBase64URL(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// getVAPIDKey returns the server's VAPID key from the configuration, or the one
+// generated and stored on first use. Subscriptions are bound to this key.
+func getVAPIDKey() (*ecdsa.PrivateKey, error) {
+	vapidKey.Lock()
+	defer vapidKey.Unlock()
+
+	if vapidKey.key != nil {
+		return vapidKey.key, nil
+	}
+
+	encoded := config.VAPIDPrivateKey
+
+	if encoded == "" {
+		result := db.QueryRow("SELECT value FROM app_settings WHERE key='vapid_private_key'")
+		if err := result.Scan(&encoded); err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+
+	if encoded == "" {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		encoded = base64.RawURLEncoding.EncodeToString(key.D.FillBytes(make([]byte, 32)))
+
+		if _, err = db.Exec("INSERT INTO app_settings(key,value) VALUES('vapid_private_key',?)", encoded); err != nil {
+			return nil, err
+		}
+	}
+
+	scalar, err := decodeBase64URL(encoded)
+	if err != nil || len(scalar) != 32 {
+		return nil, errors.New("invalid VAPID private key")
+	}
+
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(scalar)}
+	key.PublicKey.Curve = elliptic.P256()
+	key.PublicKey.X, key.PublicKey.Y = key.PublicKey.Curve.ScalarBaseMult(scalar)
+
+	vapidKey.key = key
+	return key, nil
+}
+
+// getVAPIDPublicKey returns the application server key browsers subscribe with.
+func getVAPIDPublicKey() (string, error) {
+	key, err := getVAPIDKey()
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(elliptic.Marshal(key.Curve, key.X, key.Y)), nil
+}
+
+// vapidAuthorization builds the VAPID (RFC 8292) Authorization header for a push service.
+func vapidAuthorization(endpoint string) (string, error) {
+	key, err := getVAPIDKey()
+	if err != nil {
+		return "", err
+	}
+
+	target, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": target.Scheme + "://" + target.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": config.VAPIDSubject,
+	})
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	token := unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	public, err := getVAPIDPublicKey()
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("vapid t=%s, k=%s", token, public), nil
+}
+
+// encryptWebPush encrypts a push message for the subscription with the
+// aes128gcm content coding (RFC 8188) keyed as described in RFC 8291.
+func encryptWebPush(subscription PushSubscription, plaintext []byte) ([]byte, error) {
+	curve := elliptic.P256()
+
+	uaPublic, err := decodeBase64URL(subscription.Keys.P256dh)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key: %s", err)
+	}
+
+	authSecret, err := decodeBase64URL(subscription.Keys.Auth)
+	if err != nil || len(authSecret) != 16 {
+		return nil, errors.New("invalid auth secret")
+	}
+
+	// Ephemeral application server key and salt, new ones for every message
+	asPrivate, _, _, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return sealWebPush(uaPublic, authSecret, asPrivate, salt, plaintext)
+}
+
+// sealWebPush encrypts a push message for the user agent's public key and
+// auth secret with the application server's private key and the salt.
+func sealWebPush(uaPublic []byte, authSecret []byte, asPrivate []byte, salt []byte, plaintext []byte) ([]byte, error) {
+	curve := elliptic.P256()
+
+	uaX, uaY := elliptic.Unmarshal(curve, uaPublic)
+	if uaX == nil {
+		return nil, errors.New("invalid p256dh key")
+	}
+
+	asX, asY := curve.ScalarBaseMult(asPrivate)
+	asPublic := elliptic.Marshal(curve, asX, asY)
+
+	sharedX, _ := curve.ScalarMult(uaX, uaY, asPrivate)
+	ecdhSecret := sharedX.FillBytes(make([]byte, 32))
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublic...)
+	keyInfo = append(keyInfo, asPublic...)
+
+	ikm := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ecdhSecret, authSecret, keyInfo), ikm); err != nil {
+		return nil, err
+	}
+
+	cek := make([]byte, 16)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), cek); err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 12)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// A single record, closed with the last record padding delimiter
+	record := append(append([]byte{}, plaintext...), 0x02)
+	if len(record)+gcm.Overhead() > webPushRecordSize {
+		return nil, errors.New("push message too large")
+	}
+
+	var body bytes.Buffer
+	body.Write(salt)
+	binary.Write(&body, binary.BigEndian, uint32(webPushRecordSize))
+	body.WriteByte(byte(len(asPublic)))
+	body.Write(asPublic)
+	body.Write(gcm.Seal(nil, nonce, record, nil))
+
+	return body.Bytes(), nil
+}
+
+// sendWebPush delivers an encrypted message to the subscription's push service.
+// It reports gone when the subscription has expired and should be removed.
+func sendWebPush(client *http.Client, subscription PushSubscription, payload []byte, ttl int) (gone bool, err error) {
+	body, err := encryptWebPush(subscription, payload)
+	if err != nil {
+		return false, err
+	}
+
+	authorization, err := vapidAuthorization(subscription.Endpoint)
+	if err != nil {
+		return false, err
+	}
+
+	request, err := http.NewRequest("POST", subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	request.Header.Set("Content-Encoding", "aes128gcm")
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("TTL", fmt.Sprintf("%d", ttl))
+	request.Header.Set("Urgency", "high")
+	request.Header.Set("Authorization", authorization)
+
+	response, err := client.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone {
+		return true, fmt.Errorf("subscription expired (%d)", response.StatusCode)
+	}
+
+	if response.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return false, fmt.Errorf("push service returned %d: %s", response.StatusCode, strings.TrimSpace(string(message)))
+	}
+
+	return false, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+// TestSealWebPush encrypts the example message of RFC 8291 Appendix A with
+// its keys and salt and expects the message the RFC gives.
+func TestSealWebPush(t *testing.T) {
+	decode := func(value string) []byte {
+		decoded, err := decodeBase64URL(value)
+		if err != nil {
+			t.Fatalf("decoding %q: %s", value, err)
+		}
+		return decoded
+	}
+
+	plaintext := []byte("When I grow up, I want to be a watermelon")
+	asPrivate := decode("yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw")
+	uaPublic := decode("BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4")
+	authSecret := decode("BTBZMqHH6r4Tts7J_aSIgg")
+	salt := decode("DGv6ra1nlYgDCS1FRnbzlw")
+
+	want := "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+
+	body, err := sealWebPush(uaPublic, authSecret, asPrivate, salt, plaintext)
+	if err != nil {
+		t.Fatalf("sealWebPush failed: %s", err)
+	}
+
+	if got := base64.RawURLEncoding.EncodeToString(body); got != want {
+		t.Errorf("sealWebPush = %s, want %s", got, want)
+	}
+}
+
+func TestEncryptWebPushRejectsKeys(t *testing.T) {
+	tests := []struct {
+		p256dh string
+		auth   string
+	}{
+		{"BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4", "c2hvcnQ"},
+		{"BAAA", "BTBZMqHH6r4Tts7J_aSIgg"},
+		{"!", "BTBZMqHH6r4Tts7J_aSIgg"},
+	}
+
+	for _, test := range tests {
+		var subscription PushSubscription
+		subscription.Keys.P256dh, subscription.Keys.Auth = test.p256dh, test.auth
+
+		if _, err := encryptWebPush(subscription, []byte("test")); err == nil {
+			t.Errorf("encryptWebPush(%q, %q) did not fail", test.p256dh, test.auth)
+		}
+	}
+}